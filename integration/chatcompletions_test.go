@@ -0,0 +1,72 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/chatcompletion"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/server"
+)
+
+func TestChatCompletionCache(t *testing.T) {
+	h := New(t, Options{
+		ChatCompletionCache: chatcompletion.CacheConfig{
+			ModelTTLs:  map[string]time.Duration{"gpt-4o*": time.Minute},
+			MaxEntries: 10,
+		},
+	})
+
+	complete := func(model, content string, stream bool) (string, bool) {
+		t.Helper()
+
+		resp := h.send(http.MethodPost, "/chat/completions", map[string]any{
+			"model":    model,
+			"stream":   stream,
+			"messages": []map[string]string{{"role": "user", "content": content}},
+		})
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("chat completion failed with status code %d: %v: %s", resp.StatusCode, err, data)
+		}
+		if stream {
+			return string(data), resp.Header.Get(server.CacheHeader) == "hit"
+		}
+
+		var ccr openai.CreateChatCompletionResponse
+		if err = json.Unmarshal(data, &ccr); err != nil || len(ccr.Choices) != 1 || ccr.Choices[0].Message.Content == nil {
+			t.Fatalf("failed to decode chat completion response: %v: %s", err, data)
+		}
+
+		return *ccr.Choices[0].Message.Content, resp.Header.Get(server.CacheHeader) == "hit"
+	}
+
+	for _, stream := range []bool{false, true} {
+		first, hit := complete("gpt-4o", "Hello cache", stream)
+		if hit {
+			t.Errorf("stream=%t: the first request should miss the cache", stream)
+		}
+
+		second, hit := complete("gpt-4o", "Hello cache", stream)
+		if !hit {
+			t.Errorf("stream=%t: an identical request should hit the cache", stream)
+		}
+		if !stream && second != first {
+			t.Errorf("stream=%t: cached response %q, want %q", stream, second, first)
+		}
+
+		if _, hit = complete("gpt-4o", "Hello other cache", stream); hit {
+			t.Errorf("stream=%t: a request with other messages should miss the cache", stream)
+		}
+		// The model isn't cached.
+		complete("gpt-3.5-turbo", "Hello cache", stream)
+		if _, hit = complete("gpt-3.5-turbo", "Hello cache", stream); hit {
+			t.Errorf("stream=%t: requests for a model without a TTL shouldn't be cached", stream)
+		}
+	}
+}
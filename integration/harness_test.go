@@ -0,0 +1,575 @@
+// Package integration runs the server and all agents in-process, against a temporary SQLite database and the fake
+// upstream provider, so that tests can drive assistants, threads and runs through the real HTTP API.
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/audio"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/chatcompletion"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/embeddings"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/image"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/run"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/steprunner"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents/toolrunner"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers/fake"
+	"github.com/gptscript-ai/clicky-chats/pkg/server"
+	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
+)
+
+// DefaultTimeout is how long the helpers wait for a run to reach a status.
+const DefaultTimeout = 30 * time.Second
+
+// Options configure a Harness.
+type Options struct {
+	// Fixtures script the responses of the fake upstream provider, which echoes chat completions by default.
+	Fixtures *fake.Fixtures
+	// Confirm makes runs ask for confirmation before gptscript tools run commands.
+	Confirm bool
+	// EmulateToolCalls are the models that tool calls are emulated for.
+	EmulateToolCalls []string
+	// ChatCompletionCache configures the chat completion agent's response cache, which is disabled by default.
+	ChatCompletionCache chatcompletion.CacheConfig
+}
+
+// Harness is a server, with all the agents, that runs in the test's process. Everything is stopped when the test ends.
+type Harness struct {
+	// URL is the base URL of the server's API.
+	URL string
+	// DB is the server's database.
+	DB *db.DB
+	// Upstream is the fake provider that the agents send upstream requests to.
+	Upstream *fake.Server
+
+	t      testing.TB
+	client *http.Client
+}
+
+// New starts a server and all the agents.
+func New(t testing.TB, opts Options) *Harness {
+	t.Helper()
+
+	gdb, err := db.New("sqlite://"+filepath.Join(t.TempDir(), "clicky-chats.db"), true)
+	if err != nil {
+		t.Fatalf("failed to create the database: %v", err)
+	}
+
+	upstream, err := fake.NewServer(opts.Fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for the server: %v", err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	h := &Harness{
+		URL:      fmt.Sprintf("http://127.0.0.1:%s/v1", port),
+		DB:       gdb,
+		Upstream: upstream,
+		t:        t,
+		client:   new(http.Client),
+	}
+
+	triggers := &server.Triggers{
+		ChatCompletion: trigger.New(),
+		Run:            trigger.New(),
+		RunStep:        trigger.New(),
+		RunTool:        trigger.New(),
+		Image:          trigger.New(),
+		Embeddings:     trigger.New(),
+		Audio:          trigger.New(),
+	}
+
+	var (
+		serverWG, agentsWG    = new(sync.WaitGroup), new(sync.WaitGroup)
+		serverCtx, stopServer = context.WithCancel(context.Background())
+		agentsCtx, stopAgents = context.WithCancel(context.Background())
+		stop                  = func() {
+			// Stop the agents before the server and the upstream, which they call while they drain.
+			stopAgents()
+			agentsWG.Wait()
+			stopServer()
+			serverWG.Wait()
+			_ = upstream.Close()
+			_ = gdb.Close()
+		}
+	)
+	t.Cleanup(stop)
+
+	if err = server.NewServer(gdb, nil).Start(serverCtx, serverWG, server.Config{
+		ServerURL:       "http://127.0.0.1",
+		Port:            port,
+		APIBase:         "/v1",
+		Triggers:        triggers,
+		ShutdownTimeout: 5 * time.Second,
+		Mux:             http.NewServeMux(),
+		Listener:        listener,
+	}); err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+
+	if err = startAgents(agentsCtx, agentsWG, gdb, h.URL, upstream.URL, triggers, opts); err != nil {
+		t.Fatalf("failed to start the agents: %v", err)
+	}
+
+	return h
+}
+
+// startAgents starts every agent, with the short intervals and timeouts that tests need.
+func startAgents(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, serverURL, upstreamURL string, triggers *server.Triggers, opts Options) error {
+	const (
+		agentID         = "integration"
+		pollingInterval = time.Second
+		retentionPeriod = 5 * time.Minute
+		drainTimeout    = 5 * time.Second
+		workers         = 2
+	)
+	var (
+		lease = db.Lease{
+			Duration:    time.Minute,
+			MaxAttempts: 3,
+		}
+		retryPolicy = agents.RetryPolicy{
+			MaxAttempts: 2,
+			BaseDelay:   10 * time.Millisecond,
+			MaxDelay:    100 * time.Millisecond,
+		}
+		logger = slog.Default().With("harness", "integration")
+	)
+
+	if err := chatcompletion.Start(ctx, wg, gdb, chatcompletion.Config{
+		Logger: logger.With("agent", "chat completion"),
+		Providers: []providers.Provider{{
+			Name:    "fake",
+			BaseURL: upstreamURL,
+		}},
+		RetryPolicy:     retryPolicy,
+		Cache:           opts.ChatCompletionCache,
+		PollingInterval: pollingInterval,
+		RetentionPeriod: retentionPeriod,
+		AgentID:         agentID,
+		Workers:         workers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
+		Trigger:         triggers.ChatCompletion,
+	}); err != nil {
+		return err
+	}
+
+	if err := run.Start(ctx, wg, gdb, run.Config{
+		Logger:           logger.With("agent", "run"),
+		PollingInterval:  pollingInterval,
+		RetentionPeriod:  retentionPeriod,
+		APIURL:           serverURL + "/chat/completions",
+		AgentID:          agentID,
+		Workers:          workers,
+		EmulateToolCalls: opts.EmulateToolCalls,
+		SkipBuiltInTools: true,
+		Lease:            lease,
+		DrainTimeout:     drainTimeout,
+		Trigger:          triggers.Run,
+		RunStepTrigger:   triggers.RunStep,
+	}); err != nil {
+		return err
+	}
+
+	if err := steprunner.Start(ctx, wg, gdb, nil, steprunner.Config{
+		Logger:           logger.With("agent", "step runner"),
+		PollingInterval:  pollingInterval,
+		APIURL:           serverURL,
+		AgentID:          agentID,
+		Workers:          workers,
+		Lease:            lease,
+		DrainTimeout:     drainTimeout,
+		Confirm:          opts.Confirm,
+		SkipBuiltInTools: true,
+		Trigger:          triggers.RunStep,
+		RunTrigger:       triggers.Run,
+	}); err != nil {
+		return err
+	}
+
+	if err := toolrunner.Start(ctx, wg, gdb, toolrunner.Config{
+		Logger:          logger.With("agent", "tool runner"),
+		PollingInterval: pollingInterval,
+		RetentionPeriod: retentionPeriod,
+		APIURL:          serverURL,
+		AgentID:         agentID,
+		Workers:         workers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
+		Confirm:         opts.Confirm,
+		Trigger:         triggers.RunTool,
+	}); err != nil {
+		return err
+	}
+
+	if err := image.Start(ctx, wg, gdb, image.Config{
+		Logger:          logger.With("agent", "image"),
+		PollingInterval: pollingInterval,
+		RetentionPeriod: retentionPeriod,
+		ImagesBaseURL:   upstreamURL + "/images",
+		AgentID:         agentID,
+		Workers:         workers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
+		Trigger:         triggers.Image,
+	}); err != nil {
+		return err
+	}
+
+	if err := embeddings.Start(ctx, wg, gdb, embeddings.Config{
+		Logger:          logger.With("agent", "embeddings"),
+		EmbeddingsURL:   upstreamURL + "/embeddings",
+		PollingInterval: pollingInterval,
+		RetentionPeriod: retentionPeriod,
+		AgentID:         agentID,
+		Workers:         workers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
+		Trigger:         triggers.Embeddings,
+	}); err != nil {
+		return err
+	}
+
+	return audio.Start(ctx, wg, gdb, audio.Config{
+		Logger:          logger.With("agent", "audio"),
+		PollingInterval: pollingInterval,
+		RetentionPeriod: retentionPeriod,
+		AudioBaseURL:    upstreamURL + "/audio",
+		AgentID:         agentID,
+		Workers:         workers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
+		Trigger:         triggers.Audio,
+	})
+}
+
+// SetFixtures replaces the fixtures of the fake upstream provider, for example to call a tool whose ID is only known
+// once it has been created.
+func (h *Harness) SetFixtures(fixtures *fake.Fixtures) {
+	h.Upstream.SetFixtures(fixtures)
+}
+
+// Request sends a JSON request to the API path and decodes the response into out, if it isn't nil. It returns the
+// status code and fails the test if the request can't be sent.
+func (h *Harness) Request(method, path string, body, out any) int {
+	h.t.Helper()
+
+	resp := h.send(method, path, body)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("failed to read the response of %s %s: %v", method, path, err)
+	}
+
+	if out != nil && resp.StatusCode < http.StatusBadRequest {
+		if err = json.Unmarshal(data, out); err != nil {
+			h.t.Fatalf("failed to decode the response of %s %s: %v: %s", method, path, err, data)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+// Do sends a JSON request to the API path, like Request, and fails the test if the response isn't successful.
+func (h *Harness) Do(method, path string, body, out any) {
+	h.t.Helper()
+
+	if code := h.Request(method, path, body, out); code >= http.StatusBadRequest {
+		h.t.Fatalf("%s %s failed with status code %d", method, path, code)
+	}
+}
+
+func (h *Harness) send(method, path string, body any) *http.Response {
+	h.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			h.t.Fatalf("failed to encode the request of %s %s: %v", method, path, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, h.URL+path, reader)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+
+	return resp
+}
+
+// CreateAssistant creates an assistant with the model, instructions and tools.
+func (h *Harness) CreateAssistant(model, instructions string, tools ...map[string]any) *openai.AssistantObject {
+	h.t.Helper()
+
+	req := map[string]any{
+		"model":        model,
+		"instructions": instructions,
+	}
+	if len(tools) > 0 {
+		req["tools"] = tools
+	}
+
+	assistant := new(openai.AssistantObject)
+	h.Do(http.MethodPost, "/assistants", req, assistant)
+	return assistant
+}
+
+// FunctionTool returns an assistant tool for a function that takes a string argument, which the client runs.
+func FunctionTool(name, argument string) map[string]any {
+	return map[string]any{
+		"type": "function",
+		"function": map[string]any{
+			"name": name,
+			"parameters": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{argument: map[string]any{"type": "string"}},
+			},
+		},
+	}
+}
+
+// GPTScriptTool returns an assistant tool for a gptscript tool that was created with CreateTool, which the agents run.
+func GPTScriptTool(id string) map[string]any {
+	return map[string]any{
+		"type":   "gptscript",
+		"x-tool": id,
+	}
+}
+
+// CreateTool creates a gptscript tool from its contents.
+func (h *Harness) CreateTool(contents string) *openai.XToolObject {
+	h.t.Helper()
+
+	tool := new(openai.XToolObject)
+	h.Do(http.MethodPost, "/x-tools", map[string]any{"contents": contents}, tool)
+	return tool
+}
+
+// CreateThread creates a thread with a user message for each content.
+func (h *Harness) CreateThread(contents ...string) *openai.ThreadObject {
+	h.t.Helper()
+
+	messages := make([]map[string]any, 0, len(contents))
+	for _, content := range contents {
+		messages = append(messages, map[string]any{"role": "user", "content": content})
+	}
+
+	thread := new(openai.ThreadObject)
+	h.Do(http.MethodPost, "/threads", map[string]any{"messages": messages}, thread)
+	return thread
+}
+
+// CreateMessage adds a user message to the thread.
+func (h *Harness) CreateMessage(threadID, content string) *openai.MessageObject {
+	h.t.Helper()
+
+	message := new(openai.MessageObject)
+	h.Do(http.MethodPost, "/threads/"+threadID+"/messages", map[string]any{"role": "user", "content": content}, message)
+	return message
+}
+
+// Messages lists the thread's messages, oldest first.
+func (h *Harness) Messages(threadID string) []openai.MessageObject {
+	h.t.Helper()
+
+	messages := new(openai.ListMessagesResponse)
+	h.Do(http.MethodGet, "/threads/"+threadID+"/messages?order=asc", nil, messages)
+	return messages.Data
+}
+
+// MessageText returns the text content of a message.
+func MessageText(m openai.MessageObject) string {
+	var texts []string
+	for _, c := range m.Content {
+		if text, err := c.AsMessageContentTextObject(); err == nil && text.Type == openai.MessageContentTextObjectTypeText {
+			texts = append(texts, text.Text.Value)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// CreateRun starts a run of the assistant on the thread.
+func (h *Harness) CreateRun(threadID, assistantID string) *openai.RunObject {
+	h.t.Helper()
+
+	run := new(openai.RunObject)
+	h.Do(http.MethodPost, "/threads/"+threadID+"/runs", map[string]any{"assistant_id": assistantID}, run)
+	return run
+}
+
+// GetRun gets a run.
+func (h *Harness) GetRun(threadID, runID string) *openai.RunObject {
+	h.t.Helper()
+
+	run := new(openai.RunObject)
+	h.Do(http.MethodGet, "/threads/"+threadID+"/runs/"+runID, nil, run)
+	return run
+}
+
+// RunSteps lists the steps of a run, oldest first.
+func (h *Harness) RunSteps(threadID, runID string) []openai.RunStepObject {
+	h.t.Helper()
+
+	steps := new(openai.ListRunStepsResponse)
+	h.Do(http.MethodGet, "/threads/"+threadID+"/runs/"+runID+"/steps?order=asc", nil, steps)
+	return steps.Data
+}
+
+// WaitForRun polls the run until it has one of the statuses, and fails the test if it reaches another status that it
+// can't leave, or if it takes longer than DefaultTimeout.
+func (h *Harness) WaitForRun(threadID, runID string, statuses ...openai.RunObjectStatus) *openai.RunObject {
+	h.t.Helper()
+
+	terminal := []openai.RunObjectStatus{
+		openai.RunObjectStatusCompleted,
+		openai.RunObjectStatusFailed,
+		openai.RunObjectStatusCancelled,
+		openai.RunObjectStatusExpired,
+	}
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		run := h.GetRun(threadID, runID)
+		if slices.Contains(statuses, run.Status) {
+			return run
+		}
+		if slices.Contains(terminal, run.Status) {
+			var lastError string
+			if run.LastError != nil {
+				lastError = run.LastError.Message
+			}
+			h.t.Fatalf("run %s is %s, want %v: %s", runID, run.Status, statuses, lastError)
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("run %s is still %s after %s, want %v", runID, run.Status, DefaultTimeout, statuses)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// RequiredToolCalls returns the tool calls that a run that requires action is waiting for.
+func RequiredToolCalls(run *openai.RunObject) []openai.RunToolCallObject {
+	if run.RequiredAction == nil || run.RequiredAction.SubmitToolOutputs == nil || run.RequiredAction.SubmitToolOutputs.ToolCalls == nil {
+		return nil
+	}
+
+	return *run.RequiredAction.SubmitToolOutputs.ToolCalls
+}
+
+// SubmitToolOutputs submits the outputs of the run's tool calls, by tool call ID.
+func (h *Harness) SubmitToolOutputs(threadID, runID string, outputs map[string]string) *openai.RunObject {
+	h.t.Helper()
+
+	toolOutputs := make([]map[string]string, 0, len(outputs))
+	for id, output := range outputs {
+		toolOutputs = append(toolOutputs, map[string]string{"tool_call_id": id, "output": output})
+	}
+
+	run := new(openai.RunObject)
+	h.Do(http.MethodPost, "/threads/"+threadID+"/runs/"+runID+"/submit_tool_outputs", map[string]any{"tool_outputs": toolOutputs}, run)
+	return run
+}
+
+// ConfirmRun confirms, or denies, the tool call that a run that requires confirmation is waiting for.
+func (h *Harness) ConfirmRun(threadID, runID, toolCallID string, confirm bool) {
+	h.t.Helper()
+
+	h.Do(http.MethodPost, "/threads/"+threadID+"/runs/"+runID+"/x-confirm", map[string]any{
+		"confirmation": map[string]any{
+			"tool_call_id": toolCallID,
+			"confirmation": confirm,
+		},
+	}, nil)
+}
+
+// Event is a server-sent event.
+type Event struct {
+	// Name is the event field, which is empty for streamed chat completion chunks.
+	Name string
+	Data string
+}
+
+// Stream sends a JSON request to the API path and reads the server-sent events of the response until the stream is
+// done. The [DONE] event isn't returned.
+func (h *Harness) Stream(method, path string, body any) []Event {
+	h.t.Helper()
+
+	resp := h.send(method, path, body)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		data, _ := io.ReadAll(resp.Body)
+		h.t.Fatalf("%s %s failed with status code %d: %s", method, path, resp.StatusCode, data)
+	}
+
+	var (
+		events  []Event
+		event   Event
+		scanner = bufio.NewScanner(resp.Body)
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event.Data == "[DONE]" {
+				return events
+			}
+			if event.Name != "" || event.Data != "" {
+				events = append(events, event)
+			}
+			event = Event{}
+		case strings.HasPrefix(line, "event:"):
+			event.Name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			event.Data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		h.t.Fatalf("failed to read the stream of %s %s: %v", method, path, err)
+	}
+
+	return events
+}
+
+// StreamRun starts a streamed run of the assistant on the thread and returns its events.
+func (h *Harness) StreamRun(threadID, assistantID string) []Event {
+	h.t.Helper()
+
+	return h.Stream(http.MethodPost, "/threads/"+threadID+"/runs", map[string]any{"assistant_id": assistantID, "stream": true})
+}
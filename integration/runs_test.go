@@ -0,0 +1,234 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers/fake"
+)
+
+// weatherFixtures call the weather function once for user messages about the weather, and echo the tool's response.
+var weatherFixtures = &fake.Fixtures{
+	ChatCompletions: []fake.ChatCompletion{{
+		Match:     fake.Match{Contains: "weather", Role: "user"},
+		ToolCalls: []fake.ToolCall{{Name: "get_weather", Arguments: json.RawMessage(`{"city": "Oslo"}`)}},
+	}},
+}
+
+func lastMessage(t *testing.T, h *Harness, threadID string) openai.MessageObject {
+	t.Helper()
+
+	messages := h.Messages(threadID)
+	if len(messages) == 0 {
+		t.Fatalf("thread %s has no messages", threadID)
+	}
+
+	return messages[len(messages)-1]
+}
+
+func TestRun(t *testing.T) {
+	h := New(t, Options{})
+
+	assistant := h.CreateAssistant("gpt-4o", "You are helpful.")
+	thread := h.CreateThread("Hello there!")
+
+	run := h.CreateRun(thread.Id, assistant.Id)
+	h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusCompleted)
+
+	m := lastMessage(t, h, thread.Id)
+	if m.Role != openai.Assistant || MessageText(m) != "Hello there!" {
+		t.Errorf("last message = %s %q, want the user's message echoed by the assistant", m.Role, MessageText(m))
+	}
+
+	if steps := h.RunSteps(thread.Id, run.Id); len(steps) != 1 {
+		t.Errorf("run should have a single step, got %+v", steps)
+	}
+}
+
+func TestRunFunctionToolCall(t *testing.T) {
+	h := New(t, Options{Fixtures: weatherFixtures})
+
+	assistant := h.CreateAssistant("gpt-4o", "You know the weather.", FunctionTool("get_weather", "city"))
+	thread := h.CreateThread("What's the weather like?")
+
+	run := h.CreateRun(thread.Id, assistant.Id)
+	run = h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusRequiresAction)
+
+	toolCalls := RequiredToolCalls(run)
+	if len(toolCalls) != 1 || toolCalls[0].Function.Name != "get_weather" || toolCalls[0].Function.Arguments != `{"city":"Oslo"}` {
+		t.Fatalf("required tool calls = %+v", toolCalls)
+	}
+
+	h.SubmitToolOutputs(thread.Id, run.Id, map[string]string{toolCalls[0].Id: "Sunny and warm."})
+	h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusCompleted)
+
+	if text := MessageText(lastMessage(t, h, thread.Id)); text != "Sunny and warm." {
+		t.Errorf("last message = %q, want the tool's output echoed", text)
+	}
+}
+
+func TestRunEmulatedToolCall(t *testing.T) {
+	h := New(t, Options{
+		EmulateToolCalls: []string{"gpt-3.5-*"},
+		Fixtures: &fake.Fixtures{
+			ChatCompletions: []fake.ChatCompletion{{
+				Match:   fake.Match{Model: "gpt-3.5-turbo", Contains: "weather"},
+				Content: `<tool_call>{"name": "get_weather", "arguments": {"city": "Oslo"}}</tool_call>`,
+			}},
+		},
+	})
+
+	assistant := h.CreateAssistant("gpt-3.5-turbo", "You know the weather.", FunctionTool("get_weather", "city"))
+	thread := h.CreateThread("What's the weather like?")
+
+	run := h.CreateRun(thread.Id, assistant.Id)
+	run = h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusRequiresAction)
+
+	if toolCalls := RequiredToolCalls(run); len(toolCalls) != 1 || toolCalls[0].Function.Name != "get_weather" {
+		t.Errorf("required tool calls = %+v", toolCalls)
+	}
+}
+
+func TestStreamedRun(t *testing.T) {
+	h := New(t, Options{})
+
+	assistant := h.CreateAssistant("gpt-4o", "You are helpful.")
+	thread := h.CreateThread("Hello streaming world")
+
+	var (
+		names []string
+		text  string
+	)
+	for _, e := range h.StreamRun(thread.Id, assistant.Id) {
+		names = append(names, e.Name)
+		if e.Name != "thread.message.delta" {
+			continue
+		}
+
+		var delta struct {
+			Delta struct {
+				Content []struct {
+					Text struct {
+						Value string `json:"value"`
+					} `json:"text"`
+				} `json:"content"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(e.Data), &delta); err != nil {
+			t.Fatalf("failed to decode message delta: %v", err)
+		}
+		for _, c := range delta.Delta.Content {
+			text += c.Text.Value
+		}
+	}
+
+	for _, want := range []string{"thread.run.created", "thread.message.created", "thread.message.completed", "thread.run.completed"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("stream should have a %s event, got %v", want, names)
+		}
+	}
+	if text != "Hello streaming world" {
+		t.Errorf("streamed message = %q, want the user's message", text)
+	}
+}
+
+func TestRunConfirmation(t *testing.T) {
+	h := New(t, Options{Confirm: true})
+
+	// Only gptscript's built-in tools, like sys.exec, ask for confirmation.
+	tool := h.CreateTool(`name: greet
+description: Greets Ada
+model: gpt-4o
+tools: sys.exec
+
+Run the command that greets Ada.
+`)
+	h.SetFixtures(&fake.Fixtures{
+		ChatCompletions: []fake.ChatCompletion{
+			{
+				Match:     fake.Match{Contains: "greet", Role: "user"},
+				ToolCalls: []fake.ToolCall{{Name: "gptscript_" + tool.Id, Arguments: json.RawMessage(`{}`)}},
+			},
+			{
+				Match:     fake.Match{Contains: "Run the command"},
+				ToolCalls: []fake.ToolCall{{Name: "exec", Arguments: json.RawMessage(`{"command": "echo Hello, Ada!"}`)}},
+			},
+		},
+	})
+
+	assistant := h.CreateAssistant("gpt-4o", "You greet people.", GPTScriptTool(tool.Id))
+	thread := h.CreateThread("Please greet Ada.")
+
+	run := h.CreateRun(thread.Id, assistant.Id)
+	run = h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusRequiresConfirmation)
+	if run.RequiredAction == nil || run.RequiredAction.XConfirm == nil {
+		t.Fatalf("run should require confirmation, got %+v", run.RequiredAction)
+	}
+
+	h.ConfirmRun(thread.Id, run.Id, run.RequiredAction.XConfirm.Id, true)
+	h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusCompleted)
+
+	if text := MessageText(lastMessage(t, h, thread.Id)); !strings.Contains(text, "Hello, Ada!") {
+		t.Errorf("last message = %q, want the tool's output echoed", text)
+	}
+}
+
+func TestRunUpstreamError(t *testing.T) {
+	h := New(t, Options{
+		Fixtures: &fake.Fixtures{
+			ChatCompletions: []fake.ChatCompletion{{
+				StatusCode: http.StatusTooManyRequests,
+				Error:      "Rate limit reached",
+			}},
+		},
+	})
+
+	assistant := h.CreateAssistant("gpt-4o", "You are helpful.")
+	thread := h.CreateThread("Hello?")
+
+	run := h.CreateRun(thread.Id, assistant.Id)
+	run = h.WaitForRun(thread.Id, run.Id, openai.RunObjectStatusFailed)
+	if run.LastError == nil || run.LastError.Code != openai.RunObjectLastErrorCodeRateLimitExceeded {
+		t.Errorf("run should fail with a rate limit error, got %+v", run.LastError)
+	}
+}
+
+func TestStreamedRunRetry(t *testing.T) {
+	h := New(t, Options{
+		Fixtures: &fake.Fixtures{
+			ChatCompletions: []fake.ChatCompletion{{
+				StatusCode: http.StatusServiceUnavailable,
+				Error:      "Overloaded",
+			}},
+		},
+	})
+
+	assistant := h.CreateAssistant("gpt-4o", "You are helpful.")
+	thread := h.CreateThread("Hello?")
+
+	var retries int
+	for _, e := range h.StreamRun(thread.Id, assistant.Id) {
+		if e.Name != db.RunEventRetrying {
+			continue
+		}
+		retries++
+
+		var run openai.RunObject
+		if err := json.Unmarshal([]byte(e.Data), &run); err != nil {
+			t.Fatalf("failed to decode retry event: %v", err)
+		}
+		if run.LastError == nil || !strings.Contains(run.LastError.Message, "Overloaded") {
+			t.Errorf("retry event should have the upstream error, got %+v", run.LastError)
+		}
+	}
+
+	// The harness's retry policy makes two attempts.
+	if retries != 1 {
+		t.Errorf("stream should have 1 %s event, got %d", db.RunEventRetrying, retries)
+	}
+}
@@ -1,21 +1,24 @@
 package agents
 
 import (
-	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
-	"strings"
 
 	"github.com/acorn-io/z"
-	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/sse"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 
 	// Blank import to register the github loader
 	_ "github.com/gptscript-ai/gptscript/pkg/loader/github"
@@ -29,20 +32,45 @@ func init() {
 	}
 }
 
+// NewHTTPClient returns a client for the requests that agents make to providers and to the server's API. The trace
+// context is sent with each request. The requests are sent with transport, which may, for example, record or replay
+// them, or with http.DefaultTransport if it is nil. Each agent's Config takes the transport of its client.
+func NewHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{Transport: tracing.Transport{Base: transport}}
+}
+
+// StreamChatCompletionRequest makes a streaming chat completion request. If the provider fails the request before
+// streaming the response, then an UpstreamError is returned.
 func StreamChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http.Client, url, apiKey string, cc *db.CreateChatCompletionRequest) (<-chan db.ChatCompletionResponseChunk, error) {
+	stream, _, err := streamChatCompletionRequest(ctx, l, client, url, apiKey, nil, cc)
+	return stream, err
+}
+
+// StreamRunChatCompletionRequest makes a streaming chat completion request to the chat completion API for a run of the
+// given assistant. The ID of the stored chat completion request is returned, even if the request fails, so that its
+// retries can be recorded with the run.
+func StreamRunChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http.Client, url, apiKey, assistantID string, cc *db.CreateChatCompletionRequest) (<-chan db.ChatCompletionResponseChunk, string, error) {
+	stream, header, err := streamChatCompletionRequest(ctx, l, client, url, apiKey, http.Header{db.AssistantIDHeader: {assistantID}}, cc)
+	return stream, header.Get(db.RequestIDHeader), err
+}
+
+func streamChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http.Client, url, apiKey string, header http.Header, cc *db.CreateChatCompletionRequest) (<-chan db.ChatCompletionResponseChunk, http.Header, error) {
 	// Ensure that streaming is enabled.
 	cc.Stream = z.Pointer(true)
 
 	b, err := json.Marshal(cc.ToPublic())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	l.Debug("Making stream chat completion request", "request", string(b))
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "text/event-stream")
@@ -55,12 +83,18 @@ func StreamChatCompletionRequest(ctx context.Context, l *slog.Logger, client *ht
 	resp, err := client.Do(req)
 	if err != nil {
 		l.Error("Failed to create chat completion", "err", err)
-		return nil, err
+		return nil, nil, &UpstreamError{Err: err}
+	}
+	if err = CheckResponse(resp); err != nil {
+		l.Error("Failed to create chat completion", "err", err)
+		return nil, resp.Header, err
 	}
 
-	return streamResponses(ctx, resp), nil
+	return streamResponses(ctx, resp), resp.Header, nil
 }
 
+// MakeChatCompletionRequest makes a non-streaming chat completion request. If the provider fails the request, then an
+// UpstreamError is returned.
 func MakeChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http.Client, url, apiKey string, cc *db.CreateChatCompletionRequest) (*db.CreateChatCompletionResponse, error) {
 	if z.Dereference(cc.Stream) {
 		l.Warn("Non-streaming chat completion call with streaming enabled, disabling streaming")
@@ -84,114 +118,95 @@ func MakeChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http
 		req.Header.Set("Authorization", "Bearer "+apiKey)
 	}
 
-	resp := new(openai.CreateChatCompletionResponse)
-
-	// Wait to process this error until after we have the DB object.
-	code, err := cclient.SendRequest(client, req, resp)
-
-	ccr := new(db.CreateChatCompletionResponse)
-	// err here should be shadowed.
-	if err := ccr.FromPublic(resp); err != nil {
+	res, err := client.Do(req)
+	if err != nil {
 		l.Error("Failed to create chat completion", "err", err)
+		return nil, &UpstreamError{Err: err}
 	}
-
-	// Process the request error here.
-	if err != nil {
+	if err = CheckResponse(res); err != nil {
 		l.Error("Failed to create chat completion", "err", err)
-		ccr.Error = z.Pointer(err.Error())
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resp := new(openai.CreateChatCompletionResponse)
+	if err = json.NewDecoder(res.Body).Decode(resp); err != nil {
+		l.Error("Failed to decode chat completion", "err", err)
+		return nil, fmt.Errorf("failed to decode chat completion response: %w", err)
 	}
 
-	ccr.StatusCode = code
+	ccr := new(db.CreateChatCompletionResponse)
+	if err = ccr.FromPublic(resp); err != nil {
+		return nil, err
+	}
+
+	ccr.StatusCode = res.StatusCode
 	ccr.RequestID = cc.ID
 	ccr.Done = true
 
 	return ccr, nil
 }
 
-func streamResponses(ctx context.Context, response *http.Response) <-chan db.ChatCompletionResponseChunk {
-	var (
-		emptyMessagesCount int
-		hasError           bool
+// keepAliveEvents are the types of the events that providers send to keep streams open. Events of other types are
+// parsed as chunks, because some providers name the events that carry them.
+var keepAliveEvents = []string{"ping", "keepalive", "keep-alive", "heartbeat"}
 
-		reader = bufio.NewReader(response.Body)
-		errBuf = bytes.Buffer{}
-		stream = make(chan db.ChatCompletionResponseChunk, 500)
-	)
+func streamResponses(ctx context.Context, response *http.Response) <-chan db.ChatCompletionResponseChunk {
+	stream := make(chan db.ChatCompletionResponseChunk, 500)
 
 	go func() {
 		defer close(stream)
 		defer response.Body.Close()
 
+		var (
+			reader = sse.NewReader(response.Body)
+			// skipped counts the events in a row that have no chunk, like keep-alive events.
+			skipped int
+		)
 		for {
-			rawLine, readErr := reader.ReadBytes('\n')
-			if readErr != nil {
-				sendChunk(ctx, stream, db.ChatCompletionResponseChunk{
-					JobResponse: db.JobResponse{
-						StatusCode: http.StatusInternalServerError,
-						Error:      z.Pointer(readErr.Error()),
-					},
-				})
+			event, err := reader.Next()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = fmt.Errorf("stream ended before [DONE]: %w", io.ErrUnexpectedEOF)
+				}
+				SendChunk(ctx, stream, ErrorChunk(http.StatusInternalServerError, err.Error()))
 				return
 			}
 
-			rawLine = bytes.TrimSpace(rawLine)
-			hasDataPrefix := bytes.HasPrefix(rawLine, []byte("data: "))
-			noPrefixLine := bytes.TrimSpace(bytes.TrimPrefix(rawLine, []byte("data: ")))
-
-			hasError = hasError || strings.HasPrefix(string(noPrefixLine), `{"error":`)
-
-			if !hasDataPrefix || hasError || len(noPrefixLine) == 0 {
-				if hasError {
-					_, err := errBuf.Write(noPrefixLine)
-					if err != nil {
-						sendChunk(ctx, stream, db.ChatCompletionResponseChunk{
-							JobResponse: db.JobResponse{
-								StatusCode: http.StatusInternalServerError,
-								Error:      z.Pointer(fmt.Sprintf("failed to write error buffer: %v", err)),
-							},
-						})
-						return
-					}
-
-					var ccr db.ChatCompletionResponseChunk
-					if err = json.Unmarshal(errBuf.Bytes(), &ccr); err == nil {
-						sendChunk(ctx, stream, ccr)
-						return
-					}
-					// If we can't unmarshal the error yet, then we haven't received it all. Continue until we get the whole error.
-				}
-
-				emptyMessagesCount++
-				if emptyMessagesCount > emptyMessagesLimit {
-					sendChunk(ctx, stream, db.ChatCompletionResponseChunk{
-						JobResponse: db.JobResponse{
-							StatusCode: http.StatusInternalServerError,
-							Error:      z.Pointer("stream has sent too many empty messages, limit is " + strconv.Itoa(emptyMessagesLimit)),
-						},
-					})
+			data := bytes.TrimSpace(event.Data)
+			if event.Type == "error" {
+				SendChunk(ctx, stream, streamErrorChunk(data))
+				return
+			}
+			if slices.Contains(keepAliveEvents, event.Type) || len(data) == 0 {
+				skipped++
+				if skipped > emptyMessagesLimit {
+					SendChunk(ctx, stream, ErrorChunk(http.StatusInternalServerError, "stream has sent too many empty messages, limit is "+strconv.Itoa(emptyMessagesLimit)))
 					return
 				}
-
 				continue
 			}
+			skipped = 0
+
+			if string(data) == "[DONE]" {
+				return
+			}
 
-			if string(noPrefixLine) == "[DONE]" {
+			var probe struct {
+				Error json.RawMessage `json:"error"`
+			}
+			if err = json.Unmarshal(data, &probe); err == nil && len(probe.Error) > 0 && string(probe.Error) != "null" {
+				SendChunk(ctx, stream, streamErrorChunk(data))
 				return
 			}
 
-			dbResponse := new(db.ChatCompletionResponseChunk)
-			unmarshalErr := json.Unmarshal(noPrefixLine, dbResponse)
-			if unmarshalErr != nil {
-				sendChunk(ctx, stream, db.ChatCompletionResponseChunk{
-					JobResponse: db.JobResponse{
-						StatusCode: http.StatusInternalServerError,
-						Error:      z.Pointer(fmt.Sprintf("failed to unmarshal stream message: %v", noPrefixLine)),
-					},
-				})
+			chunk := new(db.ChatCompletionResponseChunk)
+			if err = json.Unmarshal(data, chunk); err != nil {
+				SendChunk(ctx, stream, ErrorChunk(http.StatusInternalServerError, fmt.Sprintf("failed to unmarshal stream message: %s", data)))
 				return
 			}
 
-			if !sendChunk(ctx, stream, *dbResponse) {
+			if !SendChunk(ctx, stream, *chunk) {
 				return
 			}
 		}
@@ -200,8 +215,62 @@ func streamResponses(ctx context.Context, response *http.Response) <-chan db.Cha
 	return stream
 }
 
-// sendChunk sends a chunk to the stream. It returns false if the context is done and the stream should not continue.
-func sendChunk(ctx context.Context, stream chan db.ChatCompletionResponseChunk, chunk db.ChatCompletionResponseChunk) bool {
+// streamErrorChunk returns the chunk for an error that the provider sent in the stream. The error is either an object
+// like those of error responses, which may have an HTTP status code, or a string.
+func streamErrorChunk(data []byte) db.ChatCompletionResponseChunk {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+		// StatusCode is set by servers, like this one, that send chunks with errors.
+		StatusCode int `json:"status_code"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || len(body.Error) == 0 {
+		// The event's data is the error itself.
+		body.Error = data
+	}
+
+	var message string
+	if err := json.Unmarshal(body.Error, &message); err == nil {
+		return ErrorChunk(cmp.Or(body.StatusCode, http.StatusBadGateway), message)
+	}
+
+	var streamErr struct {
+		Message string          `json:"message"`
+		Type    string          `json:"type"`
+		Code    json.RawMessage `json:"code"`
+		Status  int             `json:"status"`
+	}
+	if err := json.Unmarshal(body.Error, &streamErr); err != nil || streamErr.Message == "" {
+		return ErrorChunk(http.StatusBadGateway, fmt.Sprintf("upstream sent an error in the stream: %s", data))
+	}
+
+	code := streamErr.Status
+	if code == 0 {
+		code, _ = strconv.Atoi(string(streamErr.Code))
+	}
+	if code < http.StatusBadRequest || code > 599 {
+		code = http.StatusBadGateway
+	}
+
+	message = streamErr.Message
+	if streamErr.Type != "" {
+		message = streamErr.Type + ": " + message
+	}
+
+	return ErrorChunk(code, message)
+}
+
+// ErrorChunk returns a chunk that fails the stream with the given status code and message.
+func ErrorChunk(code int, message string) db.ChatCompletionResponseChunk {
+	return db.ChatCompletionResponseChunk{
+		JobResponse: db.JobResponse{
+			StatusCode: code,
+			Error:      z.Pointer(message),
+		},
+	}
+}
+
+// SendChunk sends a chunk to the stream. It returns false if the context is done and the stream should not continue.
+func SendChunk(ctx context.Context, stream chan db.ChatCompletionResponseChunk, chunk db.ChatCompletionResponseChunk) bool {
 	select {
 	case <-ctx.Done():
 		go func() {
@@ -0,0 +1,86 @@
+package agents
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStreamResponses(t *testing.T) {
+	for _, tt := range []struct {
+		name, stream string
+		// content is the content of the chunks, and err the error of the last chunk, if there is one.
+		content    string
+		err        string
+		statusCode int
+	}{
+		{
+			name: "keep-alives and named events",
+			stream: ": keep-alive\n\n" +
+				"event: ping\ndata: {}\n\n" +
+				"data: {\"choices\": [{\"index\": 0,\ndata: \"delta\": {\"content\": \"Hello\"}}]}\n\n" +
+				"id: 2\r\ndata: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \", world\"}}]}\r\n\r\n" +
+				"data: [DONE]\n\n",
+			content: "Hello, world",
+		},
+		{
+			name: "named chunk events",
+			stream: "event: completion\ndata: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hello\"}}]}\n\n" +
+				"event: heartbeat\ndata: {}\n\n" +
+				"event: completion\ndata: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \", world\"}}]}\n\n" +
+				"event: completion\ndata: [DONE]\n\n",
+			content: "Hello, world",
+		},
+		{
+			name: "error object",
+			stream: "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hel\"}}]}\n\n" +
+				"data: {\"error\": {\"message\": \"Rate limit reached\", \"type\": \"requests\", \"code\": \"rate_limit_exceeded\", \"status\": 429}}\n\n",
+			content:    "Hel",
+			err:        "requests: Rate limit reached",
+			statusCode: http.StatusTooManyRequests,
+		},
+		{
+			name:       "error event",
+			stream:     "event: error\ndata: {\"message\": \"Overloaded\"}\n\n",
+			err:        "Overloaded",
+			statusCode: http.StatusBadGateway,
+		},
+		{
+			name:       "unterminated stream",
+			stream:     "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hi\"}}]}\n\n",
+			content:    "Hi",
+			err:        "stream ended before [DONE]: unexpected EOF",
+			statusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := streamResponses(context.Background(), &http.Response{Body: io.NopCloser(strings.NewReader(tt.stream))})
+
+			var (
+				content    strings.Builder
+				err        string
+				statusCode int
+			)
+			for chunk := range stream {
+				if chunk.Error != nil {
+					err, statusCode = *chunk.Error, chunk.GetStatusCode()
+					continue
+				}
+				for _, choice := range chunk.Choices {
+					if c := choice.Delta.Data().Content; c != nil {
+						content.WriteString(*c)
+					}
+				}
+			}
+
+			if content.String() != tt.content {
+				t.Errorf("content = %q, want %q", content.String(), tt.content)
+			}
+			if err != tt.err || statusCode != tt.statusCode {
+				t.Errorf("error = %q (%d), want %q (%d)", err, statusCode, tt.err, tt.statusCode)
+			}
+		})
+	}
+}
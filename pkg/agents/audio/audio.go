@@ -2,14 +2,15 @@ package audio
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
 	"gorm.io/gorm"
 )
@@ -37,17 +38,26 @@ type Config struct {
 	Logger                           *slog.Logger
 	PollingInterval, RetentionPeriod time.Duration
 	AudioBaseURL, APIKey, AgentID    string
+	DrainTimeout                     time.Duration
+	Workers                          int
+	Lease                            db.Lease
 	Trigger                          trigger.Trigger
+	Transport                        http.RoundTripper
+	// Providers routes the requests to audio providers by model. Defaults to sending every request to the OpenAI audio
+	// API at AudioBaseURL.
+	Providers *providers.Registry[providers.AudioProvider]
 }
 
 type agent struct {
-	logger                                        *slog.Logger
-	pollingInterval, requestRetention             time.Duration
-	id, apiKey                                    string
-	speechURL, translationsURL, transcriptionsURL string
-	client                                        *http.Client
-	db                                            *db.DB
-	trigger                                       trigger.Trigger
+	logger                            *slog.Logger
+	pollingInterval, requestRetention time.Duration
+	id                                string
+	drainTimeout                      time.Duration
+	workers                           int
+	lease                             db.Lease
+	providers                         *providers.Registry[providers.AudioProvider]
+	db                                *db.DB
+	trigger                           trigger.Trigger
 }
 
 func newAgent(db *db.DB, cfg Config) (*agent, error) {
@@ -57,110 +67,107 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	if cfg.RetentionPeriod < minRequestRetention {
 		return nil, fmt.Errorf("[audio] request retention must be at least %s", minRequestRetention)
 	}
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, fmt.Errorf("[audio] %w", err)
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, fmt.Errorf("[audio] %w", err)
+	}
 
 	if cfg.Trigger == nil {
 		cfg.Logger.Warn("[audio] No trigger provided, using noop")
 		cfg.Trigger = trigger.NewNoop()
 	}
 
+	if cfg.Providers == nil {
+		cfg.Providers = providers.NewRegistry[providers.AudioProvider]()
+		if err := cfg.Providers.Register(providers.NewOpenAIAudio(cfg.AudioBaseURL, cfg.APIKey, agents.NewHTTPClient(cfg.Transport))); err != nil {
+			return nil, fmt.Errorf("[audio] %w", err)
+		}
+	}
+
 	return &agent{
-		logger:            cfg.Logger,
-		pollingInterval:   cfg.PollingInterval,
-		requestRetention:  cfg.RetentionPeriod,
-		speechURL:         cfg.AudioBaseURL + "/speech",
-		translationsURL:   cfg.AudioBaseURL + "/translations",
-		transcriptionsURL: cfg.AudioBaseURL + "/transcriptions",
-		client:            http.DefaultClient,
-		apiKey:            cfg.APIKey,
-		db:                db,
-		id:                cfg.AgentID,
-		trigger:           cfg.Trigger,
+		logger:           cfg.Logger,
+		pollingInterval:  cfg.PollingInterval,
+		requestRetention: cfg.RetentionPeriod,
+		drainTimeout:     cfg.DrainTimeout,
+		workers:          cfg.Workers,
+		lease:            cfg.Lease,
+		providers:        cfg.Providers,
+		db:               db,
+		id:               cfg.AgentID,
+		trigger:          cfg.Trigger,
 	}, nil
 }
 
 func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
-	// Start the "job runner"
-	for _, run := range []func(context.Context, *slog.Logger) error{
+	// Start the "job runners"
+	pool := agents.Pool{
+		Name:            "audio",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}
+	for _, run := range []agents.Work{
 		a.runSpeech,
 		a.runTranslations,
 		a.runTranscriptions,
 	} {
-		wg.Add(1)
-		go func(r func(context.Context, *slog.Logger) error) {
-			defer wg.Done()
-			timer := time.NewTimer(a.pollingInterval)
-			for {
-				if err := r(ctx, a.logger); err != nil {
-					if !errors.Is(err, gorm.ErrRecordNotFound) {
-						a.logger.Error("failed run iteration", "err", err)
-					}
-
-					select {
-					case <-ctx.Done():
-						// Ensure the timer channel is drained
-						if !timer.Stop() {
-							select {
-							case <-timer.C:
-							default:
-							}
-						}
-						return
-					case <-timer.C:
-					case <-a.trigger.Triggered():
-					}
-				}
-
-				if !timer.Stop() {
-					// Ensure the timer channel is drained
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-
-				timer.Reset(a.pollingInterval)
-			}
-		}(run)
+		pool.Start(ctx, wg, a.logger, run)
 	}
 
 	// Start cleanup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var (
-			cleanupInterval = a.requestRetention / 2
-			jobObjects      = []db.Storer{
-				new(db.CreateSpeechRequest),
-				new(db.CreateSpeechResponse),
-				new(db.CreateTranslationRequest),
-				new(db.CreateTranslationResponse),
-				new(db.CreateTranscriptionRequest),
-				new(db.CreateTranscriptionResponse),
-			}
-			cdb   = a.db.WithContext(ctx)
-			timer = time.NewTimer(cleanupInterval)
-		)
-		for {
-			a.logger.Debug("looking for expired audio requests and responses")
-			expiration := time.Now().Add(-a.requestRetention)
-			if err := db.DeleteExpired(cdb, expiration, jobObjects...); err != nil {
-				a.logger.Error("failed to delete expired audio requests and responses", "err", err)
-			}
-
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
-			}
-
-			timer.Reset(cleanupInterval)
+	var (
+		jobObjects = []db.Storer{
+			new(db.CreateSpeechRequest),
+			new(db.CreateSpeechResponse),
+			new(db.CreateTranslationRequest),
+			new(db.CreateTranslationResponse),
+			new(db.CreateTranscriptionRequest),
+			new(db.CreateTranscriptionResponse),
+		}
+		cdb = a.db.WithContext(ctx)
+	)
+	agents.RunPeriodically(ctx, wg, a.requestRetention/2, func(context.Context) {
+		a.logger.Debug("looking for expired audio requests and responses")
+		expiration := time.Now().Add(-a.requestRetention)
+		if err := db.DeleteExpired(cdb, expiration, jobObjects...); err != nil {
+			a.logger.Error("failed to delete expired audio requests and responses", "err", err)
+		}
+	})
+}
+
+// respond stores the provider's response to the request and marks the request as done.
+func (a *agent) respond(gdb *gorm.DB, l *slog.Logger, request db.Storer, response db.JobFailer, jr *db.JobResponse) {
+	if jr.Error != nil {
+		l.Error("audio request failed", "status_code", jr.StatusCode, "err", *jr.Error)
+	}
+
+	jr.RequestID = request.GetID()
+	jr.Done = true
+
+	// Store the completed response and mark the request as done.
+	if err := gdb.Transaction(func(tx *gorm.DB) error {
+		if err := db.Create(tx, response); err != nil {
+			return err
 		}
-	}()
+		return tx.Model(request).Where("id = ?", request.GetID()).Update("done", true).Error
+	}); err != nil {
+		l.Error("failed to store audio response", "err", err)
+	}
+
+	a.trigger.Ready(request.GetID())
+}
+
+// fail fails the request, for example because no provider serves its model or the provider couldn't be reached. Nothing
+// is stored if gdb's context is done, so that interrupted requests are left for another agent.
+func (a *agent) fail(gdb *gorm.DB, l *slog.Logger, request db.Storer, response db.JobFailer, err error) error {
+	l.Error("failed audio request", "err", err)
+	if failErr := db.FailJob(gdb, request, response, err); failErr != nil {
+		return failErr
+	}
+
+	a.trigger.Ready(request.GetID())
+	return nil
 }
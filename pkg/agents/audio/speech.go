@@ -1,67 +1,45 @@
 package audio
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
-	"net/http"
 
-	"github.com/acorn-io/z"
-	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
-	"gorm.io/gorm"
 )
 
 func (a *agent) runSpeech(ctx context.Context, l *slog.Logger) error {
-	l.Debug("checking for an transcription request to process")
+	l.Debug("checking for a speech request to process")
 	var (
 		speechRequest = new(db.CreateSpeechRequest)
 		gdb           = a.db.WithContext(ctx)
 	)
-	if err := db.Dequeue(gdb, speechRequest, a.id); err != nil {
+	ctx, cancel, err := agents.Dequeue(ctx, l, gdb, speechRequest, a.id, a.lease, a.pollingInterval, func() db.JobFailer { return new(db.CreateSpeechResponse) })
+	if err != nil {
 		return err
 	}
+	defer cancel()
+
+	gdb = a.db.WithContext(ctx)
 
-	l = slog.With("type", "speech", "id", speechRequest.ID)
+	l = l.With("type", "speech", "id", speechRequest.ID)
 	l.Debug("processing request")
 
-	data, err := json.Marshal(speechRequest.ToPublic())
-	if err != nil {
-		return fmt.Errorf("failed to marshal create speech request: %w", err)
-	}
+	// Both kinds of speech models are strings.
+	model, _ := speechRequest.Model.Data().AsCreateSpeechRequestModel0()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.speechURL, bytes.NewReader(data))
+	provider, err := a.providers.Lookup(model)
 	if err != nil {
-		return fmt.Errorf("failed to create speech request: %w", err)
+		return a.fail(gdb, l, speechRequest, new(db.CreateSpeechResponse), err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if a.apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+a.apiKey)
-	}
-
-	sr := new(db.CreateSpeechResponse)
-	code, err := cclient.SendRequest(a.client, req, &sr.Content)
+	response, err := provider.CreateSpeech(ctx, speechRequest)
 	if err != nil {
-		l.Error("failed to send speech create request", "err", err)
-		sr.Error = z.Pointer(err.Error())
+		return a.fail(gdb, l, speechRequest, new(db.CreateSpeechResponse), fmt.Errorf("failed to make speech request: %w", err))
 	}
 
-	sr.StatusCode = code
-	sr.RequestID = speechRequest.ID
-	sr.Done = true
-
-	if err := gdb.Transaction(func(tx *gorm.DB) error {
-		if err := db.Create(tx, sr); err != nil {
-			return err
-		}
-
-		return tx.Model(speechRequest).Where("id = ?", speechRequest.ID).Update("done", true).Error
-	}); err != nil {
-		l.Error("failed to store speech create response", "err", err)
-	}
+	a.respond(gdb, l, speechRequest, response, &response.JobResponse)
 
 	return nil
 }
@@ -0,0 +1,236 @@
+package chatcompletion
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+)
+
+// CacheConfig configures the cache of chat completion responses. Requests with the same model, messages, tools and
+// parameters, made with the same API key, are answered from the cache until the cached response expires. Only
+// successful responses are cached.
+type CacheConfig struct {
+	// TTL is how long responses are cached for models and API keys without a TTL of their own. Zero disables the cache
+	// for them.
+	TTL time.Duration
+	// ModelTTLs override the TTL for models, by name or path.Match pattern. A model's name takes precedence over
+	// patterns, and longer patterns take precedence over shorter ones.
+	ModelTTLs map[string]time.Duration
+	// APIKeyTTLs override the TTL, and the model TTLs, for requests made with an API key.
+	APIKeyTTLs map[string]time.Duration
+	// MaxEntries is the number of cached responses, and MaxBytes is their total size in bytes, or unlimited if zero. The
+	// least recently used responses are evicted first.
+	MaxEntries, MaxBytes int
+}
+
+func (c CacheConfig) enabled() bool {
+	for _, ttls := range []map[string]time.Duration{c.ModelTTLs, c.APIKeyTTLs} {
+		for _, ttl := range ttls {
+			if ttl > 0 {
+				return true
+			}
+		}
+	}
+
+	return c.TTL > 0
+}
+
+// responseCache is an LRU cache of chat completion responses. A nil cache caches nothing.
+type responseCache struct {
+	ttl        time.Duration
+	modelTTLs  map[string]time.Duration
+	patterns   []string
+	apiKeyTTLs map[string]time.Duration
+	maxEntries int
+	maxBytes   int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+}
+
+// cacheEntry is either a response or the chunks of a streamed response.
+type cacheEntry struct {
+	key      string
+	expires  time.Time
+	size     int
+	response *db.CreateChatCompletionResponse
+	chunks   []db.ChatCompletionResponseChunk
+}
+
+// newResponseCache returns a cache for the configuration, or nil if it doesn't cache any responses.
+func newResponseCache(cfg CacheConfig) (*responseCache, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+	if cfg.MaxEntries <= 0 {
+		return nil, fmt.Errorf("cache max entries must be positive")
+	}
+	if cfg.MaxBytes < 0 {
+		return nil, fmt.Errorf("cache max bytes must not be negative")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("cache TTL must not be negative")
+	}
+
+	c := &responseCache{
+		ttl:        cfg.TTL,
+		modelTTLs:  make(map[string]time.Duration, len(cfg.ModelTTLs)),
+		apiKeyTTLs: make(map[string]time.Duration, len(cfg.APIKeyTTLs)),
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	for pattern, ttl := range cfg.ModelTTLs {
+		if ttl < 0 {
+			return nil, fmt.Errorf("cache TTL for model %s must not be negative", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid cache model pattern %q: %w", pattern, err)
+		}
+		c.modelTTLs[pattern] = ttl
+		c.patterns = append(c.patterns, pattern)
+	}
+	// Longer patterns are more specific, and are matched first.
+	slices.SortFunc(c.patterns, func(a, b string) int {
+		return cmp.Or(len(b)-len(a), strings.Compare(a, b))
+	})
+	for key, ttl := range cfg.APIKeyTTLs {
+		if ttl < 0 {
+			return nil, fmt.Errorf("cache TTL for an API key must not be negative")
+		}
+		// Requests only store the hash of the API key they were made with.
+		c.apiKeyTTLs[db.HashAPIKey(key)] = ttl
+	}
+
+	return c, nil
+}
+
+// ttlFor returns how long the response to the request is cached, or zero if it isn't.
+func (c *responseCache) ttlFor(cc *db.CreateChatCompletionRequest) time.Duration {
+	if c == nil {
+		return 0
+	}
+	if ttl, ok := c.apiKeyTTLs[cc.APIKeyHash]; ok && cc.APIKeyHash != "" {
+		return ttl
+	}
+	if ttl, ok := c.modelTTLs[cc.Model]; ok {
+		return ttl
+	}
+	for _, pattern := range c.patterns {
+		if ok, _ := path.Match(pattern, cc.Model); ok {
+			return c.modelTTLs[pattern]
+		}
+	}
+
+	return c.ttl
+}
+
+// cacheKey returns the hash of the canonical JSON encoding of the public request, the API key it was made with, and
+// the URL it is sent to, if it has one.
+func cacheKey(cc *db.CreateChatCompletionRequest) (string, error) {
+	public, err := json.Marshal(cc.ToPublic())
+	if err != nil {
+		return "", err
+	}
+
+	// Decoding and encoding again sorts the keys of the objects that were sent as they were received, like messages.
+	var canonical any
+	if err = json.Unmarshal(public, &canonical); err != nil {
+		return "", err
+	}
+	if public, err = json.Marshal(canonical); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n%s\n", cc.APIKeyHash, cc.ModelAPI)
+	_, _ = h.Write(public)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// get returns the cached entry for the key, or nil if there is none or it has expired.
+func (c *responseCache) get(key string) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	return entry
+}
+
+// add caches the response, or the chunks of the streamed response, for the key. Responses that are larger than the
+// cache aren't cached.
+func (c *responseCache) add(key string, ttl time.Duration, response *db.CreateChatCompletionResponse, chunks []db.ChatCompletionResponseChunk) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:      key,
+		expires:  time.Now().Add(ttl),
+		response: response,
+		chunks:   chunks,
+	}
+	if response != nil {
+		entry.size = encodedSize(response)
+	}
+	for i := range chunks {
+		entry.size += encodedSize(&chunks[i])
+	}
+	if c.maxBytes > 0 && entry.size > c.maxBytes {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.lru.Len() > c.maxEntries || c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the element from the cache. The lock must be held.
+func (c *responseCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+func encodedSize(v any) int {
+	data, _ := json.Marshal(v)
+	return len(data)
+}
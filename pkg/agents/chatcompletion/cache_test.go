@@ -0,0 +1,98 @@
+package chatcompletion
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+)
+
+func TestCacheTTL(t *testing.T) {
+	c, err := newResponseCache(CacheConfig{
+		TTL:        time.Minute,
+		ModelTTLs:  map[string]time.Duration{"gpt-4*": time.Hour, "gpt-4o*": 2 * time.Hour, "gpt-4o-mini": 0},
+		APIKeyTTLs: map[string]time.Duration{"sk-test": 3 * time.Hour},
+		MaxEntries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		model, apiKey string
+		want          time.Duration
+	}{
+		{model: "gpt-3.5-turbo", want: time.Minute},
+		{model: "gpt-4-turbo", want: time.Hour},
+		{model: "gpt-4o", want: 2 * time.Hour},
+		{model: "gpt-4o-mini", want: 0},
+		{model: "gpt-4o-mini", apiKey: "sk-test", want: 3 * time.Hour},
+		{model: "gpt-4o-mini", apiKey: "sk-other", want: 0},
+	} {
+		cc := &db.CreateChatCompletionRequest{Model: tt.model, APIKeyHash: db.HashAPIKey(tt.apiKey)}
+		if got := c.ttlFor(cc); got != tt.want {
+			t.Errorf("ttlFor(%s, %q) = %s, want %s", tt.model, tt.apiKey, got, tt.want)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	request := func(messages, apiKey string) *db.CreateChatCompletionRequest {
+		t.Helper()
+
+		cc := &db.CreateChatCompletionRequest{Model: "gpt-4o", APIKeyHash: db.HashAPIKey(apiKey)}
+		if err := json.Unmarshal([]byte(messages), &cc.Messages); err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	key := func(cc *db.CreateChatCompletionRequest) string {
+		t.Helper()
+
+		k, err := cacheKey(cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	hello := key(request(`[{"role": "user", "content": "Hello"}]`, "sk-test"))
+	if k := key(request(`[{"content":"Hello","role":"user"}]`, "sk-test")); k != hello {
+		t.Error("the order of the keys of messages shouldn't change the cache key")
+	}
+	if k := key(request(`[{"role": "user", "content": "Hello"}]`, "sk-other")); k == hello {
+		t.Error("requests made with other API keys should have other cache keys")
+	}
+	if k := key(request(`[{"role": "user", "content": "Hello!"}]`, "sk-test")); k == hello {
+		t.Error("requests with other messages should have other cache keys")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c, err := newResponseCache(CacheConfig{TTL: time.Minute, MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		c.add(key, time.Minute, &db.CreateChatCompletionResponse{Model: key}, nil)
+	}
+	// Using a makes b the least recently used response.
+	if c.get("a") == nil {
+		t.Fatal("a should be cached")
+	}
+	c.add("c", time.Minute, &db.CreateChatCompletionResponse{Model: "c"}, nil)
+
+	if c.get("b") != nil {
+		t.Error("b should have been evicted")
+	}
+	if c.get("a") == nil || c.get("c") == nil {
+		t.Error("a and c should be cached")
+	}
+
+	c.add("d", -time.Minute, &db.CreateChatCompletionResponse{Model: "d"}, nil)
+	if c.get("d") != nil {
+		t.Error("responses with a negative TTL shouldn't be cached")
+	}
+}
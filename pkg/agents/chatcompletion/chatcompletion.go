@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,29 +15,49 @@ import (
 	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/httpclient"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers/anthropic"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
 const (
 	minPollingInterval  = time.Second
 	minRequestRetention = 5 * time.Minute
-)
 
-var (
-	supportedModels = map[string]struct{}{
-		"gpt-3.5":             {},
-		"gpt-3.5-turbo":       {},
-		"gpt-4":               {},
-		"gpt-4-turbo-preview": {},
-	}
+	// chunkBatchSize and chunkBatchInterval bound how many chunks are buffered, and for how long, before they are
+	// stored in one statement.
+	chunkBatchSize     = 100
+	chunkBatchInterval = 100 * time.Millisecond
+	// compactionBatchSize is the number of streams that are compacted in each pass.
+	compactionBatchSize = 100
 )
 
 type Config struct {
-	Logger                                        *slog.Logger
-	PollingInterval, RetentionPeriod              time.Duration
-	ModelsURL, ChatCompletionURL, APIKey, AgentID string
-	Trigger                                       trigger.Trigger
+	Logger                           *slog.Logger
+	PollingInterval, RetentionPeriod time.Duration
+	AgentID                          string
+	// Providers are the upstream providers that models are routed to, in the order that they are matched.
+	Providers []providers.Provider
+	// AssistantFallbacks are the models that the chat completion requests of each assistant's runs fall back to, by
+	// assistant ID. They are tried before the fallback models of the request's provider.
+	AssistantFallbacks map[string][]string
+	// RetryPolicy configures how failed requests to the providers are retried before falling back to other models.
+	RetryPolicy agents.RetryPolicy
+	// Cache configures which responses are cached, and for how long. Nothing is cached by default.
+	Cache CacheConfig
+	// CompactAfter is how long after a streamed response is done that its chunks are compacted into a single response,
+	// which gives readers that are still streaming it time to finish. Zero disables compaction.
+	CompactAfter time.Duration
+	DrainTimeout time.Duration
+	Workers      int
+	Lease        db.Lease
+	Trigger      trigger.Trigger
+	// HTTPClients makes the transports that send the requests to the providers, which the providers can override.
+	HTTPClients *httpclient.Factory
 }
 
 func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) error {
@@ -48,7 +69,7 @@ func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) erro
 		return err
 	}
 
-	if err = a.listAndStoreModels(ctx, cfg.ModelsURL); err != nil {
+	if err = a.listAndStoreModels(ctx); err != nil {
 		return err
 	}
 
@@ -60,8 +81,15 @@ func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) erro
 type agent struct {
 	logger                           *slog.Logger
 	pollingInterval, retentionPeriod time.Duration
-	id, apiKey, url                  string
-	client                           *http.Client
+	id                               string
+	drainTimeout                     time.Duration
+	workers                          int
+	lease                            db.Lease
+	router                           *providers.Router
+	assistantFallbacks               map[string][]string
+	retryPolicy                      agents.RetryPolicy
+	cache                            *responseCache
+	compactAfter                     time.Duration
 	db                               *db.DB
 	trigger                          trigger.Trigger
 }
@@ -73,83 +101,110 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	if cfg.RetentionPeriod < minRequestRetention {
 		return nil, fmt.Errorf("[chatcompletion] request retention must be at least %s", minRequestRetention)
 	}
-
-	if cfg.Trigger == nil {
-		cfg.Logger.Warn("[chat completion] No trigger provided, using noop")
-		cfg.Trigger = trigger.NewNoop()
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, fmt.Errorf("[chatcompletion] %w", err)
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, fmt.Errorf("[chatcompletion] %w", err)
+	}
+	if cfg.CompactAfter < 0 {
+		return nil, fmt.Errorf("[chatcompletion] compact after must not be negative")
 	}
 
-	return &agent{
-		logger:          cfg.Logger,
-		pollingInterval: cfg.PollingInterval,
-		retentionPeriod: cfg.RetentionPeriod,
-		client:          http.DefaultClient,
-		apiKey:          cfg.APIKey,
-		db:              db,
-		id:              cfg.AgentID,
-		url:             cfg.ChatCompletionURL,
-		trigger:         cfg.Trigger,
-	}, nil
-}
+	if err := cfg.RetryPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("[chatcompletion] %w", err)
+	}
 
-func (a *agent) listAndStoreModels(ctx context.Context, modelsURL string) error {
-	// List models
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, modelsURL, nil)
+	router, err := providers.NewRouter(cfg.HTTPClients, cfg.Providers)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("[chatcompletion] %w", err)
 	}
 
-	req.Header.Add("Authorization", "Bearer "+a.apiKey)
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
-
-	resp, err := a.client.Do(req)
+	cache, err := newResponseCache(cfg.Cache)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("[chatcompletion] %w", err)
 	}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to list models: %s", resp.Status)
+	if cfg.Trigger == nil {
+		cfg.Logger.Warn("[chat completion] No trigger provided, using noop")
+		cfg.Trigger = trigger.NewNoop()
 	}
 
-	type models struct {
-		Data []*openai.Model `json:"data"`
-	}
+	return &agent{
+		logger:             cfg.Logger,
+		pollingInterval:    cfg.PollingInterval,
+		retentionPeriod:    cfg.RetentionPeriod,
+		router:             router,
+		assistantFallbacks: cfg.AssistantFallbacks,
+		retryPolicy:        cfg.RetryPolicy,
+		cache:              cache,
+		compactAfter:       cfg.CompactAfter,
+		db:                 db,
+		id:                 cfg.AgentID,
+		drainTimeout:       cfg.DrainTimeout,
+		workers:            cfg.Workers,
+		lease:              cfg.Lease,
+		trigger:            cfg.Trigger,
+	}, nil
+}
 
-	var m models
-	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return err
+// listAndStoreModels stores the models of every provider, and deletes the models that are no longer served. A model
+// is only stored for the provider that it is routed to. If a provider's models can't be listed, then its stored models
+// are kept, so that an unreachable provider doesn't prevent the agent from starting.
+func (a *agent) listAndStoreModels(ctx context.Context) error {
+	var (
+		publicModels []*openai.Model
+		unlisted     = make(map[*providers.Provider]struct{})
+	)
+	for _, p := range a.router.Providers() {
+		models, err := listModels(ctx, p)
+		if err != nil {
+			a.logger.Warn("Failed to list models, keeping the stored models of the provider", "provider", p.Name, "err", err)
+			unlisted[p] = struct{}{}
+			continue
+		}
+
+		for _, m := range models {
+			if routed, err := a.router.Route(m.Id); err == nil && routed == p {
+				publicModels = append(publicModels, m)
+			}
+		}
 	}
 
 	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		var dbModels []db.Model
-		if err = tx.Model(new(db.Model)).Find(&dbModels).Error; err != nil {
+		if err := tx.Model(new(db.Model)).Find(&dbModels).Error; err != nil {
 			return err
 		}
 
 		dbModelIDs := make(map[string]struct{}, len(dbModels))
 		for _, model := range dbModels {
+			// The agents serve the local models themselves, so no provider lists them.
+			if model.OwnedBy == db.LocalModelOwner {
+				continue
+			}
 			dbModelIDs[model.ID] = struct{}{}
 		}
 
-		for _, publicModel := range m.Data {
-			if _, ok := supportedModels[publicModel.Id]; !ok {
+		stored := make(map[string]struct{}, len(publicModels))
+		for _, publicModel := range publicModels {
+			if _, ok := stored[publicModel.Id]; ok {
 				continue
 			}
+			stored[publicModel.Id] = struct{}{}
+
 			if _, ok := dbModelIDs[publicModel.Id]; ok {
 				delete(dbModelIDs, publicModel.Id)
 				continue
 			}
 
 			model := new(db.Model)
-			if err = model.FromPublic(publicModel); err != nil {
+			if err := model.FromPublic(publicModel); err != nil {
 				return err
 			}
 
 			// Create the model directly instead of using the db ops because the ID is already set.
-			if err = tx.Model(&db.Model{}).Create(model).Error; err != nil && !errors.Is(err, gorm.ErrDuplicatedKey) {
+			if err := tx.Model(&db.Model{}).Create(model).Error; err != nil && !errors.Is(err, gorm.ErrDuplicatedKey) {
 				return err
 			}
 
@@ -157,7 +212,12 @@ func (a *agent) listAndStoreModels(ctx context.Context, modelsURL string) error
 		}
 
 		for id := range dbModelIDs {
-			if err = tx.Model(new(db.Model)).Delete(new(db.Model), "id = ?", id).Error; err != nil {
+			if p, err := a.router.Route(id); err == nil {
+				if _, ok := unlisted[p]; ok {
+					continue
+				}
+			}
+			if err := tx.Model(new(db.Model)).Delete(new(db.Model), "id = ?", id).Error; err != nil {
 				return err
 			}
 		}
@@ -166,149 +226,255 @@ func (a *agent) listAndStoreModels(ctx context.Context, modelsURL string) error
 	})
 }
 
-func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
-	// Start the "job runner"
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		timer := time.NewTimer(a.pollingInterval)
-		for {
-			if err := a.run(ctx); err != nil {
-				if !errors.Is(err, gorm.ErrRecordNotFound) {
-					a.logger.Error("failed run iteration", "err", err)
-				}
+// listModels lists the models of the provider. If the provider's models can't be listed, then the models that it is
+// configured with are returned.
+func listModels(ctx context.Context, p *providers.Provider) ([]*openai.Model, error) {
+	modelsURL := p.ModelListURL()
+	if modelsURL == "" {
+		models := make([]*openai.Model, 0, len(p.Models))
+		for _, id := range p.ExactModels() {
+			models = append(models, &openai.Model{
+				Id:      id,
+				Created: int(time.Now().Unix()),
+				Object:  openai.ModelObjectModel,
+				OwnedBy: p.Name,
+			})
+		}
+		return models, nil
+	}
 
-				select {
-				case <-ctx.Done():
-					// Ensure the timer channel is drained
-					if !timer.Stop() {
-						select {
-						case <-timer.C:
-						default:
-						}
-					}
-					return
-				case <-timer.C:
-				case <-a.trigger.Triggered():
-				}
-			}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, modelsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
 
-			if !timer.Stop() {
-				// Ensure the timer channel is drained
-				select {
-				case <-timer.C:
-				default:
-				}
-			}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
 
-			timer.Reset(a.pollingInterval)
-		}
-	}()
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
 
-	// Start cleanup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		cleanupInterval := a.retentionPeriod / 2
-		timer := time.NewTimer(cleanupInterval)
-
-		for {
-			a.logger.Debug("Looking for completed chat completions")
-			var runToolObjects []db.RunToolObject
-
-			if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-				if err := tx.Model(new(db.RunToolObject)).Where("created_at < ? AND done = true", int(time.Now().Add(-a.retentionPeriod).Unix())).Find(&runToolObjects).Error; err != nil {
-					return err
-				}
-				if len(runToolObjects) == 0 {
-					return nil
-				}
+	defer resp.Body.Close()
 
-				requestIDs := make([]string, 0, len(runToolObjects))
-				for _, rt := range runToolObjects {
-					requestIDs = append(requestIDs, rt.ID)
-				}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list models: %s", resp.Status)
+	}
 
-				if err := tx.Delete(new(db.RunStepEvent), "request_id IN ?", requestIDs).Error; err != nil {
-					return err
-				}
+	var m struct {
+		Data []*openai.Model `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
 
-				return tx.Delete(runToolObjects).Error
-			}); err != nil {
-				a.logger.Error("Failed to cleanup chat completions", "err", err)
+	return m.Data, nil
+}
+
+func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
+	// Start the "job runners"
+	agents.Pool{
+		Name:            "chat_completion",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}.Start(ctx, wg, a.logger, a.run)
+
+	// Start cleanup
+	agents.RunPeriodically(ctx, wg, a.retentionPeriod/2, func(ctx context.Context) {
+		a.logger.Debug("Looking for completed chat completions")
+		var runToolObjects []db.RunToolObject
+
+		if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(new(db.RunToolObject)).Where("created_at < ? AND done = true", int(time.Now().Add(-a.retentionPeriod).Unix())).Find(&runToolObjects).Error; err != nil {
+				return err
+			}
+			if len(runToolObjects) == 0 {
+				return nil
 			}
 
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
+			requestIDs := make([]string, 0, len(runToolObjects))
+			for _, rt := range runToolObjects {
+				requestIDs = append(requestIDs, rt.ID)
+			}
+
+			if err := tx.Delete(new(db.RunStepEvent), "request_id IN ?", requestIDs).Error; err != nil {
+				return err
 			}
 
-			timer.Reset(cleanupInterval)
+			return tx.Delete(runToolObjects).Error
+		}); err != nil {
+			a.logger.Error("Failed to cleanup chat completions", "err", err)
 		}
-	}()
+	})
+
+	if a.compactAfter > 0 {
+		agents.RunPeriodically(ctx, wg, a.compactAfter, a.compactStreams)
+	}
 }
 
-func (a *agent) run(ctx context.Context) error {
-	a.logger.Debug("Checking for a chat completion request")
-	// Look for a new chat completion request and claim it.
-	cc := new(db.CreateChatCompletionRequest)
-	if err := a.db.WithContext(ctx).Model(cc).Transaction(func(tx *gorm.DB) error {
-		if err := tx.Where("claimed_by IS NULL").Or("claimed_by = ? AND done = false", a.id).Order("created_at desc").First(cc).Error; err != nil {
-			return err
+// compactStreams compacts the chunks of the streamed chat completions that have been done for longer than compactAfter.
+func (a *agent) compactStreams(ctx context.Context) {
+	a.logger.Debug("Looking for streamed chat completions to compact")
+	for ctx.Err() == nil {
+		ids, err := db.CompactableStreams(a.db.WithContext(ctx), time.Now().Add(-a.compactAfter), compactionBatchSize)
+		if err != nil {
+			a.logger.Error("Failed to list streamed chat completions to compact", "err", err)
+			return
 		}
 
-		if err := tx.Where("id = ?", cc.ID).Updates(map[string]interface{}{"claimed_by": a.id}).Error; err != nil {
-			return err
+		for _, id := range ids {
+			if err = db.CompactStream(a.db.WithContext(ctx), id); err != nil {
+				a.logger.Error("Failed to compact streamed chat completion", "id", id, "err", err)
+				return
+			}
+		}
+		if len(ids) < compactionBatchSize {
+			return
 		}
+	}
+}
 
-		return nil
-	}); err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			a.logger.Error("Failed to get chat completion", "err", err)
+func (a *agent) run(ctx context.Context, l *slog.Logger) error {
+	l.Debug("Checking for a chat completion request")
+	// Look for a new chat completion request and claim it.
+	cc := new(db.CreateChatCompletionRequest)
+	ctx, cancel, err := agents.Dequeue(ctx, l, a.db.WithContext(ctx), cc, a.id, a.lease, a.pollingInterval, func() db.JobFailer {
+		if z.Dereference(cc.Stream) {
+			// The request is failed after ctx is canceled if it was cancelled.
+			return &db.ChatCompletionResponseChunk{ResponseIdx: a.nextChunkIndex(context.WithoutCancel(ctx), l, cc.ID)}
+		}
+		return new(db.CreateChatCompletionResponse)
+	})
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, db.ErrAlreadyClaimed) {
+			l.Error("Failed to get chat completion", "err", err)
 		}
 
 		return err
 	}
+	defer cancel()
 
 	chatCompletionID := cc.ID
-	l := a.logger.With("id", chatCompletionID)
+	l = l.With("id", chatCompletionID)
 
-	url := cc.ModelAPI
-	if url == "" {
-		url = a.url
+	provider, err := a.router.Route(cc.Model)
+	if err != nil {
+		return a.fail(ctx, l, cc, 0, err)
 	}
 
 	l.Debug("Found chat completion", "cc", cc)
-	if z.Dereference(cc.Stream) {
-		l.Debug("Streaming chat completion...")
-		stream, err := agents.StreamChatCompletionRequest(ctx, l, a.client, url, a.apiKey, cc)
+	streaming := z.Dereference(cc.Stream)
+	if streaming {
+		// If a previous attempt streamed part of the response, then the client has already seen it and retrying would
+		// duplicate the output.
+		if index := a.nextChunkIndex(ctx, l, chatCompletionID); index > 0 {
+			return a.fail(ctx, l, cc, index, fmt.Errorf("chat completion %s was interrupted after streaming %d chunks", chatCompletionID, index))
+		}
+	}
+
+	// The key is derived before the model can be replaced by a fallback model.
+	var key string
+	ttl := a.cache.ttlFor(cc)
+	if ttl > 0 {
+		if key, err = cacheKey(cc); err != nil {
+			l.Warn("Failed to derive the cache key of the chat completion", "err", err)
+			ttl = 0
+		} else if entry := a.cache.get(key); entry != nil {
+			metrics.ChatCompletionCacheTotal.WithLabelValues(cc.Model, "hit").Inc()
+			return a.respondFromCache(ctx, l, cc, entry)
+		} else {
+			metrics.ChatCompletionCacheTotal.WithLabelValues(cc.Model, "miss").Inc()
+		}
+	}
+
+	models := []string{cc.Model}
+	for _, model := range slices.Concat(a.assistantFallbacks[cc.AssistantID], provider.Fallbacks) {
+		if !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	}
+	if cc.ModelAPI != "" {
+		// The request is sent to the given URL, so the fallback models can't be routed.
+		models = models[:1]
+	}
+
+	var (
+		start   time.Time
+		stream  <-chan db.ChatCompletionResponseChunk
+		ccr     *db.CreateChatCompletionResponse
+		retries int
+	)
+	// Only the request is retried: once the response is streaming, the client may have already seen part of it.
+	err = agents.RetryWithFallbacks(ctx, a.retryPolicy, models, func(ctx context.Context, model string) error {
+		provider, err := a.router.Route(model)
+		if err != nil {
+			return err
+		}
+		if !provider.Breaker().Allow() {
+			return fmt.Errorf("%w: %s", providers.ErrCircuitOpen, provider.Name)
+		}
+
+		url := cc.ModelAPI
+		if url == "" {
+			url = provider.ChatCompletionsURL(model)
+		}
+		cc.Model = model
+		l := l.With("provider", provider.Name, "model", model)
+
+		start = time.Now()
+		switch {
+		case streaming && provider.API == providers.APIAnthropic:
+			l.Debug("Streaming chat completion...")
+			stream, err = anthropic.StreamChatCompletionRequest(ctx, l, provider.Client(), url, cc)
+		case streaming:
+			l.Debug("Streaming chat completion...")
+			stream, err = agents.StreamChatCompletionRequest(ctx, l, provider.Client(), url, "", cc)
+		case provider.API == providers.APIAnthropic:
+			ccr, err = anthropic.MakeChatCompletionRequest(ctx, l, provider.Client(), url, cc)
+		default:
+			ccr, err = agents.MakeChatCompletionRequest(ctx, l, provider.Client(), url, "", cc)
+		}
+
+		provider.Breaker().Record(agents.Retryable(err))
 		if err != nil {
-			l.Error("Failed to stream chat completion request", "err", err)
+			metrics.UpstreamRequestsTotal.WithLabelValues(model, upstreamCode(err)).Inc()
+		}
+		return err
+	}, func(e agents.RetryEvent) {
+		l.Warn("Chat completion request failed", "decision", e.String())
+		trace.SpanFromContext(ctx).AddEvent(e.String())
+		if err := recordRetry(a.db.WithContext(ctx), chatCompletionID, retries, e); err != nil {
+			l.Error("Failed to record retry of chat completion request", "err", err)
+		}
+		retries++
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			// The agent is shutting down or lost the lease, so leave the request for another agent, or the request was
+			// cancelled and is failed when it is released.
 			return err
 		}
+		return a.fail(ctx, l, cc, 0, err)
+	}
 
-		if err = streamResponses(l, a.db.WithContext(ctx), chatCompletionID, stream); err != nil {
+	if streaming {
+		chunks, err := streamResponses(l, a.db.WithContext(ctx), chatCompletionID, cc.Model, start, stream)
+		if err != nil {
 			l.Error("Failed to stream chat completion responses", "err", err)
+		} else if !slices.ContainsFunc(chunks, func(c db.ChatCompletionResponseChunk) bool { return c.Error != nil }) {
+			a.cache.add(key, ttl, nil, chunks)
 		}
 
 		return nil
 	}
 
-	ccr, err := agents.MakeChatCompletionRequest(ctx, l, a.client, url, a.apiKey, cc)
-	if err != nil {
-		l.Error("Failed to make chat completion request", "err", err)
-		return err
-	}
+	metrics.UpstreamDuration.WithLabelValues(cc.Model, "false").Observe(metrics.Since(start))
+	metrics.UpstreamRequestsTotal.WithLabelValues(cc.Model, metrics.Code(ccr.GetStatusCode())).Inc()
 
-	l.Debug("Made chat completion request", "status_code", ccr.StatusCode, "err", ccr.Error)
+	l.Debug("Made chat completion request", "status_code", ccr.StatusCode)
 
 	if err = a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		if err = db.Create(tx, ccr); err != nil {
@@ -320,25 +486,184 @@ func (a *agent) run(ctx context.Context) error {
 		return err
 	}
 
+	if ccr.Error == nil {
+		a.cache.add(key, ttl, ccr, nil)
+	}
+
 	a.trigger.Ready(chatCompletionID)
 	return nil
 }
 
-func streamResponses(l *slog.Logger, gdb *gorm.DB, chatCompletionID string, stream <-chan db.ChatCompletionResponseChunk) error {
+// fail stores the error as the response to the chat completion. If the request is streaming, then the error is stored
+// as the chunk with the given index.
+func (a *agent) fail(ctx context.Context, l *slog.Logger, cc *db.CreateChatCompletionRequest, index int, err error) error {
+	l.Error("Failing chat completion", "err", err)
+
+	var response db.JobFailer = new(db.CreateChatCompletionResponse)
+	if z.Dereference(cc.Stream) {
+		response = &db.ChatCompletionResponseChunk{ResponseIdx: index}
+	}
+	if err = db.FailJob(a.db.WithContext(ctx), cc, response, err); err != nil {
+		return err
+	}
+
+	a.trigger.Ready(cc.ID)
+	return nil
+}
+
+// respondFromCache stores the cached response, or the chunks of the cached streamed response, as the response to the
+// chat completion.
+func (a *agent) respondFromCache(ctx context.Context, l *slog.Logger, cc *db.CreateChatCompletionRequest, entry *cacheEntry) error {
+	l.Debug("Responding to chat completion from the cache")
+	if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if entry.response != nil {
+			ccr := *entry.response
+			ccr.JobResponse = db.JobResponse{RequestID: cc.ID}
+			ccr.CacheHit = true
+			if err := db.Create(tx, &ccr); err != nil {
+				return err
+			}
+		} else {
+			// The chunks are copied, because they are shared with concurrent hits.
+			chunks := slices.Clone(entry.chunks)
+			for i := range chunks {
+				chunks[i].RequestID = cc.ID
+				chunks[i].ResponseIdx = i
+				chunks[i].CacheHit = true
+			}
+			if err := db.CreateChunks(tx, chunks); err != nil {
+				return err
+			}
+
+			if err := db.Create(tx, &db.ChatCompletionResponseChunk{
+				JobResponse: db.JobResponse{RequestID: cc.ID, Done: true},
+				ResponseIdx: len(entry.chunks),
+				CacheHit:    true,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(cc).Where("id = ?", cc.ID).Update("done", true).Error
+	}); err != nil {
+		l.Error("Failed to create chat completion response from the cache", "err", err)
+		return err
+	}
+
+	a.trigger.Ready(cc.ID)
+	return nil
+}
+
+// upstreamCode returns the metrics label for the status code of a failed upstream request.
+// recordRetry stores the decision to retry the chat completion request or to fall back to another model, so that it can
+// be recorded in the events of the run that made the request.
+func recordRetry(gdb *gorm.DB, chatCompletionID string, index int, e agents.RetryEvent) error {
+	retry := &db.ChatCompletionRetry{
+		RequestID:     chatCompletionID,
+		RetryIdx:      index,
+		Model:         e.Model,
+		FallbackModel: e.FallbackModel,
+		Attempt:       e.Attempt,
+		Delay:         int(e.Delay.Milliseconds()),
+		Error:         e.Err.Error(),
+	}
+	var upstreamErr *agents.UpstreamError
+	if errors.As(e.Err, &upstreamErr) {
+		retry.StatusCode = upstreamErr.StatusCode
+	}
+
+	return db.Create(gdb, retry)
+}
+
+func upstreamCode(err error) string {
+	var upstreamErr *agents.UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.StatusCode != 0 {
+		return metrics.Code(upstreamErr.StatusCode)
+	}
+
+	return "error"
+}
+
+// nextChunkIndex returns the index of the next chunk to store for the streaming chat completion with the given ID.
+func (a *agent) nextChunkIndex(ctx context.Context, l *slog.Logger, chatCompletionID string) int {
+	index, err := db.NextResponseIndex(a.db.WithContext(ctx), new(db.ChatCompletionResponseChunk), chatCompletionID)
+	if err != nil {
+		l.Error("Failed to get next chat completion chunk index", "id", chatCompletionID, "err", err)
+	}
+
+	return index
+}
+
+// streamResponses stores the chunks of a streaming chat completion as they are received, and records the upstream
+// metrics of the request that was started at start. The chunks are stored in batches of at most chunkBatchSize, and
+// are buffered for at most chunkBatchInterval. The chunks are returned once the stream is done.
+func streamResponses(l *slog.Logger, gdb *gorm.DB, chatCompletionID, model string, start time.Time, stream <-chan db.ChatCompletionResponseChunk) ([]db.ChatCompletionResponseChunk, error) {
 	var (
-		index int
-		errs  []error
+		index  int
+		code   = http.StatusOK
+		errs   []error
+		chunks []db.ChatCompletionResponseChunk
+		// batch is the tail of chunks that hasn't been stored yet.
+		batch int
+		// flushErr is the error of the last flush, if it failed.
+		flushErr error
+		ticker   = time.NewTicker(chunkBatchInterval)
 	)
-	for chunk := range stream {
+	defer ticker.Stop()
+
+	// Chunks that fail to be stored are retried with the next batch, so that readers never find a gap in the stream.
+	flush := func() {
+		if flushErr = db.CreateChunks(gdb, chunks[batch:]); flushErr != nil {
+			l.Error("Failed to create chat completion response chunks", "err", flushErr)
+			return
+		}
+		batch = len(chunks)
+	}
+
+	for stream != nil {
+		select {
+		case chunk, ok := <-stream:
+			if !ok {
+				stream = nil
+				break
+			}
+
+			if index == 0 && chunk.Error == nil {
+				metrics.TimeToFirstToken.WithLabelValues(model).Observe(metrics.Since(start))
+			}
+			if chunk.Error != nil {
+				code = chunk.GetStatusCode()
+			}
+
+			chunk.RequestID = chatCompletionID
+			chunk.ResponseIdx = index
+			index++
+			chunks = append(chunks, chunk)
+			if len(chunks)-batch >= chunkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+	flush()
+	if flushErr != nil {
+		// End the stream after the chunks that were stored, with the error.
+		errs = append(errs, flushErr)
+		chunk := agents.ErrorChunk(http.StatusInternalServerError, fmt.Sprintf("failed to store the chat completion response: %v", flushErr))
 		chunk.RequestID = chatCompletionID
-		chunk.ResponseIdx = index
-		index++
+		chunk.ResponseIdx = batch
+		chunks = append(chunks[:batch], chunk)
 		if err := db.Create(gdb, &chunk); err != nil {
-			l.Error("Failed to create chat completion response chunk", "err", err)
-			errs = append(errs, err)
+			l.Error("Failed to create chat completion response error chunk", "err", err)
+			return chunks, errors.Join(append(errs, err)...)
 		}
+		index = batch + 1
 	}
 
+	metrics.UpstreamDuration.WithLabelValues(model, "true").Observe(metrics.Since(start))
+	metrics.UpstreamRequestsTotal.WithLabelValues(model, metrics.Code(code)).Inc()
+
 	chunk := &db.ChatCompletionResponseChunk{
 		JobResponse: db.JobResponse{
 			RequestID: chatCompletionID,
@@ -357,5 +682,5 @@ func streamResponses(l *slog.Logger, gdb *gorm.DB, chatCompletionID string, stre
 		errs = append(errs, err)
 	}
 
-	return errors.Join(errs...)
+	return chunks, errors.Join(errs...)
 }
@@ -0,0 +1,38 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// cleanupTimeout is how long an agent has to record that a job was interrupted after the drain deadline has passed.
+const cleanupTimeout = 10 * time.Second
+
+// ErrDrainTimeout is the cause of the cancellation of in-flight jobs that didn't finish before the drain deadline.
+var ErrDrainTimeout = errors.New("agent shut down before the job finished")
+
+// drainContext returns a context for processing jobs. It is not canceled when ctx is canceled, so that in-flight jobs
+// can finish, but it is canceled with ErrDrainTimeout once timeout has passed after ctx is canceled.
+func drainContext(ctx context.Context, timeout time.Duration) context.Context {
+	drainCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, func() {
+			cancel(ErrDrainTimeout)
+		})
+	})
+
+	return drainCtx
+}
+
+// Interrupted returns true if the job being processed with ctx was canceled because the agent shut down before it
+// finished.
+func Interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrDrainTimeout)
+}
+
+// CleanupContext returns a context for recording that a job was interrupted, because the context the job was processed
+// with has already been canceled.
+func CleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
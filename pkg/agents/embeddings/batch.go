@@ -0,0 +1,236 @@
+package embeddings
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"gorm.io/datatypes"
+)
+
+const (
+	defaultBatchSize        = 2048
+	defaultBatchConcurrency = 4
+)
+
+// createEmbeddings embeds the inputs of the request that aren't cached, each distinct input once, in batches of at
+// most batchSize inputs that are sent to the provider concurrently. The embeddings are returned in the order of the
+// inputs, with the usage of all the batches. If a batch fails, the response of the first batch that failed is returned.
+func (a *agent) createEmbeddings(ctx context.Context, l *slog.Logger, provider providers.EmbeddingsProvider, er *db.CreateEmbeddingRequest) (*db.CreateEmbeddingResponse, error) {
+	inputs, ok := splitInputs(er.Input.Data())
+	if !ok {
+		// Let the provider decide what to do with inputs that can't be split, like empty arrays.
+		return provider.CreateEmbeddings(ctx, er)
+	}
+
+	// Identical inputs are embedded once, and the embeddings of the distinct inputs are looked up in the cache.
+	var (
+		distinct   []string
+		positions  = make(map[string]int, len(inputs))
+		embeddings = make([]*openai.Embedding_Embedding, 0, len(inputs))
+		misses     []int
+	)
+	for _, input := range inputs {
+		if _, ok := positions[input]; ok {
+			continue
+		}
+		positions[input] = len(distinct)
+		distinct = append(distinct, input)
+
+		if a.cache == nil {
+			embeddings = append(embeddings, nil)
+			misses = append(misses, len(distinct)-1)
+			continue
+		}
+		if embedding, ok := a.cache.get(embeddingCacheKey(er, input)); ok {
+			metrics.EmbeddingsCacheTotal.WithLabelValues(er.Model, "hit").Inc()
+			embeddings = append(embeddings, &embedding)
+			continue
+		}
+		metrics.EmbeddingsCacheTotal.WithLabelValues(er.Model, "miss").Inc()
+		embeddings = append(embeddings, nil)
+		misses = append(misses, len(distinct)-1)
+	}
+
+	var batches [][]int
+	for len(misses) > 0 {
+		n := min(len(misses), a.batchSize)
+		batches, misses = append(batches, misses[:n]), misses[n:]
+	}
+	l.Debug("Embedding inputs", "inputs", len(inputs), "distinct", len(distinct), "batches", len(batches))
+
+	responses, failed, err := a.embedBatches(ctx, provider, er, distinct, batches)
+	if err != nil || failed != nil {
+		return failed, err
+	}
+
+	model, usage := er.Model, db.EmbeddingUsage{}
+	for i, resp := range responses {
+		if i == 0 {
+			model = resp.Model
+		}
+		usage.PromptTokens += resp.Usage.Data().PromptTokens
+		usage.TotalTokens += resp.Usage.Data().TotalTokens
+
+		for _, e := range resp.Data {
+			embedding, d := e.Embedding.Data(), batches[i][e.Index]
+			embeddings[d] = &embedding
+			a.cache.add(embeddingCacheKey(er, distinct[d]), embedding)
+		}
+	}
+
+	data := make([]db.Embedding, 0, len(inputs))
+	for i, input := range inputs {
+		data = append(data, db.Embedding{
+			Index:     i,
+			Embedding: datatypes.NewJSONType(*embeddings[positions[input]]),
+		})
+	}
+
+	return &db.CreateEmbeddingResponse{
+		JobResponse: db.JobResponse{StatusCode: http.StatusOK},
+		Data:        data,
+		Model:       model,
+		Usage:       datatypes.NewJSONType(usage),
+	}, nil
+}
+
+// embedBatches sends the batches of inputs, which are indexes of the distinct inputs, to the provider, and returns the
+// provider's responses in the order of the batches, or the response of the first batch that failed.
+func (a *agent) embedBatches(ctx context.Context, provider providers.EmbeddingsProvider, er *db.CreateEmbeddingRequest, distinct []string, batches [][]int) ([]*db.CreateEmbeddingResponse, *db.CreateEmbeddingResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, a.batchConcurrency)
+		responses = make([]*db.CreateEmbeddingResponse, len(batches))
+		errs      = make([]error, len(batches))
+	)
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			responses[i], errs[i] = embedBatch(ctx, provider, er, distinct, batch)
+			if errs[i] != nil || responses[i].Error != nil {
+				// The request fails with this batch, so the other batches aren't needed.
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Batches that were cancelled because another batch failed have errors too, so failed responses are returned first.
+	for _, resp := range responses {
+		if resp != nil && resp.Error != nil {
+			return nil, resp, nil
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return responses, nil, nil
+}
+
+// embedBatch sends the batch of inputs to the provider as a copy of the request, and checks that the provider embedded
+// each of them.
+func embedBatch(ctx context.Context, provider providers.EmbeddingsProvider, er *db.CreateEmbeddingRequest, distinct []string, batch []int) (*db.CreateEmbeddingResponse, error) {
+	inputs := make([]string, 0, len(batch))
+	for _, d := range batch {
+		inputs = append(inputs, distinct[d])
+	}
+
+	input := new(openai.CreateEmbeddingRequest_Input)
+	if err := input.UnmarshalJSON([]byte("[" + strings.Join(inputs, ",") + "]")); err != nil {
+		return nil, fmt.Errorf("failed to create embeddings batch: %w", err)
+	}
+
+	batchRequest := *er
+	batchRequest.Input = datatypes.NewJSONType(*input)
+
+	resp, err := provider.CreateEmbeddings(ctx, &batchRequest)
+	if err != nil || resp.Error != nil {
+		return resp, err
+	}
+
+	seen := make([]bool, len(batch))
+	for _, e := range resp.Data {
+		if e.Index < 0 || e.Index >= len(batch) || seen[e.Index] {
+			return badProviderResponse(fmt.Sprintf("provider returned an embedding with unexpected index %d", e.Index)), nil
+		}
+		seen[e.Index] = true
+	}
+	if len(resp.Data) != len(batch) {
+		return badProviderResponse(fmt.Sprintf("provider returned %d embeddings for %d inputs", len(resp.Data), len(batch))), nil
+	}
+
+	return resp, nil
+}
+
+// splitInputs returns the compact JSON encoding of each input of the request, or false if the inputs can't be split.
+// A string or an array of tokens is a single input.
+func splitInputs(input openai.CreateEmbeddingRequest_Input) ([]string, bool) {
+	data, err := input.MarshalJSON()
+	if err != nil {
+		return nil, false
+	}
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '"' {
+		return compactInputs(data)
+	}
+
+	var elements []json.RawMessage
+	if err = json.Unmarshal(data, &elements); err != nil || len(elements) == 0 {
+		return nil, false
+	}
+	if first := bytes.TrimSpace(elements[0]); len(first) > 0 && first[0] != '"' && first[0] != '[' {
+		// An array of tokens.
+		return compactInputs(data)
+	}
+
+	return compactInputs(elements...)
+}
+
+func compactInputs(inputs ...json.RawMessage) ([]string, bool) {
+	result := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, input); err != nil {
+			return nil, false
+		}
+		result = append(result, buf.String())
+	}
+
+	return result, true
+}
+
+func badProviderResponse(message string) *db.CreateEmbeddingResponse {
+	return &db.CreateEmbeddingResponse{
+		JobResponse: db.JobResponse{
+			Error:      z.Pointer(message),
+			StatusCode: http.StatusBadGateway,
+		},
+	}
+}
@@ -0,0 +1,144 @@
+package embeddings
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/datatypes"
+)
+
+// recordingProvider embeds each input as a vector holding its length, and records the inputs of its requests.
+type recordingProvider struct {
+	lock     sync.Mutex
+	requests [][]string
+	fail     string
+}
+
+func (p *recordingProvider) CreateEmbeddings(_ context.Context, er *db.CreateEmbeddingRequest) (*db.CreateEmbeddingResponse, error) {
+	inputs, err := er.Input.Data().AsCreateEmbeddingRequestInput1()
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	p.requests = append(p.requests, inputs)
+	p.lock.Unlock()
+
+	if slices.Contains(inputs, p.fail) {
+		return &db.CreateEmbeddingResponse{JobResponse: db.JobResponse{Error: z.Pointer("rate limited"), StatusCode: http.StatusTooManyRequests}}, nil
+	}
+
+	resp := &db.CreateEmbeddingResponse{
+		JobResponse: db.JobResponse{StatusCode: http.StatusOK},
+		Model:       "upstream-model",
+		Usage:       datatypes.NewJSONType(db.EmbeddingUsage{PromptTokens: len(inputs), TotalTokens: len(inputs)}),
+	}
+	// Respond out of order, like the indexes allow.
+	for i := len(inputs) - 1; i >= 0; i-- {
+		embedding := new(openai.Embedding_Embedding)
+		if err = embedding.FromEmbeddingEmbedding0([]float32{float32(len(inputs[i]))}); err != nil {
+			return nil, err
+		}
+		resp.Data = append(resp.Data, db.Embedding{Index: i, Embedding: datatypes.NewJSONType(*embedding)})
+	}
+
+	return resp, nil
+}
+
+func TestCreateEmbeddings(t *testing.T) {
+	cache, err := newEmbeddingCache(CacheConfig{TTL: time.Minute, MaxEntries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &agent{batchSize: 2, batchConcurrency: 2, cache: cache}
+
+	// apiKeyHash is the hash of the API key that the requests are made with.
+	var apiKeyHash string
+	embed := func(t *testing.T, p *recordingProvider, texts ...string) *db.CreateEmbeddingResponse {
+		t.Helper()
+		input := new(openai.CreateEmbeddingRequest_Input)
+		if err := input.FromCreateEmbeddingRequestInput1(texts); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := a.createEmbeddings(context.Background(), slog.Default(), p, &db.CreateEmbeddingRequest{Input: datatypes.NewJSONType(*input), Model: "model", APIKeyHash: apiKeyHash})
+		if err != nil {
+			t.Fatalf("createEmbeddings() = %v", err)
+		}
+		return resp
+	}
+
+	p := new(recordingProvider)
+	resp := embed(t, p, "a", "bb", "a", "ccc", "dddd", "bb", "eeeee")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code = %d, error = %v", resp.StatusCode, z.Dereference(resp.Error))
+	}
+
+	var requested []string
+	for _, inputs := range p.requests {
+		if len(inputs) > 2 {
+			t.Errorf("batch of %d inputs is larger than the batch size", len(inputs))
+		}
+		requested = append(requested, inputs...)
+	}
+	slices.Sort(requested)
+	if want := []string{"a", "bb", "ccc", "dddd", "eeeee"}; !slices.Equal(requested, want) {
+		t.Errorf("requested inputs = %v, want %v", requested, want)
+	}
+
+	var lengths []float32
+	for i, e := range resp.Data {
+		if e.Index != i {
+			t.Errorf("embedding %d has index %d", i, e.Index)
+		}
+		vector, err := e.Embedding.Data().AsEmbeddingEmbedding0()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, vector...)
+	}
+	if want := []float32{1, 2, 1, 3, 4, 2, 5}; !slices.Equal(lengths, want) {
+		t.Errorf("embeddings = %v, want %v", lengths, want)
+	}
+	if usage := resp.Usage.Data(); usage.TotalTokens != 5 {
+		t.Errorf("total tokens = %d, want 5", usage.TotalTokens)
+	}
+	if resp.Model != "upstream-model" {
+		t.Errorf("model = %s, want upstream-model", resp.Model)
+	}
+
+	// Cached inputs aren't sent again.
+	p = new(recordingProvider)
+	resp = embed(t, p, "bb", "ffffff", "a")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code = %d, error = %v", resp.StatusCode, z.Dereference(resp.Error))
+	}
+	if len(p.requests) != 1 || !slices.Equal(p.requests[0], []string{"ffffff"}) {
+		t.Errorf("requests = %v, want only the uncached input", p.requests)
+	}
+	if usage := resp.Usage.Data(); usage.TotalTokens != 1 {
+		t.Errorf("total tokens = %d, want 1", usage.TotalTokens)
+	}
+
+	// Embeddings cached for one API key aren't used for another.
+	apiKeyHash = db.HashAPIKey("sk-other")
+	p = new(recordingProvider)
+	embed(t, p, "a")
+	if len(p.requests) != 1 || !slices.Equal(p.requests[0], []string{"a"}) {
+		t.Errorf("requests for another API key = %v, want the input cached for the first key", p.requests)
+	}
+	apiKeyHash = ""
+
+	// A failed batch fails the request.
+	resp = embed(t, &recordingProvider{fail: "ggg"}, "x", "y", "ggg", "z")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Error == nil {
+		t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,123 @@
+package embeddings
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+// CacheConfig configures the cache of embeddings. Inputs with the same content, embedded by the same model with the
+// same dimensions and encoding format for the same API key, are answered from the cache until the cached embedding
+// expires.
+type CacheConfig struct {
+	// TTL is how long embeddings are cached. Zero disables the cache.
+	TTL time.Duration
+	// MaxEntries is the number of cached embeddings. The least recently used embeddings are evicted first.
+	MaxEntries int
+}
+
+// embeddingCache is an LRU cache of the embeddings of single inputs. A nil cache caches nothing.
+type embeddingCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type embeddingCacheEntry struct {
+	key       string
+	expires   time.Time
+	embedding openai.Embedding_Embedding
+}
+
+// newEmbeddingCache returns a cache for the configuration, or nil if it's disabled.
+func newEmbeddingCache(cfg CacheConfig) (*embeddingCache, error) {
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("cache TTL must not be negative")
+	}
+	if cfg.TTL == 0 {
+		return nil, nil
+	}
+	if cfg.MaxEntries <= 0 {
+		return nil, fmt.Errorf("cache max entries must be positive")
+	}
+
+	return &embeddingCache{
+		ttl:        cfg.TTL,
+		maxEntries: cfg.MaxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}, nil
+}
+
+// embeddingCacheKey returns the hash of the input's content, of the parameters of the request that change its
+// embedding, and of the API key that the request was made with, so that embeddings aren't shared between API keys.
+func embeddingCacheKey(er *db.CreateEmbeddingRequest, input string) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n%s\n%s\n%d\n%s\n", er.APIKeyHash, er.Model, er.ModelAPI, z.Dereference(er.Dimensions), z.Dereference(er.EncodingFormat))
+	_, _ = h.Write([]byte(input))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached embedding for the key, or false if there is none or it has expired.
+func (c *embeddingCache) get(key string) (openai.Embedding_Embedding, bool) {
+	if c == nil {
+		return openai.Embedding_Embedding{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return openai.Embedding_Embedding{}, false
+	}
+
+	entry := e.Value.(*embeddingCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return openai.Embedding_Embedding{}, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.embedding, true
+}
+
+// add caches the embedding for the key.
+func (c *embeddingCache) add(key string, embedding openai.Embedding_Embedding) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&embeddingCacheEntry{
+		key:       key,
+		expires:   time.Now().Add(c.ttl),
+		embedding: embedding,
+	})
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the element from the cache. The lock must be held.
+func (c *embeddingCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*embeddingCacheEntry)
+	delete(c.entries, entry.key)
+}
@@ -1,9 +1,7 @@
 package embeddings
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -11,12 +9,11 @@ import (
 	"sync"
 	"time"
 
-	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
 
-	"github.com/acorn-io/z"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
-	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
 	"gorm.io/gorm"
 )
 
@@ -29,7 +26,22 @@ type Config struct {
 	Logger                           *slog.Logger
 	PollingInterval, RetentionPeriod time.Duration
 	EmbeddingsURL, APIKey, AgentID   string
+	DrainTimeout                     time.Duration
+	Workers                          int
+	Lease                            db.Lease
 	Trigger                          trigger.Trigger
+	Transport                        http.RoundTripper
+	// Providers routes the requests to embeddings providers by model. Defaults to sending every request to the OpenAI
+	// embeddings API at EmbeddingsURL, or at the URL of the request's model API.
+	Providers *providers.Registry[providers.EmbeddingsProvider]
+	// BatchSize is the number of inputs sent to the provider in one request, and BatchConcurrency is the number of
+	// those requests sent at once for each embeddings request. Default to 2048 and 4.
+	BatchSize, BatchConcurrency int
+	// Cache configures the cache of the embeddings of inputs. Nothing is cached by default.
+	Cache CacheConfig
+	// Local configures the local embeddings model, which is registered with the providers and stored as a model if it
+	// has a name.
+	Local LocalConfig
 }
 
 func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) error {
@@ -41,7 +53,15 @@ func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) erro
 		return err
 	}
 
-	// Models are listed and stored by the chat completion agent - this includes embedding models
+	// Models are listed and stored by the chat completion agent - this includes embedding models. The local model is
+	// stored here, and removed if it's disabled.
+	var localModels []string
+	if cfg.Local.Model != "" {
+		localModels = append(localModels, cfg.Local.Model)
+	}
+	if err = db.StoreLocalModels(gdb.WithContext(ctx), localModels...); err != nil {
+		return fmt.Errorf("[embeddings] failed to store local models: %w", err)
+	}
 
 	a.Start(ctx, wg)
 	return nil
@@ -50,8 +70,13 @@ func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) erro
 type agent struct {
 	logger                            *slog.Logger
 	pollingInterval, requestRetention time.Duration
-	id, apiKey, url                   string
-	client                            *http.Client
+	id                                string
+	drainTimeout                      time.Duration
+	workers                           int
+	lease                             db.Lease
+	providers                         *providers.Registry[providers.EmbeddingsProvider]
+	batchSize, batchConcurrency       int
+	cache                             *embeddingCache
 	db                                *db.DB
 	trigger                           trigger.Trigger
 }
@@ -63,144 +88,131 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	if cfg.RetentionPeriod < minRequestRetention {
 		return nil, fmt.Errorf("[embeddings] request retention must be at least %s", minRequestRetention)
 	}
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, fmt.Errorf("[embeddings] %w", err)
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, fmt.Errorf("[embeddings] %w", err)
+	}
+	if err := cfg.Local.validate(); err != nil {
+		return nil, fmt.Errorf("[embeddings] %w", err)
+	}
+	if cfg.BatchSize < 0 {
+		return nil, fmt.Errorf("[embeddings] batch size must not be negative")
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.BatchConcurrency < 0 {
+		return nil, fmt.Errorf("[embeddings] batch concurrency must not be negative")
+	}
+	if cfg.BatchConcurrency == 0 {
+		cfg.BatchConcurrency = defaultBatchConcurrency
+	}
+	cache, err := newEmbeddingCache(cfg.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("[embeddings] %w", err)
+	}
 
 	if cfg.Trigger == nil {
 		cfg.Logger.Warn("[embeddings] No trigger provided, using noop")
 		cfg.Trigger = trigger.NewNoop()
 	}
 
+	if cfg.Providers == nil {
+		cfg.Providers = providers.NewRegistry[providers.EmbeddingsProvider]()
+		if err := cfg.Providers.Register(providers.NewOpenAIEmbeddings(cfg.EmbeddingsURL, cfg.APIKey, agents.NewHTTPClient(cfg.Transport))); err != nil {
+			return nil, fmt.Errorf("[embeddings] %w", err)
+		}
+	}
+	if cfg.Local.Model != "" {
+		if err := cfg.Providers.Register(newLocalEmbeddings(cfg.Local), cfg.Local.Model); err != nil {
+			return nil, fmt.Errorf("[embeddings] %w", err)
+		}
+	}
+
 	return &agent{
 		logger:           cfg.Logger,
 		pollingInterval:  cfg.PollingInterval,
 		requestRetention: cfg.RetentionPeriod,
-		client:           http.DefaultClient,
-		apiKey:           cfg.APIKey,
+		providers:        cfg.Providers,
+		batchSize:        cfg.BatchSize,
+		batchConcurrency: cfg.BatchConcurrency,
+		cache:            cache,
 		db:               db,
 		id:               cfg.AgentID,
-		url:              cfg.EmbeddingsURL,
+		drainTimeout:     cfg.DrainTimeout,
+		workers:          cfg.Workers,
+		lease:            cfg.Lease,
 		trigger:          cfg.Trigger,
 	}, nil
 }
 
 func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
 	/*
-	 * Embeddings Runner
+	 * Embeddings Runners
 	 */
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		timer := time.NewTimer(a.pollingInterval)
-		for {
-			if err := a.run(ctx); err != nil {
-				if !errors.Is(err, gorm.ErrRecordNotFound) {
-					a.logger.Error("failed embeddings iteration", "err", err)
-				}
-				select {
-				case <-ctx.Done():
-					// Ensure the timer channel is drained
-					if !timer.Stop() {
-						select {
-						case <-timer.C:
-						default:
-						}
-					}
-					return
-				case <-timer.C:
-				case <-a.trigger.Triggered():
-				}
-			}
-
-			if !timer.Stop() {
-				// Ensure the timer channel is drained
-				select {
-				case <-timer.C:
-				default:
-				}
-			}
-
-			timer.Reset(a.pollingInterval)
-		}
-	}()
+	agents.Pool{
+		Name:            "embeddings",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}.Start(ctx, wg, a.logger, a.run)
 
 	/*
 	 * Cleanup Job
 	 */
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var (
-			cleanupInterval = a.requestRetention / 2
-			jobObjects      = []db.Storer{
-				new(db.CreateEmbeddingRequest),
-				new(db.CreateEmbeddingResponse),
-			}
-			cdb   = a.db.WithContext(ctx)
-			timer = time.NewTimer(cleanupInterval)
-		)
-		for {
-			a.logger.Debug("Looking for expired create embeddings requests and responses that we can cleanup")
-			expiration := time.Now().Add(-a.requestRetention)
-			if err := db.DeleteExpired(cdb, expiration, jobObjects...); err != nil {
-				a.logger.Error("failed to delete expired embeddings requests/responses", "err", err)
-			}
-
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
-			}
-
-			timer.Reset(cleanupInterval)
+	var (
+		jobObjects = []db.Storer{
+			new(db.CreateEmbeddingRequest),
+			new(db.CreateEmbeddingResponse),
 		}
-	}()
+		cdb = a.db.WithContext(ctx)
+	)
+	agents.RunPeriodically(ctx, wg, a.requestRetention/2, func(context.Context) {
+		a.logger.Debug("Looking for expired create embeddings requests and responses that we can cleanup")
+		expiration := time.Now().Add(-a.requestRetention)
+		if err := db.DeleteExpired(cdb, expiration, jobObjects...); err != nil {
+			a.logger.Error("failed to delete expired embeddings requests/responses", "err", err)
+		}
+	})
 }
 
-func (a *agent) run(ctx context.Context) error {
-	a.logger.Debug("Checking for an embeddings request to process")
+func (a *agent) run(ctx context.Context, l *slog.Logger) error {
+	l.Debug("Checking for an embeddings request to process")
 	// Look for a new embeddings request and claim it.
 	embedreq := new(db.CreateEmbeddingRequest)
-	if err := a.db.WithContext(ctx).Model(embedreq).Transaction(func(tx *gorm.DB) error {
-		if err := tx.Where("claimed_by IS NULL").Or("claimed_by = ? AND done = false", a.id).
-			Order("created_at desc").
-			First(embedreq).Error; err != nil {
-			return err
-		}
-
-		if err := tx.Where("id = ?", embedreq.ID).
-			Updates(map[string]interface{}{"claimed_by": a.id}).Error; err != nil {
-			return err
-		}
-
-		return nil
-	}); err != nil {
+	ctx, cancel, err := agents.Dequeue(ctx, l, a.db.WithContext(ctx), embedreq, a.id, a.lease, a.pollingInterval, func() db.JobFailer { return new(db.CreateEmbeddingResponse) })
+	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return fmt.Errorf("failed to get embeddings request: %w", err)
 		}
 		return err
 	}
+	defer cancel()
 
 	embeddingsID := embedreq.ID
-	l := a.logger.With("id", embeddingsID)
+	l = l.With("id", embeddingsID)
 	l.Debug("Processing request")
 
-	url := embedreq.ModelAPI
-	if url == "" {
-		url = a.url
-	}
-
 	l.Debug("Found embeddings request", "er", embedreq)
 
-	embedresp, err := makeEmbeddingsRequest(ctx, l, a.client, url, a.apiKey, embedreq)
+	provider, err := a.providers.Lookup(embedreq.Model)
+	if err != nil {
+		return a.fail(a.db.WithContext(ctx), l, embedreq, err)
+	}
+
+	embedresp, err := a.createEmbeddings(ctx, l, provider, embedreq)
 	if err != nil {
-		return fmt.Errorf("failed to make embeddings request: %w", err)
+		return a.fail(a.db.WithContext(ctx), l, embedreq, fmt.Errorf("failed to make embeddings request: %w", err))
 	}
+	if embedresp.Error != nil {
+		l.Error("Failed to create embeddings", "err", *embedresp.Error)
+	}
+
+	embedresp.RequestID = embeddingsID
+	embedresp.Done = true
 
 	l.Debug("Made embeddings request", "status_code", embedresp.StatusCode)
 
@@ -218,45 +230,14 @@ func (a *agent) run(ctx context.Context) error {
 	return nil
 }
 
-func makeEmbeddingsRequest(ctx context.Context, l *slog.Logger, client *http.Client, url, apiKey string, er *db.CreateEmbeddingRequest) (*db.CreateEmbeddingResponse, error) {
-	b, err := json.Marshal(er.ToPublic())
-	if err != nil {
-		return nil, err
+// fail fails the request, for example because no provider serves its model or the provider couldn't be reached. Nothing
+// is stored if gdb's context is done, so that interrupted requests are left for another agent.
+func (a *agent) fail(gdb *gorm.DB, l *slog.Logger, request *db.CreateEmbeddingRequest, err error) error {
+	l.Error("Failed to create embeddings", "err", err)
+	if failErr := db.FailJob(gdb, request, new(db.CreateEmbeddingResponse), err); failErr != nil {
+		return failErr
 	}
 
-	l.Debug("Making embeddings request", "request", string(b))
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	if apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-	}
-
-	resp := new(openai.CreateEmbeddingResponse)
-
-	// Wait to process this error until after we have the DB object.
-	code, err := cclient.SendRequest(client, req, resp)
-
-	embedresp := new(db.CreateEmbeddingResponse)
-	// err here should be shadowed.
-	if err := embedresp.FromPublic(resp); err != nil {
-		l.Error("Failed to create embeddings", "err", err)
-	}
-
-	// Process the request error here.
-	if err != nil {
-		l.Error("Failed to create embeddings", "err", err)
-		embedresp.Error = z.Pointer(err.Error())
-	}
-
-	embedresp.StatusCode = code
-	embedresp.RequestID = er.ID
-	embedresp.Done = true
-
-	return embedresp, nil
+	a.trigger.Ready(request.ID)
+	return nil
 }
@@ -0,0 +1,184 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"gorm.io/datatypes"
+)
+
+const (
+	defaultLocalDimensions = 256
+	maxLocalDimensions     = 8192
+)
+
+// LocalConfig configures the built-in embeddings model, which computes embeddings locally instead of sending requests
+// to a provider.
+type LocalConfig struct {
+	// Model is the name that the model is served and stored as. The model isn't served if the name is empty.
+	Model string
+	// Dimensions is the length of the embeddings of requests that don't set dimensions. Defaults to 256.
+	Dimensions int
+	// NGram is the length of the character n-grams that are hashed into the embeddings, or zero to hash words.
+	NGram int
+}
+
+func (c LocalConfig) validate() error {
+	if c.Dimensions < 0 || c.Dimensions > maxLocalDimensions {
+		return fmt.Errorf("local embeddings dimensions must be at most %d, or zero for the default", maxLocalDimensions)
+	}
+	if c.NGram < 0 {
+		return fmt.Errorf("local embeddings n-gram length must not be negative")
+	}
+
+	return nil
+}
+
+// localEmbeddings computes deterministic embeddings by hashing the words, or character n-grams, of the input into the
+// dimensions of a vector. Inputs that share words have similar embeddings, which is enough to exercise retrieval
+// without a model.
+type localEmbeddings struct {
+	LocalConfig
+}
+
+func newLocalEmbeddings(cfg LocalConfig) *localEmbeddings {
+	if cfg.Dimensions == 0 {
+		cfg.Dimensions = defaultLocalDimensions
+	}
+	return &localEmbeddings{LocalConfig: cfg}
+}
+
+func (e *localEmbeddings) CreateEmbeddings(_ context.Context, er *db.CreateEmbeddingRequest) (*db.CreateEmbeddingResponse, error) {
+	dimensions := e.Dimensions
+	if d := z.Dereference(er.Dimensions); d != 0 {
+		dimensions = d
+	}
+	if dimensions < 1 || dimensions > maxLocalDimensions {
+		return badEmbeddingsRequest(fmt.Sprintf("dimensions must be between 1 and %d", maxLocalDimensions)), nil
+	}
+
+	base64Encoded := false
+	switch z.Dereference(er.EncodingFormat) {
+	case "", "float":
+	case "base64":
+		base64Encoded = true
+	default:
+		return badEmbeddingsRequest(fmt.Sprintf("unsupported encoding format %q", *er.EncodingFormat)), nil
+	}
+
+	input, err := er.Input.Data().MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	inputs, err := providers.EmbeddingInputs(input)
+	if err != nil {
+		return badEmbeddingsRequest(err.Error()), nil
+	}
+
+	var (
+		data   = make([]db.Embedding, 0, len(inputs))
+		tokens int
+	)
+	for i, input := range inputs {
+		features := e.features(input)
+		tokens += len(features)
+
+		vector, embedding := hashFeatures(features, dimensions), new(openai.Embedding_Embedding)
+		if base64Encoded {
+			err = embedding.FromEmbeddingEmbedding1(providers.EncodeEmbedding(vector))
+		} else {
+			err = embedding.FromEmbeddingEmbedding0(vector)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, db.Embedding{
+			Index:     i,
+			Embedding: datatypes.NewJSONType(*embedding),
+		})
+	}
+
+	return &db.CreateEmbeddingResponse{
+		JobResponse: db.JobResponse{StatusCode: http.StatusOK},
+		Data:        data,
+		Model:       e.Model,
+		Usage:       datatypes.NewJSONType(db.EmbeddingUsage{PromptTokens: tokens, TotalTokens: tokens}),
+	}, nil
+}
+
+// features returns the lowercase words of the input, or its character n-grams. The n-grams of each word are padded
+// with spaces, so that the beginnings and ends of words are features too.
+func (e *localEmbeddings) features(input string) []string {
+	words := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if e.NGram == 0 {
+		return words
+	}
+
+	var ngrams []string
+	for _, word := range words {
+		runes := []rune(" " + word + " ")
+		if len(runes) <= e.NGram {
+			ngrams = append(ngrams, string(runes))
+			continue
+		}
+		for i := 0; i+e.NGram <= len(runes); i++ {
+			ngrams = append(ngrams, string(runes[i:i+e.NGram]))
+		}
+	}
+
+	return ngrams
+}
+
+// hashFeatures returns the unit vector of the features, each of which is added to, or subtracted from, the dimension
+// that it hashes to. An input without features has a zero vector.
+func hashFeatures(features []string, dimensions int) []float32 {
+	vector := make([]float64, dimensions)
+	for _, feature := range features {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(feature))
+		sum := h.Sum64()
+
+		if sum>>63 == 0 {
+			vector[sum%uint64(dimensions)]++
+		} else {
+			vector[sum%uint64(dimensions)]--
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+
+	result := make([]float32, dimensions)
+	if norm == 0 {
+		return result
+	}
+	for i, v := range vector {
+		result[i] = float32(v / norm)
+	}
+
+	return result
+}
+
+func badEmbeddingsRequest(message string) *db.CreateEmbeddingResponse {
+	return &db.CreateEmbeddingResponse{
+		JobResponse: db.JobResponse{
+			Error:      z.Pointer(message),
+			StatusCode: http.StatusBadRequest,
+		},
+	}
+}
@@ -0,0 +1,109 @@
+package embeddings
+
+import (
+	"context"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"gorm.io/datatypes"
+)
+
+func TestLocalEmbeddings(t *testing.T) {
+	e := newLocalEmbeddings(LocalConfig{Model: "local"})
+
+	embed := func(t *testing.T, dimensions int, format string, texts ...string) *db.CreateEmbeddingResponse {
+		t.Helper()
+		input := new(openai.CreateEmbeddingRequest_Input)
+		if err := input.FromCreateEmbeddingRequestInput1(texts); err != nil {
+			t.Fatal(err)
+		}
+		req := &db.CreateEmbeddingRequest{Input: datatypes.NewJSONType(*input), Model: "local"}
+		if dimensions != 0 {
+			req.Dimensions = z.Pointer(dimensions)
+		}
+		if format != "" {
+			req.EncodingFormat = z.Pointer(format)
+		}
+
+		resp, err := e.CreateEmbeddings(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateEmbeddings() = %v", err)
+		}
+		return resp
+	}
+	vectors := func(t *testing.T, resp *db.CreateEmbeddingResponse) [][]float32 {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status code = %d, error = %v", resp.StatusCode, z.Dereference(resp.Error))
+		}
+		result := make([][]float32, 0, len(resp.Data))
+		for _, d := range resp.Data {
+			vector, err := d.Embedding.Data().AsEmbeddingEmbedding0()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, vector)
+		}
+		return result
+	}
+
+	t.Run("deterministic and similar", func(t *testing.T) {
+		v := vectors(t, embed(t, 0, "", "The quick brown fox", "the quick, brown fox!", "the quick red fox", "a lazy dog sleeps"))
+		if len(v) != 4 || len(v[0]) != defaultLocalDimensions {
+			t.Fatalf("got %d embeddings of %d dimensions", len(v), len(v[0]))
+		}
+		if sim := cosine(v[0], v[1]); math.Abs(sim-1) > 1e-6 {
+			t.Errorf("similarity of the same words = %f, want 1", sim)
+		}
+		if near, far := cosine(v[0], v[2]), cosine(v[0], v[3]); near <= far {
+			t.Errorf("similarity of shared words = %f, not more than unrelated words = %f", near, far)
+		}
+	})
+
+	t.Run("dimensions", func(t *testing.T) {
+		if v := vectors(t, embed(t, 32, "", "hello")); len(v[0]) != 32 {
+			t.Errorf("got %d dimensions, want 32", len(v[0]))
+		}
+		if resp := embed(t, maxLocalDimensions+1, "", "hello"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("base64", func(t *testing.T) {
+		resp := embed(t, 16, "base64", "hello world")
+		encoded, err := resp.Data[0].Embedding.Data().AsEmbeddingEmbedding1()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 16*4 {
+			t.Fatalf("got %d bytes, want %d", len(data), 16*4)
+		}
+		if want := providers.EncodeEmbedding(vectors(t, embed(t, 16, "float", "hello world"))[0]); encoded != want {
+			t.Errorf("base64 embedding = %s, want %s", encoded, want)
+		}
+
+		if resp := embed(t, 0, "int8", "hello"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	return dot / math.Sqrt(na*nb)
+}
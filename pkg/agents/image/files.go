@@ -0,0 +1,93 @@
+package image
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/gorm"
+)
+
+// imageFiles returns the images of the response as files, decoding the images that the provider returned as base64 and
+// downloading the others from the provider's URLs.
+func (a *agent) imageFiles(ctx context.Context, requestID string, ir *db.ImagesResponse) ([]*db.File, error) {
+	files := make([]*db.File, 0, len(ir.Data))
+	for i, image := range ir.Data {
+		var (
+			content []byte
+			err     error
+		)
+		switch {
+		case image.B64Json != nil:
+			if content, err = base64.StdEncoding.DecodeString(*image.B64Json); err != nil {
+				return nil, fmt.Errorf("failed to decode image %d: %w", i, err)
+			}
+		case image.Url != nil:
+			if content, err = a.download(ctx, *image.Url); err != nil {
+				return nil, fmt.Errorf("failed to download image %d: %w", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("image %d has neither a URL nor base64 content", i)
+		}
+
+		files = append(files, &db.File{
+			Content:  content,
+			Purpose:  string(openai.OpenAIFilePurposeAssistantsOutput),
+			Filename: fmt.Sprintf("%s-%d%s", requestID, i, imageExtension(content)),
+		})
+	}
+
+	return files, nil
+}
+
+func (a *agent) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// storeFiles stores the files of the images, and replaces the images in the response with links to download them.
+func (a *agent) storeFiles(tx *gorm.DB, ir *db.ImagesResponse, files []*db.File) error {
+	for i, file := range files {
+		if err := db.Create(tx, file); err != nil {
+			return err
+		}
+
+		ir.FileIDs = append(ir.FileIDs, file.ID)
+		ir.Data[i].B64Json = nil
+		ir.Data[i].Url = z.Pointer(fmt.Sprintf("%s/files/%s/content", a.filesBaseURL, file.ID))
+	}
+
+	return nil
+}
+
+func imageExtension(content []byte) string {
+	switch http.DetectContentType(content) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ".png"
+	}
+}
@@ -1,18 +1,13 @@
 package image
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
-	"net/http"
 
 	"github.com/acorn-io/z"
-	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
-	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
-	"gorm.io/gorm"
 )
 
 func (a *agent) runGenerations(ctx context.Context, l *slog.Logger) error {
@@ -21,56 +16,28 @@ func (a *agent) runGenerations(ctx context.Context, l *slog.Logger) error {
 		createRequest = new(db.CreateImageRequest)
 		gdb           = a.db.WithContext(ctx)
 	)
-	if err := db.Dequeue(gdb, createRequest, a.id); err != nil {
+	ctx, cancel, err := agents.Dequeue(ctx, l, gdb, createRequest, a.id, a.lease, a.pollingInterval, func() db.JobFailer { return new(db.ImagesResponse) })
+	if err != nil {
 		return err
 	}
+	defer cancel()
 
-	l = slog.With("type", "createimage", "id", createRequest.ID)
-	l.Debug("processing request")
+	gdb = a.db.WithContext(ctx)
 
-	data, err := json.Marshal(createRequest.ToPublic())
-	if err != nil {
-		return fmt.Errorf("failed to marshal create image request: %w", err)
-	}
+	l = l.With("type", "createimage", "id", createRequest.ID)
+	l.Debug("processing request")
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.generationsURL, bytes.NewReader(data))
+	provider, err := a.providers.Lookup(z.Dereference(createRequest.Model))
 	if err != nil {
-		return fmt.Errorf("failed to create image request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	if a.apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+a.apiKey)
-	}
-
-	oir, ir := new(openai.ImagesResponse), new(db.ImagesResponse)
-	code, err := cclient.SendRequest(a.client, req, oir)
-	if err := ir.FromPublic(oir); err != nil {
-		l.Error("failed to convert image response", "err", err)
+		return a.fail(gdb, l, createRequest, err)
 	}
 
-	// Process the request error here.
+	ir, err := provider.CreateImage(ctx, createRequest)
 	if err != nil {
-		l.Error("failed to send image create request", "err", err)
-		ir.Error = z.Pointer(err.Error())
-	}
-
-	ir.StatusCode = code
-	ir.RequestID = createRequest.ID
-	ir.Done = true
-
-	// Store the completed response and mark the request as done.
-	if err = gdb.Transaction(func(tx *gorm.DB) error {
-		if err = db.Create(tx, ir); err != nil {
-			return err
-		}
-		return tx.Model(createRequest).Where("id = ?", createRequest.ID).Update("done", true).Error
-	}); err != nil {
-		l.Error("failed to store image create response", "err", err)
+		return a.fail(gdb, l, createRequest, fmt.Errorf("failed to make image create request: %w", err))
 	}
 
-	a.trigger.Ready(createRequest.ID)
+	a.respond(ctx, gdb, l, createRequest, ir)
 
 	return nil
 }
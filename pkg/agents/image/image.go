@@ -2,14 +2,17 @@ package image
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
 	"gorm.io/gorm"
 )
@@ -37,17 +40,33 @@ type Config struct {
 	Logger                           *slog.Logger
 	PollingInterval, RetentionPeriod time.Duration
 	ImagesBaseURL, APIKey, AgentID   string
+	DrainTimeout                     time.Duration
+	Workers                          int
+	Lease                            db.Lease
 	Trigger                          trigger.Trigger
+	Transport                        http.RoundTripper
+	// Providers routes the requests to image providers by model. Requests without a model are routed to the default
+	// provider. Defaults to sending every request to the OpenAI images API at ImagesBaseURL.
+	Providers *providers.Registry[providers.ImageProvider]
+	// StoreImages stores the generated images as files, and replaces them in the responses with links to download the
+	// files from FilesBaseURL, which paths like /files/{file_id}/content are appended to.
+	StoreImages  bool
+	FilesBaseURL string
 }
 
 type agent struct {
-	logger                                  *slog.Logger
-	pollingInterval, requestRetention       time.Duration
-	id, apiKey                              string
-	generationsURL, editsURL, variationsURL string
-	client                                  *http.Client
-	db                                      *db.DB
-	trigger                                 trigger.Trigger
+	logger                            *slog.Logger
+	pollingInterval, requestRetention time.Duration
+	id                                string
+	drainTimeout                      time.Duration
+	workers                           int
+	lease                             db.Lease
+	providers                         *providers.Registry[providers.ImageProvider]
+	storeImages                       bool
+	filesBaseURL                      string
+	client                            *http.Client
+	db                                *db.DB
+	trigger                           trigger.Trigger
 }
 
 func newAgent(db *db.DB, cfg Config) (*agent, error) {
@@ -57,21 +76,40 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	if cfg.RetentionPeriod < minRequestRetention {
 		return nil, fmt.Errorf("[image] request retention must be at least %s", minRequestRetention)
 	}
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, fmt.Errorf("[image] %w", err)
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, fmt.Errorf("[image] %w", err)
+	}
+
+	if cfg.StoreImages && cfg.FilesBaseURL == "" {
+		return nil, fmt.Errorf("[image] files base URL is required to store images")
+	}
 
 	if cfg.Trigger == nil {
 		cfg.Logger.Warn("[image] No trigger provided, using noop")
 		cfg.Trigger = trigger.NewNoop()
 	}
 
+	if cfg.Providers == nil {
+		cfg.Providers = providers.NewRegistry[providers.ImageProvider]()
+		if err := cfg.Providers.Register(providers.NewOpenAIImages(cfg.ImagesBaseURL, cfg.APIKey, agents.NewHTTPClient(cfg.Transport))); err != nil {
+			return nil, fmt.Errorf("[image] %w", err)
+		}
+	}
+
 	return &agent{
 		logger:           cfg.Logger,
 		pollingInterval:  cfg.PollingInterval,
 		requestRetention: cfg.RetentionPeriod,
-		generationsURL:   cfg.ImagesBaseURL + "/generations",
-		editsURL:         cfg.ImagesBaseURL + "/edits",
-		variationsURL:    cfg.ImagesBaseURL + "/variations",
-		client:           http.DefaultClient,
-		apiKey:           cfg.APIKey,
+		drainTimeout:     cfg.DrainTimeout,
+		workers:          cfg.Workers,
+		lease:            cfg.Lease,
+		providers:        cfg.Providers,
+		storeImages:      cfg.StoreImages,
+		filesBaseURL:     strings.TrimSuffix(cfg.FilesBaseURL, "/"),
+		client:           agents.NewHTTPClient(cfg.Transport),
 		db:               db,
 		id:               cfg.AgentID,
 		trigger:          cfg.Trigger,
@@ -79,86 +117,88 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 }
 
 func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
-	// Start the "job runner"
-	for _, run := range []func(context.Context, *slog.Logger) error{
+	// Start the "job runners"
+	pool := agents.Pool{
+		Name:            "image",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}
+	for _, run := range []agents.Work{
 		a.runGenerations,
 		a.runEdits,
 		a.runVariations,
 	} {
-		wg.Add(1)
-		go func(r func(context.Context, *slog.Logger) error) {
-			defer wg.Done()
-			timer := time.NewTimer(a.pollingInterval)
-			for {
-				if err := r(ctx, a.logger); err != nil {
-					if !errors.Is(err, gorm.ErrRecordNotFound) {
-						a.logger.Error("failed run iteration", "err", err)
-					}
-
-					select {
-					case <-ctx.Done():
-						// Ensure the timer channel is drained
-						if !timer.Stop() {
-							select {
-							case <-timer.C:
-							default:
-							}
-						}
-						return
-					case <-timer.C:
-					case <-a.trigger.Triggered():
-					}
-				}
-
-				if !timer.Stop() {
-					// Ensure the timer channel is drained
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-
-				timer.Reset(a.pollingInterval)
-			}
-		}(run)
+		pool.Start(ctx, wg, a.logger, run)
 	}
 
 	// Start cleanup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var (
-			cleanupInterval = a.requestRetention / 2
-			jobObjects      = []db.Storer{
-				new(db.CreateImageRequest),
-				new(db.CreateImageEditRequest),
-				new(db.CreateImageVariationRequest),
-				new(db.ImagesResponse),
-			}
-			cdb   = a.db.WithContext(ctx)
-			timer = time.NewTimer(cleanupInterval)
-		)
-		for {
-			a.logger.Debug("looking for expired image requests and responses")
-			expiration := time.Now().Add(-a.requestRetention)
-			if err := db.DeleteExpired(cdb, expiration, jobObjects...); err != nil {
-				a.logger.Error("failed to delete expired image requests and responses", "err", err)
-			}
+	var (
+		jobObjects = []db.Storer{
+			new(db.CreateImageRequest),
+			new(db.CreateImageEditRequest),
+			new(db.CreateImageVariationRequest),
+		}
+		cdb = a.db.WithContext(ctx)
+	)
+	agents.RunPeriodically(ctx, wg, a.requestRetention/2, func(context.Context) {
+		a.logger.Debug("looking for expired image requests and responses")
+		expiration := time.Now().Add(-a.requestRetention)
+		if err := db.DeleteExpiredImages(cdb, expiration, jobObjects...); err != nil {
+			a.logger.Error("failed to delete expired image requests and responses", "err", err)
+		}
+	})
+}
 
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
+// respond stores the provider's response to the request, and the images as files if they are stored, and marks the
+// request as done.
+func (a *agent) respond(ctx context.Context, gdb *gorm.DB, l *slog.Logger, request db.Storer, ir *db.ImagesResponse) {
+	var files []*db.File
+	if a.storeImages && ir.Error == nil {
+		var err error
+		if files, err = a.imageFiles(ctx, request.GetID(), ir); err != nil {
+			l.Error("failed to get generated images", "err", err)
+			ir = &db.ImagesResponse{
+				JobResponse: db.JobResponse{
+					Error:      z.Pointer(fmt.Sprintf("failed to get generated images: %v", err)),
+					StatusCode: http.StatusBadGateway,
+				},
 			}
+		}
+	}
+
+	if ir.Error != nil {
+		l.Error("image request failed", "status_code", ir.StatusCode, "err", *ir.Error)
+	}
 
-			timer.Reset(cleanupInterval)
+	ir.RequestID = request.GetID()
+	ir.Done = true
+
+	// Store the completed response and mark the request as done.
+	if err := gdb.Transaction(func(tx *gorm.DB) error {
+		if err := a.storeFiles(tx, ir, files); err != nil {
+			return err
+		}
+		if err := db.Create(tx, ir); err != nil {
+			return err
 		}
-	}()
+		return tx.Model(request).Where("id = ?", request.GetID()).Update("done", true).Error
+	}); err != nil {
+		l.Error("failed to store image response", "err", err)
+	}
+
+	a.trigger.Ready(request.GetID())
+}
+
+// fail fails the request, for example because no provider serves its model or the provider couldn't be reached. Nothing
+// is stored if gdb's context is done, so that interrupted requests are left for another agent.
+func (a *agent) fail(gdb *gorm.DB, l *slog.Logger, request db.Storer, err error) error {
+	l.Error("failed image request", "err", err)
+	if failErr := db.FailJob(gdb, request, new(db.ImagesResponse), err); failErr != nil {
+		return failErr
+	}
+
+	a.trigger.Ready(request.GetID())
+	return nil
 }
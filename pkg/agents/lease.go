@@ -0,0 +1,147 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// ErrRequestCancelled is the cause of the cancellation of jobs whose request was cancelled, for example because its
+// client disconnected, while an agent was processing it.
+var ErrRequestCancelled = errors.New("request was cancelled")
+
+// Dequeue claims the next request and keeps the lease on it alive until the returned cancel function is called. The
+// returned context is canceled if the lease is lost to another agent, or with ErrRequestCancelled if the request is
+// cancelled, which is checked every polling interval. If the request has been attempted the maximum number of times,
+// then it is failed with the response returned by newFailedResponse and the error is returned. If the request is
+// interrupted because the agent is shutting down, then the claim on it is abandoned by the cancel function. If it was
+// cancelled, then the cancel function fails it with the response returned by newFailedResponse, so that the failed
+// response is stored after everything the agent stored for it.
+func Dequeue(ctx context.Context, l *slog.Logger, gdb *gorm.DB, request db.Job, agentID string, lease db.Lease, pollingInterval time.Duration, newFailedResponse func() db.JobFailer) (context.Context, context.CancelFunc, error) {
+	if err := db.Dequeue(gdb, request, agentID, lease); errors.Is(err, db.ErrMaxAttemptsExceeded) {
+		l.Error("Failing abandoned request", "id", request.GetID(), "err", err)
+		if failErr := db.FailJob(gdb, request, newFailedResponse(), err); failErr != nil {
+			return nil, nil, errors.Join(err, failErr)
+		}
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if reason := request.GetCancelReason(); reason != "" {
+		// The request was cancelled while another agent was processing it, and that agent didn't fail it.
+		err := db.CancelCause(reason)
+		l.Info("Failing cancelled request", "id", request.GetID(), "err", err)
+		if failErr := db.FailJob(gdb, request, newFailedResponse(), err); failErr != nil {
+			return nil, nil, errors.Join(err, failErr)
+		}
+		return nil, nil, err
+	}
+
+	// Continue the trace of whoever created the request, which may have been another process.
+	ctx, span := tracing.Start(tracing.WithTraceParent(ctx, request.GetTraceParent()), "process "+reflect.TypeOf(request).Elem().Name(),
+		attribute.String("job.id", request.GetID()),
+		attribute.Int("job.attempts", request.GetAttempts()),
+	)
+
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	go KeepLeaseAlive(leaseCtx, func() { cancel(db.ErrLeaseLost) }, l, gdb, request, request.GetID(), agentID, lease, db.JobLease)
+	go PollForDone(leaseCtx, func() { cancel(ErrRequestCancelled) }, gdb, request, request.GetID(), pollingInterval)
+
+	return leaseCtx, func() {
+		defer span.End()
+		interrupted, cancelled := Interrupted(leaseCtx), Cancelled(leaseCtx)
+		cancel(nil)
+		if interrupted {
+			AbandonInterrupted(leaseCtx, l, gdb, request, request.GetID(), agentID, db.JobLease)
+		} else if cancelled {
+			failCancelled(leaseCtx, l, gdb, request, newFailedResponse)
+		}
+	}, nil
+}
+
+// Cancelled returns true if the job being processed with ctx was canceled because its request was cancelled.
+func Cancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrRequestCancelled)
+}
+
+// failCancelled fails a request that was cancelled while the agent was processing it, unless it was already done.
+func failCancelled(ctx context.Context, l *slog.Logger, gdb *gorm.DB, request db.Job, newFailedResponse func() db.JobFailer) {
+	ctx, cancel := CleanupContext(ctx)
+	defer cancel()
+
+	l.Info("Failing cancelled request", "id", request.GetID())
+	if err := db.FailCancelledJob(gdb.WithContext(ctx), request, newFailedResponse()); err != nil {
+		l.Error("Failed to fail cancelled request", "id", request.GetID(), "err", err)
+	}
+}
+
+// PollForDone polls the request with the given ID until the context is done. If the request is done, which it is
+// before the agent has responded only if it was failed by someone else, or it was marked as cancelled, then cancel is
+// called so that the work is stopped. The obj is only used to determine the table.
+func PollForDone(ctx context.Context, cancel func(), gdb *gorm.DB, obj any, id string, pollingInterval time.Duration) {
+	model := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+	timer := time.NewTimer(pollingInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			stopTimer(timer)
+			return
+		case <-timer.C:
+		}
+
+		var done int64
+		if err := gdb.WithContext(ctx).Model(model).Where("id = ?", id).Where("done = ? OR cancel_reason <> ?", true, "").Count(&done).Error; err == nil && done > 0 {
+			cancel()
+			return
+		}
+
+		timer.Reset(pollingInterval)
+	}
+}
+
+// AbandonInterrupted gives up the agent's claim on a job that was interrupted because the agent is shutting down, so
+// that another agent can claim it without waiting for the lease to lapse.
+func AbandonInterrupted(ctx context.Context, l *slog.Logger, gdb *gorm.DB, obj any, id, agentID string, columns db.LeaseColumns) {
+	ctx, cancel := CleanupContext(ctx)
+	defer cancel()
+
+	l.Warn("Abandoning job interrupted by shutdown", "id", id)
+	model := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+	if err := db.AbandonJob(gdb.WithContext(ctx), model, id, agentID, columns); err != nil {
+		l.Error("Failed to abandon interrupted job", "id", id, "err", err)
+	}
+}
+
+// KeepLeaseAlive extends the agent's lease on the object with the given ID until the context is done. If the lease is
+// lost to another agent, then cancel is called so that the work is abandoned. The obj is only used to determine the table.
+func KeepLeaseAlive(ctx context.Context, cancel func(), l *slog.Logger, gdb *gorm.DB, obj any, id, agentID string, lease db.Lease, columns db.LeaseColumns) {
+	// Use a new object so that the caller's object isn't modified concurrently.
+	model := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+	timer := time.NewTimer(lease.HeartbeatInterval())
+	for {
+		select {
+		case <-ctx.Done():
+			stopTimer(timer)
+			return
+		case <-timer.C:
+		}
+
+		if err := db.ExtendLease(gdb.WithContext(ctx), model, id, agentID, lease, columns); errors.Is(err, db.ErrLeaseLost) {
+			l.Warn("Lease lost, abandoning work", "id", id)
+			cancel()
+			return
+		} else if err != nil && ctx.Err() == nil {
+			l.Error("Failed to extend lease", "id", id, "err", err)
+		}
+
+		timer.Reset(lease.HeartbeatInterval())
+	}
+}
@@ -0,0 +1,108 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
+	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
+	"gorm.io/gorm"
+)
+
+// Work claims and processes a single job. It returns gorm.ErrRecordNotFound if there are no jobs to process.
+type Work func(ctx context.Context, l *slog.Logger) error
+
+// Pool is a set of workers that process an agent's jobs concurrently, each one job at a time.
+type Pool struct {
+	// Name identifies the agent in metrics.
+	Name            string
+	Workers         int
+	PollingInterval time.Duration
+	// DrainTimeout is how long in-flight jobs are given to finish after the pool is stopped.
+	DrainTimeout time.Duration
+	Trigger      trigger.Trigger
+}
+
+func ValidateWorkers(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+
+	return nil
+}
+
+// Start starts the workers. A worker that processes a job immediately looks for another one. Otherwise, it waits for
+// the polling interval or for the trigger before looking again.
+//
+// When ctx is canceled, the workers stop claiming jobs. Jobs that are in-flight are processed with a context that is
+// canceled with ErrDrainTimeout if they don't finish within the drain timeout.
+func (p Pool) Start(ctx context.Context, wg *sync.WaitGroup, l *slog.Logger, work Work) {
+	workCtx := drainContext(ctx, p.DrainTimeout)
+	for i := 0; i < p.Workers; i++ {
+		wg.Add(1)
+		go func(l *slog.Logger) {
+			defer wg.Done()
+			timer := time.NewTimer(p.PollingInterval)
+			defer stopTimer(timer)
+			for ctx.Err() == nil {
+				start := time.Now()
+				err := work(workCtx, l)
+				if err == nil || errors.Is(err, db.ErrAlreadyClaimed) {
+					if err == nil {
+						metrics.JobDuration.WithLabelValues(p.Name, metrics.Result(nil)).Observe(metrics.Since(start))
+					}
+					continue
+				}
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					metrics.JobDuration.WithLabelValues(p.Name, metrics.Result(err)).Observe(metrics.Since(start))
+					l.Error("failed run iteration", "err", err)
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-timer.C:
+				case <-p.Trigger.Triggered():
+				}
+
+				stopTimer(timer)
+				timer.Reset(p.PollingInterval)
+			}
+		}(l.With("worker", i))
+	}
+}
+
+// RunPeriodically calls f immediately and then every interval until the context is done.
+func RunPeriodically(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, f func(context.Context)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		timer := time.NewTimer(interval)
+		for {
+			f(ctx)
+
+			select {
+			case <-ctx.Done():
+				stopTimer(timer)
+				return
+			case <-timer.C:
+			}
+
+			timer.Reset(interval)
+		}
+	}()
+}
+
+// stopTimer stops the timer and ensures that its channel is drained so that it can be reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
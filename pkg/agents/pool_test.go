@@ -0,0 +1,90 @@
+package agents
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
+	"gorm.io/gorm"
+)
+
+func TestPoolProcessesConcurrently(t *testing.T) {
+	const workers = 3
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		wg          = new(sync.WaitGroup)
+		started     = make(chan struct{}, workers)
+		release     = make(chan struct{})
+		jobs        = workers
+		lock        sync.Mutex
+	)
+	defer cancel()
+
+	Pool{Workers: workers, PollingInterval: time.Hour, Trigger: trigger.NewNoop()}.Start(ctx, wg, slog.Default(), func(ctx context.Context, _ *slog.Logger) error {
+		lock.Lock()
+		if jobs == 0 {
+			lock.Unlock()
+			return gorm.ErrRecordNotFound
+		}
+		jobs--
+		lock.Unlock()
+
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	// Every job should be in progress at the same time, one on each worker.
+	for i := 0; i < workers; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d jobs were processed concurrently", i, workers)
+		}
+	}
+
+	close(release)
+	cancel()
+	wg.Wait()
+}
+
+func TestPoolDrainsInFlightJobs(t *testing.T) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		wg          = new(sync.WaitGroup)
+		started     = make(chan struct{})
+		interrupted = make(chan bool, 1)
+		claims      int
+		lock        sync.Mutex
+	)
+	defer cancel()
+
+	Pool{Workers: 1, PollingInterval: time.Hour, DrainTimeout: 100 * time.Millisecond, Trigger: trigger.NewNoop()}.Start(ctx, wg, slog.Default(), func(ctx context.Context, _ *slog.Logger) error {
+		lock.Lock()
+		claims++
+		lock.Unlock()
+
+		close(started)
+		<-ctx.Done()
+		interrupted <- Interrupted(ctx)
+		return nil
+	})
+
+	<-started
+	cancel()
+	wg.Wait()
+
+	// The in-flight job must not be canceled with the pool, only after the drain timeout, and no more jobs are claimed.
+	if !<-interrupted {
+		t.Fatal("expected the in-flight job to be interrupted by the drain timeout")
+	}
+	if claims != 1 {
+		t.Fatalf("expected 1 job to be claimed, got %d", claims)
+	}
+}
@@ -0,0 +1,196 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+)
+
+// StatusOverloaded is returned by Anthropic when its API is temporarily overloaded.
+const StatusOverloaded = 529
+
+// UpstreamError is a failed request to the model provider. StatusCode is 0 if no response was received.
+type UpstreamError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode == 0 {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("upstream returned %d: %v", e.StatusCode, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// GetStatusCode returns the status code to respond with for the error.
+func (e *UpstreamError) GetStatusCode() int {
+	if e.StatusCode == 0 {
+		return http.StatusBadGateway
+	}
+
+	return e.StatusCode
+}
+
+// CheckResponse returns an UpstreamError, and closes the body, if the response has an error status code.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		body = []byte(fmt.Sprintf("failed to read body for error response: %v", err))
+	}
+
+	return &UpstreamError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Err:        errors.New(strings.TrimSpace(string(body))),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// Retryable returns true if the error is transient, so the request may succeed if it is retried: the provider couldn't
+// be reached, it is rate limiting requests, or it had a server error.
+func Retryable(err error) bool {
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+
+	switch upstreamErr.StatusCode {
+	case 0:
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, StatusOverloaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryPolicy configures how requests to the model provider are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is attempted for each model before falling back to the next one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, which doubles for each retry up to MaxDelay. The delays are
+	// jittered. A Retry-After header from the provider overrides the delay, up to MaxDelay.
+	BaseDelay, MaxDelay time.Duration
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("upstream max attempts must be at least 1")
+	}
+	if p.BaseDelay <= 0 || p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("upstream retry delays must be positive, and the max delay must be at least the base delay")
+	}
+
+	return nil
+}
+
+// Backoff returns the delay before the given retry, starting at 1.
+func (p RetryPolicy) Backoff(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, p.MaxDelay)
+	}
+
+	delay := p.MaxDelay
+	if retry < 32 {
+		delay = min(p.BaseDelay<<(retry-1), p.MaxDelay)
+	}
+	if delay <= 0 {
+		delay = p.MaxDelay
+	}
+
+	// Use "equal jitter" so that the delay is at least half of the exponential delay.
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// RetryEvent describes a decision to retry a request or to fall back to another model.
+type RetryEvent struct {
+	Model string
+	// FallbackModel is set if the next attempt is for a fallback model instead of a retry.
+	FallbackModel string
+	// Attempt is the number of attempts that have been made for the model.
+	Attempt int
+	// Delay is how long until the request is retried.
+	Delay time.Duration
+	Err   error
+}
+
+func (e RetryEvent) String() string {
+	if e.FallbackModel != "" {
+		return fmt.Sprintf("falling back from %s to %s after %d attempt(s): %v", e.Model, e.FallbackModel, e.Attempt, e.Err)
+	}
+
+	return fmt.Sprintf("retrying %s in %s after attempt %d: %v", e.Model, e.Delay.Round(time.Millisecond), e.Attempt, e.Err)
+}
+
+// RetryWithFallbacks calls attempt for each model in order until an attempt succeeds. An attempt that fails with a
+// Retryable error is retried with backoff for the same model until the policy's attempts are used up, and then the next
+// model is tried. An attempt that fails with providers.ErrCircuitOpen falls back to the next model immediately. Any
+// other error is returned without more attempts. Each decision is passed to observe before it is acted on.
+func RetryWithFallbacks(ctx context.Context, policy RetryPolicy, models []string, attempt func(ctx context.Context, model string) error, observe func(RetryEvent)) error {
+	var err error
+	for i, model := range models {
+		var attempts int
+		for {
+			attempts++
+			if err = attempt(ctx, model); err == nil || !Retryable(err) && !errors.Is(err, providers.ErrCircuitOpen) {
+				return err
+			}
+			if errors.Is(err, providers.ErrCircuitOpen) || attempts >= policy.MaxAttempts {
+				break
+			}
+
+			var upstreamErr *UpstreamError
+			errors.As(err, &upstreamErr)
+			delay := policy.Backoff(attempts, upstreamErr.RetryAfter)
+			observe(RetryEvent{Model: model, Attempt: attempts, Delay: delay, Err: err})
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				stopTimer(timer)
+				return errors.Join(err, ctx.Err())
+			case <-timer.C:
+			}
+		}
+
+		if i+1 < len(models) {
+			observe(RetryEvent{Model: model, FallbackModel: models[i+1], Attempt: attempts, Err: err})
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,103 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+)
+
+func TestRetryWithFallbacks(t *testing.T) {
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, string(body))
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	var (
+		policy = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+		events []RetryEvent
+	)
+	err := RetryWithFallbacks(context.Background(), policy, []string{"primary", "fallback"}, func(ctx context.Context, model string) error {
+		if model == "fallback" {
+			return nil
+		}
+
+		_, err := MakeChatCompletionRequest(ctx, slog.Default(), upstream.Client(), upstream.URL, "", &db.CreateChatCompletionRequest{Model: model})
+		return err
+	}, func(e RetryEvent) {
+		events = append(events, e)
+	})
+	if err != nil {
+		t.Fatalf("RetryWithFallbacks() = %v", err)
+	}
+
+	if len(requests) != policy.MaxAttempts {
+		t.Errorf("primary model was attempted %d times, want %d", len(requests), policy.MaxAttempts)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d retry events, want 2: %v", len(events), events)
+	}
+	if events[0].FallbackModel != "" || events[0].Delay != policy.MaxDelay {
+		t.Errorf("first event should retry after the Retry-After delay capped at %s, got %v", policy.MaxDelay, events[0])
+	}
+	if events[1].FallbackModel != "fallback" || events[1].Attempt != policy.MaxAttempts {
+		t.Errorf("second event should fall back after %d attempts, got %v", policy.MaxAttempts, events[1])
+	}
+	var upstreamErr *UpstreamError
+	if !errors.As(events[1].Err, &upstreamErr) || upstreamErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("fallback error = %v, want status %d", events[1].Err, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRetryWithFallbacksStops(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	for name, test := range map[string]struct {
+		err      error
+		attempts []string
+	}{
+		"not retryable":  {err: &UpstreamError{StatusCode: http.StatusBadRequest}, attempts: []string{"a"}},
+		"circuit open":   {err: providers.ErrCircuitOpen, attempts: []string{"a", "b"}},
+		"always failing": {err: &UpstreamError{StatusCode: http.StatusBadGateway}, attempts: []string{"a", "a", "a", "b", "b", "b"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var attempts []string
+			err := RetryWithFallbacks(context.Background(), policy, []string{"a", "b"}, func(_ context.Context, model string) error {
+				attempts = append(attempts, model)
+				return test.err
+			}, func(RetryEvent) {})
+			if !errors.Is(err, test.err) {
+				t.Errorf("RetryWithFallbacks() = %v, want %v", err, test.err)
+			}
+			if !slices.Equal(attempts, test.attempts) {
+				t.Errorf("attempted %v, want %v", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 40: 8 * time.Second} {
+		for range 10 {
+			if got := policy.Backoff(retry, 0); got < want/2 || got > want {
+				t.Errorf("Backoff(%d) = %s, want between %s and %s", retry, got, want/2, want)
+			}
+		}
+	}
+}
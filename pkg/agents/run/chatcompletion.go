@@ -79,6 +79,7 @@ func prepareChatCompletionRequest(ctx context.Context, builtInFunctionDefinition
 	}
 
 	return &db.CreateChatCompletionRequest{
+		JobRequest:  db.JobRequest{Priority: run.Priority},
 		Stream:      z.Pointer(true),
 		Messages:    chatMessages,
 		Model:       assistant.Model,
@@ -0,0 +1,346 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/acorn-io/z"
+	"github.com/google/uuid"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/datatypes"
+)
+
+// Models that don't support tools natively are asked to call tools by responding with JSON in these tags, which many
+// open models are trained to do.
+const (
+	toolCallStart     = "<tool_call>"
+	toolCallEnd       = "</tool_call>"
+	toolResponseStart = "<tool_response>"
+	toolResponseEnd   = "</tool_response>"
+)
+
+const toolCallInstructions = `You can call the following tools. Each tool is described by a JSON schema of its arguments:
+
+<tools>
+%s
+</tools>
+
+To call tools, respond with only one or more tool calls, each formatted like this, and nothing else:
+<tool_call>
+{"name": "<tool name>", "arguments": <arguments object>}
+</tool_call>
+
+The results of the tool calls will be returned to you in <tool_response></tool_response> tags. If you don't need to call a tool, respond normally.`
+
+// emulatedToolCall is a tool call in the text of a response from a model that doesn't support tools natively.
+type emulatedToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// requestMessage has the fields of every type of chat completion request message.
+type requestMessage struct {
+	Role       string                                 `json:"role"`
+	Content    json.RawMessage                        `json:"content"`
+	ToolCalls  []openai.ChatCompletionMessageToolCall `json:"tool_calls"`
+	ToolCallID string                                 `json:"tool_call_id"`
+}
+
+// validateToolCallEmulation returns an error if any of the patterns of models that tool calls are emulated for is
+// invalid.
+func validateToolCallEmulation(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid tool call emulation model pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// emulatesToolCalls returns true if tool calls are emulated in the prompt for the model.
+func (a *agent) emulatesToolCalls(model string) bool {
+	for _, pattern := range a.emulateToolCalls {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emulateToolCalls returns a copy of the chat completion request for a model that doesn't support tools natively. The
+// tools are described in the system prompt instead, and previous tool calls and their results are written in the
+// format that the model is asked to call tools with.
+func emulateToolCalls(cc *db.CreateChatCompletionRequest) (*db.CreateChatCompletionRequest, error) {
+	toolDefinitions := make([]string, 0, len(cc.Tools))
+	for _, t := range cc.Tools {
+		definition, err := json.Marshal(t.Function)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe tool %s: %w", t.Function.Name, err)
+		}
+		toolDefinitions = append(toolDefinitions, string(definition))
+	}
+	instructions := fmt.Sprintf(toolCallInstructions, strings.Join(toolDefinitions, "\n"))
+
+	var (
+		messages      = make([]openai.ChatCompletionRequestMessage, 0, len(cc.Messages)+1)
+		toolResponses []string
+	)
+	for i, m := range cc.Messages {
+		data, err := m.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+		}
+
+		var msg requestMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+		}
+
+		if msg.Role == string(openai.ChatCompletionRequestToolMessageRoleTool) {
+			var output string
+			if err = json.Unmarshal(msg.Content, &output); err != nil {
+				return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+			}
+
+			// The results of the tool calls are sent together in one user message.
+			toolResponses = append(toolResponses, toolResponseStart+"\n"+output+"\n"+toolResponseEnd)
+			continue
+		}
+		if len(toolResponses) > 0 {
+			if messages, err = appendUserMessage(messages, strings.Join(toolResponses, "\n")); err != nil {
+				return nil, err
+			}
+			toolResponses = nil
+		}
+
+		switch {
+		case msg.Role == string(openai.ChatCompletionRequestSystemMessageRoleSystem) && len(messages) == 0:
+			var content string
+			if err = json.Unmarshal(msg.Content, &content); err != nil {
+				return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+			}
+
+			if err = m.FromChatCompletionRequestSystemMessage(openai.ChatCompletionRequestSystemMessage{
+				Role:    openai.ChatCompletionRequestSystemMessageRoleSystem,
+				Content: content + "\n\n" + instructions,
+			}); err != nil {
+				return nil, err
+			}
+		case msg.Role == string(openai.ChatCompletionRequestAssistantMessageRoleAssistant) && len(msg.ToolCalls) > 0:
+			calls := make([]string, 0, len(msg.ToolCalls))
+			for _, tc := range msg.ToolCalls {
+				arguments := json.RawMessage(tc.Function.Arguments)
+				if !json.Valid(arguments) {
+					arguments = json.RawMessage("{}")
+				}
+
+				call, err := json.Marshal(emulatedToolCall{Name: tc.Function.Name, Arguments: arguments})
+				if err != nil {
+					return nil, err
+				}
+				calls = append(calls, toolCallStart+"\n"+string(call)+"\n"+toolCallEnd)
+			}
+
+			if err = m.FromChatCompletionRequestAssistantMessage(openai.ChatCompletionRequestAssistantMessage{
+				Role:    openai.ChatCompletionRequestAssistantMessageRoleAssistant,
+				Content: z.Pointer(strings.Join(calls, "\n")),
+			}); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(messages) == 0 && msg.Role != string(openai.ChatCompletionRequestSystemMessageRoleSystem) {
+			// There are no instructions, so the tools are described in a system message of their own.
+			system := new(openai.ChatCompletionRequestMessage)
+			if err = system.FromChatCompletionRequestSystemMessage(openai.ChatCompletionRequestSystemMessage{
+				Role:    openai.ChatCompletionRequestSystemMessageRoleSystem,
+				Content: instructions,
+			}); err != nil {
+				return nil, err
+			}
+			messages = append(messages, *system)
+		}
+
+		messages = append(messages, m)
+	}
+	if len(toolResponses) > 0 {
+		var err error
+		if messages, err = appendUserMessage(messages, strings.Join(toolResponses, "\n")); err != nil {
+			return nil, err
+		}
+	}
+
+	emulated := *cc
+	emulated.Messages = messages
+	emulated.Tools = nil
+	emulated.ToolChoice = datatypes.NewJSONType[*openai.ChatCompletionToolChoiceOption](nil)
+
+	return &emulated, nil
+}
+
+func appendUserMessage(messages []openai.ChatCompletionRequestMessage, content string) ([]openai.ChatCompletionRequestMessage, error) {
+	userMessageContent := new(openai.ChatCompletionRequestUserMessage_Content)
+	if err := userMessageContent.FromChatCompletionRequestUserMessageContent0(content); err != nil {
+		return nil, err
+	}
+
+	m := new(openai.ChatCompletionRequestMessage)
+	if err := m.FromChatCompletionRequestUserMessage(openai.ChatCompletionRequestUserMessage{
+		Role:    openai.ChatCompletionRequestUserMessageRoleUser,
+		Content: *userMessageContent,
+	}); err != nil {
+		return nil, err
+	}
+
+	return append(messages, *m), nil
+}
+
+// parseEmulatedToolCalls translates the tool calls in the text of a streamed response into tool call chunks, like the
+// ones that models with native tool support stream. Text is held back until it is clear whether the response is a
+// message or tool calls, and then it is either streamed as it is or parsed once the response is complete.
+func parseEmulatedToolCalls(ctx context.Context, stream <-chan db.ChatCompletionResponseChunk) <-chan db.ChatCompletionResponseChunk {
+	out := make(chan db.ChatCompletionResponseChunk, cap(stream))
+	go func() {
+		defer close(out)
+		defer func() {
+			go func() {
+				//nolint:revive
+				for range stream {
+				}
+			}()
+		}()
+
+		var (
+			// last is the last chunk received, which the chunks that are sent are based on.
+			last               db.ChatCompletionResponseChunk
+			text               strings.Builder
+			decided, toolCalls bool
+		)
+		for chunk := range stream {
+			if chunk.Error != nil || len(chunk.Choices) == 0 || decided && !toolCalls {
+				if !agents.SendChunk(ctx, out, chunk) {
+					return
+				}
+				continue
+			}
+
+			last = chunk
+			delta := chunk.Choices[0].Delta.Data()
+			text.WriteString(z.Dereference(delta.Content))
+			if decided {
+				continue
+			}
+
+			trimmed := strings.TrimLeft(text.String(), " \t\r\n")
+			switch {
+			case strings.HasPrefix(trimmed, toolCallStart):
+				decided, toolCalls = true, true
+			case strings.HasPrefix(toolCallStart, trimmed):
+				// It isn't clear yet whether the response is a message, so only send the rest of the chunk.
+				if delta.Content != nil || chunk.Choices[0].FinishReason != "" {
+					continue
+				}
+				if !agents.SendChunk(ctx, out, chunk) {
+					return
+				}
+			default:
+				// The response is a message, so send the text that was held back.
+				decided = true
+				if !agents.SendChunk(ctx, out, withDelta(chunk, openai.ChatCompletionStreamResponseDelta{Content: z.Pointer(text.String())}, chunk.Choices[0].FinishReason)) {
+					return
+				}
+			}
+		}
+
+		switch {
+		case !decided && last.Choices == nil:
+			// Nothing was held back.
+			return
+		case !decided:
+			// The response ended before it was clear whether it is a message, so send the text that was held back.
+			var delta openai.ChatCompletionStreamResponseDelta
+			if text.Len() > 0 {
+				delta.Content = z.Pointer(text.String())
+			}
+			agents.SendChunk(ctx, out, withDelta(last, delta, last.Choices[0].FinishReason))
+			return
+		case !toolCalls:
+			return
+		}
+
+		calls := parseToolCalls(text.String())
+		if len(calls) == 0 {
+			// The tool calls couldn't be parsed, so the text is all that can be returned.
+			agents.SendChunk(ctx, out, withDelta(last, openai.ChatCompletionStreamResponseDelta{Content: z.Pointer(text.String())}, last.Choices[0].FinishReason))
+			return
+		}
+
+		for i, call := range calls {
+			arguments := string(call.Arguments)
+			if err := json.Unmarshal(call.Arguments, new(string)); err == nil {
+				// Some models write the arguments as a JSON string, like the OpenAI API does.
+				_ = json.Unmarshal(call.Arguments, &arguments)
+			} else if len(call.Arguments) == 0 {
+				arguments = "{}"
+			}
+
+			if !agents.SendChunk(ctx, out, withDelta(last, openai.ChatCompletionStreamResponseDelta{
+				ToolCalls: &[]openai.ChatCompletionMessageToolCallChunk{{
+					Id:    z.Pointer("call_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:24]),
+					Index: i,
+					Type:  z.Pointer(openai.ChatCompletionMessageToolCallChunkTypeFunction),
+					Function: &struct {
+						Arguments *string `json:"arguments,omitempty"`
+						Name      *string `json:"name,omitempty"`
+					}{
+						Arguments: z.Pointer(arguments),
+						Name:      z.Pointer(call.Name),
+					},
+				}},
+			}, "")) {
+				return
+			}
+		}
+
+		agents.SendChunk(ctx, out, withDelta(last, openai.ChatCompletionStreamResponseDelta{}, string(openai.CreateChatCompletionStreamResponseChoicesFinishReasonToolCalls)))
+	}()
+
+	return out
+}
+
+// parseToolCalls returns the tool calls in the text. A tool call without an end tag runs to the end of the text.
+func parseToolCalls(text string) []emulatedToolCall {
+	var calls []emulatedToolCall
+	for {
+		_, rest, found := strings.Cut(text, toolCallStart)
+		if !found {
+			return calls
+		}
+
+		var call string
+		call, text, _ = strings.Cut(rest, toolCallEnd)
+
+		var tc emulatedToolCall
+		if err := json.Unmarshal([]byte(strings.TrimSpace(call)), &tc); err == nil && tc.Name != "" {
+			calls = append(calls, tc)
+		}
+	}
+}
+
+// withDelta returns a copy of the chunk with the delta and finish reason.
+func withDelta(chunk db.ChatCompletionResponseChunk, delta openai.ChatCompletionStreamResponseDelta, finishReason string) db.ChatCompletionResponseChunk {
+	chunk.Choices = datatypes.NewJSONSlice([]db.ChunkChoice{{
+		Index:        chunk.Choices[0].Index,
+		FinishReason: finishReason,
+		Delta:        datatypes.NewJSONType(delta),
+	}})
+
+	return chunk
+}
@@ -0,0 +1,139 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/datatypes"
+)
+
+func TestEmulateToolCalls(t *testing.T) {
+	cc := new(db.CreateChatCompletionRequest)
+	if err := json.Unmarshal([]byte(`{
+		"model": "llama3",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Oslo?"},
+			{"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Oslo\"}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "sunny"}
+		],
+		"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}]
+	}`), cc); err != nil {
+		t.Fatal(err)
+	}
+
+	emulated, err := emulateToolCalls(cc)
+	if err != nil {
+		t.Fatalf("emulateToolCalls() = %v", err)
+	}
+	if len(emulated.Tools) != 0 || len(cc.Tools) != 1 {
+		t.Errorf("tools should only be removed from the emulated request")
+	}
+
+	var messages []requestMessage
+	data, _ := json.Marshal(emulated.Messages)
+	if err = json.Unmarshal(data, &messages); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ role, content string }{
+		{"system", `Be brief.` + "\n\nYou can call the following tools"},
+		{"user", `Weather in Oslo?`},
+		{"assistant", "<tool_call>\n" + `{"name":"weather","arguments":{"city":"Oslo"}}` + "\n</tool_call>"},
+		{"user", "<tool_response>\nsunny\n</tool_response>"},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("got %d messages, want %d: %s", len(messages), len(want), data)
+	}
+	for i, w := range want {
+		var content string
+		_ = json.Unmarshal(messages[i].Content, &content)
+		if messages[i].Role != w.role || !strings.HasPrefix(content, w.content) {
+			t.Errorf("message %d = %s %q, want %s %q", i, messages[i].Role, content, w.role, w.content)
+		}
+	}
+	if content := string(messages[0].Content); !strings.Contains(content, `\"name\":\"weather\"`) {
+		t.Errorf("system prompt should describe the tools, got %s", content)
+	}
+}
+
+func TestParseEmulatedToolCalls(t *testing.T) {
+	for name, test := range map[string]struct {
+		chunks        []string
+		wantContent   string
+		wantToolCalls []db.GenericToolCallInfo
+	}{
+		"tool calls": {
+			chunks: []string{"", " <tool", "_call>\n{\"name\": \"weather\", \"arguments\": {\"city\": \"Oslo\"}}\n</tool_call>\n<tool_call>", `{"name": "time", "arguments": "{}"}`, "</tool_call>"},
+			wantToolCalls: []db.GenericToolCallInfo{
+				{Name: "weather", Arguments: `{"city": "Oslo"}`},
+				{Name: "time", Arguments: `{}`},
+			},
+		},
+		"message": {
+			chunks:      []string{"<", "b>Sunny</b>", " today"},
+			wantContent: "<b>Sunny</b> today",
+		},
+		"unparseable tool call": {
+			chunks:      []string{"<tool_call>", "weather(Oslo)"},
+			wantContent: "<tool_call>weather(Oslo)",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			stream := make(chan db.ChatCompletionResponseChunk, len(test.chunks)+2)
+			stream <- chunkWithDelta(openai.ChatCompletionStreamResponseDelta{Role: z.Pointer(openai.ChatCompletionStreamResponseDeltaRoleAssistant)}, "")
+			for _, content := range test.chunks {
+				stream <- chunkWithDelta(openai.ChatCompletionStreamResponseDelta{Content: z.Pointer(content)}, "")
+			}
+			stream <- chunkWithDelta(openai.ChatCompletionStreamResponseDelta{}, "stop")
+			close(stream)
+
+			var (
+				runStep   = new(db.RunStep)
+				toolCalls []db.GenericToolCallInfo
+				content   string
+				finish    string
+			)
+			for chunk := range parseEmulatedToolCalls(context.Background(), stream) {
+				if _, err := runStep.Merge(&toolCalls, chunk); err != nil {
+					t.Fatalf("Merge() = %v", err)
+				}
+				content += z.Dereference(chunk.Choices[0].Delta.Data().Content)
+				finish = chunk.Choices[0].FinishReason
+			}
+
+			if content != test.wantContent {
+				t.Errorf("content = %q, want %q", content, test.wantContent)
+			}
+			if len(toolCalls) != len(test.wantToolCalls) {
+				t.Fatalf("got tool calls %+v, want %+v", toolCalls, test.wantToolCalls)
+			}
+			for i, tc := range toolCalls {
+				if !strings.HasPrefix(tc.ID, "call_") || tc.Name != test.wantToolCalls[i].Name || tc.Arguments != test.wantToolCalls[i].Arguments {
+					t.Errorf("tool call %d = %+v, want %+v", i, tc, test.wantToolCalls[i])
+				}
+			}
+			wantFinish := "stop"
+			if len(test.wantToolCalls) > 0 {
+				wantFinish = "tool_calls"
+			}
+			if finish != wantFinish {
+				t.Errorf("finish reason = %q, want %q", finish, wantFinish)
+			}
+		})
+	}
+}
+
+func chunkWithDelta(delta openai.ChatCompletionStreamResponseDelta, finishReason string) db.ChatCompletionResponseChunk {
+	return db.ChatCompletionResponseChunk{
+		Choices: datatypes.NewJSONSlice([]db.ChunkChoice{{
+			FinishReason: finishReason,
+			Delta:        datatypes.NewJSONType(delta),
+		}}),
+	}
+}
@@ -13,7 +13,9 @@ import (
 	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -28,7 +30,16 @@ type Config struct {
 	Logger                           *slog.Logger
 	PollingInterval, RetentionPeriod time.Duration
 	APIURL, APIKey, AgentID          string
-	Trigger, RunStepTrigger          trigger.Trigger
+	DrainTimeout                     time.Duration
+	Workers                          int
+	Lease                            db.Lease
+	// EmulateToolCalls are the models, or path.Match patterns, that don't support tools natively. Tools are described
+	// in the prompt for these models instead, and tool calls are parsed out of their responses.
+	EmulateToolCalls []string
+	// SkipBuiltInTools doesn't load the built-in gptscript tools, which are downloaded if they aren't stored yet.
+	SkipBuiltInTools        bool
+	Trigger, RunStepTrigger trigger.Trigger
+	Transport               http.RoundTripper
 }
 
 func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) error {
@@ -40,9 +51,11 @@ func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) erro
 		return err
 	}
 
-	a.builtInToolDefinitions, err = populateTools(ctx, cfg.Logger, gdb.WithContext(ctx))
-	if err != nil {
-		return err
+	if !cfg.SkipBuiltInTools {
+		a.builtInToolDefinitions, err = populateTools(ctx, cfg.Logger, gdb.WithContext(ctx))
+		if err != nil {
+			return err
+		}
 	}
 
 	a.Start(ctx, wg)
@@ -54,6 +67,10 @@ type agent struct {
 	logger                           *slog.Logger
 	pollingInterval, retentionPeriod time.Duration
 	id, apiKey, url                  string
+	drainTimeout                     time.Duration
+	workers                          int
+	lease                            db.Lease
+	emulateToolCalls                 []string
 	client                           *http.Client
 	db                               *db.DB
 	builtInToolDefinitions           map[string]*openai.FunctionObject
@@ -67,6 +84,15 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	if cfg.RetentionPeriod < minRequestRetention {
 		return nil, fmt.Errorf("[run] request retention must be at least %s", minRequestRetention)
 	}
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, fmt.Errorf("[run] %w", err)
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, fmt.Errorf("[run] %w", err)
+	}
+	if err := validateToolCallEmulation(cfg.EmulateToolCalls); err != nil {
+		return nil, fmt.Errorf("[run] %w", err)
+	}
 
 	if cfg.Trigger == nil {
 		cfg.Logger.Warn("[run] No trigger provided, using noop")
@@ -78,122 +104,76 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	}
 
 	return &agent{
-		logger:          cfg.Logger,
-		pollingInterval: cfg.PollingInterval,
-		retentionPeriod: cfg.RetentionPeriod,
-		client:          http.DefaultClient,
-		apiKey:          cfg.APIKey,
-		db:              db,
-		id:              cfg.AgentID,
-		url:             cfg.APIURL,
-		trigger:         cfg.Trigger,
-		runStepTrigger:  cfg.RunStepTrigger,
+		logger:           cfg.Logger,
+		pollingInterval:  cfg.PollingInterval,
+		retentionPeriod:  cfg.RetentionPeriod,
+		client:           agents.NewHTTPClient(cfg.Transport),
+		apiKey:           cfg.APIKey,
+		db:               db,
+		id:               cfg.AgentID,
+		url:              cfg.APIURL,
+		drainTimeout:     cfg.DrainTimeout,
+		workers:          cfg.Workers,
+		lease:            cfg.Lease,
+		emulateToolCalls: cfg.EmulateToolCalls,
+		trigger:          cfg.Trigger,
+		runStepTrigger:   cfg.RunStepTrigger,
 	}, nil
 }
 
 func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
-	// Start the "job runner"
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		timer := time.NewTimer(a.pollingInterval)
-		for {
-			if err := a.run(ctx); err != nil {
-				if !errors.Is(err, gorm.ErrRecordNotFound) {
-					a.logger.Error("failed run iteration", "err", err)
-				}
-				select {
-				case <-ctx.Done():
-					// Ensure the timer channel is drained
-					if !timer.Stop() {
-						select {
-						case <-timer.C:
-						default:
-						}
-					}
-					return
-				case <-timer.C:
-				case <-a.trigger.Triggered():
-				}
-			}
+	// Start the "job runners"
+	agents.Pool{
+		Name:            "run",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}.Start(ctx, wg, a.logger, a.run)
 
-			if !timer.Stop() {
-				// Ensure the timer channel has been drained.
-				select {
-				case <-timer.C:
-				default:
-				}
-			}
-
-			timer.Reset(a.pollingInterval)
+	// Start cleanup
+	var (
+		jobObjects = []db.Storer{
+			new(db.RunEvent),
 		}
-	}()
+		cdb = a.db.WithContext(ctx)
+	)
+	agents.RunPeriodically(ctx, wg, a.retentionPeriod/2, func(context.Context) {
+		a.logger.Debug("Looking for completed runs")
+
+		// Look for a runs, runSteps, and runEvents to clean-up.
+		var runs []db.Run
+		if err := cdb.Transaction(func(tx *gorm.DB) error {
+			if err := db.DeleteExpired(tx, time.Now().Add(-a.retentionPeriod), jobObjects...); err != nil {
+				return err
+			}
 
-	// Start cleanup
-	wg.Add(1)
-	go func() {
-		wg.Done()
-		var (
-			cleanupInterval = a.retentionPeriod / 2
-			jobObjects      = []db.Storer{
-				new(db.RunEvent),
+			// TODO(thedadams): Under which circumstances should we clean up old runs? This currently does nothing.
+			if err := tx.Model(new(db.Run)).Where("id IS NULL").Order("created_at desc").Find(&runs).Error; err != nil {
+				return err
 			}
-			cdb = a.db.WithContext(ctx)
-
-			timer = time.NewTimer(cleanupInterval)
-		)
-		for {
-			a.logger.Debug("Looking for completed runs")
-
-			// Look for a runs, runSteps, and runEvents to clean-up.
-			var runs []db.Run
-			if err := cdb.Transaction(func(tx *gorm.DB) error {
-				if err := db.DeleteExpired(tx, time.Now().Add(-a.retentionPeriod), jobObjects...); err != nil {
-					return err
-				}
-
-				// TODO(thedadams): Under which circumstances should we clean up old runs? This currently does nothing.
-				if err := tx.Model(new(db.Run)).Where("id IS NULL").Order("created_at desc").Find(&runs).Error; err != nil {
-					return err
-				}
-				if len(runs) == 0 {
-					return nil
-				}
-
-				runIDs := make([]string, 0, len(runs))
-				for _, run := range runs {
-					runIDs = append(runIDs, run.ID)
-				}
-
-				if err := tx.Delete(new(db.RunStep), "run_id IN ?", runIDs).Error; err != nil {
-					return err
-				}
-
-				return tx.Delete(runs).Error
-			}); err != nil {
-				a.logger.Error("Failed to cleanup run completions", "err", err)
+			if len(runs) == 0 {
+				return nil
 			}
 
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
+			runIDs := make([]string, 0, len(runs))
+			for _, run := range runs {
+				runIDs = append(runIDs, run.ID)
 			}
 
-			timer.Reset(cleanupInterval)
+			if err := tx.Delete(new(db.RunStep), "run_id IN ?", runIDs).Error; err != nil {
+				return err
+			}
+
+			return tx.Delete(runs).Error
+		}); err != nil {
+			a.logger.Error("Failed to cleanup run completions", "err", err)
 		}
-	}()
+	})
 }
 
-func (a *agent) run(ctx context.Context) error {
-	a.logger.Debug("Checking for a run")
+func (a *agent) run(ctx context.Context, l *slog.Logger) error {
+	l.Debug("Checking for a run")
 	// Look for a new run and claim it. Also, query for the other objects we need.
 	var (
 		run       = new(db.Run)
@@ -202,11 +182,23 @@ func (a *agent) run(ctx context.Context) error {
 		messages  = make([]db.Message, 0)
 		tools     = make([]db.Tool, 0)
 	)
+	var attempts int
 	err := a.db.WithContext(ctx).Model(run).Transaction(func(tx *gorm.DB) error {
-		if err := tx.Where("claimed_by IS NULL AND status = ?", openai.RunObjectStatusQueued).Or("claimed_by = ? AND status = ? AND system_status = ?", a.id, openai.RunObjectStatusInProgress, openai.RunObjectStatusQueued).Order("created_at desc").First(run).Error; err != nil {
+		// A run can be claimed if it is queued, if the step runner has handed it back, or if the agent processing it has
+		// stopped renewing its lease.
+		if err := tx.Where("status = ? OR (status = ? AND (system_status IS NULL OR system_status = ?))", openai.RunObjectStatusQueued, openai.RunObjectStatusInProgress, openai.RunObjectStatusQueued).
+			Scopes(db.JobLease.Claimable(a.id)).
+			Order(db.QueueOrder).
+			First(run).Error; err != nil {
 			return err
 		}
 
+		attempts = run.Attempts
+		if attempts >= a.lease.MaxAttempts {
+			// Claim the run so that it can be failed.
+			return db.JobLease.ClaimJob(tx.Model(run), run.ID, a.id, db.JobLease.Claim(a.id, a.lease, attempts))
+		}
+
 		thread := new(db.Thread)
 		if err := tx.Model(new(db.Thread)).Where("id = ?", run.ThreadID).First(thread).Error; err != nil {
 			return err
@@ -257,13 +249,11 @@ func (a *agent) run(ctx context.Context) error {
 			}
 		}
 
-		updates := map[string]any{
-			"claimed_by":  a.id,
-			"status":      openai.RunObjectStatusInProgress,
-			"started_at":  startedAt,
-			"event_index": run.EventIndex,
-		}
-		if err := tx.Model(run).Clauses(clause.Returning{}).Where("id = ?", run.ID).Updates(updates).Error; err != nil {
+		updates := db.JobLease.Claim(a.id, a.lease, attempts)
+		updates["status"] = openai.RunObjectStatusInProgress
+		updates["started_at"] = startedAt
+		updates["event_index"] = run.EventIndex
+		if err := db.JobLease.ClaimJob(tx.Model(run).Clauses(clause.Returning{}), run.ID, a.id, updates); err != nil {
 			return err
 		}
 
@@ -275,18 +265,46 @@ func (a *agent) run(ctx context.Context) error {
 		return nil
 	})
 	if err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
+		if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, db.ErrAlreadyClaimed) {
 			return fmt.Errorf("failed to get run: %w", err)
 		}
 		return err
 	}
 
 	runID := run.ID
-	l := a.logger.With("id", runID)
+	l = l.With("id", runID)
+
+	if attempts >= a.lease.MaxAttempts {
+		err = fmt.Errorf("%w: run was attempted %d times", db.ErrMaxAttemptsExceeded, attempts)
+		l.Error("Failing abandoned run", "err", err)
+		if err := failRun(a.db.WithContext(ctx), run, err, openai.RunObjectLastErrorCodeServerError); err != nil {
+			l.Error("failed to fail run", "error", err)
+		}
+		return err
+	}
+
+	// Continue the trace of the request that created the run, which may have been handled by another process.
+	ctx, span := tracing.Start(tracing.WithTraceParent(ctx, run.TraceParent), "process run", attribute.String("run.id", runID))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	// If the lease is lost, then the context is canceled and nothing more is stored for this run.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go agents.KeepLeaseAlive(ctx, cancel, l, a.db.WithContext(ctx), run, runID, a.id, a.lease, db.JobLease)
 
 	defer func() {
+		if agents.Interrupted(ctx) {
+			cleanupCtx, cancel := agents.CleanupContext(ctx)
+			defer cancel()
+			if err := requeueRun(a.db.WithContext(cleanupCtx), run, a.id); err != nil {
+				l.Error("failed to requeue interrupted run", "error", err)
+			}
+			return
+		}
 		if err != nil {
-			if err := failRun(a.db.WithContext(ctx), run, err, openai.RunObjectLastErrorCodeServerError); err != nil {
+			if err := failRun(a.db.WithContext(ctx), run, err, lastErrorCode(err)); err != nil {
 				l.Error("failed to fail run", "error", err)
 			}
 		}
@@ -299,7 +317,14 @@ func (a *agent) run(ctx context.Context) error {
 		return err
 	}
 
-	stream, err := agents.StreamChatCompletionRequest(ctx, l, a.client, a.url, a.apiKey, cc)
+	// The request is sent to the chat completion API, whose agent retries it and falls back to the models configured for
+	// the assistant and its provider, so it isn't retried here. The retries are done by the time the API responds.
+	stream, requestID, err := a.streamChatCompletion(ctx, l, run.AssistantID, cc)
+	if requestID != "" {
+		if err := recordRetries(a.db.WithContext(ctx), run, requestID); err != nil {
+			l.Error("Failed to record retries of chat completion request from run", "err", err)
+		}
+	}
 	if err != nil {
 		l.Error("Failed to make chat completion request from run", "err", err)
 		return err
@@ -308,6 +333,15 @@ func (a *agent) run(ctx context.Context) error {
 	if err = compileChunksAndApplyStatuses(ctx, l, a.db.WithContext(ctx), run, stream); err != nil {
 		// If we get an error here, then we have already failed the run. Log the error and return so that we don't try to fail the run again.
 		l.Error("failed to compile chat completion chunks", "error", err)
+		err = nil
+	}
+	if agents.Interrupted(ctx) {
+		return nil
+	}
+
+	// Release the run so that any agent can pick it up once the step runner or the user has acted on it.
+	if err := a.db.WithContext(ctx).Model(run).Where("id = ?", runID).Where("claimed_by = ?", a.id).Updates(db.JobLease.Release()).Error; err != nil {
+		l.Error("failed to release run", "error", err)
 	}
 
 	a.runStepTrigger.Kick(runID)
@@ -316,6 +350,120 @@ func (a *agent) run(ctx context.Context) error {
 	return nil
 }
 
+// streamChatCompletion makes the run's chat completion request, with the tools described in the prompt if the model
+// doesn't support them natively. The ID of the chat completion request is returned if the API stored it.
+func (a *agent) streamChatCompletion(ctx context.Context, l *slog.Logger, assistantID string, cc *db.CreateChatCompletionRequest) (<-chan db.ChatCompletionResponseChunk, string, error) {
+	if len(cc.Tools) == 0 || !a.emulatesToolCalls(cc.Model) {
+		return agents.StreamRunChatCompletionRequest(ctx, l, a.client, a.url, a.apiKey, assistantID, cc)
+	}
+
+	emulated, err := emulateToolCalls(cc)
+	if err != nil {
+		return nil, "", err
+	}
+	stream, requestID, err := agents.StreamRunChatCompletionRequest(ctx, l, a.client, a.url, a.apiKey, assistantID, emulated)
+	if err != nil {
+		return nil, requestID, err
+	}
+
+	return parseEmulatedToolCalls(ctx, stream), requestID, nil
+}
+
+// recordRetries creates a run event for each decision to retry the run's chat completion request or to fall back to
+// another model. The run's model is updated when falling back.
+func recordRetries(gdb *gorm.DB, run *db.Run, requestID string) error {
+	var retries []db.ChatCompletionRetry
+	if err := gdb.Where("request_id = ?", requestID).Order("retry_idx").Find(&retries).Error; err != nil || len(retries) == 0 {
+		return err
+	}
+
+	return gdb.Transaction(func(tx *gorm.DB) error {
+		for _, retry := range retries {
+			eventName := db.RunEventRetrying
+			run.EventIndex++
+			updates := map[string]any{"event_index": run.EventIndex}
+			if retry.FallbackModel != "" {
+				eventName = db.RunEventFallback
+				run.Model = retry.FallbackModel
+				updates["model"] = run.Model
+			}
+			if err := tx.Model(run).Where("id = ?", run.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+
+			// The error is only set on the event's copy of the run, because the run hasn't failed.
+			snapshot := *run
+			snapshot.LastError = datatypes.NewJSONType(&db.RunLastError{
+				Code:    string(statusErrorCode(retry.StatusCode)),
+				Message: retry.Error,
+			})
+
+			if err := db.Create(tx, &db.RunEvent{
+				EventName: eventName,
+				JobResponse: db.JobResponse{
+					RequestID: run.ID,
+				},
+				Run:         datatypes.NewJSONType(&snapshot),
+				ResponseIdx: run.EventIndex,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// lastErrorCode returns the code of the run error for err.
+func lastErrorCode(err error) openai.RunObjectLastErrorCode {
+	var upstreamErr *agents.UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return statusErrorCode(upstreamErr.StatusCode)
+	}
+
+	return openai.RunObjectLastErrorCodeServerError
+}
+
+// statusErrorCode returns the code of the run error for a failed request with the given status code.
+func statusErrorCode(statusCode int) openai.RunObjectLastErrorCode {
+	if statusCode == http.StatusTooManyRequests {
+		return openai.RunObjectLastErrorCodeRateLimitExceeded
+	}
+
+	return openai.RunObjectLastErrorCodeServerError
+}
+
+// requeueRun puts a run that was interrupted because the agent is shutting down back in the queue, and gives up the
+// agent's claim on it so that another agent can pick it up. Nothing is changed if the run is no longer in progress or
+// has been claimed by another agent.
+func requeueRun(gdb *gorm.DB, run *db.Run, agentID string) error {
+	return gdb.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", run.ID).Where("claimed_by = ?", agentID).Where("status = ?", openai.RunObjectStatusInProgress).First(run).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		run.EventIndex++
+		updates := db.JobLease.Abandon()
+		updates["status"] = openai.RunObjectStatusQueued
+		updates["event_index"] = run.EventIndex
+		if err := tx.Model(run).Clauses(clause.Returning{}).Where("id = ?", run.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return db.Create(tx, &db.RunEvent{
+			EventName: string(openai.ThreadRunQueued),
+			JobResponse: db.JobResponse{
+				RequestID: run.ID,
+			},
+			Run:         datatypes.NewJSONType(run),
+			ResponseIdx: run.EventIndex,
+		})
+	})
+}
+
 // failRun will mark the run as failed. The caller should wrap this in a transaction.
 func failRun(gdb *gorm.DB, run *db.Run, err error, errorCode openai.RunObjectLastErrorCode) error {
 	runError := &db.RunLastError{
@@ -20,6 +20,7 @@ import (
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
 	kb "github.com/gptscript-ai/clicky-chats/pkg/knowledgebases"
 	"github.com/gptscript-ai/clicky-chats/pkg/tools"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
 	"github.com/gptscript-ai/gptscript/pkg/cache"
 	"github.com/gptscript-ai/gptscript/pkg/confirm"
@@ -31,6 +32,7 @@ import (
 	"github.com/gptscript-ai/gptscript/pkg/server"
 	"github.com/gptscript-ai/gptscript/pkg/types"
 	"github.com/gptscript-ai/gptscript/pkg/version"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -46,7 +48,13 @@ type Config struct {
 	PollingInterval         time.Duration
 	APIURL, APIKey, AgentID string
 	Cache, Confirm          bool
-	Trigger, RunTrigger     trigger.Trigger
+	DrainTimeout            time.Duration
+	Workers                 int
+	Lease                   db.Lease
+	// SkipBuiltInTools doesn't load the built-in gptscript tools, which are downloaded if they aren't stored yet.
+	SkipBuiltInTools    bool
+	Trigger, RunTrigger trigger.Trigger
+	Transport           http.RoundTripper
 }
 
 var inputModifiers = map[string]func(*agent, *db.RunStep, []string, string) ([]string, string, error){
@@ -70,9 +78,11 @@ func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, kbm *kb.Knowledg
 		return err
 	}
 
-	a.builtInToolDefinitions, err = populateTools(ctx, cfg.Logger, gdb.WithContext(ctx))
-	if err != nil {
-		return err
+	if !cfg.SkipBuiltInTools {
+		a.builtInToolDefinitions, err = populateTools(ctx, cfg.Logger, gdb.WithContext(ctx))
+		if err != nil {
+			return err
+		}
 	}
 
 	a.Start(ctx, wg)
@@ -85,6 +95,9 @@ type agent struct {
 	pollingInterval     time.Duration
 	id, apiKey, url     string
 	cache, confirm      bool
+	drainTimeout        time.Duration
+	workers             int
+	lease               db.Lease
 	client              *http.Client
 	db                  *db.DB
 	kbm                 *kb.KnowledgeBaseManager
@@ -97,6 +110,12 @@ func newAgent(db *db.DB, kbm *kb.KnowledgeBaseManager, cfg Config) (*agent, erro
 	if cfg.PollingInterval < minPollingInterval {
 		return nil, fmt.Errorf("polling interval must be at least %s", minPollingInterval)
 	}
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, err
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, err
+	}
 
 	if cfg.Trigger == nil {
 		cfg.Logger.Warn("[step runner] No trigger provided, using noop")
@@ -112,7 +131,10 @@ func newAgent(db *db.DB, kbm *kb.KnowledgeBaseManager, cfg Config) (*agent, erro
 		pollingInterval: cfg.PollingInterval,
 		cache:           cfg.Cache,
 		confirm:         cfg.Confirm,
-		client:          http.DefaultClient,
+		drainTimeout:    cfg.DrainTimeout,
+		workers:         cfg.Workers,
+		lease:           cfg.Lease,
+		client:          agents.NewHTTPClient(cfg.Transport),
 		apiKey:          cfg.APIKey,
 		db:              db,
 		kbm:             kbm,
@@ -140,47 +162,30 @@ func (a *agent) newOpts(caster *broadcaster.Broadcaster[server.Event]) *gptscrip
 }
 
 func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
-	// Start the "job runner"
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		timer := time.NewTimer(a.pollingInterval)
-		for {
-			a.run(ctx)
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
-			case <-a.trigger.Triggered():
-			}
-
-			if !timer.Stop() {
-				// Ensure the timer channel has been drained.
-				select {
-				case <-timer.C:
-				default:
-				}
-			}
-
-			timer.Reset(a.pollingInterval)
-		}
-	}()
+	// Start the "job runners"
+	agents.Pool{
+		Name:            "run_step",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}.Start(ctx, wg, a.logger, a.run)
 }
 
-func (a *agent) run(ctx context.Context) {
-	a.logger.Debug("Checking for a run")
+func (a *agent) run(ctx context.Context, l *slog.Logger) error {
+	l.Debug("Checking for a run")
 	// Look for a new run and claim it. Also, query for the other objects we need.
-	run, runStep := new(db.Run), new(db.RunStep)
+	var (
+		attempts     int
+		run, runStep = new(db.Run), new(db.RunStep)
+	)
 	if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		if err := tx.Model(run).Where("system_status = ?", string(openai.RunObjectStatusRequiresAction)).Where("system_claimed_by IS NULL OR system_claimed_by = ?", a.id).Order("created_at desc").First(run).Error; err != nil {
+		// A run can be claimed if it requires action, or if the agent processing it has stopped renewing its lease.
+		if err := tx.Model(run).
+			Where("system_status = ? OR (system_status = ? AND status = ?)", string(openai.RunObjectStatusRequiresAction), string(openai.RunObjectStatusInProgress), string(openai.RunObjectStatusInProgress)).
+			Scopes(db.SystemLease.Claimable(a.id)).
+			Order(db.QueueOrder).
+			First(run).Error; err != nil {
 			return err
 		}
 
@@ -204,39 +209,60 @@ func (a *agent) run(ctx context.Context) {
 			return err
 		}
 
-		updates := map[string]any{
-			"system_claimed_by": a.id,
-			"system_status":     string(openai.RunObjectStatusInProgress),
-			"event_index":       run.EventIndex,
-		}
-		return tx.Model(run).Clauses(clause.Returning{}).Where("id = ?", run.ID).Updates(updates).Error
+		attempts = run.SystemAttempts
+		updates := db.SystemLease.Claim(a.id, a.lease, attempts)
+		updates["system_status"] = string(openai.RunObjectStatusInProgress)
+		updates["event_index"] = run.EventIndex
+		return db.SystemLease.ClaimJob(tx.Model(run).Clauses(clause.Returning{}), run.ID, a.id, updates)
 	}); err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			a.logger.Error("failed to get run", "error", err)
+		if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, db.ErrAlreadyClaimed) {
+			return fmt.Errorf("failed to get run: %w", err)
 		}
-		return
+		return err
+	}
+
+	l = l.With("run_id", run.ID, "run_step_id", runStep.ID)
+	if attempts >= a.lease.MaxAttempts {
+		failRunStep(l, a.db.WithContext(ctx), run, runStep, fmt.Errorf("%w: run step was attempted %d times", db.ErrMaxAttemptsExceeded, attempts), openai.RunObjectLastErrorCodeServerError)
+		return nil
 	}
 
 	caster := broadcaster.New[server.Event]()
 	go caster.Start(ctx)
+	defer caster.Shutdown()
 
-	go func() {
-		defer caster.Shutdown()
-		if err := a.processRunStep(ctx, caster.Subscribe(), a.newOpts(caster), run, runStep); err != nil {
-			a.logger.Error("failed to process run step", "err", err)
-		}
-	}()
+	if err := a.processRunStep(ctx, l, caster.Subscribe(), a.newOpts(caster), run, runStep); err != nil {
+		l.Error("failed to process run step", "err", err)
+	}
+
+	return nil
 }
 
-func (a *agent) processRunStep(ctx context.Context, events *broadcaster.Subscription[server.Event], opts *gptscript.Options, run *db.Run, runStep *db.RunStep) (err error) {
+func (a *agent) processRunStep(ctx context.Context, l *slog.Logger, events *broadcaster.Subscription[server.Event], opts *gptscript.Options, run *db.Run, runStep *db.RunStep) (err error) {
+	ctx, span := tracing.Start(tracing.WithTraceParent(ctx, run.TraceParent), "process run step",
+		attribute.String("run.id", run.ID),
+		attribute.String("run_step.id", runStep.ID),
+	)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	timeoutCtx, cancel := context.WithTimeout(ctx, toolCallTimeout)
 	defer cancel()
 
 	go agents.PollForCancellation(timeoutCtx, cancel, a.db.WithContext(timeoutCtx), runStep, runStep.ID, a.pollingInterval)
 
-	l := a.logger.With("run_id", run.ID, "run_step_id", runStep.ID)
+	go agents.KeepLeaseAlive(timeoutCtx, cancel, l, a.db.WithContext(timeoutCtx), run, run.ID, a.id, a.lease, db.SystemLease)
 
 	defer func() {
+		if agents.Interrupted(ctx) {
+			cleanupCtx, cancel := agents.CleanupContext(ctx)
+			defer cancel()
+			if err := requeueRunStep(a.db.WithContext(cleanupCtx), run, a.id); err != nil {
+				l.Error("Failed to requeue interrupted run step", "err", err)
+			}
+			return
+		}
 		if err != nil && !errors.Is(err, context.Canceled) {
 			failRunStep(l, a.db.WithContext(ctx), run, runStep, err, openai.RunObjectLastErrorCodeServerError)
 		}
@@ -330,10 +356,11 @@ func (a *agent) processRunStep(ctx context.Context, events *broadcaster.Subscrip
 			return err
 		}
 
-		return tx.Model(run).Where("id = ?", run.ID).Updates(map[string]any{
-			"system_status": string(openai.RunObjectStatusQueued),
-			"event_index":   run.EventIndex,
-		}).Error
+		// Hand the run back to the run agent and release the claim on it.
+		updates := db.SystemLease.Release()
+		updates["system_status"] = string(openai.RunObjectStatusQueued)
+		updates["event_index"] = run.EventIndex
+		return tx.Model(run).Where("id = ?", run.ID).Updates(updates).Error
 	}); err != nil {
 		l.Error("Failed to update run step", "err", err)
 		return err
@@ -423,6 +450,19 @@ func failRunStep(l *slog.Logger, gdb *gorm.DB, run *db.Run, runStep *db.RunStep,
 	}
 }
 
+// requeueRunStep hands a run step that was interrupted because the agent is shutting down back to the queue, and gives
+// up the agent's claim on the run so that another step runner can pick it up. The step's tool calls are run again from
+// the start. Nothing is changed if the run step is no longer being processed by this agent.
+//
+// No event is emitted: from the client's point of view the step is still in progress, and the step runner that picks it
+// up emits the step's events as it runs the tool calls.
+func requeueRunStep(gdb *gorm.DB, run *db.Run, agentID string) error {
+	updates := db.SystemLease.Abandon()
+	updates["system_status"] = string(openai.RunObjectStatusRequiresAction)
+
+	return gdb.Model(run).Where("id = ?", run.ID).Where("system_claimed_by = ?", agentID).Where("system_status = ?", openai.RunObjectStatusInProgress).Updates(updates).Error
+}
+
 func extractToolCalls(runStepDetails *openai.RunStepObject_StepDetails) ([]openai.RunStepDetailsToolCallsObject_ToolCalls_Item, error) {
 	// Extract the tool call
 	details, err := db.ExtractRunStepDetails(*runStepDetails)
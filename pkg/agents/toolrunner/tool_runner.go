@@ -17,9 +17,11 @@ import (
 	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
 	gogptscript "github.com/gptscript-ai/go-gptscript"
 	"github.com/gptscript-ai/gptscript/pkg/server"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -34,7 +36,11 @@ type Config struct {
 	PollingInterval, RetentionPeriod time.Duration
 	APIURL, APIKey, AgentID          string
 	Cache, Confirm                   bool
+	DrainTimeout                     time.Duration
+	Workers                          int
+	Lease                            db.Lease
 	Trigger                          trigger.Trigger
+	Transport                        http.RoundTripper
 }
 
 func Start(ctx context.Context, wg *sync.WaitGroup, gdb *db.DB, cfg Config) error {
@@ -56,6 +62,9 @@ type agent struct {
 	pollingInterval, retentionPeriod time.Duration
 	id, apiKey, url                  string
 	cache, confirm                   bool
+	drainTimeout                     time.Duration
+	workers                          int
+	lease                            db.Lease
 	client                           *http.Client
 	db                               *db.DB
 	trigger                          trigger.Trigger
@@ -65,6 +74,12 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 	if cfg.PollingInterval < minPollingInterval {
 		return nil, fmt.Errorf("polling interval must be at least %s", minPollingInterval)
 	}
+	if err := agents.ValidateWorkers(cfg.Workers); err != nil {
+		return nil, err
+	}
+	if err := cfg.Lease.Validate(); err != nil {
+		return nil, err
+	}
 
 	if cfg.Trigger == nil {
 		cfg.Logger.Warn("No trigger provided, using noop")
@@ -77,7 +92,10 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 		retentionPeriod: cfg.RetentionPeriod,
 		cache:           cfg.Cache,
 		confirm:         cfg.Confirm,
-		client:          http.DefaultClient,
+		drainTimeout:    cfg.DrainTimeout,
+		workers:         cfg.Workers,
+		lease:           cfg.Lease,
+		client:          agents.NewHTTPClient(cfg.Transport),
 		apiKey:          cfg.APIKey,
 		db:              db,
 		id:              cfg.AgentID,
@@ -87,136 +105,119 @@ func newAgent(db *db.DB, cfg Config) (*agent, error) {
 }
 
 func (a *agent) Start(ctx context.Context, wg *sync.WaitGroup) {
-	// Start the "job runner"
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		timer := time.NewTimer(a.pollingInterval)
-		for {
-			a.run(ctx)
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
-			case <-a.trigger.Triggered():
-			}
+	// Start the "job runners"
+	agents.Pool{
+		Name:            "tool_run",
+		Workers:         a.workers,
+		PollingInterval: a.pollingInterval,
+		DrainTimeout:    a.drainTimeout,
+		Trigger:         a.trigger,
+	}.Start(ctx, wg, a.logger, a.run)
 
-			if !timer.Stop() {
-				// Ensure the timer channel has been drained.
-				select {
-				case <-timer.C:
-				default:
-				}
+	// Start cleanup
+	agents.RunPeriodically(ctx, wg, a.retentionPeriod/2, func(ctx context.Context) {
+		a.logger.Debug("Looking for completed tool runs")
+		var runToolObjects []db.RunToolObject
+		if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(new(db.RunToolObject)).Where("done = true").Find(&runToolObjects).Error; err != nil {
+				return err
+			}
+			if len(runToolObjects) == 0 {
+				return nil
 			}
 
-			timer.Reset(a.pollingInterval)
-		}
-	}()
-
-	// Start cleanup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		cleanupInterval := a.retentionPeriod / 2
-		timer := time.NewTimer(cleanupInterval)
-
-		for {
-			a.logger.Debug("Looking for completed tool runs")
-			var runToolObjects []db.RunToolObject
-			if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-				if err := tx.Model(new(db.RunToolObject)).Where("done = true").Find(&runToolObjects).Error; err != nil {
-					return err
-				}
-				if len(runToolObjects) == 0 {
-					return nil
-				}
-
-				requestIDs := make([]string, 0, len(runToolObjects))
-				for _, rt := range runToolObjects {
-					requestIDs = append(requestIDs, rt.ID)
-				}
-
-				if err := tx.Delete(new(db.RunStepEvent), "request_id IN ?", requestIDs).Error; err != nil {
-					return err
-				}
-
-				return tx.Delete(runToolObjects).Error
-			}); err != nil {
-				a.logger.Error("Failed to cleanup chat completions", "err", err)
+			requestIDs := make([]string, 0, len(runToolObjects))
+			for _, rt := range runToolObjects {
+				requestIDs = append(requestIDs, rt.ID)
 			}
 
-			select {
-			case <-ctx.Done():
-				// Ensure the timer channel is drained
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
-					}
-				}
-				return
-			case <-timer.C:
+			if err := tx.Delete(new(db.RunStepEvent), "request_id IN ?", requestIDs).Error; err != nil {
+				return err
 			}
 
-			timer.Reset(cleanupInterval)
+			return tx.Delete(runToolObjects).Error
+		}); err != nil {
+			a.logger.Error("Failed to cleanup chat completions", "err", err)
 		}
-	}()
+	})
 }
 
-func (a *agent) run(ctx context.Context) {
-	a.logger.Debug("Checking for a tool to run")
-	// Look for a new run tool and claim it.
-	runToolObject := new(db.RunToolObject)
+func (a *agent) run(ctx context.Context, l *slog.Logger) error {
+	l.Debug("Checking for a tool to run")
+	// Look for a new run tool, or one whose lease has lapsed, and claim it.
+	var (
+		attempts      int
+		runToolObject = new(db.RunToolObject)
+	)
 	if err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		if err := tx.Model(runToolObject).Where("status = ?", "queued").Where("claimed_by IS NULL OR claimed_by = ?", a.id).Order("created_at desc").First(runToolObject).Error; err != nil {
+		if err := tx.Model(runToolObject).
+			Where("done = false").
+			Where("status IN ?", []string{string(openai.RunObjectStatusQueued), string(openai.RunObjectStatusInProgress)}).
+			Scopes(db.JobLease.Claimable(a.id)).
+			Order(db.QueueOrder).
+			First(runToolObject).Error; err != nil {
 			return err
 		}
 
-		updates := map[string]any{
-			"claimed_by": a.id,
-			"status":     string(openai.RunObjectStatusInProgress),
-		}
-		return tx.Model(runToolObject).Clauses(clause.Returning{}).Where("id = ?", runToolObject.ID).Updates(updates).Error
+		attempts = runToolObject.Attempts
+		updates := db.JobLease.Claim(a.id, a.lease, attempts)
+		updates["status"] = string(openai.RunObjectStatusInProgress)
+		return db.JobLease.ClaimJob(tx.Model(runToolObject).Clauses(clause.Returning{}), runToolObject.ID, a.id, updates)
 	}); err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			a.logger.Error("failed to get run", "error", err)
+		if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, db.ErrAlreadyClaimed) {
+			return fmt.Errorf("failed to get run tool: %w", err)
 		}
-		return
+		return err
+	}
+
+	l = l.With("run_tool_id", runToolObject.ID)
+	if attempts >= a.lease.MaxAttempts {
+		a.failToolRun(l, a.db.WithContext(ctx), runToolObject, fmt.Errorf("%w: tool run was attempted %d times", db.ErrMaxAttemptsExceeded, attempts))
+		return nil
+	}
+	if attempts > 0 {
+		// The tool has already been run and has streamed events, so running it again would duplicate its output.
+		a.failToolRun(l, a.db.WithContext(ctx), runToolObject, fmt.Errorf("tool run was interrupted"))
+		return nil
 	}
 
 	caster := broadcaster.New[server.Event]()
 	go caster.Start(ctx)
+	defer caster.Shutdown()
 
-	go func() {
-		defer caster.Shutdown()
-		if err := a.processToolRun(ctx, runToolObject); err != nil {
-			a.logger.Error("failed to process tool run", "err", err)
-		}
-	}()
+	if err := a.processToolRun(ctx, l, runToolObject); err != nil {
+		l.Error("failed to process tool run", "err", err)
+	}
+	if agents.Interrupted(ctx) {
+		// Running the tool again would duplicate the output that has already been streamed, so fail it instead.
+		cleanupCtx, cancel := agents.CleanupContext(ctx)
+		defer cancel()
+		a.failToolRun(l, a.db.WithContext(cleanupCtx), runToolObject, agents.ErrDrainTimeout)
+	}
+
+	return nil
 }
 
-func (a *agent) processToolRun(ctx context.Context, runToolObject *db.RunToolObject) error {
-	var err error
+func (a *agent) processToolRun(ctx context.Context, l *slog.Logger, runToolObject *db.RunToolObject) (err error) {
+	ctx, span := tracing.Start(tracing.WithTraceParent(ctx, runToolObject.TraceParent), "process tool run", attribute.String("run_tool.id", runToolObject.ID))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	timeoutCtx, cancel := context.WithTimeout(ctx, toolCallTimeout)
 	defer cancel()
 
-	l := a.logger.With("run_tool_id", runToolObject.ID)
 	gdb := a.db.WithContext(ctx)
+
+	go agents.KeepLeaseAlive(timeoutCtx, cancel, l, gdb, runToolObject, runToolObject.ID, a.id, a.lease, db.JobLease)
+
 	runToolObject.Output, err = runTool(timeoutCtx, l, gdb, runToolObject)
 	if err != nil {
 		return fmt.Errorf("failed to run tool: %w", err)
 	}
 
-	// Update the run tool with the output
-	if err = gdb.Model(runToolObject).Where("id = ?", runToolObject.ID).Updates(
+	// Update the run tool with the output, unless another agent has taken it over.
+	if err = gdb.Model(runToolObject).Where("id = ?", runToolObject.ID).Where("claimed_by = ?", a.id).Updates(
 		map[string]any{
 			"output": runToolObject.Output,
 			"status": string(openai.RunObjectStatusCompleted),
@@ -230,6 +231,31 @@ func (a *agent) processToolRun(ctx context.Context, runToolObject *db.RunToolObj
 	return nil
 }
 
+// failToolRun stores a final event with the error and marks the tool run as failed.
+func (a *agent) failToolRun(l *slog.Logger, gdb *gorm.DB, runToolObject *db.RunToolObject, cause error) {
+	l.Error("Failing tool run", "err", cause)
+	if err := gdb.Transaction(func(tx *gorm.DB) error {
+		index, err := db.NextResponseIndex(tx, new(db.RunStepEvent), runToolObject.ID)
+		if err != nil {
+			return err
+		}
+
+		if err = db.FailJob(tx, runToolObject, &db.RunStepEvent{ResponseIdx: index}, cause); err != nil {
+			return err
+		}
+
+		return tx.Model(runToolObject).Where("id = ?", runToolObject.ID).Updates(map[string]any{
+			"output": cause.Error(),
+			"status": string(openai.RunObjectStatusFailed),
+		}).Error
+	}); err != nil {
+		l.Error("Failed to fail tool run", "err", err)
+		return
+	}
+
+	a.trigger.Ready(runToolObject.ID)
+}
+
 func runTool(ctx context.Context, l *slog.Logger, gdb *gorm.DB, runToolObject *db.RunToolObject) (string, error) {
 	stdOut, stdErr, events, wait := gogptscript.StreamExecFileWithEvents(ctx, runToolObject.File, runToolObject.Input, gogptscript.Opts{
 		DisableCache: runToolObject.DisableCache,
@@ -6,15 +6,20 @@ import (
 	"fmt"
 	"log/slog"
 	"os/exec"
+	"strconv"
 	"time"
 
 	"github.com/acorn-io/broadcaster"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 	"github.com/gptscript-ai/gptscript/pkg/gptscript"
 	"github.com/gptscript-ai/gptscript/pkg/runner"
 	"github.com/gptscript-ai/gptscript/pkg/server"
 	"github.com/gptscript-ai/gptscript/pkg/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"gorm.io/gorm"
 )
 
@@ -68,14 +73,30 @@ func RunTool(ctx context.Context, l *slog.Logger, events *broadcaster.Subscripti
 		l.Debug("done receiving events")
 	}()
 
+	ctx, span := tracing.Start(ctx, "run tool "+prg.ToolSet[prg.EntryToolID].Name,
+		attribute.String("run.id", runID),
+		attribute.String("run_step.id", runStepID),
+	)
+	defer span.End()
+
+	start := time.Now()
 	output, err := runToolCall(server.ContextWithNewID(ctx), opts, prg, envs, arguments)
-	if errors.Is(err, context.DeadlineExceeded) {
+	exitCode, execErr := "0", new(exec.ExitError)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		exitCode = "timeout"
 		output = "The tool call took too long to complete, aborting"
-	} else if execErr := new(exec.ExitError); errors.As(err, &execErr) {
+	case errors.As(err, &execErr):
+		exitCode = strconv.Itoa(execErr.ExitCode())
 		output = fmt.Sprintf("The tool call returned an exit code of %d with message %q, aborting", execErr.ExitCode(), execErr.String())
-	} else if err != nil {
+	case err != nil:
+		metrics.ToolCallDuration.WithLabelValues("error").Observe(metrics.Since(start))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return "", err
 	}
+	metrics.ToolCallDuration.WithLabelValues(exitCode).Observe(metrics.Since(start))
+	span.SetAttributes(attribute.String("tool.exit_code", exitCode))
 
 	return output, nil
 }
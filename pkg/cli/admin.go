@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/acorn-io/cmd"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+func newAdmin() *cobra.Command {
+	return cmd.Command(new(Admin), new(AdminQueues), &AdminJob{action: "requeue"}, &AdminJob{action: "cancel"}, &AdminJob{action: "purge"})
+}
+
+type Admin struct{}
+
+func (a *Admin) Customize(cmd *cobra.Command) {
+	cmd.Short = "Inspect and manage the job queues of a running server"
+}
+
+func (a *Admin) Run(cmd *cobra.Command, _ []string) error {
+	return cmd.Help()
+}
+
+// AdminAPI is the server that admin commands are sent to.
+type AdminAPI struct {
+	URL   string `usage:"Server URL including the API base" default:"http://localhost:8080/v1" env:"CLICKY_CHATS_ADMIN_URL"`
+	Token string `usage:"Admin token of the server" env:"CLICKY_CHATS_ADMIN_TOKEN"`
+}
+
+func (a AdminAPI) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, body)
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+type AdminQueues struct {
+	AdminAPI
+}
+
+func (a *AdminQueues) Customize(cmd *cobra.Command) {
+	cmd.Use = "queues"
+	cmd.Short = "Show the pending, claimed, and done jobs of each queue"
+	cmd.Args = cobra.NoArgs
+}
+
+func (a *AdminQueues) Run(cmd *cobra.Command, _ []string) error {
+	var queues struct {
+		Data []db.QueueStats `json:"data"`
+	}
+	if err := a.do(cmd.Context(), http.MethodGet, "/x/admin/queues", &queues); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "QUEUE\tPENDING\tCLAIMED\tDONE\tOLDEST PENDING\tCLAIMS")
+	for _, q := range queues.Data {
+		oldest := "-"
+		if q.OldestPendingAge != nil {
+			oldest = (time.Duration(*q.OldestPendingAge) * time.Second).String()
+		}
+
+		claims := make([]string, 0, len(q.ClaimsByAgent))
+		for agentID, count := range q.ClaimsByAgent {
+			claims = append(claims, fmt.Sprintf("%s=%d", agentID, count))
+		}
+		sort.Strings(claims)
+
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", q.Name, q.Pending, q.Claimed, q.Done, oldest, strings.Join(claims, ","))
+	}
+
+	return w.Flush()
+}
+
+var adminActionsDone = map[string]string{
+	"requeue": "Requeued",
+	"cancel":  "Cancelled",
+	"purge":   "Purged",
+}
+
+// AdminJob applies an admin action to a single job.
+type AdminJob struct {
+	AdminAPI
+
+	action string
+}
+
+func (a *AdminJob) Customize(cmd *cobra.Command) {
+	cmd.Use = a.action + " QUEUE JOB_ID"
+	cmd.Args = cobra.ExactArgs(2)
+	switch a.action {
+	case "requeue":
+		cmd.Short = "Release the claim on a job and reset its attempts so that any agent can claim it"
+	case "cancel":
+		cmd.Short = "Cancel a job that hasn't finished"
+	case "purge":
+		cmd.Short = "Delete a job and everything produced for it"
+	}
+	cmd.Long = fmt.Sprintf("%s\n\nQUEUE is one of: %s", cmd.Short, strings.Join(db.QueueNames(), ", "))
+}
+
+func (a *AdminJob) Run(cmd *cobra.Command, args []string) error {
+	method, path := http.MethodPost, fmt.Sprintf("/x/admin/queues/%s/jobs/%s/%s", args[0], args[1], a.action)
+	if a.action == "purge" {
+		method, path = http.MethodDelete, fmt.Sprintf("/x/admin/queues/%s/jobs/%s", args[0], args[1])
+	}
+
+	var job server.AdminJob
+	if err := a.do(cmd.Context(), method, path, &job); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s job %s\n", adminActionsDone[job.Action], job.Queue, job.ID)
+	return nil
+}
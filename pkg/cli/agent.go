@@ -2,12 +2,16 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
 	"github.com/gptscript-ai/clicky-chats/pkg/agents/audio"
 	"github.com/gptscript-ai/clicky-chats/pkg/agents/chatcompletion"
 	"github.com/gptscript-ai/clicky-chats/pkg/agents/embeddings"
@@ -16,8 +20,14 @@ import (
 	"github.com/gptscript-ai/clicky-chats/pkg/agents/steprunner"
 	"github.com/gptscript-ai/clicky-chats/pkg/agents/toolrunner"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/httpclient"
 	kb "github.com/gptscript-ai/clicky-chats/pkg/knowledgebases"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers/fake"
 	"github.com/gptscript-ai/clicky-chats/pkg/server"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
+	"github.com/gptscript-ai/clicky-chats/pkg/vcr"
 	"github.com/spf13/cobra"
 )
 
@@ -26,36 +36,103 @@ type Agent struct {
 
 	DSN string `usage:"Server datastore" default:"sqlite://clicky-chats.db" env:"CLICKY_CHATS_DSN"`
 
+	MetricsAddress string `usage:"Address to serve metrics on when running the agents without the server, empty to disable" default:":9090" env:"CLICKY_CHATS_METRICS_ADDRESS"`
+
 	RetentionPeriod          string `usage:"Chat completion retention period" default:"5m" env:"CLICKY_CHATS_RETENTION_PERIOD"`
 	PollingInterval          string `usage:"Chat completion polling interval" default:"1s" env:"CLICKY_CHATS_POLLING_INTERVAL"`
+	LeaseDuration            string `usage:"How long a claim on a job lasts without a heartbeat before another agent can reclaim it" default:"1m" env:"CLICKY_CHATS_LEASE_DURATION"`
+	MaxAttempts              int    `usage:"Number of times a job is claimed before it is failed" default:"3" env:"CLICKY_CHATS_MAX_ATTEMPTS"`
+	DrainTimeout             string `usage:"How long in-flight jobs are given to finish on shutdown" default:"30s" env:"CLICKY_CHATS_DRAIN_TIMEOUT"`
 	DefaultChatCompletionURL string `usage:"The default URL for the chat completion agent to use" default:"https://api.openai.com/v1/chat/completions" env:"CLICKY_CHATS_CHAT_COMPLETION_SERVER_URL"`
 	ModelsURL                string `usage:"The url for the to get the available models" default:"https://api.openai.com/v1/models" env:"CLICKY_CHATS_CHAT_COMPLETION_SERVER_URL"`
+	ModelRoutes              string `usage:"YAML or JSON file that routes models to upstream providers, overrides the default chat completion and models URLs and adds image, audio and embeddings providers" env:"CLICKY_CHATS_MODEL_ROUTES"`
+	UpstreamMaxAttempts      int    `usage:"Number of times a failed chat completion request is attempted for a model before falling back to the next model" default:"3" env:"CLICKY_CHATS_UPSTREAM_MAX_ATTEMPTS"`
+	UpstreamRetryDelay       string `usage:"Delay before the first retry of a failed chat completion request, which doubles for each retry" default:"1s" env:"CLICKY_CHATS_UPSTREAM_RETRY_DELAY"`
+	UpstreamMaxRetryDelay    string `usage:"Maximum delay between retries of a failed chat completion request, including delays requested with Retry-After" default:"30s" env:"CLICKY_CHATS_UPSTREAM_MAX_RETRY_DELAY"`
+
+	ChatCompletionCacheTTL        string            `usage:"How long identical chat completion requests made with the same API key are answered from a cache, disabled if empty" env:"CLICKY_CHATS_CHAT_COMPLETION_CACHE_TTL"`
+	ChatCompletionCacheModelTTLs  map[string]string `usage:"Chat completion cache TTLs for models or model patterns (model=TTL), 0 disables the cache for them" env:"CLICKY_CHATS_CHAT_COMPLETION_CACHE_MODEL_TTLS"`
+	ChatCompletionCacheAPIKeyTTLs map[string]string `usage:"Chat completion cache TTLs for requests made with an API key (key=TTL), overrides the model TTLs" env:"CLICKY_CHATS_CHAT_COMPLETION_CACHE_API_KEY_TTLS"`
+	ChatCompletionCacheMaxEntries int               `usage:"Maximum number of cached chat completion responses" default:"1000" env:"CLICKY_CHATS_CHAT_COMPLETION_CACHE_MAX_ENTRIES"`
+	ChatCompletionCacheMaxBytes   int               `usage:"Maximum total size of the cached chat completion responses in bytes, 0 for no limit" default:"67108864" env:"CLICKY_CHATS_CHAT_COMPLETION_CACHE_MAX_BYTES"`
+	ChatCompletionCompactAfter    string            `usage:"How long after a streamed chat completion is done that its chunks are compacted into a single response, 0 disables compaction" default:"1m" env:"CLICKY_CHATS_CHAT_COMPLETION_COMPACT_AFTER"`
+
+	FakeUpstream         bool   `usage:"Serve upstream requests from a built-in fake provider, for development and tests without network access or an API key" default:"false" env:"CLICKY_CHATS_FAKE_UPSTREAM"`
+	FakeUpstreamFixtures string `usage:"YAML or JSON file with the fake provider's models and scripted chat completions, enables the fake provider" env:"CLICKY_CHATS_FAKE_UPSTREAM_FIXTURES"`
+
+	CassetteMode string `usage:"Record the upstream requests of the agents, and their responses, in the cassette, or replay them from it: record or replay" env:"CLICKY_CHATS_CASSETTE_MODE"`
+	Cassette     string `usage:"Directory that upstream requests are recorded in, or replayed from" default:"cassettes" env:"CLICKY_CHATS_CASSETTE"`
+
+	ClientProxy            string `usage:"Proxy URL for the requests of the agents and the knowledge base manager, defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables" env:"CLICKY_CHATS_CLIENT_PROXY"`
+	ClientCAFile           string `usage:"PEM file with certificate authorities to trust in addition to the system's" env:"CLICKY_CHATS_CLIENT_CA_FILE"`
+	ClientCert             string `usage:"PEM file with the client certificate to present to servers that request one" env:"CLICKY_CHATS_CLIENT_CERT"`
+	ClientKey              string `usage:"PEM file with the key of the client certificate" env:"CLICKY_CHATS_CLIENT_KEY"`
+	ClientDialTimeout      string `usage:"How long requests wait to connect" default:"30s" env:"CLICKY_CHATS_CLIENT_DIAL_TIMEOUT"`
+	ClientHandshakeTimeout string `usage:"How long requests wait for the TLS handshake" default:"10s" env:"CLICKY_CHATS_CLIENT_HANDSHAKE_TIMEOUT"`
+	ClientResponseTimeout  string `usage:"How long requests wait for the response headers, no limit if empty" env:"CLICKY_CHATS_CLIENT_RESPONSE_TIMEOUT"`
 
 	ToolRunnerBaseURL string `usage:"Tool runner base URL" default:"http://localhost:8080/v1" env:"CLICKY_CHATS_TOOL_RUNNER_BASE_URL"`
+	SkipBuiltInTools  bool   `usage:"Don't load the built-in gptscript tools, which are downloaded if they aren't stored yet, so that the agents can start without network access" default:"false" env:"CLICKY_CHATS_SKIP_BUILT_IN_TOOLS"`
 
 	DefaultImagesURL string `usage:"The default base URL for the image agent to use" default:"https://api.openai.com/v1/images" env:"CLICKY_CHATS_IMAGES_SERVER_URL"`
+	StoreImages      bool   `usage:"Store generated images as files, and respond with links to download them from the server" default:"false" env:"CLICKY_CHATS_STORE_IMAGES"`
+	ImageFilesURL    string `usage:"Server URL including the API base, that links to stored images point to" default:"http://localhost:8080/v1" env:"CLICKY_CHATS_IMAGE_FILES_URL"`
 
 	DefaultEmbeddingsURL string `usage:"The defaultURL for the embedding agent to use" default:"https://api.openai.com/v1/embeddings" env:"CLICKY_CHATS_EMBEDDINGS_SERVER_URL"`
 
+	EmbeddingsBatchSize        int    `usage:"Maximum number of inputs sent to the embeddings provider in one request" default:"2048" env:"CLICKY_CHATS_EMBEDDINGS_BATCH_SIZE"`
+	EmbeddingsBatchConcurrency int    `usage:"Number of batches of an embeddings request sent to the provider at once" default:"4" env:"CLICKY_CHATS_EMBEDDINGS_BATCH_CONCURRENCY"`
+	EmbeddingsCacheTTL         string `usage:"How long the embeddings of identical inputs are answered from a cache, disabled if empty" env:"CLICKY_CHATS_EMBEDDINGS_CACHE_TTL"`
+	EmbeddingsCacheMaxEntries  int    `usage:"Maximum number of cached embeddings" default:"10000" env:"CLICKY_CHATS_EMBEDDINGS_CACHE_MAX_ENTRIES"`
+
+	LocalEmbeddingsModel      string `usage:"Name of the local embeddings model, which computes deterministic embeddings without a provider, disabled if empty" env:"CLICKY_CHATS_LOCAL_EMBEDDINGS_MODEL"`
+	LocalEmbeddingsDimensions int    `usage:"Length of the local embeddings model's embeddings, for requests that don't set dimensions" default:"256" env:"CLICKY_CHATS_LOCAL_EMBEDDINGS_DIMENSIONS"`
+	LocalEmbeddingsNGram      int    `usage:"Length of the character n-grams that the local embeddings model hashes, or 0 to hash words" default:"0" env:"CLICKY_CHATS_LOCAL_EMBEDDINGS_NGRAM"`
+
 	DefaultAudioURL string `usage:"The default URL for the translation agent to use" default:"https://api.openai.com/v1/audio" env:"CLICKY_CHATS_AUDIO_SERVER_URL"`
 
 	APIURL      string `usage:"URL for API calls" default:"http://localhost:8080/v1/chat/completions" env:"CLICKY_CHATS_SERVER_URL"`
 	ModelAPIKey string `usage:"API key for API calls" env:"CLICKY_CHATS_MODEL_API_KEY"`
 	AgentID     string `usage:"Agent ID to identify this agent" default:"my-agent" env:"CLICKY_CHATS_AGENT_ID"`
 
+	EmulateToolCalls string `usage:"Comma-separated models, or patterns, that don't support tools natively, for which runs describe tools in the prompt and parse tool calls out of the response" env:"CLICKY_CHATS_EMULATE_TOOL_CALLS"`
+
 	Cache   bool `usage:"Enable the cache for Function calling" default:"true" env:"CLICKY_CHATS_CACHE"`
 	Confirm bool `usage:"Enable the confirmation for Function calling" default:"false" env:"CLICKY_CHATS_CONFIRM"`
+
+	ChatCompletionWorkers int `usage:"Number of chat completion requests to process concurrently" default:"4" env:"CLICKY_CHATS_CHAT_COMPLETION_WORKERS"`
+	RunWorkers            int `usage:"Number of runs to process concurrently" default:"4" env:"CLICKY_CHATS_RUN_WORKERS"`
+	RunStepWorkers        int `usage:"Number of run steps to process concurrently" default:"4" env:"CLICKY_CHATS_RUN_STEP_WORKERS"`
+	ToolRunWorkers        int `usage:"Number of tool runs to process concurrently" default:"4" env:"CLICKY_CHATS_TOOL_RUN_WORKERS"`
+	EmbeddingsWorkers     int `usage:"Number of embeddings requests to process concurrently" default:"2" env:"CLICKY_CHATS_EMBEDDINGS_WORKERS"`
+	ImageWorkers          int `usage:"Number of image requests of each type to process concurrently" default:"2" env:"CLICKY_CHATS_IMAGE_WORKERS"`
+	AudioWorkers          int `usage:"Number of audio requests of each type to process concurrently" default:"2" env:"CLICKY_CHATS_AUDIO_WORKERS"`
 }
 
 func (s *Agent) Run(cmd *cobra.Command, _ []string) error {
+	shutdownTracing, err := setupTracing(cmd.Context(), "clicky-chats-agent")
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing()
+
 	gormDB, err := db.New(s.DSN, false)
 	if err != nil {
 		return err
 	}
 
+	if err = gormDB.CheckSchemaVersion(cmd.Context()); err != nil {
+		return err
+	}
+
+	clients, err := s.httpClients()
+	if err != nil {
+		return err
+	}
+
 	var kbm *kb.KnowledgeBaseManager
 	if s.Config.KnowledgeRetrievalAPIURL != "" {
-		kbm, err = kb.NewKnowledgeBaseManager(cmd.Context(), s.Config, gormDB)
+		kbm, err = kb.NewKnowledgeBaseManager(cmd.Context(), s.Config, gormDB, clients.Transport())
 		if err != nil {
 			return err
 		}
@@ -64,15 +141,58 @@ func (s *Agent) Run(cmd *cobra.Command, _ []string) error {
 	}
 
 	wg := new(sync.WaitGroup)
-	if err = runAgents(cmd.Context(), wg, gormDB, kbm, s, new(server.Triggers)); err != nil {
+	if err = runAgents(cmd.Context(), wg, gormDB, kbm, clients, s, new(server.Triggers)); err != nil {
 		return err
 	}
 
+	if s.MetricsAddress != "" {
+		// Keep serving metrics while the agents drain.
+		metricsServer := serveMetrics(s.MetricsAddress, gormDB)
+		defer metricsServer.Close()
+	}
+
 	wg.Wait()
 	return nil
 }
 
-func runAgents(ctx context.Context, wg *sync.WaitGroup, gormDB *db.DB, kbm *kb.KnowledgeBaseManager, s *Agent, triggers *server.Triggers) error {
+// serveMetrics serves the metrics of agents that run without the server, which serves them otherwise.
+func serveMetrics(addr string, gormDB *db.DB) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", gormDB.Check)
+	mux.Handle("GET /metrics", metrics.Handler(gormDB))
+	metricsServer := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		slog.Info("Serving metrics", "addr", addr)
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "err", err)
+		}
+	}()
+
+	return metricsServer
+}
+
+// setupTracing exports traces if an OTLP endpoint is configured. The returned function flushes the spans that haven't
+// been exported yet.
+func setupTracing(ctx context.Context, serviceName string) (func(), error) {
+	shutdown, err := tracing.Setup(ctx, serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Error("Failed to flush traces", "err", err)
+		}
+	}, nil
+}
+
+func runAgents(ctx context.Context, wg *sync.WaitGroup, gormDB *db.DB, kbm *kb.KnowledgeBaseManager, clients *httpclient.Factory, s *Agent, triggers *server.Triggers) error {
 	retentionPeriod, err := time.ParseDuration(s.RetentionPeriod)
 	if err != nil {
 		return fmt.Errorf("failed to parse chat completion retention period: %w", err)
@@ -81,73 +201,211 @@ func runAgents(ctx context.Context, wg *sync.WaitGroup, gormDB *db.DB, kbm *kb.K
 	if err != nil {
 		return fmt.Errorf("failed to parse chat completion polling interval: %w", err)
 	}
+	leaseDuration, err := time.ParseDuration(s.LeaseDuration)
+	if err != nil {
+		return fmt.Errorf("failed to parse lease duration: %w", err)
+	}
+	drainTimeout, err := time.ParseDuration(s.DrainTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to parse drain timeout: %w", err)
+	}
+	lease := db.Lease{
+		Duration:    leaseDuration,
+		MaxAttempts: s.MaxAttempts,
+	}
+	retryDelay, err := time.ParseDuration(s.UpstreamRetryDelay)
+	if err != nil {
+		return fmt.Errorf("failed to parse upstream retry delay: %w", err)
+	}
+	maxRetryDelay, err := time.ParseDuration(s.UpstreamMaxRetryDelay)
+	if err != nil {
+		return fmt.Errorf("failed to parse upstream max retry delay: %w", err)
+	}
+	retryPolicy := agents.RetryPolicy{
+		MaxAttempts: s.UpstreamMaxAttempts,
+		BaseDelay:   retryDelay,
+		MaxDelay:    maxRetryDelay,
+	}
+
+	cacheConfig, err := s.chatCompletionCacheConfig()
+	if err != nil {
+		return err
+	}
+	compactAfter, err := time.ParseDuration(s.ChatCompletionCompactAfter)
+	if err != nil {
+		return fmt.Errorf("failed to parse chat completion compact after: %w", err)
+	}
+	var embeddingsCacheTTL time.Duration
+	if s.EmbeddingsCacheTTL != "" {
+		if embeddingsCacheTTL, err = time.ParseDuration(s.EmbeddingsCacheTTL); err != nil {
+			return fmt.Errorf("failed to parse embeddings cache TTL: %w", err)
+		}
+	}
 
 	apiKey := s.ModelAPIKey
 	if apiKey == "" {
 		apiKey = os.Getenv("OPENAI_API_KEY")
 	}
 
+	if s.FakeUpstream || s.FakeUpstreamFixtures != "" {
+		fakeUpstream, err := startFakeUpstream(s.FakeUpstreamFixtures)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// Keep serving until the agents have drained.
+			go func() {
+				wg.Wait()
+				_ = fakeUpstream.Close()
+			}()
+		}()
+
+		s = s.withUpstream(fakeUpstream.URL)
+	}
+
+	upstreamClients := clients
+	if s.CassetteMode != "" {
+		cassette, err := vcr.NewTransport(vcr.Mode(s.CassetteMode), s.Cassette, nil)
+		if err != nil {
+			return err
+		}
+		upstreamClients = clients.Wrap(cassette.Wrap)
+		slog.Info("Using a cassette for upstream requests", "mode", s.CassetteMode, "cassette", s.Cassette)
+	}
+
+	routes := &providers.Config{Providers: []providers.Provider{{
+		Name:      "openai",
+		BaseURL:   strings.TrimSuffix(s.DefaultChatCompletionURL, "/chat/completions"),
+		ModelsURL: s.ModelsURL,
+		APIKey:    apiKey,
+	}}}
+	if s.ModelRoutes != "" {
+		if routes, err = providers.LoadConfig(s.ModelRoutes); err != nil {
+			return err
+		}
+	}
+	for _, p := range routes.Providers {
+		if !p.HTTP.IsZero() {
+			slog.Info("Overriding HTTP client settings for provider", "provider", p.Name, "http", p.HTTP)
+		}
+	}
+
 	triggers.Complete()
 
 	ccCfg := chatcompletion.Config{
-		APIKey:            apiKey,
-		ModelsURL:         s.ModelsURL,
-		ChatCompletionURL: s.DefaultChatCompletionURL,
-		PollingInterval:   pollingInterval,
-		RetentionPeriod:   retentionPeriod,
-		AgentID:           s.AgentID,
-		Trigger:           triggers.ChatCompletion,
+		Providers:          routes.Providers,
+		AssistantFallbacks: routes.AssistantFallbacks(),
+		RetryPolicy:        retryPolicy,
+		Cache:              cacheConfig,
+		CompactAfter:       compactAfter,
+		PollingInterval:    pollingInterval,
+		RetentionPeriod:    retentionPeriod,
+		AgentID:            s.AgentID,
+		Workers:            s.ChatCompletionWorkers,
+		Lease:              lease,
+		DrainTimeout:       drainTimeout,
+		Trigger:            triggers.ChatCompletion,
+		HTTPClients:        upstreamClients,
 	}
 	if err := chatcompletion.Start(ctx, wg, gormDB, ccCfg); err != nil {
 		return err
 	}
 
 	runCfg := run.Config{
-		PollingInterval: pollingInterval,
-		RetentionPeriod: retentionPeriod,
-		APIURL:          s.APIURL,
-		APIKey:          apiKey,
-		AgentID:         s.AgentID,
-		Trigger:         triggers.Run,
-		RunStepTrigger:  triggers.RunStep,
+		PollingInterval:  pollingInterval,
+		RetentionPeriod:  retentionPeriod,
+		APIURL:           s.APIURL,
+		APIKey:           apiKey,
+		AgentID:          s.AgentID,
+		Workers:          s.RunWorkers,
+		EmulateToolCalls: splitList(s.EmulateToolCalls),
+		SkipBuiltInTools: s.SkipBuiltInTools,
+		Lease:            lease,
+		DrainTimeout:     drainTimeout,
+		Trigger:          triggers.Run,
+		RunStepTrigger:   triggers.RunStep,
+		Transport:        clients.Transport(),
 	}
 	if err = run.Start(ctx, wg, gormDB, runCfg); err != nil {
 		return err
 	}
 
 	stepRunnerCfg := steprunner.Config{
-		PollingInterval: pollingInterval,
-		APIURL:          s.ToolRunnerBaseURL,
-		APIKey:          apiKey,
-		AgentID:         s.AgentID,
-		Cache:           s.Cache,
-		Confirm:         s.Confirm,
-		Trigger:         triggers.RunStep,
-		RunTrigger:      triggers.Run,
+		PollingInterval:  pollingInterval,
+		APIURL:           s.ToolRunnerBaseURL,
+		APIKey:           apiKey,
+		AgentID:          s.AgentID,
+		Workers:          s.RunStepWorkers,
+		Lease:            lease,
+		DrainTimeout:     drainTimeout,
+		Cache:            s.Cache,
+		Confirm:          s.Confirm,
+		SkipBuiltInTools: s.SkipBuiltInTools,
+		Trigger:          triggers.RunStep,
+		RunTrigger:       triggers.Run,
+		Transport:        clients.Transport(),
 	}
 	if err = steprunner.Start(ctx, wg, gormDB, kbm, stepRunnerCfg); err != nil {
 		return err
 	}
 
+	// The image, audio and embeddings providers of the routes are registered next to the default OpenAI ones.
+	upstreamClient := agents.NewHTTPClient(upstreamClients.Transport())
+	imageProviders, err := routes.ImageProviders(providers.NewOpenAIImages(s.DefaultImagesURL, apiKey, upstreamClient), upstreamClient)
+	if err != nil {
+		return err
+	}
+	audioProviders, err := routes.AudioProviders(providers.NewOpenAIAudio(s.DefaultAudioURL, apiKey, upstreamClient), upstreamClient)
+	if err != nil {
+		return err
+	}
+	embeddingsProviders, err := routes.EmbeddingsProviders(providers.NewOpenAIEmbeddings(s.DefaultEmbeddingsURL, apiKey, upstreamClient), upstreamClient)
+	if err != nil {
+		return err
+	}
+
 	imageCfg := image.Config{
 		PollingInterval: pollingInterval,
 		RetentionPeriod: retentionPeriod,
 		ImagesBaseURL:   s.DefaultImagesURL,
 		APIKey:          apiKey,
 		AgentID:         s.AgentID,
+		Workers:         s.ImageWorkers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
 		Trigger:         triggers.Image,
+		Transport:       upstreamClients.Transport(),
+		Providers:       imageProviders,
+		StoreImages:     s.StoreImages,
+		FilesBaseURL:    s.ImageFilesURL,
 	}
 	if err = image.Start(ctx, wg, gormDB, imageCfg); err != nil {
 		return err
 	}
 
 	embedCfg := embeddings.Config{
-		APIKey:          apiKey,
-		EmbeddingsURL:   s.DefaultEmbeddingsURL,
-		PollingInterval: pollingInterval,
-		RetentionPeriod: retentionPeriod,
-		AgentID:         s.AgentID,
-		Trigger:         triggers.Embeddings,
+		APIKey:           apiKey,
+		EmbeddingsURL:    s.DefaultEmbeddingsURL,
+		PollingInterval:  pollingInterval,
+		RetentionPeriod:  retentionPeriod,
+		AgentID:          s.AgentID,
+		Workers:          s.EmbeddingsWorkers,
+		Lease:            lease,
+		DrainTimeout:     drainTimeout,
+		Trigger:          triggers.Embeddings,
+		Transport:        upstreamClients.Transport(),
+		Providers:        embeddingsProviders,
+		BatchSize:        s.EmbeddingsBatchSize,
+		BatchConcurrency: s.EmbeddingsBatchConcurrency,
+		Cache: embeddings.CacheConfig{
+			TTL:        embeddingsCacheTTL,
+			MaxEntries: s.EmbeddingsCacheMaxEntries,
+		},
+		Local: embeddings.LocalConfig{
+			Model:      s.LocalEmbeddingsModel,
+			Dimensions: s.LocalEmbeddingsDimensions,
+			NGram:      s.LocalEmbeddingsNGram,
+		},
 	}
 	if err = embeddings.Start(ctx, wg, gormDB, embedCfg); err != nil {
 		return err
@@ -159,7 +417,12 @@ func runAgents(ctx context.Context, wg *sync.WaitGroup, gormDB *db.DB, kbm *kb.K
 		AudioBaseURL:    s.DefaultAudioURL,
 		APIKey:          apiKey,
 		AgentID:         s.AgentID,
+		Workers:         s.AudioWorkers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
 		Trigger:         triggers.Audio,
+		Transport:       upstreamClients.Transport(),
+		Providers:       audioProviders,
 	}
 	if err = audio.Start(ctx, wg, gormDB, audioCfg); err != nil {
 		return err
@@ -171,9 +434,13 @@ func runAgents(ctx context.Context, wg *sync.WaitGroup, gormDB *db.DB, kbm *kb.K
 		APIURL:          s.ToolRunnerBaseURL,
 		APIKey:          apiKey,
 		AgentID:         s.AgentID,
+		Workers:         s.ToolRunWorkers,
+		Lease:           lease,
+		DrainTimeout:    drainTimeout,
 		Cache:           s.Cache,
 		Confirm:         s.Confirm,
 		Trigger:         triggers.RunTool,
+		Transport:       clients.Transport(),
 	}
 	if err = toolrunner.Start(ctx, wg, gormDB, toolRunnerCfg); err != nil {
 		return err
@@ -181,3 +448,110 @@ func runAgents(ctx context.Context, wg *sync.WaitGroup, gormDB *db.DB, kbm *kb.K
 
 	return nil
 }
+
+// httpClients returns the factory of the transports that the agents and the knowledge base manager send requests with,
+// and logs its settings.
+func (s *Agent) httpClients() (*httpclient.Factory, error) {
+	cfg := httpclient.Config{
+		Proxy:                 s.ClientProxy,
+		CAFile:                s.ClientCAFile,
+		CertFile:              s.ClientCert,
+		KeyFile:               s.ClientKey,
+		DialTimeout:           s.ClientDialTimeout,
+		TLSHandshakeTimeout:   s.ClientHandshakeTimeout,
+		ResponseHeaderTimeout: s.ClientResponseTimeout,
+	}
+
+	clients, err := httpclient.NewFactory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure HTTP clients: %w", err)
+	}
+	slog.Info("HTTP client settings", "http", cfg)
+
+	return clients, nil
+}
+
+// chatCompletionCacheConfig returns the configuration of the chat completion cache.
+func (s *Agent) chatCompletionCacheConfig() (chatcompletion.CacheConfig, error) {
+	cfg := chatcompletion.CacheConfig{
+		MaxEntries: s.ChatCompletionCacheMaxEntries,
+		MaxBytes:   s.ChatCompletionCacheMaxBytes,
+	}
+
+	var err error
+	if s.ChatCompletionCacheTTL != "" {
+		if cfg.TTL, err = time.ParseDuration(s.ChatCompletionCacheTTL); err != nil {
+			return cfg, fmt.Errorf("failed to parse chat completion cache TTL: %w", err)
+		}
+	}
+	if cfg.ModelTTLs, err = parseDurations(s.ChatCompletionCacheModelTTLs); err != nil {
+		return cfg, fmt.Errorf("failed to parse chat completion cache model TTLs: %w", err)
+	}
+	if cfg.APIKeyTTLs, err = parseDurations(s.ChatCompletionCacheAPIKeyTTLs); err != nil {
+		return cfg, fmt.Errorf("failed to parse chat completion cache API key TTLs: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func parseDurations(durations map[string]string) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration, len(durations))
+	for k, v := range durations {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		parsed[k] = d
+	}
+
+	return parsed, nil
+}
+
+// startFakeUpstream starts the fake provider with the fixtures file, if there is one.
+func startFakeUpstream(fixturesFile string) (*fake.Server, error) {
+	fixtures := new(fake.Fixtures)
+	if fixturesFile != "" {
+		var err error
+		if fixtures, err = fake.LoadFixtures(fixturesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	server, err := fake.NewServer(fixtures)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Serving upstream requests from the fake provider", "url", server.URL, "fixtures", fixturesFile)
+	return server, nil
+}
+
+// withUpstream returns a copy of the agent configuration that sends every upstream request to the base URL, ignoring
+// the model routes.
+func (s *Agent) withUpstream(baseURL string) *Agent {
+	if s.ModelRoutes != "" {
+		slog.Warn("Ignoring the model routes because upstream requests are sent to the fake provider", "routes", s.ModelRoutes)
+	}
+
+	upstream := *s
+	upstream.ModelRoutes = ""
+	upstream.DefaultChatCompletionURL = baseURL + "/chat/completions"
+	upstream.ModelsURL = baseURL + "/models"
+	upstream.DefaultImagesURL = baseURL + "/images"
+	upstream.DefaultEmbeddingsURL = baseURL + "/embeddings"
+	upstream.DefaultAudioURL = baseURL + "/audio"
+
+	return &upstream
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
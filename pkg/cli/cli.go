@@ -6,7 +6,7 @@ import (
 )
 
 func New() *cobra.Command {
-	return cmd.Command(&ClickyChats{}, new(Server), new(Agent))
+	return cmd.Command(&ClickyChats{}, new(Server), new(Agent), new(Migrate), newAdmin())
 }
 
 type ClickyChats struct{}
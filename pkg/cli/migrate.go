@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/spf13/cobra"
+)
+
+type Migrate struct {
+	DSN   string `usage:"Server datastore" default:"sqlite://clicky-chats.db" env:"CLICKY_CHATS_DSN"`
+	Steps int    `usage:"Number of migrations to apply or revert, 0 means all for up and one for down" default:"0" env:"CLICKY_CHATS_MIGRATE_STEPS"`
+}
+
+func (m *Migrate) Customize(cmd *cobra.Command) {
+	cmd.Use = "migrate up|down|status"
+	cmd.Short = "Manage the database schema"
+	cmd.Args = cobra.ExactArgs(1)
+	cmd.ValidArgs = []string{"up", "down", "status"}
+}
+
+func (m *Migrate) Run(cmd *cobra.Command, args []string) error {
+	gormDB, err := db.New(m.DSN, false)
+	if err != nil {
+		return err
+	}
+	defer gormDB.Close()
+
+	switch args[0] {
+	case "up":
+		count, err := gormDB.MigrateUp(cmd.Context(), m.Steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s), latest version is %d\n", count, db.LatestSchemaVersion())
+	case "down":
+		steps := m.Steps
+		if steps <= 0 {
+			steps = 1
+		}
+		count, err := gormDB.MigrateDown(cmd.Context(), steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %d migration(s)\n", count)
+	case "status":
+		statuses, err := gormDB.MigrationStatus(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = time.Unix(int64(*s.AppliedAt), 0).Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", strconv.Itoa(s.Version), s.Name, appliedAt)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+
+		if err = gormDB.CheckSchemaVersion(cmd.Context()); err != nil {
+			fmt.Println(err)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected one of up, down, or status", args[0])
+	}
+
+	return nil
+}
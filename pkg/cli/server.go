@@ -1,10 +1,14 @@
 package cli
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	kb "github.com/gptscript-ai/clicky-chats/pkg/knowledgebases"
@@ -16,25 +20,55 @@ import (
 type Server struct {
 	Agent
 
-	AutoMigrate string `usage:"Auto migrate" default:"true" env:"CLICKY_CHATS_AUTO_MIGRATE"`
+	AutoMigrate string `usage:"Apply pending schema migrations on startup" default:"true" env:"CLICKY_CHATS_AUTO_MIGRATE"`
 
 	ServerURL     string `usage:"Server URL" default:"http://localhost" env:"CLICKY_CHATS_SERVER_URL"`
 	ServerPort    string `usage:"Server port" default:"8080" env:"CLICKY_CHATS_SERVER_PORT"`
 	ServerAPIBase string `usage:"Server API base" default:"/v1" env:"CLICKY_CHATS_SERVER_API_BASE"`
 
 	WithAgents bool `usage:"Run the server and agents" default:"false" env:"CLICKY_CHATS_WITH_AGENTS"`
+
+	AdminToken string `usage:"Bearer token required by the admin API, which is disabled if unset" env:"CLICKY_CHATS_ADMIN_TOKEN"`
+
+	APIKeyPriorities    map[string]string `usage:"Queue priorities for jobs created with an API key (key=priority)" env:"CLICKY_CHATS_API_KEY_PRIORITIES"`
+	AssistantPriorities map[string]string `usage:"Queue priorities for runs of an assistant (assistant ID=priority), overrides the API key priority" env:"CLICKY_CHATS_ASSISTANT_PRIORITIES"`
 }
 
 func (s *Server) Run(cmd *cobra.Command, _ []string) error {
+	apiKeyPriorities, err := parsePriorities(s.APIKeyPriorities)
+	if err != nil {
+		return fmt.Errorf("failed to parse API key priorities: %w", err)
+	}
+	assistantPriorities, err := parsePriorities(s.AssistantPriorities)
+	if err != nil {
+		return fmt.Errorf("failed to parse assistant priorities: %w", err)
+	}
+
+	drainTimeout, err := time.ParseDuration(s.DrainTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to parse drain timeout: %w", err)
+	}
+
+	shutdownTracing, err := setupTracing(cmd.Context(), "clicky-chats")
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing()
+
 	wg := new(sync.WaitGroup)
 	gormDB, err := db.New(s.DSN, s.AutoMigrate == "true")
 	if err != nil {
 		return err
 	}
 
+	clients, err := s.httpClients()
+	if err != nil {
+		return err
+	}
+
 	var kbManager *kb.KnowledgeBaseManager
 	if s.Config.KnowledgeRetrievalAPIURL != "" {
-		kbManager, err = kb.NewKnowledgeBaseManager(cmd.Context(), s.Config, gormDB)
+		kbManager, err = kb.NewKnowledgeBaseManager(cmd.Context(), s.Config, gormDB, clients.Transport())
 		if err != nil {
 			return err
 		}
@@ -56,21 +90,50 @@ func (s *Server) Run(cmd *cobra.Command, _ []string) error {
 
 	ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	defer cancel()
-	if err = server.NewServer(gormDB, kbManager).Start(ctx, wg, server.Config{
+	serverCtx, cancelServer := ctx, cancel
+	if s.WithAgents {
+		// The tool runner calls back into the server, so keep serving until the agents have drained.
+		serverCtx, cancelServer = context.WithCancel(context.WithoutCancel(ctx))
+		defer cancelServer()
+	}
+
+	if err = server.NewServer(gormDB, kbManager).Start(serverCtx, wg, server.Config{
 		ServerURL: s.ServerURL,
 		Port:      s.ServerPort,
 		APIBase:   s.ServerAPIBase,
 		Triggers:  triggers,
+		Priorities: server.Priorities{
+			APIKeys:    apiKeyPriorities,
+			Assistants: assistantPriorities,
+		},
+		ShutdownTimeout: drainTimeout,
+		AdminToken:      s.AdminToken,
 	}); err != nil {
 		return err
 	}
 
 	if s.WithAgents {
-		if err = runAgents(cmd.Context(), wg, gormDB, kbManager, &s.Agent, triggers); err != nil {
+		agentsWG := new(sync.WaitGroup)
+		if err = runAgents(cmd.Context(), agentsWG, gormDB, kbManager, clients, &s.Agent, triggers); err != nil {
 			return err
 		}
+		agentsWG.Wait()
+		cancelServer()
 	}
 
 	wg.Wait()
 	return nil
 }
+
+func parsePriorities(priorities map[string]string) (map[string]int, error) {
+	parsed := make(map[string]int, len(priorities))
+	for k, v := range priorities {
+		priority, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority %q: %w", v, err)
+		}
+		parsed[k] = priority
+	}
+
+	return parsed, nil
+}
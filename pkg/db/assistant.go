@@ -127,7 +127,7 @@ func assistantToolToChatCompletionTool(t *openai.AssistantObject_Tools_Item, gpt
 		if function == nil {
 			function = tools[ob.XTool]
 			if function == nil {
-				return openai.ChatCompletionTool{}, fmt.Errorf("tool %s not found", t)
+				return openai.ChatCompletionTool{}, fmt.Errorf("tool %s not found", ob.XTool)
 			}
 		}
 
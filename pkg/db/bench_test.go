@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/gorm"
+)
+
+const (
+	benchRequests         = 2000
+	benchChunksPerRequest = 50
+)
+
+// seedHotTables fills the tables that are queried on hot paths with enough rows that a missing index is noticeable.
+func seedHotTables(tb testing.TB, gdb *DB) {
+	tb.Helper()
+	tx := gdb.WithContext(context.Background())
+
+	requests := make([]CreateChatCompletionRequest, 0, benchRequests)
+	chunks := make([]ChatCompletionResponseChunk, 0, benchRequests*benchChunksPerRequest)
+	events := make([]RunEvent, 0, benchRequests*benchChunksPerRequest)
+	runs := make([]Run, 0, benchRequests)
+	for i := 0; i < benchRequests; i++ {
+		request := CreateChatCompletionRequest{
+			JobRequest: JobRequest{
+				Base: Base{ID: fmt.Sprintf("chatcmpl-%d", i), CreatedAt: i},
+				Done: true,
+			},
+		}
+		// Leave a few requests unclaimed so that there is something to dequeue.
+		if i%100 != 0 {
+			request.ClaimedBy = z.Pointer("bench-agent")
+		}
+		requests = append(requests, request)
+
+		status := string(openai.RunObjectStatusCompleted)
+		if i%100 == 0 {
+			status = string(openai.RunObjectStatusQueued)
+		}
+		runs = append(runs, Run{
+			Metadata: Metadata{Base: Base{ID: fmt.Sprintf("run_%d", i), CreatedAt: i}},
+			ThreadID: fmt.Sprintf("thread_%d", i),
+			Status:   status,
+		})
+
+		for j := 0; j < benchChunksPerRequest; j++ {
+			chunks = append(chunks, ChatCompletionResponseChunk{
+				Base:        Base{ID: fmt.Sprintf("chatcmpl-%d-%d", i, j), CreatedAt: i},
+				JobResponse: JobResponse{RequestID: request.ID, Done: j == benchChunksPerRequest-1},
+				ResponseIdx: j,
+			})
+			events = append(events, RunEvent{
+				Base:        Base{ID: fmt.Sprintf("run-event_%d-%d", i, j), CreatedAt: i},
+				JobResponse: JobResponse{RequestID: fmt.Sprintf("run_%d", i), Done: j == benchChunksPerRequest-1},
+				ResponseIdx: j,
+			})
+		}
+	}
+
+	if err := tx.Transaction(func(tx *gorm.DB) error {
+		for _, objs := range []any{requests, runs, chunks, events} {
+			if err := tx.CreateInBatches(objs, 500).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		tb.Fatalf("failed to seed database: %v", err)
+	}
+}
+
+func newMigratedDB(tb testing.TB) *DB {
+	tb.Helper()
+	gdb := newTestDB(tb, true)
+	if err := gdb.EnsureSchema(context.Background()); err != nil {
+		tb.Fatalf("failed to migrate database: %v", err)
+	}
+
+	return gdb
+}
+
+func newBenchDB(tb testing.TB) *DB {
+	tb.Helper()
+	gdb := newMigratedDB(tb)
+	seedHotTables(tb, gdb)
+	return gdb
+}
+
+func TestHotQueriesUseIndexes(t *testing.T) {
+	gdb := newMigratedDB(t)
+
+	tests := []struct {
+		name, query, index string
+		args               []any
+	}{
+		{
+			name:  "stream chunks",
+			query: "SELECT * FROM chat_completion_response_chunks WHERE request_id = ? AND response_idx >= ? ORDER BY response_idx asc LIMIT 1",
+			args:  []any{"chatcmpl-10", 5},
+			index: "idx_chat_completion_response_chunks_request",
+		},
+		{
+			name:  "stream run events",
+			query: "SELECT * FROM run_events WHERE request_id = ? AND response_idx >= ? ORDER BY response_idx asc LIMIT 1",
+			args:  []any{"run_10", 5},
+			index: "idx_run_events_request",
+		},
+		{
+			name:  "dequeue",
+			query: "SELECT * FROM create_chat_completion_requests WHERE claimed_by IS NULL OR (claimed_by = ? AND done = false)",
+			args:  []any{"bench-agent"},
+			index: "idx_create_chat_completion_requests_claim",
+		},
+		{
+			name:  "claim run",
+			query: "SELECT * FROM runs WHERE status = ? AND claimed_by IS NULL",
+			args:  []any{string(openai.RunObjectStatusQueued)},
+			index: "idx_runs_claim",
+		},
+		{
+			name:  "run steps",
+			query: "SELECT * FROM run_steps WHERE run_id = ? AND status = ? AND type = ?",
+			args:  []any{"run_10", string(openai.RunObjectStatusInProgress), string(openai.RunStepDetailsToolCallsObjectTypeToolCalls)},
+			index: "idx_run_steps_run_status_type",
+		},
+		{
+			name:  "thread messages",
+			query: "SELECT * FROM messages WHERE thread_id = ? AND created_at <= ? ORDER BY created_at asc",
+			args:  []any{"thread_10", 10},
+			index: "idx_messages_thread_id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var plan []struct {
+				Detail string
+			}
+			if err := gdb.WithContext(context.Background()).Raw("EXPLAIN QUERY PLAN "+tt.query, tt.args...).Scan(&plan).Error; err != nil {
+				t.Fatalf("failed to explain query: %v", err)
+			}
+
+			details := make([]string, 0, len(plan))
+			for _, p := range plan {
+				details = append(details, p.Detail)
+			}
+			if !strings.Contains(strings.Join(details, "\n"), tt.index) {
+				t.Errorf("query plan does not use index %s:\n%s", tt.index, strings.Join(details, "\n"))
+			}
+		})
+	}
+}
+
+func BenchmarkDequeue(b *testing.B) {
+	gdb := newBenchDB(b)
+	tx := gdb.WithContext(context.Background())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Use a fresh agent ID each iteration so that the same unclaimed request isn't reclaimed.
+		if err := Dequeue(tx, new(CreateChatCompletionRequest), fmt.Sprintf("agent-%d", i), Lease{Duration: time.Minute, MaxAttempts: 3}); err != nil {
+			b.StopTimer()
+			if err = tx.Model(new(CreateChatCompletionRequest)).Where("claimed_by LIKE ?", "agent-%").Updates(JobLease.Release()).Error; err != nil {
+				b.Fatalf("failed to reset claims: %v", err)
+			}
+			b.StartTimer()
+		}
+	}
+}
+
+func BenchmarkChunkLookup(b *testing.B) {
+	gdb := newBenchDB(b)
+	tx := gdb.WithContext(context.Background())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chunk := new(ChatCompletionResponseChunk)
+		if err := tx.Model(chunk).Where("request_id = ?", fmt.Sprintf("chatcmpl-%d", i%benchRequests)).Where("response_idx >= ?", i%benchChunksPerRequest).Order("response_idx asc").First(chunk).Error; err != nil {
+			b.Fatalf("failed to get chunk: %v", err)
+		}
+	}
+}
@@ -13,7 +13,8 @@ type ChatCompletionResponseChunk struct {
 	SystemFingerprint *string                          `json:"system_fingerprint,omitempty"`
 	// Not part of the public API
 	JobResponse `json:",inline"`
-	ResponseIdx int `json:"response_idx"`
+	ResponseIdx int  `json:"response_idx" gorm:"index:,composite:request,priority:2"`
+	CacheHit    bool `json:"cache_hit"`
 }
 
 func (c *ChatCompletionResponseChunk) IDPrefix() string {
@@ -28,6 +29,11 @@ func (c *ChatCompletionResponseChunk) GetEvent() string {
 	return ""
 }
 
+// IsCacheHit returns true if the chunk was served from the chat completion cache.
+func (c *ChatCompletionResponseChunk) IsCacheHit() bool {
+	return c.CacheHit
+}
+
 func (c *ChatCompletionResponseChunk) ToPublic() any {
 	//nolint:govet
 	return &openai.CreateChatCompletionStreamResponse{
@@ -57,6 +63,7 @@ func (c *ChatCompletionResponseChunk) FromPublic(obj any) error {
 			o.SystemFingerprint,
 			JobResponse{},
 			0,
+			false,
 		}
 	}
 
@@ -0,0 +1,24 @@
+package db
+
+// ChatCompletionRetry records the decision to retry a failed chat completion request, or to fall back to another
+// model. The run agent records the retries of a run's chat completion request in the run's events.
+type ChatCompletionRetry struct {
+	Base      `json:",inline"`
+	RequestID string `json:"request_id" gorm:"index"`
+	// RetryIdx orders the retries of the request.
+	RetryIdx int    `json:"retry_idx"`
+	Model    string `json:"model"`
+	// FallbackModel is set if the next attempt is for a fallback model instead of a retry.
+	FallbackModel string `json:"fallback_model,omitempty"`
+	// Attempt is the number of attempts that have been made for the model.
+	Attempt int `json:"attempt"`
+	// Delay is how long until the request is retried, in milliseconds.
+	Delay int `json:"delay"`
+	// Error is the error of the last attempt, and StatusCode its status code, or 0 if the provider didn't respond.
+	Error      string `json:"error"`
+	StatusCode int    `json:"status_code"`
+}
+
+func (*ChatCompletionRetry) IDPrefix() string {
+	return "ccretry-"
+}
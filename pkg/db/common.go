@@ -3,6 +3,7 @@ package db
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"net/http"
 
 	"github.com/acorn-io/z"
@@ -26,7 +27,7 @@ type Storer interface {
 
 type Base struct {
 	ID        string `json:"id" gorm:"primarykey"`
-	CreatedAt int    `json:"created_at,omitempty"`
+	CreatedAt int    `json:"created_at,omitempty" gorm:"index"`
 }
 
 func (b *Base) SetID(id string) {
@@ -50,18 +51,44 @@ type Metadata struct {
 	Metadata datatypes.JSONMap `json:"metadata,omitempty"`
 }
 
+// QueueOrder is the order in which agents claim jobs: higher priority jobs first, then oldest first.
+const QueueOrder = "priority desc, created_at asc"
+
 type JobRequest struct {
-	Base      `json:",inline"`
-	ClaimedBy *string `json:"claimed_by,omitempty"`
-	Done      bool    `json:"done"`
+	Base           `json:",inline"`
+	ClaimedBy      *string `json:"claimed_by,omitempty" gorm:"index:,composite:claim,priority:1"`
+	Done           bool    `json:"done" gorm:"index:,composite:claim,priority:2"`
+	LeaseExpiresAt *int    `json:"lease_expires_at,omitempty"`
+	Attempts       int     `json:"attempts,omitempty"`
+	Priority       int     `json:"priority,omitempty"`
+	TraceParent    string  `json:"trace_parent,omitempty"`
+	// CancelReason is set when a request that an agent is processing is cancelled. The agent stops processing it and
+	// fails it with the error for the reason, so that nothing is stored for it after the failed response.
+	CancelReason string `json:"cancel_reason,omitempty"`
 }
 
 func (j JobRequest) IsDone() bool {
 	return j.Done
 }
 
+func (j JobRequest) GetAttempts() int {
+	return j.Attempts
+}
+
+func (j JobRequest) GetCancelReason() string {
+	return j.CancelReason
+}
+
+func (j JobRequest) GetTraceParent() string {
+	return j.TraceParent
+}
+
+func (j *JobRequest) SetTraceParent(traceParent string) {
+	j.TraceParent = traceParent
+}
+
 type JobResponse struct {
-	RequestID  string  `json:"request_id"`
+	RequestID  string  `json:"request_id" gorm:"index:,composite:request,priority:1"`
 	Error      *string `json:"error"`
 	StatusCode int     `json:"status_code"`
 	Done       bool    `json:"done"`
@@ -87,6 +114,20 @@ func (j JobResponse) GetRequestID() string {
 	return j.RequestID
 }
 
+// Fail sets the response to be the final, failed response for the request with the given ID. The status code is taken
+// from the error if it has one.
+func (j *JobResponse) Fail(requestID string, err error) {
+	j.RequestID = requestID
+	j.Error = z.Pointer(err.Error())
+	j.StatusCode = http.StatusInternalServerError
+	j.Done = true
+
+	var coded interface{ GetStatusCode() int }
+	if errors.As(err, &coded) {
+		j.StatusCode = coded.GetStatusCode()
+	}
+}
+
 func IsTerminal(status string) bool {
 	switch status {
 	case string(openai.RunObjectStatusCompleted), string(openai.RunObjectStatusFailed), string(openai.RunObjectStatusCancelled), string(openai.RunObjectStatusExpired):
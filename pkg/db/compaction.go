@@ -0,0 +1,313 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/datatypes"
+	gdb "gorm.io/gorm"
+)
+
+// CreateChunks creates the chunks in one statement, setting their IDs and CreatedAt fields like Create.
+func CreateChunks(db *gdb.DB, chunks []ChatCompletionResponseChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	now := int(time.Now().Unix())
+	for i := range chunks {
+		SetNewID(&chunks[i])
+		chunks[i].SetCreatedAt(now)
+	}
+
+	return db.Create(&chunks).Error
+}
+
+// errCompactedConcurrently rolls back the compaction of a stream that another agent compacted first.
+var errCompactedConcurrently = errors.New("stream was compacted concurrently")
+
+// CompactableStreams returns the IDs of at most limit streamed chat completions that were done before the given time
+// and whose chunks haven't been compacted.
+func CompactableStreams(db *gdb.DB, before time.Time, limit int) ([]string, error) {
+	var ids []string
+	return ids, db.Model(new(ChatCompletionResponseChunk)).
+		Distinct("request_id").
+		Where("done = false").
+		Where("request_id IN (?)", db.Model(new(ChatCompletionResponseChunk)).Select("request_id").Where("done = true AND created_at <= ?", int(before.Unix()))).
+		Limit(limit).
+		Pluck("request_id", &ids).Error
+}
+
+// CompactStream replaces the chunks of a streamed chat completion that is done with a single response, keeping the
+// final chunk that marks the stream done. Readers that find the gap before the final chunk replay the stream from the
+// response with CreateChatCompletionResponse.ChunksAfter. Nothing is done if the stream was compacted concurrently.
+func CompactStream(db *gdb.DB, requestID string) error {
+	err := db.Transaction(func(tx *gdb.DB) error {
+		var chunks []ChatCompletionResponseChunk
+		if err := tx.Where("request_id = ? AND done = false", requestID).Order("response_idx asc").Find(&chunks).Error; err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			return nil
+		}
+
+		result := tx.Delete(new(ChatCompletionResponseChunk), "request_id = ? AND done = false", requestID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(chunks)) {
+			return errCompactedConcurrently
+		}
+
+		response := CompactChunks(chunks)
+		response.RequestID = requestID
+		return Create(tx, response)
+	})
+	if errors.Is(err, errCompactedConcurrently) {
+		return nil
+	}
+	return err
+}
+
+// CompactChunks merges the chunks of a streamed chat completion into a response. The content and tool call arguments
+// of each choice are concatenated, and the error of the stream, if it failed, is kept.
+func CompactChunks(chunks []ChatCompletionResponseChunk) *CreateChatCompletionResponse {
+	response := &CreateChatCompletionResponse{
+		JobResponse: JobResponse{Done: true},
+	}
+
+	var (
+		messages []openai.ChatCompletionResponseMessage
+		choices  []Choice
+	)
+	for _, chunk := range chunks {
+		if chunk.Error != nil {
+			response.Error = chunk.Error
+			response.StatusCode = chunk.StatusCode
+			continue
+		}
+
+		if response.Model == "" {
+			response.Model = chunk.Model
+		}
+		if response.SystemFingerprint == nil {
+			response.SystemFingerprint = chunk.SystemFingerprint
+		}
+		response.CacheHit = response.CacheHit || chunk.CacheHit
+
+		for _, chunkChoice := range chunk.Choices {
+			messages = expandSlice(messages, chunkChoice.Index)
+			choices = expandSlice(choices, chunkChoice.Index)
+
+			choice := &choices[chunkChoice.Index]
+			choice.Index = chunkChoice.Index
+			if chunkChoice.FinishReason != "" {
+				choice.FinishReason = chunkChoice.FinishReason
+			}
+			if content := chunkChoice.Logprobs.Data().Content; len(content) > 0 {
+				choice.Logprobs = datatypes.NewJSONType(Lobprob{Content: append(choice.Logprobs.Data().Content, content...)})
+			}
+
+			mergeDelta(&messages[chunkChoice.Index], chunkChoice.Delta.Data())
+		}
+	}
+
+	for i := range choices {
+		if messages[i].Role == "" {
+			messages[i].Role = openai.ChatCompletionResponseMessageRoleAssistant
+		}
+		choices[i].Message = datatypes.NewJSONType(messages[i])
+	}
+	response.Choices = choices
+
+	return response
+}
+
+func mergeDelta(message *openai.ChatCompletionResponseMessage, delta openai.ChatCompletionStreamResponseDelta) {
+	if delta.Role != nil {
+		message.Role = openai.ChatCompletionResponseMessageRole(*delta.Role)
+	}
+	if delta.Content != nil {
+		message.Content = z.Pointer(z.Dereference(message.Content) + *delta.Content)
+	}
+
+	if fc := delta.FunctionCall; fc != nil {
+		if message.FunctionCall == nil {
+			message.FunctionCall = new(struct {
+				Arguments string `json:"arguments"`
+				Name      string `json:"name"`
+			})
+		}
+		message.FunctionCall.Name += z.Dereference(fc.Name)
+		message.FunctionCall.Arguments += z.Dereference(fc.Arguments)
+	}
+
+	if delta.ToolCalls == nil {
+		return
+	}
+	if message.ToolCalls == nil {
+		message.ToolCalls = new(openai.ChatCompletionMessageToolCalls)
+	}
+	for _, chunkTC := range *delta.ToolCalls {
+		*message.ToolCalls = expandSlice(*message.ToolCalls, chunkTC.Index)
+		tc := &(*message.ToolCalls)[chunkTC.Index]
+
+		if id := z.Dereference(chunkTC.Id); id != "" {
+			tc.Id = id
+		}
+		if chunkTC.Type != nil {
+			tc.Type = openai.ChatCompletionMessageToolCallType(*chunkTC.Type)
+		}
+		if chunkTC.Function != nil {
+			tc.Function.Name += z.Dereference(chunkTC.Function.Name)
+			tc.Function.Arguments += z.Dereference(chunkTC.Function.Arguments)
+		}
+	}
+}
+
+// ChunksAfter returns the chunks that stream the rest of the compacted response of a streamed chat completion to a
+// reader that has already streamed the given chunks of it: one chunk with the rest of the message of every choice that
+// isn't finished, followed by a chunk with the error, if the stream failed. The chunks don't include the final chunk
+// that marks the stream done.
+func (c *CreateChatCompletionResponse) ChunksAfter(streamed []ChatCompletionResponseChunk) []ChatCompletionResponseChunk {
+	read := CompactChunks(streamed)
+	chunk := ChatCompletionResponseChunk{
+		Base:              c.Base,
+		Model:             c.Model,
+		SystemFingerprint: c.SystemFingerprint,
+		JobResponse:       JobResponse{RequestID: c.RequestID},
+		CacheHit:          c.CacheHit,
+	}
+	for _, choice := range c.Choices {
+		if choice.Index >= len(read.Choices) {
+			chunk.Choices = append(chunk.Choices, ChunkChoice{
+				FinishReason: choice.FinishReason,
+				Index:        choice.Index,
+				Logprobs:     choice.Logprobs,
+				Delta:        datatypes.NewJSONType(messageDelta(choice.Message.Data())),
+			})
+			continue
+		}
+
+		readChoice := read.Choices[choice.Index]
+		if readChoice.FinishReason != "" {
+			continue
+		}
+
+		remaining := ChunkChoice{
+			FinishReason: choice.FinishReason,
+			Index:        choice.Index,
+			Delta:        datatypes.NewJSONType(remainingDelta(choice.Message.Data(), readChoice.Message.Data())),
+		}
+		if content := choice.Logprobs.Data().Content; len(content) > len(readChoice.Logprobs.Data().Content) {
+			remaining.Logprobs = datatypes.NewJSONType(Lobprob{Content: content[len(readChoice.Logprobs.Data().Content):]})
+		}
+		chunk.Choices = append(chunk.Choices, remaining)
+	}
+
+	var chunks []ChatCompletionResponseChunk
+	if len(chunk.Choices) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	if c.Error != nil && read.Error == nil {
+		chunks = append(chunks, ChatCompletionResponseChunk{
+			Base:        c.Base,
+			JobResponse: JobResponse{RequestID: c.RequestID, Error: c.Error, StatusCode: c.StatusCode},
+			ResponseIdx: len(chunks),
+			CacheHit:    c.CacheHit,
+		})
+	}
+
+	return chunks
+}
+
+func messageDelta(message openai.ChatCompletionResponseMessage) openai.ChatCompletionStreamResponseDelta {
+	delta := openai.ChatCompletionStreamResponseDelta{
+		Content: message.Content,
+		Role:    z.Pointer(openai.ChatCompletionStreamResponseDeltaRole(message.Role)),
+	}
+	if fc := message.FunctionCall; fc != nil {
+		delta.FunctionCall = &struct {
+			Arguments *string `json:"arguments,omitempty"`
+			Name      *string `json:"name,omitempty"`
+		}{
+			Arguments: z.Pointer(fc.Arguments),
+			Name:      z.Pointer(fc.Name),
+		}
+	}
+	if message.ToolCalls != nil {
+		toolCalls := make([]openai.ChatCompletionMessageToolCallChunk, 0, len(*message.ToolCalls))
+		for i, tc := range *message.ToolCalls {
+			toolCalls = append(toolCalls, toolCallChunk(i, tc))
+		}
+		delta.ToolCalls = &toolCalls
+	}
+
+	return delta
+}
+
+// remainingDelta returns the delta that streams the rest of a message whose start, read, has already been streamed.
+func remainingDelta(message, read openai.ChatCompletionResponseMessage) openai.ChatCompletionStreamResponseDelta {
+	var delta openai.ChatCompletionStreamResponseDelta
+	if content := rest(z.Dereference(message.Content), z.Dereference(read.Content)); content != "" {
+		delta.Content = z.Pointer(content)
+	}
+	if fc := message.FunctionCall; fc != nil {
+		readFC := z.Dereference(read.FunctionCall)
+		delta.FunctionCall = &struct {
+			Arguments *string `json:"arguments,omitempty"`
+			Name      *string `json:"name,omitempty"`
+		}{
+			Arguments: z.Pointer(rest(fc.Arguments, readFC.Arguments)),
+			Name:      z.Pointer(rest(fc.Name, readFC.Name)),
+		}
+	}
+	if message.ToolCalls != nil {
+		readToolCalls := z.Dereference(read.ToolCalls)
+		toolCalls := make([]openai.ChatCompletionMessageToolCallChunk, 0, len(*message.ToolCalls))
+		for i, tc := range *message.ToolCalls {
+			if i >= len(readToolCalls) {
+				toolCalls = append(toolCalls, toolCallChunk(i, tc))
+				continue
+			}
+
+			readTC := readToolCalls[i]
+			toolCalls = append(toolCalls, openai.ChatCompletionMessageToolCallChunk{
+				Function: &struct {
+					Arguments *string `json:"arguments,omitempty"`
+					Name      *string `json:"name,omitempty"`
+				}{
+					Arguments: z.Pointer(rest(tc.Function.Arguments, readTC.Function.Arguments)),
+					Name:      z.Pointer(rest(tc.Function.Name, readTC.Function.Name)),
+				},
+				Index: i,
+			})
+		}
+		delta.ToolCalls = &toolCalls
+	}
+
+	return delta
+}
+
+func toolCallChunk(index int, tc openai.ChatCompletionMessageToolCall) openai.ChatCompletionMessageToolCallChunk {
+	return openai.ChatCompletionMessageToolCallChunk{
+		Function: &struct {
+			Arguments *string `json:"arguments,omitempty"`
+			Name      *string `json:"name,omitempty"`
+		}{
+			Arguments: z.Pointer(tc.Function.Arguments),
+			Name:      z.Pointer(tc.Function.Name),
+		},
+		Id:    z.Pointer(tc.Id),
+		Index: index,
+		Type:  z.Pointer(openai.ChatCompletionMessageToolCallChunkType(tc.Type)),
+	}
+}
+
+// rest returns what is left of s after the part of it that was already streamed.
+func rest(s, streamed string) string {
+	return s[min(len(streamed), len(s)):]
+}
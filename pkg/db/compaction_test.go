@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/datatypes"
+)
+
+func TestCompactStream(t *testing.T) {
+	tx := newMigratedDB(t).WithContext(context.Background())
+
+	delta := func(content string, toolCall *openai.ChatCompletionMessageToolCallChunk) ChunkChoice {
+		d := openai.ChatCompletionStreamResponseDelta{Content: z.Pointer(content)}
+		if toolCall != nil {
+			d.ToolCalls = &[]openai.ChatCompletionMessageToolCallChunk{*toolCall}
+		}
+		return ChunkChoice{Delta: datatypes.NewJSONType(d)}
+	}
+	toolCall := func(id, name, arguments string) *openai.ChatCompletionMessageToolCallChunk {
+		tc := &openai.ChatCompletionMessageToolCallChunk{
+			Function: &struct {
+				Arguments *string `json:"arguments,omitempty"`
+				Name      *string `json:"name,omitempty"`
+			}{Arguments: z.Pointer(arguments)},
+		}
+		if id != "" {
+			tc.Id, tc.Function.Name = z.Pointer(id), z.Pointer(name)
+		}
+		return tc
+	}
+
+	chunks := []ChatCompletionResponseChunk{
+		{Model: "gpt-4o", Choices: []ChunkChoice{delta("Hel", nil)}},
+		{Model: "gpt-4o", Choices: []ChunkChoice{delta("lo", toolCall("call_1", "weather", `{"city":`))}},
+		{Model: "gpt-4o", Choices: []ChunkChoice{delta("", toolCall("", "", `"Paris"}`))}},
+		{JobResponse: JobResponse{Done: true}},
+	}
+	for i := range chunks {
+		chunks[i].RequestID = "chatcmpl-1"
+		chunks[i].ResponseIdx = i
+	}
+	chunks[2].Choices[0].FinishReason = "tool_calls"
+	if err := CreateChunks(tx, chunks); err != nil {
+		t.Fatalf("failed to create chunks: %v", err)
+	}
+
+	if ids, err := CompactableStreams(tx, time.Now().Add(-time.Minute), 10); err != nil || len(ids) != 0 {
+		t.Fatalf("streams compactable before they are old enough = %v, %v", ids, err)
+	}
+	ids, err := CompactableStreams(tx, time.Now().Add(time.Minute), 10)
+	if err != nil || len(ids) != 1 || ids[0] != "chatcmpl-1" {
+		t.Fatalf("compactable streams = %v, %v, want [chatcmpl-1]", ids, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = CompactStream(tx, "chatcmpl-1"); err != nil {
+			t.Fatalf("failed to compact stream: %v", err)
+		}
+	}
+
+	var remaining []ChatCompletionResponseChunk
+	if err = tx.Find(&remaining, "request_id = ?", "chatcmpl-1").Error; err != nil {
+		t.Fatalf("failed to list chunks: %v", err)
+	}
+	if len(remaining) != 1 || !remaining[0].Done || remaining[0].ResponseIdx != 3 {
+		t.Fatalf("remaining chunks = %+v, want only the done chunk", remaining)
+	}
+
+	var responses []CreateChatCompletionResponse
+	if err = tx.Find(&responses, "request_id = ?", "chatcmpl-1").Error; err != nil {
+		t.Fatalf("failed to list responses: %v", err)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("got %d compacted responses, want 1", len(responses))
+	}
+
+	replayed := responses[0].ChunksAfter(nil)
+	if len(replayed) != 1 || len(replayed[0].Choices) != 1 {
+		t.Fatalf("replayed chunks = %+v, want one chunk with one choice", replayed)
+	}
+	choice := replayed[0].Choices[0]
+	d := choice.Delta.Data()
+	if z.Dereference(d.Content) != "Hello" || choice.FinishReason != "tool_calls" || replayed[0].Model != "gpt-4o" {
+		t.Errorf("replayed choice = %+v, want content Hello finished by tool_calls", choice)
+	}
+	if d.ToolCalls == nil || len(*d.ToolCalls) != 1 {
+		t.Fatalf("replayed tool calls = %v, want one", d.ToolCalls)
+	}
+	tc := (*d.ToolCalls)[0]
+	if z.Dereference(tc.Id) != "call_1" || z.Dereference(tc.Function.Name) != "weather" || z.Dereference(tc.Function.Arguments) != `{"city":"Paris"}` {
+		t.Errorf("replayed tool call = %s %s(%s)", z.Dereference(tc.Id), z.Dereference(tc.Function.Name), z.Dereference(tc.Function.Arguments))
+	}
+
+	// A reader that streamed the first two chunks gets the rest of the content and tool call.
+	replayed = responses[0].ChunksAfter(chunks[:2])
+	if len(replayed) != 1 || len(replayed[0].Choices) != 1 {
+		t.Fatalf("chunks replayed after the first two = %+v, want one chunk with one choice", replayed)
+	}
+	choice = replayed[0].Choices[0]
+	d = choice.Delta.Data()
+	if d.Content != nil || d.Role != nil || choice.FinishReason != "tool_calls" {
+		t.Errorf("choice replayed after the first two chunks = %+v, want only the finish reason and tool call", choice)
+	}
+	if d.ToolCalls == nil || len(*d.ToolCalls) != 1 {
+		t.Fatalf("tool calls replayed after the first two chunks = %v, want one", d.ToolCalls)
+	}
+	tc = (*d.ToolCalls)[0]
+	if tc.Id != nil || z.Dereference(tc.Function.Name) != "" || z.Dereference(tc.Function.Arguments) != `"Paris"}` {
+		t.Errorf("tool call replayed after the first two chunks = %s %s(%s)", z.Dereference(tc.Id), z.Dereference(tc.Function.Name), z.Dereference(tc.Function.Arguments))
+	}
+	if replayed = responses[0].ChunksAfter(chunks[:3]); len(replayed) != 0 {
+		t.Errorf("chunks replayed after the whole stream = %+v, want none", replayed)
+	}
+
+	if ids, err = CompactableStreams(tx, time.Now().Add(time.Minute), 10); err != nil || len(ids) != 0 {
+		t.Errorf("compactable streams after compaction = %v, %v", ids, err)
+	}
+}
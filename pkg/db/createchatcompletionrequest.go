@@ -1,15 +1,30 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+
 	"github.com/acorn-io/z"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
 	"gorm.io/datatypes"
 )
 
+const (
+	// AssistantIDHeader is set on the chat completion requests of runs to the ID of the run's assistant, so that the
+	// requests fall back to the assistant's fallback models.
+	AssistantIDHeader = "X-Clicky-Chats-Assistant-ID"
+	// RequestIDHeader is set on the responses of the chat completion API to the ID of the request.
+	RequestIDHeader = "X-Clicky-Chats-Request-ID"
+)
+
 type CreateChatCompletionRequest struct {
 	// The following fields are not exposed in the public API
 	JobRequest `json:",inline"`
 	ModelAPI   string `json:"model_api"`
+	// APIKeyHash identifies the API key that the request was made with, without storing the key.
+	APIKeyHash string `json:"api_key_hash"`
+	// AssistantID is the ID of the assistant of the run that made the request, if a run made it.
+	AssistantID string `json:"assistant_id"`
 
 	// The following fields are exposed in the public API
 	FrequencyPenalty *float32                                                     `json:"frequency_penalty"`
@@ -32,6 +47,16 @@ type CreateChatCompletionRequest struct {
 	User             *string                                                      `json:"user,omitempty"`
 }
 
+// HashAPIKey returns the hash that identifies an API key in requests, or an empty string if there is no key.
+func HashAPIKey(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 func (c *CreateChatCompletionRequest) IDPrefix() string {
 	return "chatcmpl-"
 }
@@ -104,6 +129,8 @@ func (c *CreateChatCompletionRequest) FromPublic(obj any) error {
 		*c = CreateChatCompletionRequest{
 			JobRequest{},
 			"",
+			"",
+			"",
 			o.FrequencyPenalty,
 			datatypes.NewJSONType(z.Dereference(o.LogitBias)),
 			o.Logprobs,
@@ -16,6 +16,8 @@ type CreateChatCompletionResponse struct {
 	Model             string                                      `json:"model"`
 	SystemFingerprint *string                                     `json:"system_fingerprint,omitempty"`
 	Usage             datatypes.JSONType[*openai.CompletionUsage] `json:"usage,omitempty"`
+	// Not part of the public API
+	CacheHit bool `json:"cache_hit"`
 }
 
 func (c *CreateChatCompletionResponse) IDPrefix() string {
@@ -40,12 +42,18 @@ func (c *CreateChatCompletionResponse) FromPublic(obj any) error {
 			o.Model,
 			o.SystemFingerprint,
 			datatypes.NewJSONType(o.Usage),
+			false,
 		}
 	}
 
 	return nil
 }
 
+// IsCacheHit returns true if the response was served from the chat completion cache.
+func (c *CreateChatCompletionResponse) IsCacheHit() bool {
+	return c.CacheHit
+}
+
 func (c *CreateChatCompletionResponse) ToPublic() any {
 	//nolint:govet
 	return &openai.CreateChatCompletionResponse{
@@ -9,6 +9,8 @@ type CreateEmbeddingRequest struct {
 	// The following fields are not exposed in the public API
 	JobRequest `json:",inline"`
 	ModelAPI   string `json:"model_api"`
+	// APIKeyHash identifies the API key that the request was made with, without storing the key.
+	APIKeyHash string `json:"api_key_hash"`
 
 	// The following fields are exposed in the public API
 	// Required fields
@@ -63,6 +65,7 @@ func (e *CreateEmbeddingRequest) FromPublic(obj any) error {
 		*e = CreateEmbeddingRequest{
 			JobRequest{},
 			"",
+			"",
 
 			datatypes.NewJSONType(o.Input),
 			model,
@@ -60,46 +60,6 @@ func New(dsn string, autoMigrate bool) (*DB, error) {
 	}, nil
 }
 
-func (db *DB) AutoMigrate() error {
-	if !db.autoMigrate {
-		return nil
-	}
-
-	return db.gormDB.AutoMigrate(
-		Thread{},
-		Message{},
-		Run{},
-		MessageFile{},
-		File{},
-		Assistant{},
-		AssistantFile{},
-		FineTuningJob{},
-		Model{},
-		CreateChatCompletionRequest{},
-		CreateChatCompletionResponse{},
-		ChatCompletionResponseChunk{},
-		RunStep{},
-		CreateImageRequest{},
-		CreateImageEditRequest{},
-		CreateImageVariationRequest{},
-		ImagesResponse{},
-		CreateEmbeddingRequest{},
-		CreateEmbeddingResponse{},
-		CreateSpeechRequest{},
-		CreateSpeechResponse{},
-		CreateTranslationRequest{},
-		CreateTranslationResponse{},
-		CreateTranscriptionRequest{},
-		CreateTranscriptionResponse{},
-
-		Tool{},
-		BuiltInTool{},
-		RunEvent{},
-		RunStepEvent{},
-		RunToolObject{},
-	)
-}
-
 func (db *DB) Check(w http.ResponseWriter, _ *http.Request) {
 	if err := db.sqlDB.Ping(); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -1,13 +1,22 @@
 package db
 
 import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/acorn-io/z"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
 	"gorm.io/datatypes"
+	gdb "gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type ImagesResponse struct {
 	// The following fields are not exposed in the public API
 	JobResponse `json:",inline"`
+	// FileIDs are the IDs of the files that the images are stored as, in the order of the images, if they are stored.
+	FileIDs datatypes.JSONSlice[string] `json:"file_ids,omitempty"`
 
 	// The following fields are exposed in the public API
 	Base `json:",inline"`
@@ -43,6 +52,7 @@ func (i *ImagesResponse) FromPublic(obj any) error {
 	//nolint:govet
 	*i = ImagesResponse{
 		JobResponse{},
+		nil,
 		Base{
 			"",
 			o.Created,
@@ -52,3 +62,63 @@ func (i *ImagesResponse) FromPublic(obj any) error {
 
 	return nil
 }
+
+// GetImageFile returns the file with the given ID if it stores an image of an images response, and
+// gorm.ErrRecordNotFound otherwise, so that other files, like the ones uploaded by users, can't be downloaded.
+func GetImageFile(db *gdb.DB, id string) (*File, error) {
+	file := new(File)
+	return file, db.Where("id = ? AND purpose = ?", id, string(openai.OpenAIFilePurposeAssistantsOutput)).
+		Where("EXISTS (?)", db.Model(new(ImagesResponse)).Select("1").Where(fileIDsContain(db, id))).
+		First(file).Error
+}
+
+// fileIDsContain returns the condition that the file IDs of an images response contain the given ID.
+func fileIDsContain(db *gdb.DB, id string) clause.Expression {
+	if db.Dialector.Name() == "mysql" {
+		return clause.Expr{SQL: "JSON_CONTAINS(file_ids, JSON_QUOTE(?))", Vars: []any{id}}
+	}
+	return clause.Expr{SQL: "EXISTS (SELECT 1 FROM json_each(file_ids) WHERE json_each.value = ?)", Vars: []any{id}}
+}
+
+// DeleteExpiredImages deletes the requests and images responses created before or at the given expiration time, like
+// DeleteExpired, along with the files that the images of the responses are stored as.
+func DeleteExpiredImages(db *gdb.DB, expiration time.Time, requests ...Storer) error {
+	return db.Transaction(func(tx *gdb.DB) error {
+		var responseFileIDs []datatypes.JSONSlice[string]
+		if err := tx.Model(new(ImagesResponse)).Where("created_at <= ?", expiration.Unix()).Pluck("file_ids", &responseFileIDs).Error; err != nil {
+			return err
+		}
+
+		var fileIDs []string
+		for _, ids := range responseFileIDs {
+			fileIDs = append(fileIDs, ids...)
+		}
+		if len(fileIDs) > 0 {
+			if err := tx.Where("id IN ? AND purpose = ?", fileIDs, string(openai.OpenAIFilePurposeAssistantsOutput)).Delete(new(File)).Error; err != nil {
+				return err
+			}
+		}
+
+		return DeleteExpired(tx, expiration, append(requests, new(ImagesResponse))...)
+	})
+}
+
+// InlineImageFiles replaces the URLs of the images that are stored as files with the base64-encoded content of the
+// files, for requests that asked for b64_json.
+func InlineImageFiles(db *gdb.DB, ir *ImagesResponse) error {
+	for i, id := range ir.FileIDs {
+		if i >= len(ir.Data) {
+			break
+		}
+
+		file := new(File)
+		if err := db.Where("id = ?", id).First(file).Error; err != nil {
+			return fmt.Errorf("failed to get image file %s: %w", id, err)
+		}
+
+		ir.Data[i].B64Json = z.Pointer(base64.StdEncoding.EncodeToString(file.Content))
+		ir.Data[i].Url = nil
+	}
+
+	return nil
+}
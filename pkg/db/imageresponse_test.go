@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+func TestInlineImageFiles(t *testing.T) {
+	tx := newMigratedDB(t).WithContext(context.Background())
+
+	file := &File{Content: []byte("image"), Purpose: string(openai.OpenAIFilePurposeAssistantsOutput), Filename: "image.png"}
+	if err := Create(tx, file); err != nil {
+		t.Fatal(err)
+	}
+
+	ir := &ImagesResponse{
+		FileIDs: datatypes.JSONSlice[string]{file.ID},
+		Data:    datatypes.JSONSlice[openai.Image]{{Url: z.Pointer("http://localhost:8080/v1/files/" + file.ID + "/content"), RevisedPrompt: z.Pointer("a cat")}},
+	}
+	if err := Create(tx, ir); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := new(ImagesResponse)
+	if err := tx.Where("id = ?", ir.ID).First(stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := InlineImageFiles(tx, stored); err != nil {
+		t.Fatalf("InlineImageFiles() = %v", err)
+	}
+
+	image := stored.Data[0]
+	if got := z.Dereference(image.B64Json); got != "aW1hZ2U=" {
+		t.Errorf("b64_json = %q, want the base64 content of the file", got)
+	}
+	if image.Url != nil {
+		t.Errorf("url = %q, want none", *image.Url)
+	}
+	if z.Dereference(image.RevisedPrompt) != "a cat" {
+		t.Errorf("revised prompt = %v, want it kept", image.RevisedPrompt)
+	}
+
+	if err := tx.Delete(file).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := InlineImageFiles(tx, ir); err == nil {
+		t.Error("InlineImageFiles() of a deleted file should fail")
+	}
+}
+
+func TestGetImageFile(t *testing.T) {
+	tx := newMigratedDB(t).WithContext(context.Background())
+
+	image := &File{Content: []byte("image"), Purpose: string(openai.OpenAIFilePurposeAssistantsOutput), Filename: "image.png"}
+	upload := &File{Content: []byte("upload"), Purpose: string(openai.OpenAIFilePurposeAssistantsOutput), Filename: "upload.png"}
+	for _, f := range []*File{image, upload} {
+		if err := Create(tx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Create(tx, &ImagesResponse{FileIDs: datatypes.JSONSlice[string]{image.ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if file, err := GetImageFile(tx, image.ID); err != nil || string(file.Content) != "image" {
+		t.Errorf("GetImageFile() of an image file = %v, %v", file, err)
+	}
+	if _, err := GetImageFile(tx, upload.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("GetImageFile() of a file that isn't an image = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestDeleteExpiredImages(t *testing.T) {
+	tx := newMigratedDB(t).WithContext(context.Background())
+
+	expired := &File{Content: []byte("expired"), Purpose: string(openai.OpenAIFilePurposeAssistantsOutput), Filename: "expired.png"}
+	kept := &File{Content: []byte("kept"), Purpose: string(openai.OpenAIFilePurposeAssistantsOutput), Filename: "kept.png"}
+	for _, f := range []*File{expired, kept} {
+		if err := Create(tx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expiredResponse := &ImagesResponse{FileIDs: datatypes.JSONSlice[string]{expired.ID}}
+	if err := Create(tx, expiredResponse); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Model(expiredResponse).Where("id = ?", expiredResponse.ID).Update("created_at", 0).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Create(tx, &ImagesResponse{FileIDs: datatypes.JSONSlice[string]{kept.ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteExpiredImages(tx, time.Now().Add(-time.Minute), new(CreateImageRequest)); err != nil {
+		t.Fatalf("DeleteExpiredImages() = %v", err)
+	}
+
+	if err := tx.Where("id = ?", expiredResponse.ID).First(new(ImagesResponse)).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("expired images response should be deleted, got %v", err)
+	}
+	if err := tx.Where("id = ?", expired.ID).First(new(File)).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("file of the expired images response should be deleted, got %v", err)
+	}
+	if err := tx.Where("id = ?", kept.ID).First(new(File)).Error; err != nil {
+		t.Errorf("file of the images response that hasn't expired should be kept, got %v", err)
+	}
+}
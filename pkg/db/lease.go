@@ -0,0 +1,167 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	gdb "gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MinLeaseDuration is the shortest lease that an agent can hold on a job.
+const MinLeaseDuration = 5 * time.Second
+
+var (
+	// ErrMaxAttemptsExceeded is returned when a job has been claimed the maximum number of times without completing.
+	// The job is still claimed by the agent so that it can be failed.
+	ErrMaxAttemptsExceeded = errors.New("max attempts exceeded")
+	// ErrLeaseLost is returned when an agent's lease on a job has been taken over by another agent.
+	ErrLeaseLost = errors.New("lease lost")
+	// ErrAlreadyClaimed is returned when another worker claims a job between it being found and being claimed.
+	ErrAlreadyClaimed = errors.New("job already claimed")
+)
+
+// Lease configures how long an agent's claim on a job is valid without a heartbeat, and how many times a job can be
+// claimed before it is failed. Agents store the results of a job with the context of their lease, which is cancelled if
+// the lease is lost or the job is cancelled, so that nothing is stored for a job that the agent no longer holds.
+type Lease struct {
+	Duration    time.Duration
+	MaxAttempts int
+}
+
+func (l Lease) Validate() error {
+	if l.Duration < MinLeaseDuration {
+		return fmt.Errorf("lease duration must be at least %s", MinLeaseDuration)
+	}
+	if l.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+
+	return nil
+}
+
+// HeartbeatInterval is how often an agent should extend its lease so that it doesn't lapse while the agent is working.
+func (l Lease) HeartbeatInterval() time.Duration {
+	return l.Duration / 3
+}
+
+func (l Lease) expiresAt() int {
+	return int(time.Now().Add(l.Duration).Unix())
+}
+
+// LeaseColumns are the columns used to claim a job. Runs have two independent claims: one for the run agent and one
+// for the step runner.
+type LeaseColumns struct {
+	ClaimedBy, ExpiresAt, Attempts string
+}
+
+var (
+	JobLease = LeaseColumns{
+		ClaimedBy: "claimed_by",
+		ExpiresAt: "lease_expires_at",
+		Attempts:  "attempts",
+	}
+	SystemLease = LeaseColumns{
+		ClaimedBy: "system_claimed_by",
+		ExpiresAt: "system_lease_expires_at",
+		Attempts:  "system_attempts",
+	}
+)
+
+// Claimable is a scope that limits a query to jobs that are not claimed, or whose lease has lapsed. Claims made before
+// leases were introduced don't have an expiration and can only be reclaimed by the agent that made them.
+func (c LeaseColumns) Claimable(agentID string) func(*gdb.DB) *gdb.DB {
+	return func(tx *gdb.DB) *gdb.DB {
+		return tx.Where(
+			fmt.Sprintf("%[1]s IS NULL OR (%[1]s = ? AND %[2]s IS NULL) OR %[2]s < ?", c.ClaimedBy, c.ExpiresAt),
+			agentID, int(time.Now().Unix()),
+		)
+	}
+}
+
+// Claim returns the updates that claim a job for the given agent. The number of attempts is only incremented if the
+// job hasn't exceeded the maximum, because a job that has is claimed only to fail it.
+func (c LeaseColumns) Claim(agentID string, lease Lease, attempts int) map[string]any {
+	updates := map[string]any{
+		c.ClaimedBy: agentID,
+		c.ExpiresAt: lease.expiresAt(),
+	}
+	if attempts < lease.MaxAttempts {
+		updates[c.Attempts] = attempts + 1
+	}
+
+	return updates
+}
+
+// ClaimJob applies the claim updates to the job with the given ID if it is still claimable by the agent. The check is
+// part of the update so that two workers that find the same job can't both claim it. If the job has already been
+// claimed, then ErrAlreadyClaimed is returned.
+func (c LeaseColumns) ClaimJob(db *gdb.DB, id, agentID string, updates map[string]any) error {
+	result := db.Where("id = ?", id).Scopes(c.Claimable(agentID)).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAlreadyClaimed
+	}
+
+	return nil
+}
+
+// Release returns the updates that release a claim on a job after the agent has finished its part of the work.
+func (c LeaseColumns) Release() map[string]any {
+	return map[string]any{
+		c.ClaimedBy: nil,
+		c.ExpiresAt: nil,
+		c.Attempts:  0,
+	}
+}
+
+// Abandon returns the updates that give up a claim on a job that the agent couldn't finish, so that another agent can
+// claim it without waiting for the lease to lapse. Unlike Release, the number of attempts is kept so that a job that is
+// repeatedly abandoned is eventually failed.
+func (c LeaseColumns) Abandon() map[string]any {
+	return map[string]any{
+		c.ClaimedBy: nil,
+		c.ExpiresAt: nil,
+	}
+}
+
+// AbandonJob gives up the agent's claim on the job with the given ID. Nothing is changed if the agent doesn't hold the
+// claim.
+func AbandonJob(db *gdb.DB, model any, id, agentID string, columns LeaseColumns) error {
+	return db.Model(model).Where("id = ?", id).Where(columns.ClaimedBy+" = ?", agentID).Updates(columns.Abandon()).Error
+}
+
+// ExtendLease extends the lease held by the given agent on the job with the given ID. If the agent no longer holds the
+// lease, then ErrLeaseLost is returned.
+func ExtendLease(db *gdb.DB, model any, id, agentID string, lease Lease, columns LeaseColumns) error {
+	result := db.Model(model).Where("id = ?", id).Where(columns.ClaimedBy+" = ?", agentID).Update(columns.ExpiresAt, lease.expiresAt())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// JobFailer is a response that can be stored to fail a request.
+type JobFailer interface {
+	Storer
+	Fail(requestID string, err error)
+}
+
+// FailJob stores the response as the failed result of the request and marks the request as done.
+func FailJob(db *gdb.DB, request Storer, response JobFailer, err error) error {
+	response.Fail(request.GetID(), err)
+	return db.Transaction(func(tx *gdb.DB) error {
+		if err := Create(tx, response); err != nil {
+			return err
+		}
+
+		return tx.Model(request).Clauses(clause.Returning{}).Where("id = ?", request.GetID()).Update("done", true).Error
+	})
+}
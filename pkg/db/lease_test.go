@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+func TestDequeueLease(t *testing.T) {
+	var (
+		gdb   = newMigratedDB(t)
+		tx    = gdb.WithContext(context.Background())
+		lease = Lease{Duration: time.Minute, MaxAttempts: 2}
+	)
+
+	request := new(CreateChatCompletionRequest)
+	if err := Create(tx, request); err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	claimed := new(CreateChatCompletionRequest)
+	if err := Dequeue(tx, claimed, "agent-1", lease); err != nil {
+		t.Fatalf("failed to dequeue request: %v", err)
+	}
+	if claimed.ID != request.ID {
+		t.Fatalf("Dequeue() claimed %s, want %s", claimed.ID, request.ID)
+	}
+
+	if err := Dequeue(tx, new(CreateChatCompletionRequest), "agent-2", lease); err == nil {
+		t.Fatalf("Dequeue() should not claim a request with an active lease")
+	}
+	if err := ExtendLease(tx, new(CreateChatCompletionRequest), request.ID, "agent-2", lease, JobLease); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("ExtendLease() by another agent = %v, want %v", err, ErrLeaseLost)
+	}
+
+	expireLease := func() {
+		t.Helper()
+		if err := tx.Model(request).Where("id = ?", request.ID).Update("lease_expires_at", int(time.Now().Add(-time.Second).Unix())).Error; err != nil {
+			t.Fatalf("failed to expire lease: %v", err)
+		}
+	}
+
+	// Another agent can reclaim the request once the lease lapses.
+	expireLease()
+	if err := Dequeue(tx, claimed, "agent-2", lease); err != nil {
+		t.Fatalf("failed to reclaim request: %v", err)
+	}
+	if claimed.ID != request.ID || claimed.Attempts != 2 {
+		t.Fatalf("Dequeue() reclaimed %s with %d attempts, want %s with 2 attempts", claimed.ID, claimed.Attempts, request.ID)
+	}
+	if err := ExtendLease(tx, new(CreateChatCompletionRequest), request.ID, "agent-2", lease, JobLease); err != nil {
+		t.Errorf("ExtendLease() = %v", err)
+	}
+
+	// The request has been attempted the maximum number of times, so it should be failed.
+	expireLease()
+	if err := Dequeue(tx, claimed, "agent-1", lease); !errors.Is(err, ErrMaxAttemptsExceeded) {
+		t.Fatalf("Dequeue() = %v, want %v", err, ErrMaxAttemptsExceeded)
+	}
+	if err := FailJob(tx, claimed, new(CreateChatCompletionResponse), errors.New("abandoned")); err != nil {
+		t.Fatalf("failed to fail request: %v", err)
+	}
+
+	response := new(CreateChatCompletionResponse)
+	if err := tx.Model(response).Where("request_id = ?", request.ID).First(response).Error; err != nil {
+		t.Fatalf("failed to get failed response: %v", err)
+	}
+	if !response.Done || response.GetErrorString() != "abandoned" {
+		t.Errorf("failed response = %+v, want done with error", response.JobResponse)
+	}
+
+	if err := Dequeue(tx, new(CreateChatCompletionRequest), "agent-1", lease); err == nil {
+		t.Errorf("Dequeue() should not claim a done request")
+	}
+}
+
+func TestDequeueOrder(t *testing.T) {
+	var (
+		gdb   = newMigratedDB(t)
+		tx    = gdb.WithContext(context.Background())
+		lease = Lease{Duration: time.Minute, MaxAttempts: 3}
+	)
+
+	requests := []CreateChatCompletionRequest{
+		{JobRequest: JobRequest{Base: Base{ID: "newest", CreatedAt: 3}}},
+		{JobRequest: JobRequest{Base: Base{ID: "oldest", CreatedAt: 1}}},
+		{JobRequest: JobRequest{Base: Base{ID: "prioritized", CreatedAt: 4}, Priority: 10}},
+		{JobRequest: JobRequest{Base: Base{ID: "middle", CreatedAt: 2}}},
+	}
+	if err := tx.Create(&requests).Error; err != nil {
+		t.Fatalf("failed to create requests: %v", err)
+	}
+
+	for _, want := range []string{"prioritized", "oldest", "middle", "newest"} {
+		claimed := new(CreateChatCompletionRequest)
+		if err := Dequeue(tx, claimed, "agent", lease); err != nil {
+			t.Fatalf("failed to dequeue request: %v", err)
+		}
+		if claimed.ID != want {
+			t.Errorf("Dequeue() claimed %s, want %s", claimed.ID, want)
+		}
+		if err := tx.Model(claimed).Where("id = ?", claimed.ID).Update("done", true).Error; err != nil {
+			t.Fatalf("failed to complete request: %v", err)
+		}
+	}
+}
+
+func TestClaimJobConflict(t *testing.T) {
+	var (
+		gdb   = newMigratedDB(t)
+		tx    = gdb.WithContext(context.Background())
+		lease = Lease{Duration: time.Minute, MaxAttempts: 3}
+	)
+
+	run := new(Run)
+	if err := Create(tx, run); err != nil {
+		t.Fatalf("failed to create run: %v", err)
+	}
+
+	// Two workers found the same run, but only the first to claim it should succeed.
+	first, second := new(Run), new(Run)
+	if err := JobLease.ClaimJob(tx.Model(first).Clauses(clause.Returning{}), run.ID, "agent", JobLease.Claim("agent", lease, 0)); err != nil {
+		t.Fatalf("ClaimJob() = %v", err)
+	}
+	if first.ClaimedBy == nil || first.Attempts != 1 {
+		t.Errorf("ClaimJob() did not return the claimed run: %+v", first)
+	}
+	if err := JobLease.ClaimJob(tx.Model(second).Clauses(clause.Returning{}), run.ID, "agent", JobLease.Claim("agent", lease, 0)); !errors.Is(err, ErrAlreadyClaimed) {
+		t.Errorf("ClaimJob() = %v, want %v", err, ErrAlreadyClaimed)
+	}
+}
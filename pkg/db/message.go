@@ -11,7 +11,7 @@ type Message struct {
 	Role              string                                                 `json:"role"`
 	Content           datatypes.JSONSlice[openai.MessageObject_Content_Item] `json:"content"`
 	AssistantID       *string                                                `json:"assistant_id,omitempty"`
-	ThreadID          string                                                 `json:"thread_id,omitempty"`
+	ThreadID          string                                                 `json:"thread_id,omitempty" gorm:"index"`
 	RunID             *string                                                `json:"run_id,omitempty"`
 	FileIDs           datatypes.JSONSlice[string]                            `json:"file_ids,omitempty"`
 	Status            string                                                 `json:"status,omitempty"`
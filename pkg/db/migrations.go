@@ -0,0 +1,423 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// anyDialect is used as the key for migration functions that work for every supported dialect.
+	anyDialect = "*"
+
+	migrationLockName    = "clicky_chats_schema_migrations"
+	migrationLockTimeout = 60
+)
+
+// ErrUnknownSchemaVersion is returned when the database schema has been migrated to a version this binary doesn't know about.
+var ErrUnknownSchemaVersion = errors.New("unknown database schema version")
+
+// MigrationFunc makes (or reverts) a change to the schema. It is called within a transaction, but MySQL commits each
+// DDL statement implicitly, so a migration that fails there keeps the changes made before the failure. Migration
+// functions must therefore succeed when they are run again after a partial failure: the helpers below skip the
+// columns and indexes that already exist, or are already gone.
+type MigrationFunc func(tx *gorm.DB) error
+
+// Migration is a single, versioned change to the database schema.
+// Up and Down are keyed by dialect name (for example, "sqlite" or "mysql"). The function for anyDialect is used if
+// there isn't a dialect-specific one.
+type Migration struct {
+	Version  int
+	Name     string
+	Up, Down map[string]MigrationFunc
+}
+
+func (m Migration) up(dialect string) MigrationFunc {
+	return forDialect(m.Up, dialect)
+}
+
+func (m Migration) down(dialect string) MigrationFunc {
+	return forDialect(m.Down, dialect)
+}
+
+func forDialect(funcs map[string]MigrationFunc, dialect string) MigrationFunc {
+	if f, ok := funcs[dialect]; ok {
+		return f
+	}
+	return funcs[anyDialect]
+}
+
+// SchemaMigration records a migration that has been applied to the database.
+type SchemaMigration struct {
+	Version   int    `json:"version" gorm:"primarykey;autoIncrement:false"`
+	Name      string `json:"name"`
+	AppliedAt int    `json:"applied_at"`
+}
+
+// MigrationStatus describes whether a known migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *int
+}
+
+// LatestSchemaVersion returns the schema version that this binary expects.
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// EnsureSchema migrates the database to the latest version, if auto migration is enabled, and then verifies that the
+// schema version is the one this binary expects.
+func (db *DB) EnsureSchema(ctx context.Context) error {
+	if db.autoMigrate {
+		if _, err := db.MigrateUp(ctx, 0); err != nil {
+			return err
+		}
+	}
+
+	return db.CheckSchemaVersion(ctx)
+}
+
+// CheckSchemaVersion returns an error if the database schema is not at the version this binary expects.
+func (db *DB) CheckSchemaVersion(ctx context.Context) error {
+	applied, err := db.appliedMigrations(db.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	for version := range applied {
+		if !slices.ContainsFunc(migrations, func(m Migration) bool { return m.Version == version }) {
+			return fmt.Errorf("%w: database has migration %d applied, latest known version is %d", ErrUnknownSchemaVersion, version, LatestSchemaVersion())
+		}
+	}
+
+	var pending int
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("database schema has %d pending migration(s), run `clicky-chats migrate up` or enable auto migration", pending)
+	}
+
+	return nil
+}
+
+// MigrateUp applies pending migrations in order. If steps is positive, then at most that many migrations are applied.
+// The number of migrations applied is returned.
+func (db *DB) MigrateUp(ctx context.Context, steps int) (int, error) {
+	var count int
+	err := db.withMigrationLock(ctx, func(gdb *gorm.DB) error {
+		dialect := gdb.Dialector.Name()
+		for _, m := range migrations {
+			if steps > 0 && count >= steps {
+				return nil
+			}
+
+			applied, err := db.applyMigration(gdb, m, func(tx *gorm.DB, applied bool) error {
+				if applied {
+					return errSkipMigration
+				}
+
+				up := m.up(dialect)
+				if up == nil {
+					return fmt.Errorf("migration %d (%s) has no up function for dialect %s", m.Version, m.Name, dialect)
+				}
+				if err := up(tx); err != nil {
+					return err
+				}
+
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: int(time.Now().Unix())}).Error
+			})
+			if err != nil {
+				return err
+			}
+			if applied {
+				slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+				count++
+			}
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// MigrateDown reverts applied migrations, newest first. If steps is positive, then at most that many migrations are
+// reverted; otherwise, all migrations are reverted. The number of migrations reverted is returned.
+func (db *DB) MigrateDown(ctx context.Context, steps int) (int, error) {
+	var count int
+	err := db.withMigrationLock(ctx, func(gdb *gorm.DB) error {
+		dialect := gdb.Dialector.Name()
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if steps > 0 && count >= steps {
+				return nil
+			}
+
+			m := migrations[i]
+			reverted, err := db.applyMigration(gdb, m, func(tx *gorm.DB, applied bool) error {
+				if !applied {
+					return errSkipMigration
+				}
+
+				down := m.down(dialect)
+				if down == nil {
+					return fmt.Errorf("migration %d (%s) cannot be reverted for dialect %s", m.Version, m.Name, dialect)
+				}
+				if err := down(tx); err != nil {
+					return err
+				}
+
+				return tx.Delete(new(SchemaMigration), "version = ?", m.Version).Error
+			})
+			if err != nil {
+				return err
+			}
+			if reverted {
+				slog.Info("Reverted migration", "version", m.Version, "name", m.Name)
+				count++
+			}
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// MigrationStatus returns the status of every known migration, in order.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations(db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+		}
+		if sm, ok := applied[m.Version]; ok {
+			status.AppliedAt = &sm.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+var errSkipMigration = errors.New("skip migration")
+
+// applyMigration runs fn in a transaction. The applied argument to fn is determined within the same transaction so that
+// concurrent migrators don't apply a migration twice. If fn returns errSkipMigration, then the transaction is rolled back
+// and false is returned.
+func (db *DB) applyMigration(gdb *gorm.DB, m Migration, fn func(tx *gorm.DB, applied bool) error) (bool, error) {
+	err := gdb.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(new(SchemaMigration)).Where("version = ?", m.Version).Count(&count).Error; err != nil {
+			return err
+		}
+
+		return fn(tx, count > 0)
+	})
+	if errors.Is(err, errSkipMigration) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+	}
+
+	return true, nil
+}
+
+func (db *DB) appliedMigrations(gdb *gorm.DB) (map[int]SchemaMigration, error) {
+	if !gdb.Migrator().HasTable(new(SchemaMigration)) {
+		return nil, nil
+	}
+
+	var schemaMigrations []SchemaMigration
+	if err := gdb.Model(new(SchemaMigration)).Find(&schemaMigrations).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]SchemaMigration, len(schemaMigrations))
+	for _, sm := range schemaMigrations {
+		applied[sm.Version] = sm
+	}
+
+	return applied, nil
+}
+
+// withMigrationLock ensures that only one process migrates the database at a time. All statements are run on a single
+// connection, which is required for MySQL's named locks.
+func (db *DB) withMigrationLock(ctx context.Context, fn func(gdb *gorm.DB) error) error {
+	return db.WithContext(ctx).Connection(func(gdb *gorm.DB) error {
+		if gdb.Dialector.Name() == "mysql" {
+			var locked *int
+			if err := gdb.Raw("SELECT GET_LOCK(?, ?)", migrationLockName, migrationLockTimeout).Scan(&locked).Error; err != nil {
+				return fmt.Errorf("failed to acquire migration lock: %w", err)
+			}
+			if locked == nil || *locked != 1 {
+				return fmt.Errorf("timed out waiting for migration lock")
+			}
+
+			defer func() {
+				if err := gdb.Exec("SELECT RELEASE_LOCK(?)", migrationLockName).Error; err != nil {
+					slog.Error("Failed to release migration lock", "err", err)
+				}
+			}()
+		}
+
+		// SQLite serializes the migration transactions themselves, so no additional lock is needed.
+		if err := gdb.AutoMigrate(new(SchemaMigration)); err != nil {
+			return fmt.Errorf("failed to create schema migrations table: %w", err)
+		}
+
+		return fn(gdb)
+	})
+}
+
+// tableIndexes identifies the tables to create the indexes declared on a model in. The model is a snapshot of the
+// indexed fields taken when the migration was written, so that the migration doesn't change with the models.
+type tableIndexes struct {
+	tables []string
+	model  any
+}
+
+// indexes returns the names of the indexes declared on the model, for the given table.
+func (ti tableIndexes) indexes(tx *gorm.DB, table string) ([]string, error) {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.ParseWithSpecialTableName(ti.model, table); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(stmt.Schema.ParseIndexes()))
+	for name := range stmt.Schema.ParseIndexes() {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// createIndexes creates the indexes declared on the models in their tables, unless they exist.
+func createIndexes(tx *gorm.DB, indexes []tableIndexes) error {
+	for _, ti := range indexes {
+		for _, table := range ti.tables {
+			names, err := ti.indexes(tx, table)
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				if tx.Table(table).Migrator().HasIndex(ti.model, name) {
+					continue
+				}
+				if err = tx.Table(table).Migrator().CreateIndex(ti.model, name); err != nil {
+					return fmt.Errorf("failed to create index %s: %w", name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// dropIndexes drops the indexes declared on the models from their tables, if they exist.
+func dropIndexes(tx *gorm.DB, indexes []tableIndexes) error {
+	for _, ti := range indexes {
+		for _, table := range ti.tables {
+			names, err := ti.indexes(tx, table)
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				if !tx.Table(table).Migrator().HasIndex(ti.model, name) {
+					continue
+				}
+				if err = tx.Table(table).Migrator().DropIndex(ti.model, name); err != nil {
+					return fmt.Errorf("failed to drop index %s: %w", name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// tableColumns identifies the tables to add the columns of a model to. The model is a snapshot of the new fields taken
+// when the migration was written, so that the migration doesn't change with the models.
+type tableColumns struct {
+	tables []string
+	model  any
+}
+
+// columns returns the names of the fields of the model that are stored in columns.
+func (tc tableColumns) columns(tx *gorm.DB) ([]string, error) {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(tc.model); err != nil {
+		return nil, err
+	}
+
+	return stmt.Schema.DBNames, nil
+}
+
+// addColumns adds the columns of the models to their tables, unless they exist.
+func addColumns(tx *gorm.DB, columns []tableColumns) error {
+	for _, tc := range columns {
+		names, err := tc.columns(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tc.tables {
+			for _, name := range names {
+				if tx.Table(table).Migrator().HasColumn(tc.model, name) {
+					continue
+				}
+				if err = tx.Table(table).Migrator().AddColumn(tc.model, name); err != nil {
+					return fmt.Errorf("failed to add column %s to %s: %w", name, table, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// dropColumns drops the columns of the models from their tables, if they exist. The columns are dropped with ALTER TABLE rather than the
+// migrator, because the sqlite migrator drops a column by recreating the table, which loses the table's indexes.
+func dropColumns(tx *gorm.DB, columns []tableColumns) error {
+	for _, tc := range columns {
+		names, err := tc.columns(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tc.tables {
+			for _, name := range names {
+				if !tx.Table(table).Migrator().HasColumn(tc.model, name) {
+					continue
+				}
+				if err = tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: table}, clause.Column{Name: name}).Error; err != nil {
+					return fmt.Errorf("failed to drop column %s from %s: %w", name, table, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
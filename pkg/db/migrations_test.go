@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func newTestDB(t testing.TB, autoMigrate bool) *DB {
+	t.Helper()
+	gdb, err := New("sqlite://"+filepath.Join(t.TempDir(), "test.db"), autoMigrate)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = gdb.Close()
+	})
+
+	return gdb
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	gdb := newTestDB(t, false)
+
+	if err := gdb.CheckSchemaVersion(ctx); err == nil {
+		t.Fatalf("expected an error for an unmigrated database")
+	}
+
+	count, err := gdb.MigrateUp(ctx, 0)
+	if err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+	if count != len(migrations) {
+		t.Errorf("MigrateUp() applied %d migrations, want %d", count, len(migrations))
+	}
+	if err = gdb.CheckSchemaVersion(ctx); err != nil {
+		t.Errorf("CheckSchemaVersion() after migrating up = %v", err)
+	}
+
+	// Migrating again should be a no-op.
+	if count, err = gdb.MigrateUp(ctx, 0); err != nil || count != 0 {
+		t.Errorf("second MigrateUp() = %d, %v, want 0, nil", count, err)
+	}
+
+	statuses, err := gdb.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatalf("failed to get migration status: %v", err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("migration %d should be applied", s.Version)
+		}
+	}
+
+	if count, err = gdb.MigrateDown(ctx, 0); err != nil || count != len(migrations) {
+		t.Fatalf("MigrateDown() = %d, %v, want %d, nil", count, err, len(migrations))
+	}
+	if gdb.gormDB.Migrator().HasTable(new(Run)) {
+		t.Errorf("runs table should have been dropped")
+	}
+
+	if err = gdb.EnsureSchema(ctx); err == nil {
+		t.Errorf("EnsureSchema() without auto migration should fail for a reverted database")
+	}
+
+	if count, err = gdb.MigrateUp(ctx, 0); err != nil || count != len(migrations) {
+		t.Errorf("MigrateUp() after reverting = %d, %v, want %d, nil", count, err, len(migrations))
+	}
+}
+
+// TestMigrationsRerun checks that migrations succeed when they are run again, as they are after failing part way on
+// MySQL, where the schema changes made before the failure are committed but the migration isn't recorded.
+func TestMigrationsRerun(t *testing.T) {
+	ctx := context.Background()
+	gdb := newMigratedDB(t)
+
+	if err := gdb.gormDB.Where("1 = 1").Delete(new(SchemaMigration)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count, err := gdb.MigrateUp(ctx, 0); err != nil || count != len(migrations) {
+		t.Fatalf("MigrateUp() of applied migrations = %d, %v, want %d, nil", count, err, len(migrations))
+	}
+
+	if _, err := gdb.MigrateDown(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if err := gdb.gormDB.Create(&SchemaMigration{Version: m.Version, Name: m.Name}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := gdb.MigrateDown(ctx, 0); err != nil || count != len(migrations) {
+		t.Errorf("MigrateDown() of reverted migrations = %d, %v, want %d, nil", count, err, len(migrations))
+	}
+}
+
+// TestMigratedSchemaMatchesModels checks that migrating up creates every column and index declared on the models, so
+// that a change to a model without a migration is caught.
+func TestMigratedSchemaMatchesModels(t *testing.T) {
+	gdb := newMigratedDB(t).gormDB
+
+	models := []any{
+		Thread{}, Message{}, Run{}, MessageFile{}, File{}, Assistant{}, AssistantFile{}, FineTuningJob{}, Model{},
+		CreateChatCompletionRequest{}, CreateChatCompletionResponse{}, ChatCompletionResponseChunk{}, RunStep{},
+		CreateImageRequest{}, CreateImageEditRequest{}, CreateImageVariationRequest{}, ImagesResponse{},
+		CreateEmbeddingRequest{}, CreateEmbeddingResponse{}, CreateSpeechRequest{}, CreateSpeechResponse{},
+		CreateTranslationRequest{}, CreateTranslationResponse{}, CreateTranscriptionRequest{},
+		CreateTranscriptionResponse{}, Tool{}, BuiltInTool{}, RunEvent{}, RunStepEvent{}, RunToolObject{},
+		ChatCompletionRetry{},
+	}
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: gdb}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, column := range stmt.Schema.DBNames {
+			if !gdb.Migrator().HasColumn(model, column) {
+				t.Errorf("table %s has no column %s", stmt.Schema.Table, column)
+			}
+		}
+		for name := range stmt.Schema.ParseIndexes() {
+			if !gdb.Migrator().HasIndex(model, name) {
+				t.Errorf("table %s has no index %s", stmt.Schema.Table, name)
+			}
+		}
+	}
+}
+
+func TestCheckSchemaVersionUnknown(t *testing.T) {
+	ctx := context.Background()
+	gdb := newTestDB(t, true)
+
+	if err := gdb.EnsureSchema(ctx); err != nil {
+		t.Fatalf("failed to ensure schema: %v", err)
+	}
+
+	if err := gdb.gormDB.Create(&SchemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future"}).Error; err != nil {
+		t.Fatalf("failed to create schema migration: %v", err)
+	}
+
+	if err := gdb.CheckSchemaVersion(ctx); !errors.Is(err, ErrUnknownSchemaVersion) {
+		t.Errorf("CheckSchemaVersion() = %v, want %v", err, ErrUnknownSchemaVersion)
+	}
+}
@@ -1,6 +1,12 @@
 package db
 
-import "github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+import (
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	gdb "gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
 
 type Model struct {
 	Base    `json:",inline"`
@@ -40,3 +46,30 @@ func (m *Model) FromPublic(obj any) error {
 
 	return nil
 }
+
+// LocalModelOwner owns the models that the agents serve themselves, like the local embeddings model. No provider lists
+// these models, so they are kept when the models of the providers are stored.
+const LocalModelOwner = "clicky-chats"
+
+// StoreLocalModels stores the local models with the given IDs, and deletes the other local models.
+func StoreLocalModels(db *gdb.DB, ids ...string) error {
+	return db.Transaction(func(tx *gdb.DB) error {
+		stale := tx.Where("owned_by = ?", LocalModelOwner)
+		if len(ids) > 0 {
+			stale = stale.Where("id NOT IN ?", ids)
+		}
+		if err := stale.Delete(new(Model)).Error; err != nil {
+			return err
+		}
+
+		now := int(time.Now().Unix())
+		for _, id := range ids {
+			// Create the model directly instead of using Create because the ID is the model's name.
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Model{Base: Base{ID: id, CreatedAt: now}, OwnedBy: LocalModelOwner}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 	"gorm.io/datatypes"
 	gdb "gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -29,6 +30,9 @@ func List[T any](db *gdb.DB, objs *[]T) error {
 func Create(db *gdb.DB, obj Storer) error {
 	SetNewID(obj)
 	obj.SetCreatedAt(int(time.Now().Unix()))
+	if t, ok := obj.(Traced); ok && t.GetTraceParent() == "" && db.Statement.Context != nil {
+		t.SetTraceParent(tracing.TraceParent(db.Statement.Context))
+	}
 
 	slog.Debug("Creating", "id", obj.GetID())
 	return CreateAny(db, obj)
@@ -64,27 +68,53 @@ func DeleteExpired(db *gdb.DB, expiration time.Time, objs ...Storer) error {
 	})
 }
 
-// Dequeue dequeues the next request from the database, marking it as claimed by the given agent.
-func Dequeue(db *gdb.DB, request Storer, agentID string) error {
+// Traced is an object that stores the trace context of its creator, so that the agent processing it continues the trace.
+type Traced interface {
+	GetTraceParent() string
+	SetTraceParent(string)
+}
+
+// Job is a request that is claimed and processed by an agent.
+type Job interface {
+	Storer
+	Traced
+	GetAttempts() int
+	GetCancelReason() string
+}
+
+// Dequeue dequeues the next request from the database, marking it as claimed by the given agent until the lease expires.
+// If the request has already been attempted the maximum number of times, then it is claimed and ErrMaxAttemptsExceeded
+// is returned so that the caller can fail it.
+func Dequeue(db *gdb.DB, request Job, agentID string, lease Lease) error {
+	var attempts int
 	err := db.Model(request).Transaction(func(tx *gdb.DB) error {
-		if err := tx.Where("claimed_by IS NULL").Or("claimed_by = ? AND done = false", agentID).
-			Order("created_at desc").
+		if err := tx.Where("done = false").Scopes(JobLease.Claimable(agentID)).
+			Order(QueueOrder).
 			First(request).Error; err != nil {
 			return err
 		}
 
-		if err := tx.Where("id = ?", request.GetID()).
-			Updates(map[string]interface{}{"claimed_by": agentID}).Error; err != nil {
-			return err
+		attempts = request.GetAttempts()
+		return JobLease.ClaimJob(tx, request.GetID(), agentID, JobLease.Claim(agentID, lease, attempts))
+	})
+	if err != nil {
+		if !errors.Is(err, gdb.ErrRecordNotFound) && !errors.Is(err, ErrAlreadyClaimed) {
+			err = fmt.Errorf("failed to dequeue request %T: %w", request, err)
 		}
+		return err
+	}
 
-		return nil
-	})
-	if err != nil && !errors.Is(err, gdb.ErrRecordNotFound) {
-		err = fmt.Errorf("failed to dequeue request %T: %w", request, err)
+	if attempts >= lease.MaxAttempts {
+		return fmt.Errorf("%w: request %s was attempted %d times", ErrMaxAttemptsExceeded, request.GetID(), attempts)
 	}
 
-	return err
+	return nil
+}
+
+// NextResponseIndex returns the index of the next response object, such as a chunk or an event, for the given request.
+func NextResponseIndex(db *gdb.DB, model any, requestID string) (int, error) {
+	var index int
+	return index, db.Model(model).Select("COALESCE(MAX(response_idx) + 1, 0)").Where("request_id = ?", requestID).Scan(&index).Error
 }
 
 // Modify modifies the object in the database. All validation should be done before calling this function.
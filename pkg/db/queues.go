@@ -0,0 +1,411 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	gdb "gorm.io/gorm"
+)
+
+var (
+	// ErrUnknownQueue is returned when an admin action names a queue that doesn't exist.
+	ErrUnknownQueue = errors.New("unknown queue")
+	// ErrJobDone is returned when an admin action can't be applied because the job has already finished.
+	ErrJobDone = errors.New("job is already done")
+	// ErrJobCancelled is the error that jobs cancelled by an administrator are failed with.
+	ErrJobCancelled = errors.New("job was cancelled by an administrator")
+	// ErrClientDisconnected is the error that requests are failed with when their client disconnects before the
+	// response is ready.
+	ErrClientDisconnected error = clientDisconnectedError{}
+)
+
+// StatusClientClosedRequest is the non-standard status code, borrowed from nginx, that requests are failed with when
+// their client disconnects.
+const StatusClientClosedRequest = 499
+
+type clientDisconnectedError struct{}
+
+func (clientDisconnectedError) Error() string {
+	return "client disconnected before the response was ready"
+}
+
+func (clientDisconnectedError) GetStatusCode() int {
+	return StatusClientClosedRequest
+}
+
+// QueueStats describe the backlog of one type of job.
+type QueueStats struct {
+	Name    string `json:"name"`
+	Pending int64  `json:"pending"`
+	Claimed int64  `json:"claimed"`
+	Done    int64  `json:"done"`
+	// OldestPendingAge is the age, in seconds, of the oldest job waiting to be claimed.
+	OldestPendingAge *int64           `json:"oldest_pending_age,omitempty"`
+	ClaimsByAgent    map[string]int64 `json:"claims_by_agent"`
+}
+
+// jobKind is a table that holds jobs of a queue.
+type jobKind struct {
+	model func() Storer
+	// response returns the response that fails a request, nil for runs which are cancelled instead.
+	response func(tx *gdb.DB, request Storer) (JobFailer, error)
+	// cancelled are extra updates applied to a request when it is cancelled.
+	cancelled map[string]any
+	// agentFails is true if the agent processing a request of this kind watches for its cancellation, and then stops
+	// and fails the request itself.
+	agentFails bool
+}
+
+// queue is one type of job. A job is pending if it is ready and its claim is free or has lapsed, claimed if it is not
+// done and has an active claim, and done when the done condition holds.
+type queue struct {
+	name  string
+	kinds []jobKind
+	lease LeaseColumns
+	ready string
+	done  string
+}
+
+func (q queue) pending(tx *gdb.DB, now int) *gdb.DB {
+	return tx.Where(q.ready).Where(fmt.Sprintf("%[1]s IS NULL OR %[2]s < ?", q.lease.ClaimedBy, q.lease.ExpiresAt), now)
+}
+
+func (q queue) claimed(tx *gdb.DB, now int) *gdb.DB {
+	return tx.Not(q.done).Where(fmt.Sprintf("%[1]s IS NOT NULL AND (%[2]s IS NULL OR %[2]s >= ?)", q.lease.ClaimedBy, q.lease.ExpiresAt), now)
+}
+
+func requestKind(model func() Storer, response func() JobFailer) jobKind {
+	return jobKind{
+		model: model,
+		response: func(*gdb.DB, Storer) (JobFailer, error) {
+			return response(), nil
+		},
+		agentFails: true,
+	}
+}
+
+func requestQueue(name string, kinds ...jobKind) queue {
+	return queue{
+		name:  name,
+		kinds: kinds,
+		lease: JobLease,
+		ready: "done = false",
+		done:  "done = true",
+	}
+}
+
+var (
+	runStatusDone = fmt.Sprintf("status IN ('%s', '%s', '%s', '%s')", openai.RunObjectStatusCompleted, openai.RunObjectStatusFailed, openai.RunObjectStatusCancelled, openai.RunObjectStatusExpired)
+
+	queues = []queue{
+		requestQueue("chat_completion", jobKind{
+			model: func() Storer { return new(CreateChatCompletionRequest) },
+			response: func(tx *gdb.DB, request Storer) (JobFailer, error) {
+				if !z.Dereference(request.(*CreateChatCompletionRequest).Stream) {
+					return new(CreateChatCompletionResponse), nil
+				}
+
+				index, err := NextResponseIndex(tx, new(ChatCompletionResponseChunk), request.GetID())
+				return &ChatCompletionResponseChunk{ResponseIdx: index}, err
+			},
+			agentFails: true,
+		}),
+		{
+			name:  "run",
+			kinds: []jobKind{{model: func() Storer { return new(Run) }}},
+			lease: JobLease,
+			ready: fmt.Sprintf("status = '%s' OR (status = '%s' AND (system_status IS NULL OR system_status = '%[1]s'))", openai.RunObjectStatusQueued, openai.RunObjectStatusInProgress),
+			done:  runStatusDone,
+		},
+		{
+			name:  "run_step",
+			kinds: []jobKind{{model: func() Storer { return new(Run) }}},
+			lease: SystemLease,
+			ready: fmt.Sprintf("system_status = '%s' OR (system_status = '%s' AND status = '%[2]s')", openai.RunObjectStatusRequiresAction, openai.RunObjectStatusInProgress),
+			// The step runner hands runs back to the run agent by setting their system status to queued.
+			done: fmt.Sprintf("system_status IN ('%s', '%s')", openai.RunObjectStatusQueued, openai.RunObjectStatusFailed),
+		},
+		requestQueue("tool_run", jobKind{
+			model: func() Storer { return new(RunToolObject) },
+			response: func(tx *gdb.DB, request Storer) (JobFailer, error) {
+				index, err := NextResponseIndex(tx, new(RunStepEvent), request.GetID())
+				return &RunStepEvent{ResponseIdx: index}, err
+			},
+			cancelled: map[string]any{
+				"output": ErrJobCancelled.Error(),
+				"status": string(openai.RunObjectStatusFailed),
+			},
+		}),
+		requestQueue("embeddings",
+			requestKind(func() Storer { return new(CreateEmbeddingRequest) }, func() JobFailer { return new(CreateEmbeddingResponse) }),
+		),
+		requestQueue("image",
+			requestKind(func() Storer { return new(CreateImageRequest) }, func() JobFailer { return new(ImagesResponse) }),
+			requestKind(func() Storer { return new(CreateImageEditRequest) }, func() JobFailer { return new(ImagesResponse) }),
+			requestKind(func() Storer { return new(CreateImageVariationRequest) }, func() JobFailer { return new(ImagesResponse) }),
+		),
+		requestQueue("audio",
+			requestKind(func() Storer { return new(CreateSpeechRequest) }, func() JobFailer { return new(CreateSpeechResponse) }),
+			requestKind(func() Storer { return new(CreateTranscriptionRequest) }, func() JobFailer { return new(CreateTranscriptionResponse) }),
+			requestKind(func() Storer { return new(CreateTranslationRequest) }, func() JobFailer { return new(CreateTranslationResponse) }),
+		),
+	}
+)
+
+// QueueNames returns the names of the queues in the order they are reported.
+func QueueNames() []string {
+	names := make([]string, 0, len(queues))
+	for _, q := range queues {
+		names = append(names, q.name)
+	}
+
+	return names
+}
+
+func findQueue(name string) (queue, error) {
+	for _, q := range queues {
+		if q.name == name {
+			return q, nil
+		}
+	}
+
+	return queue{}, fmt.Errorf("%w %q", ErrUnknownQueue, name)
+}
+
+// ListQueueStats returns the stats of every queue.
+func ListQueueStats(db *gdb.DB) ([]QueueStats, error) {
+	now := time.Now()
+	stats := make([]QueueStats, 0, len(queues))
+	for _, q := range queues {
+		s := QueueStats{
+			Name:          q.name,
+			ClaimsByAgent: make(map[string]int64),
+		}
+		for _, kind := range q.kinds {
+			model := kind.model()
+			var count int64
+			if err := q.pending(db.Model(model), int(now.Unix())).Count(&count).Error; err != nil {
+				return nil, err
+			}
+			s.Pending += count
+
+			if err := q.claimed(db.Model(model), int(now.Unix())).Count(&count).Error; err != nil {
+				return nil, err
+			}
+			s.Claimed += count
+
+			if err := db.Model(model).Where(q.done).Count(&count).Error; err != nil {
+				return nil, err
+			}
+			s.Done += count
+
+			var oldest *int
+			if err := q.pending(db.Model(model), int(now.Unix())).Select("MIN(created_at)").Scan(&oldest).Error; err != nil {
+				return nil, err
+			}
+			if oldest != nil {
+				if age := now.Unix() - int64(*oldest); s.OldestPendingAge == nil || age > *s.OldestPendingAge {
+					s.OldestPendingAge = &age
+				}
+			}
+
+			var claims []struct {
+				AgentID string
+				Count   int64
+			}
+			if err := q.claimed(db.Model(model), int(now.Unix())).
+				Select(q.lease.ClaimedBy + " AS agent_id, COUNT(*) AS count").
+				Group(q.lease.ClaimedBy).
+				Scan(&claims).Error; err != nil {
+				return nil, err
+			}
+			for _, c := range claims {
+				s.ClaimsByAgent[c.AgentID] += c.Count
+			}
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats, nil
+}
+
+// findJob finds the job with the given ID in any of the queue's tables.
+func (q queue) findJob(tx *gdb.DB, id string) (jobKind, Storer, error) {
+	for _, kind := range q.kinds {
+		job := kind.model()
+		if err := tx.Where("id = ?", id).First(job).Error; err == nil {
+			return kind, job, nil
+		} else if !errors.Is(err, gdb.ErrRecordNotFound) {
+			return jobKind{}, nil, err
+		}
+	}
+
+	return jobKind{}, nil, gdb.ErrRecordNotFound
+}
+
+// RequeueJob releases the claim on a job that hasn't finished and resets its attempts, so that any agent can claim it
+// immediately.
+func RequeueJob(db *gdb.DB, queueName, id string) error {
+	q, err := findQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gdb.DB) error {
+		_, job, err := q.findJob(tx, id)
+		if err != nil {
+			return err
+		}
+
+		var done int64
+		if err = tx.Model(job).Where("id = ?", id).Where(q.done).Count(&done).Error; err != nil {
+			return err
+		}
+		if done > 0 {
+			return ErrJobDone
+		}
+
+		return tx.Model(job).Where("id = ?", id).Updates(q.lease.Release()).Error
+	})
+}
+
+// CancelJob cancels a job that hasn't finished. Requests are failed with ErrJobCancelled, and runs are cancelled. A
+// chat completion, embeddings, image or audio request that an agent is processing is only marked as cancelled, and the
+// agent stops and fails it. Other agents aren't interrupted, but their result is ignored.
+func CancelJob(db *gdb.DB, queueName, id string) error {
+	return cancelJob(db, queueName, id, ErrJobCancelled)
+}
+
+// CancelDisconnectedJob fails a request that hasn't finished with ErrClientDisconnected, because its client is no
+// longer waiting for the response.
+func CancelDisconnectedJob(db *gdb.DB, queueName, id string) error {
+	return cancelJob(db, queueName, id, ErrClientDisconnected)
+}
+
+func cancelJob(db *gdb.DB, queueName, id string, cause error) error {
+	q, err := findQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gdb.DB) error {
+		kind, job, err := q.findJob(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if kind.response == nil {
+			if IsTerminal(job.(*Run).Status) {
+				return ErrJobDone
+			}
+
+			_, err = CancelRun(tx, id)
+			return err
+		}
+
+		if job.(interface{ IsDone() bool }).IsDone() {
+			return ErrJobDone
+		}
+
+		if kind.agentFails {
+			// The agent processing the request may still be storing responses for it, so only it can store the failed
+			// response without anything being stored after it.
+			result := tx.Model(job).Where("id = ?", id).Where("claimed_by IS NOT NULL").Update("cancel_reason", cause.Error())
+			if result.Error != nil || result.RowsAffected > 0 {
+				return result.Error
+			}
+		}
+
+		response, err := kind.response(tx, job)
+		if err != nil {
+			return err
+		}
+		if err = FailJob(tx, job, response, cause); err != nil {
+			return err
+		}
+		if kind.cancelled != nil {
+			return tx.Model(job).Where("id = ?", id).Updates(kind.cancelled).Error
+		}
+
+		return nil
+	})
+}
+
+// CancelCause returns the error that a request cancelled for the given reason is failed with.
+func CancelCause(reason string) error {
+	for _, err := range []error{ErrJobCancelled, ErrClientDisconnected} {
+		if err.Error() == reason {
+			return err
+		}
+	}
+
+	return errors.New(reason)
+}
+
+// FailCancelledJob fails a request that was cancelled while it was being processed with the error for its cancel
+// reason, unless it is already done.
+func FailCancelledJob(db *gdb.DB, request Job, response JobFailer) error {
+	return db.Transaction(func(tx *gdb.DB) error {
+		if err := tx.Where("id = ?", request.GetID()).First(request).Error; err != nil {
+			return err
+		}
+		if request.(interface{ IsDone() bool }).IsDone() {
+			return nil
+		}
+
+		return FailJob(tx, request, response, CancelCause(request.GetCancelReason()))
+	})
+}
+
+// PurgeJob deletes a job and everything that was produced for it, regardless of its state.
+func PurgeJob(db *gdb.DB, queueName, id string) error {
+	q, err := findQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gdb.DB) error {
+		_, job, err := q.findJob(tx, id)
+		if err != nil {
+			return err
+		}
+
+		var responses []any
+		switch job.(type) {
+		case *Run:
+			if err = tx.Model(new(Thread)).Where("locked_by_run_id = ?", id).Update("locked_by_run_id", nil).Error; err != nil {
+				return err
+			}
+			if err = tx.Delete(new(RunStep), "run_id = ?", id).Error; err != nil {
+				return err
+			}
+			responses = []any{new(RunEvent)}
+		case *CreateChatCompletionRequest:
+			responses = []any{new(ChatCompletionResponseChunk), new(CreateChatCompletionResponse), new(ChatCompletionRetry)}
+		case *RunToolObject:
+			responses = []any{new(RunStepEvent)}
+		case *CreateEmbeddingRequest:
+			responses = []any{new(CreateEmbeddingResponse)}
+		case *CreateImageRequest, *CreateImageEditRequest, *CreateImageVariationRequest:
+			responses = []any{new(ImagesResponse)}
+		case *CreateSpeechRequest:
+			responses = []any{new(CreateSpeechResponse)}
+		case *CreateTranscriptionRequest:
+			responses = []any{new(CreateTranscriptionResponse)}
+		case *CreateTranslationRequest:
+			responses = []any{new(CreateTranslationResponse)}
+		}
+
+		for _, response := range responses {
+			if err = tx.Delete(response, "request_id = ?", id).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(job, "id = ?", id).Error
+	})
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+func TestQueueStats(t *testing.T) {
+	var (
+		gdb   = newMigratedDB(t)
+		tx    = gdb.WithContext(context.Background())
+		lease = Lease{Duration: time.Minute, MaxAttempts: 3}
+	)
+
+	for i := 0; i < 3; i++ {
+		if err := Create(tx, new(CreateChatCompletionRequest)); err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+	}
+	if err := Dequeue(tx, new(CreateChatCompletionRequest), "agent-1", lease); err != nil {
+		t.Fatalf("failed to dequeue request: %v", err)
+	}
+	done := new(CreateChatCompletionRequest)
+	if err := Dequeue(tx, done, "agent-1", lease); err != nil {
+		t.Fatalf("failed to dequeue request: %v", err)
+	}
+	if err := FailJob(tx, done, new(CreateChatCompletionResponse), errors.New("failed")); err != nil {
+		t.Fatalf("failed to fail request: %v", err)
+	}
+
+	run := &Run{Status: string(openai.RunObjectStatusQueued)}
+	if err := Create(tx, run); err != nil {
+		t.Fatalf("failed to create run: %v", err)
+	}
+
+	stats, err := ListQueueStats(tx)
+	if err != nil {
+		t.Fatalf("ListQueueStats() = %v", err)
+	}
+	if len(stats) != len(QueueNames()) {
+		t.Fatalf("ListQueueStats() returned %d queues, want %d", len(stats), len(QueueNames()))
+	}
+
+	for _, s := range stats {
+		switch s.Name {
+		case "chat_completion":
+			if s.Pending != 1 || s.Claimed != 1 || s.Done != 1 {
+				t.Errorf("chat completion queue has %d pending, %d claimed, %d done, want 1 of each", s.Pending, s.Claimed, s.Done)
+			}
+			if s.ClaimsByAgent["agent-1"] != 1 {
+				t.Errorf("chat completion queue has %d claims by agent-1, want 1", s.ClaimsByAgent["agent-1"])
+			}
+			if s.OldestPendingAge == nil {
+				t.Errorf("chat completion queue should report the age of the oldest pending job")
+			}
+		case "run":
+			if s.Pending != 1 || s.Claimed != 0 || s.Done != 0 {
+				t.Errorf("run queue has %d pending, %d claimed, %d done, want 1 pending", s.Pending, s.Claimed, s.Done)
+			}
+		}
+	}
+}
+
+func TestAdminJobActions(t *testing.T) {
+	var (
+		gdb   = newMigratedDB(t)
+		tx    = gdb.WithContext(context.Background())
+		lease = Lease{Duration: time.Minute, MaxAttempts: 3}
+	)
+
+	request := new(CreateChatCompletionRequest)
+	request.Stream = z.Pointer(true)
+	if err := Create(tx, request); err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if err := Dequeue(tx, new(CreateChatCompletionRequest), "agent-1", lease); err != nil {
+		t.Fatalf("failed to dequeue request: %v", err)
+	}
+
+	if err := RequeueJob(tx, "nope", request.ID); !errors.Is(err, ErrUnknownQueue) {
+		t.Errorf("RequeueJob() with an unknown queue = %v, want %v", err, ErrUnknownQueue)
+	}
+
+	// Requeuing releases the claim so that another agent can claim the request immediately.
+	if err := RequeueJob(tx, "chat_completion", request.ID); err != nil {
+		t.Fatalf("RequeueJob() = %v", err)
+	}
+	claimed := new(CreateChatCompletionRequest)
+	if err := Dequeue(tx, claimed, "agent-2", lease); err != nil {
+		t.Fatalf("failed to dequeue requeued request: %v", err)
+	}
+	if claimed.Attempts != 1 {
+		t.Errorf("requeued request was claimed with %d attempts, want 1", claimed.Attempts)
+	}
+
+	// Cancelling a claimed request only marks it, and the agent fails it with a final chunk.
+	if err := CancelJob(tx, "chat_completion", request.ID); err != nil {
+		t.Fatalf("CancelJob() = %v", err)
+	}
+	if err := tx.Where("id = ?", request.ID).First(claimed).Error; err != nil || claimed.Done || claimed.CancelReason != ErrJobCancelled.Error() {
+		t.Fatalf("cancelled request has done %v and cancel reason %q (err: %v)", claimed.Done, claimed.CancelReason, err)
+	}
+	if err := FailCancelledJob(tx, claimed, new(ChatCompletionResponseChunk)); err != nil {
+		t.Fatalf("FailCancelledJob() = %v", err)
+	}
+	chunk := new(ChatCompletionResponseChunk)
+	if err := tx.Where("request_id = ?", request.ID).First(chunk).Error; err != nil {
+		t.Fatalf("failed to get the chunk for the cancelled request: %v", err)
+	}
+	if !chunk.Done || chunk.GetErrorString() != ErrJobCancelled.Error() {
+		t.Errorf("cancelled request's chunk has done %v and error %q", chunk.Done, chunk.GetErrorString())
+	}
+	if err := CancelJob(tx, "chat_completion", request.ID); !errors.Is(err, ErrJobDone) {
+		t.Errorf("CancelJob() on a done request = %v, want %v", err, ErrJobDone)
+	}
+	if err := RequeueJob(tx, "chat_completion", request.ID); !errors.Is(err, ErrJobDone) {
+		t.Errorf("RequeueJob() on a done request = %v, want %v", err, ErrJobDone)
+	}
+
+	// Purging deletes the request and its responses.
+	if err := PurgeJob(tx, "chat_completion", request.ID); err != nil {
+		t.Fatalf("PurgeJob() = %v", err)
+	}
+	var count int64
+	if err := tx.Model(new(ChatCompletionResponseChunk)).Where("request_id = ?", request.ID).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("purged request has %d chunks left (err: %v)", count, err)
+	}
+	if err := CancelJob(tx, "chat_completion", request.ID); err == nil {
+		t.Errorf("CancelJob() on a purged request should fail")
+	}
+}
+
+func TestCancelDisconnectedJob(t *testing.T) {
+	var (
+		gdb = newMigratedDB(t)
+		tx  = gdb.WithContext(context.Background())
+	)
+
+	request := new(CreateEmbeddingRequest)
+	if err := Create(tx, request); err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	if err := CancelDisconnectedJob(tx, "embeddings", request.ID); err != nil {
+		t.Fatalf("CancelDisconnectedJob() = %v", err)
+	}
+	response := new(CreateEmbeddingResponse)
+	if err := tx.Where("request_id = ?", request.ID).First(response).Error; err != nil {
+		t.Fatalf("failed to get the response for the cancelled request: %v", err)
+	}
+	if response.GetStatusCode() != StatusClientClosedRequest || response.GetErrorString() != ErrClientDisconnected.Error() {
+		t.Errorf("cancelled request's response has status code %d and error %q", response.GetStatusCode(), response.GetErrorString())
+	}
+	if err := CancelDisconnectedJob(tx, "embeddings", request.ID); !errors.Is(err, ErrJobDone) {
+		t.Errorf("CancelDisconnectedJob() on a done request = %v, want %v", err, ErrJobDone)
+	}
+
+	// A claimed request is failed by its agent with the same error.
+	request = new(CreateEmbeddingRequest)
+	if err := Create(tx, request); err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if err := Dequeue(tx, request, "agent-1", Lease{Duration: time.Minute, MaxAttempts: 3}); err != nil {
+		t.Fatalf("failed to dequeue request: %v", err)
+	}
+	if err := CancelDisconnectedJob(tx, "embeddings", request.ID); err != nil {
+		t.Fatalf("CancelDisconnectedJob() = %v", err)
+	}
+	if err := FailCancelledJob(tx, request, new(CreateEmbeddingResponse)); err != nil {
+		t.Fatalf("FailCancelledJob() = %v", err)
+	}
+	response = new(CreateEmbeddingResponse)
+	if err := tx.Where("request_id = ?", request.ID).First(response).Error; err != nil {
+		t.Fatalf("failed to get the response for the cancelled request: %v", err)
+	}
+	if response.GetStatusCode() != StatusClientClosedRequest || response.GetErrorString() != ErrClientDisconnected.Error() {
+		t.Errorf("cancelled request's response has status code %d and error %q", response.GetStatusCode(), response.GetErrorString())
+	}
+	if err := FailCancelledJob(tx, request, new(CreateEmbeddingResponse)); err != nil {
+		t.Errorf("FailCancelledJob() on a done request = %v", err)
+	}
+}
@@ -12,8 +12,8 @@ import (
 type Run struct {
 	Metadata       `json:",inline"`
 	AssistantID    string                                           `json:"assistant_id"`
-	ThreadID       string                                           `json:"thread_id"`
-	Status         string                                           `json:"status"`
+	ThreadID       string                                           `json:"thread_id" gorm:"index"`
+	Status         string                                           `json:"status" gorm:"index:,composite:claim,priority:1"`
 	RequiredAction datatypes.JSONType[*RunRequiredAction]           `json:"required_action"`
 	LastError      datatypes.JSONType[*RunLastError]                `json:"last_error"`
 	ExpiresAt      *int                                             `json:"expires_at,omitempty"`
@@ -28,16 +28,32 @@ type Run struct {
 	Usage          datatypes.JSONType[*openai.RunCompletionUsage]   `json:"usage"`
 
 	// These are not part of the public API
-	ClaimedBy       *string `json:"claimed_by,omitempty"`
-	SystemClaimedBy *string `json:"system_claimed_by,omitempty"`
-	SystemStatus    *string `json:"system_status,omitempty"`
+	ClaimedBy       *string `json:"claimed_by,omitempty" gorm:"index:,composite:claim,priority:2"`
+	SystemClaimedBy *string `json:"system_claimed_by,omitempty" gorm:"index:,composite:system_claim,priority:2"`
+	SystemStatus    *string `json:"system_status,omitempty" gorm:"index:,composite:system_claim,priority:1"`
 	EventIndex      int     `json:"event_index,omitempty"`
+
+	LeaseExpiresAt       *int `json:"lease_expires_at,omitempty"`
+	Attempts             int  `json:"attempts,omitempty"`
+	SystemLeaseExpiresAt *int `json:"system_lease_expires_at,omitempty"`
+	SystemAttempts       int  `json:"system_attempts,omitempty"`
+	Priority             int  `json:"priority,omitempty"`
+
+	TraceParent string `json:"trace_parent,omitempty"`
 }
 
 func (r *Run) IDPrefix() string {
 	return "run_"
 }
 
+func (r *Run) GetTraceParent() string {
+	return r.TraceParent
+}
+
+func (r *Run) SetTraceParent(traceParent string) {
+	r.TraceParent = traceParent
+}
+
 func (r *Run) ToPublic() any {
 	//nolint:govet
 	return &openai.RunObject{
@@ -117,6 +133,14 @@ func (r *Run) FromPublic(obj any) error {
 			nil,
 			nil,
 			0,
+
+			nil,
+			0,
+			nil,
+			0,
+			0,
+
+			"",
 		}
 	}
 
@@ -5,6 +5,16 @@ import (
 	"gorm.io/datatypes"
 )
 
+// Run events that aren't part of the OpenAI API. Clients that don't know about them can ignore them.
+const (
+	// RunEventRetrying is recorded when a failed chat completion request for a run is retried. The run's last error is
+	// set to the error that is being retried.
+	RunEventRetrying = "thread.run.x-retrying"
+	// RunEventFallback is recorded when a run falls back to another model. The run's model is set to the fallback
+	// model, and its last error is set to the error that caused the fallback.
+	RunEventFallback = "thread.run.x-fallback"
+)
+
 type RunEvent struct {
 	JobResponse `json:",inline"`
 	Base        `json:",inline"`
@@ -16,7 +26,7 @@ type RunEvent struct {
 	RunStepDelta datatypes.JSONType[*RunStepDelta] `json:"run_step_delta,omitempty"`
 	Message      datatypes.JSONType[*Message]      `json:"message,omitempty"`
 	MessageDelta datatypes.JSONType[*MessageDelta] `json:"message_delta,omitempty"`
-	ResponseIdx  int                               `json:"response_idx"`
+	ResponseIdx  int                               `json:"response_idx" gorm:"index:,composite:request,priority:2"`
 }
 
 func (r *RunEvent) IDPrefix() string {
@@ -20,11 +20,11 @@ type RunStep struct {
 	ExpiredAt   *int                                                 `json:"expired_at"`
 	FailedAt    *int                                                 `json:"failed_at"`
 	LastError   datatypes.JSONType[RunLastError]                     `json:"last_error"`
-	RunID       string                                               `json:"run_id"`
-	Status      string                                               `json:"status"`
+	RunID       string                                               `json:"run_id" gorm:"index:,composite:run_status_type,priority:1"`
+	Status      string                                               `json:"status" gorm:"index:,composite:run_status_type,priority:2"`
 	StepDetails datatypes.JSONType[openai.RunStepObject_StepDetails] `json:"step_details"`
 	ThreadID    string                                               `json:"thread_id"`
-	Type        string                                               `json:"type"`
+	Type        string                                               `json:"type" gorm:"index:,composite:run_status_type,priority:3"`
 	Usage       datatypes.JSONType[*openai.RunStepCompletionUsage]   `json:"usage"`
 
 	// These are not part of the public API
@@ -27,7 +27,7 @@ type RunStepEvent struct {
 	Input              string                  `json:"input,omitempty"`
 	Output             string                  `json:"output,omitempty"`
 	Err                string                  `json:"err,omitempty"`
-	ResponseIdx        int                     `json:"response_idx"`
+	ResponseIdx        int                     `json:"response_idx" gorm:"index:,composite:request,priority:2"`
 }
 
 func (r *RunStepEvent) IDPrefix() string {
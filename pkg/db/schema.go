@@ -0,0 +1,398 @@
+package db
+
+import (
+	"slices"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// migrations is the ordered list of schema migrations. New migrations must be appended with the next version number and
+// must never be modified once released.
+//
+// Migrations don't use the models, which change over time. The initial migration creates the tables from the snapshots
+// in schema_v1.go, and later migrations declare the columns and indexes they add in snapshots of their own.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				for _, t := range v1Tables() {
+					if err := tx.Table(t.name).AutoMigrate(t.model); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				tables := v1Tables()
+				slices.Reverse(tables)
+				for _, t := range tables {
+					if err := tx.Migrator().DropTable(t.name); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add indexes for hot queries",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return createIndexes(tx, hotQueryIndexes())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropIndexes(tx, hotQueryIndexes())
+			},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add job leases",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, leaseColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, leaseColumns())
+			},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add job priorities",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, priorityColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, priorityColumns())
+			},
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add trace context",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, traceColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, traceColumns())
+			},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add chat completion cache",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, cacheColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, cacheColumns())
+			},
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add image files",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, imageFileColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, imageFileColumns())
+			},
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add job cancellation",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, cancelColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, cancelColumns())
+			},
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add embeddings API key hashes",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return addColumns(tx, embeddingsKeyColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				return dropColumns(tx, embeddingsKeyColumns())
+			},
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add chat completion retries",
+		Up: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				if err := tx.Table("chat_completion_retries").AutoMigrate(v10ChatCompletionRetry{}); err != nil {
+					return err
+				}
+				return addColumns(tx, retryColumns())
+			},
+		},
+		Down: map[string]MigrationFunc{
+			anyDialect: func(tx *gorm.DB) error {
+				if err := dropColumns(tx, retryColumns()); err != nil {
+					return err
+				}
+				return tx.Migrator().DropTable("chat_completion_retries")
+			},
+		},
+	},
+}
+
+// requestTables are the tables of the models that embed JobRequest.
+var requestTables = []string{
+	"create_chat_completion_requests",
+	"create_image_requests",
+	"create_image_edit_requests",
+	"create_image_variation_requests",
+	"create_embedding_requests",
+	"create_speech_requests",
+	"create_translation_requests",
+	"create_transcription_requests",
+	"run_tool_objects",
+}
+
+// Indexes added by version 2.
+
+type v2CreatedAtIndex struct {
+	CreatedAt int `gorm:"index"`
+}
+
+type v2RequestIndexes struct {
+	CreatedAt int     `gorm:"index"`
+	ClaimedBy *string `gorm:"index:,composite:claim,priority:1"`
+	Done      bool    `gorm:"index:,composite:claim,priority:2"`
+}
+
+type v2ResponseIndexes struct {
+	CreatedAt int    `gorm:"index"`
+	RequestID string `gorm:"index:,composite:request,priority:1"`
+}
+
+type v2IndexedResponseIndexes struct {
+	CreatedAt   int    `gorm:"index"`
+	RequestID   string `gorm:"index:,composite:request,priority:1"`
+	ResponseIdx int    `gorm:"index:,composite:request,priority:2"`
+}
+
+type v2RunIndexes struct {
+	CreatedAt       int     `gorm:"index"`
+	ThreadID        string  `gorm:"index"`
+	Status          string  `gorm:"index:,composite:claim,priority:1"`
+	ClaimedBy       *string `gorm:"index:,composite:claim,priority:2"`
+	SystemStatus    *string `gorm:"index:,composite:system_claim,priority:1"`
+	SystemClaimedBy *string `gorm:"index:,composite:system_claim,priority:2"`
+}
+
+type v2RunStepIndexes struct {
+	CreatedAt int    `gorm:"index"`
+	RunID     string `gorm:"index:,composite:run_status_type,priority:1"`
+	Status    string `gorm:"index:,composite:run_status_type,priority:2"`
+	Type      string `gorm:"index:,composite:run_status_type,priority:3"`
+}
+
+type v2MessageIndexes struct {
+	CreatedAt int    `gorm:"index"`
+	ThreadID  string `gorm:"index"`
+}
+
+// hotQueryIndexes are the indexes used by the agents when claiming jobs and by the server when streaming responses.
+func hotQueryIndexes() []tableIndexes {
+	return []tableIndexes{
+		{tables: requestTables, model: v2RequestIndexes{}},
+		{
+			tables: []string{
+				"create_chat_completion_responses",
+				"images_responses",
+				"create_embedding_responses",
+				"create_speech_responses",
+				"create_translation_responses",
+				"create_transcription_responses",
+			},
+			model: v2ResponseIndexes{},
+		},
+		{tables: []string{"chat_completion_response_chunks", "run_events", "run_step_events"}, model: v2IndexedResponseIndexes{}},
+		{tables: []string{"runs"}, model: v2RunIndexes{}},
+		{tables: []string{"run_steps"}, model: v2RunStepIndexes{}},
+		{tables: []string{"messages"}, model: v2MessageIndexes{}},
+		{
+			tables: []string{
+				"threads",
+				"message_files",
+				"files",
+				"assistants",
+				"assistant_files",
+				"fine_tuning_jobs",
+				"models",
+				"tools",
+				"built_in_tools",
+			},
+			model: v2CreatedAtIndex{},
+		},
+	}
+}
+
+// Columns added by version 3.
+
+type v3RequestLease struct {
+	LeaseExpiresAt *int
+	Attempts       int
+}
+
+type v3RunLease struct {
+	LeaseExpiresAt       *int
+	Attempts             int
+	SystemLeaseExpiresAt *int
+	SystemAttempts       int
+}
+
+// leaseColumns are the columns that track an agent's lease on a job and the number of times the job has been attempted.
+func leaseColumns() []tableColumns {
+	return []tableColumns{
+		{tables: []string{"runs"}, model: v3RunLease{}},
+		{tables: requestTables, model: v3RequestLease{}},
+	}
+}
+
+// Columns added by version 4.
+
+type v4Priority struct {
+	Priority int
+}
+
+// priorityColumns are the columns that determine the order in which jobs are claimed.
+func priorityColumns() []tableColumns {
+	return []tableColumns{
+		{tables: append([]string{"runs"}, requestTables...), model: v4Priority{}},
+	}
+}
+
+// Columns added by version 5.
+
+type v5TraceParent struct {
+	TraceParent string
+}
+
+// traceColumns are the columns that store the trace context of a job's creator.
+func traceColumns() []tableColumns {
+	return []tableColumns{
+		{tables: append([]string{"runs"}, requestTables...), model: v5TraceParent{}},
+	}
+}
+
+// Columns added by version 6.
+
+type v6APIKeyHash struct {
+	APIKeyHash string
+}
+
+type v6CacheHit struct {
+	CacheHit bool
+}
+
+// cacheColumns are the columns that scope cached chat completions to API keys, and mark the responses that were cached.
+func cacheColumns() []tableColumns {
+	return []tableColumns{
+		{tables: []string{"create_chat_completion_requests"}, model: v6APIKeyHash{}},
+		{tables: []string{"create_chat_completion_responses", "chat_completion_response_chunks"}, model: v6CacheHit{}},
+	}
+}
+
+// Columns added by version 7.
+
+type v7ImageFiles struct {
+	FileIDs datatypes.JSON
+}
+
+// imageFileColumns are the columns that reference the files that generated images are stored as.
+func imageFileColumns() []tableColumns {
+	return []tableColumns{
+		{tables: []string{"images_responses"}, model: v7ImageFiles{}},
+	}
+}
+
+// Columns added by version 8.
+
+type v8CancelReason struct {
+	CancelReason string
+}
+
+// cancelColumns are the columns that mark requests that were cancelled while an agent was processing them.
+func cancelColumns() []tableColumns {
+	return []tableColumns{
+		{tables: requestTables, model: v8CancelReason{}},
+	}
+}
+
+// Columns added by version 9.
+
+type v9APIKeyHash struct {
+	APIKeyHash string
+}
+
+// embeddingsKeyColumns are the columns that scope cached embeddings to API keys.
+func embeddingsKeyColumns() []tableColumns {
+	return []tableColumns{
+		{tables: []string{"create_embedding_requests"}, model: v9APIKeyHash{}},
+	}
+}
+
+// Table and columns added by version 10.
+
+type v10ChatCompletionRetry struct {
+	ID            string `gorm:"primarykey"`
+	CreatedAt     int    `gorm:"index:idx_chat_completion_retries_created_at"`
+	RequestID     string `gorm:"index:idx_chat_completion_retries_request_id"`
+	RetryIdx      int
+	Model         string
+	FallbackModel string
+	Attempt       int
+	Delay         int
+	Error         string
+	StatusCode    int
+}
+
+type v10AssistantID struct {
+	AssistantID string
+}
+
+// retryColumns are the columns that chat completion requests need for the fallback models of assistants.
+func retryColumns() []tableColumns {
+	return []tableColumns{
+		{tables: []string{"create_chat_completion_requests"}, model: v10AssistantID{}},
+	}
+}
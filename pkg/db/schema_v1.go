@@ -0,0 +1,456 @@
+package db
+
+import "gorm.io/datatypes"
+
+// The structs in this file are snapshots of the models as of schema version 1, which the initial migration creates the
+// tables from. They must never be changed: later changes to the schema are made by new migrations, so that the initial
+// migration creates the same tables no matter how the models change.
+//
+// JSON fields are declared as datatypes.JSON, which has the same column type as the typed JSON fields of the models.
+
+type v1Thread struct {
+	ID            string `gorm:"primarykey"`
+	CreatedAt     int
+	Metadata      datatypes.JSON
+	LockedByRunID string
+}
+
+type v1Message struct {
+	ID                string `gorm:"primarykey"`
+	CreatedAt         int
+	Metadata          datatypes.JSON
+	Role              string
+	Content           datatypes.JSON
+	AssistantID       *string
+	ThreadID          string
+	RunID             *string
+	FileIDs           datatypes.JSON
+	Status            string
+	CompletedAt       *int
+	IncompleteAt      *int
+	IncompleteDetails datatypes.JSON
+}
+
+type v1Run struct {
+	ID              string `gorm:"primarykey"`
+	CreatedAt       int
+	Metadata        datatypes.JSON
+	AssistantID     string
+	ThreadID        string
+	Status          string
+	RequiredAction  datatypes.JSON
+	LastError       datatypes.JSON
+	ExpiresAt       *int
+	StartedAt       *int
+	CancelledAt     *int
+	CompletedAt     *int
+	FailedAt        *int
+	Model           string
+	Instructions    string
+	Tools           datatypes.JSON
+	FileIDs         datatypes.JSON
+	Usage           datatypes.JSON
+	ClaimedBy       *string
+	SystemClaimedBy *string
+	SystemStatus    *string
+	EventIndex      int
+}
+
+type v1MessageFile struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt int
+	MessageID string
+}
+
+type v1File struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt int
+	Content   []byte
+	Purpose   string
+	Filename  string
+}
+
+type v1Assistant struct {
+	ID           string `gorm:"primarykey"`
+	CreatedAt    int
+	Metadata     datatypes.JSON
+	Description  *string
+	FileIDs      datatypes.JSON
+	Instructions *string
+	Model        string
+	Name         *string
+	Tools        datatypes.JSON
+}
+
+type v1AssistantFile struct {
+	ID          string `gorm:"primarykey"`
+	CreatedAt   int
+	AssistantID string
+}
+
+type v1FineTuningJob struct {
+	ID              string `gorm:"primarykey"`
+	CreatedAt       int
+	Error           datatypes.JSON
+	FineTunedModel  *string
+	FinishedAt      *int
+	Hyperparameters datatypes.JSON
+	Model           string
+	OrganizationID  string
+	ResultFiles     datatypes.JSON
+	Status          string
+	TrainedTokens   *int
+	TrainingFile    string
+	ValidationFile  *string
+}
+
+type v1Model struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt int
+	OwnedBy   string
+}
+
+type v1CreateChatCompletionRequest struct {
+	ID               string `gorm:"primarykey"`
+	CreatedAt        int
+	ClaimedBy        *string
+	Done             bool
+	ModelAPI         string
+	FrequencyPenalty *float32
+	LogitBias        datatypes.JSON
+	Logprobs         *bool
+	MaxTokens        *int
+	Messages         datatypes.JSON
+	Model            string
+	N                *int
+	PresencePenalty  *float32
+	ResponseFormat   *string
+	Seed             *int
+	Stop             datatypes.JSON
+	Stream           *bool
+	Temperature      *float32
+	ToolChoice       datatypes.JSON
+	Tools            datatypes.JSON
+	TopLogprobs      *int
+	TopP             *float32
+	User             *string
+}
+
+type v1CreateChatCompletionResponse struct {
+	RequestID         string
+	Error             *string
+	StatusCode        int
+	Done              bool
+	ID                string `gorm:"primarykey"`
+	CreatedAt         int
+	Choices           datatypes.JSON
+	Model             string
+	SystemFingerprint *string
+	Usage             datatypes.JSON
+}
+
+type v1ChatCompletionResponseChunk struct {
+	ID                string `gorm:"primarykey"`
+	CreatedAt         int
+	Choices           datatypes.JSON
+	Model             string
+	SystemFingerprint *string
+	RequestID         string
+	Error             *string
+	StatusCode        int
+	Done              bool
+	ResponseIdx       int
+}
+
+type v1RunStep struct {
+	ID                 string `gorm:"primarykey"`
+	CreatedAt          int
+	Metadata           datatypes.JSON
+	AssistantID        string
+	CancelledAt        *int
+	CompletedAt        *int
+	ExpiredAt          *int
+	FailedAt           *int
+	LastError          datatypes.JSON
+	RunID              string
+	Status             string
+	StepDetails        datatypes.JSON
+	ThreadID           string
+	Type               string
+	Usage              datatypes.JSON
+	ClaimedBy          *string
+	RunnerType         *string
+	RetrievalArguments string
+}
+
+type v1CreateImageRequest struct {
+	ID             string `gorm:"primarykey"`
+	CreatedAt      int
+	ClaimedBy      *string
+	Done           bool
+	Model          *string
+	N              *int
+	Prompt         string
+	Quality        *string
+	ResponseFormat *string
+	Size           *string
+	Style          *string
+	User           *string
+}
+
+type v1CreateImageEditRequest struct {
+	ID             string `gorm:"primarykey"`
+	CreatedAt      int
+	ClaimedBy      *string
+	Done           bool
+	Image          []byte
+	Mask           []byte
+	Model          *string
+	N              *int
+	Prompt         string
+	ResponseFormat *string
+	Size           *string
+	User           *string
+}
+
+type v1CreateImageVariationRequest struct {
+	ID             string `gorm:"primarykey"`
+	CreatedAt      int
+	ClaimedBy      *string
+	Done           bool
+	Image          []byte
+	Model          *string
+	N              *int
+	ResponseFormat *string
+	Size           *string
+	User           *string
+}
+
+type v1ImagesResponse struct {
+	RequestID  string
+	Error      *string
+	StatusCode int
+	Done       bool
+	ID         string `gorm:"primarykey"`
+	CreatedAt  int
+	Data       datatypes.JSON
+}
+
+type v1CreateEmbeddingRequest struct {
+	ID             string `gorm:"primarykey"`
+	CreatedAt      int
+	ClaimedBy      *string
+	Done           bool
+	ModelAPI       string
+	Input          datatypes.JSON
+	Model          string
+	EncodingFormat *string
+	Dimensions     *int
+	User           *string
+}
+
+type v1CreateEmbeddingResponse struct {
+	RequestID  string
+	Error      *string
+	StatusCode int
+	Done       bool
+	ID         string `gorm:"primarykey"`
+	CreatedAt  int
+	Data       datatypes.JSON
+	Model      string
+	Usage      datatypes.JSON
+}
+
+type v1CreateSpeechRequest struct {
+	ID             string `gorm:"primarykey"`
+	CreatedAt      int
+	ClaimedBy      *string
+	Done           bool
+	Input          string
+	Model          datatypes.JSON
+	ResponseFormat *string
+	Speed          *float32
+	Voice          string
+}
+
+type v1CreateSpeechResponse struct {
+	RequestID  string
+	Error      *string
+	StatusCode int
+	Done       bool
+	ID         string `gorm:"primarykey"`
+	CreatedAt  int
+	Content    []byte
+}
+
+type v1CreateTranslationRequest struct {
+	ID             string `gorm:"primarykey"`
+	CreatedAt      int
+	ClaimedBy      *string
+	Done           bool
+	FileName       string
+	File           []byte
+	Model          string
+	Prompt         *string
+	ResponseFormat *string
+	Temperature    *float32
+}
+
+type v1CreateTranslationResponse struct {
+	RequestID  string
+	Error      *string
+	StatusCode int
+	Done       bool
+	ID         string `gorm:"primarykey"`
+	CreatedAt  int
+	Text       string
+}
+
+type v1CreateTranscriptionRequest struct {
+	ID                     string `gorm:"primarykey"`
+	CreatedAt              int
+	ClaimedBy              *string
+	Done                   bool
+	FileName               string
+	File                   []byte
+	Language               *string
+	Model                  string
+	Prompt                 *string
+	ResponseFormat         *string
+	Temperature            *float32
+	TimestampGranularities datatypes.JSON
+}
+
+type v1CreateTranscriptionResponse struct {
+	RequestID  string
+	Error      *string
+	StatusCode int
+	Done       bool
+	ID         string `gorm:"primarykey"`
+	CreatedAt  int
+	Text       string
+}
+
+type v1Tool struct {
+	ID          string `gorm:"primarykey"`
+	CreatedAt   int
+	Name        string
+	Description string
+	Contents    *string
+	URL         *string
+	Subtool     *string
+	EnvVars     datatypes.JSON
+	Program     datatypes.JSON
+}
+
+type v1BuiltInTool struct {
+	ID          string `gorm:"primarykey"`
+	CreatedAt   int
+	Name        string
+	Description string
+	Contents    *string
+	URL         *string
+	Subtool     *string
+	EnvVars     datatypes.JSON
+	Program     datatypes.JSON
+	Commit      string
+}
+
+type v1RunEvent struct {
+	RequestID    string
+	Error        *string
+	StatusCode   int
+	Done         bool
+	ID           string `gorm:"primarykey"`
+	CreatedAt    int
+	EventName    string
+	Run          datatypes.JSON
+	Thread       datatypes.JSON
+	RunStep      datatypes.JSON
+	RunStepDelta datatypes.JSON
+	Message      datatypes.JSON
+	MessageDelta datatypes.JSON
+	ResponseIdx  int
+}
+
+type v1RunStepEvent struct {
+	ID                 string `gorm:"primarykey"`
+	CreatedAt          int
+	RequestID          string
+	Error              *string
+	StatusCode         int
+	Done               bool
+	CallContext        datatypes.JSON
+	ToolSubCalls       datatypes.JSON
+	ToolResults        int
+	Type               string
+	ChatCompletionID   string
+	ChatRequest        datatypes.JSON
+	ChatResponse       datatypes.JSON
+	ChatResponseCached bool
+	Content            string
+	RunID              string
+	Input              string
+	Output             string
+	Err                string
+	ResponseIdx        int
+}
+
+type v1RunToolObject struct {
+	ID            string `gorm:"primarykey"`
+	CreatedAt     int
+	ClaimedBy     *string
+	Done          bool
+	EnvVars       datatypes.JSON
+	File          string
+	Input         string
+	Subtool       string
+	Chdir         string
+	DisableCache  bool
+	DangerousMode bool
+	Output        string
+	Status        string
+	Confirmed     *bool
+}
+
+// v1Table is a table of schema version 1 and the snapshot of its model.
+type v1Table struct {
+	name  string
+	model any
+}
+
+// v1Tables are the tables of schema version 1, in the order they are created.
+func v1Tables() []v1Table {
+	return []v1Table{
+		{"threads", v1Thread{}},
+		{"messages", v1Message{}},
+		{"runs", v1Run{}},
+		{"message_files", v1MessageFile{}},
+		{"files", v1File{}},
+		{"assistants", v1Assistant{}},
+		{"assistant_files", v1AssistantFile{}},
+		{"fine_tuning_jobs", v1FineTuningJob{}},
+		{"models", v1Model{}},
+		{"create_chat_completion_requests", v1CreateChatCompletionRequest{}},
+		{"create_chat_completion_responses", v1CreateChatCompletionResponse{}},
+		{"chat_completion_response_chunks", v1ChatCompletionResponseChunk{}},
+		{"run_steps", v1RunStep{}},
+		{"create_image_requests", v1CreateImageRequest{}},
+		{"create_image_edit_requests", v1CreateImageEditRequest{}},
+		{"create_image_variation_requests", v1CreateImageVariationRequest{}},
+		{"images_responses", v1ImagesResponse{}},
+		{"create_embedding_requests", v1CreateEmbeddingRequest{}},
+		{"create_embedding_responses", v1CreateEmbeddingResponse{}},
+		{"create_speech_requests", v1CreateSpeechRequest{}},
+		{"create_speech_responses", v1CreateSpeechResponse{}},
+		{"create_translation_requests", v1CreateTranslationRequest{}},
+		{"create_translation_responses", v1CreateTranslationResponse{}},
+		{"create_transcription_requests", v1CreateTranscriptionRequest{}},
+		{"create_transcription_responses", v1CreateTranscriptionResponse{}},
+		{"tools", v1Tool{}},
+		{"built_in_tools", v1BuiltInTool{}},
+		{"run_events", v1RunEvent{}},
+		{"run_step_events", v1RunStepEvent{}},
+		{"run_tool_objects", v1RunToolObject{}},
+	}
+}
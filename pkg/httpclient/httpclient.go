@@ -0,0 +1,244 @@
+// Package httpclient makes the transports of the HTTP clients that the agents use, so that requests can be sent
+// through a proxy, trust internal certificate authorities, present a client certificate and time out.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Config configures a transport. Durations are parsed with time.ParseDuration, and empty fields keep the defaults of
+// http.DefaultTransport.
+type Config struct {
+	// Proxy is the URL of the proxy that requests are sent through. By default, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables are used.
+	Proxy string `json:"proxy,omitempty"`
+	// CAFile is a PEM file with certificate authorities that are trusted in addition to the system's.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the PEM files of the client certificate that is presented to servers that request one.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// DialTimeout limits the time taken to connect, and TLSHandshakeTimeout the time taken by the TLS handshake.
+	DialTimeout         string `json:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout string `json:"tlsHandshakeTimeout,omitempty"`
+	// ResponseHeaderTimeout limits the time waited for the response headers once a request is sent. It doesn't limit
+	// the time taken to read streamed responses.
+	ResponseHeaderTimeout string `json:"responseHeaderTimeout,omitempty"`
+}
+
+// IsZero returns true if nothing is configured.
+func (c Config) IsZero() bool {
+	return c == Config{}
+}
+
+// Merge returns the configuration with the fields that are set in override replacing its own.
+func (c Config) Merge(override Config) Config {
+	for _, f := range []struct{ field, override *string }{
+		{&c.Proxy, &override.Proxy},
+		{&c.CAFile, &override.CAFile},
+		{&c.CertFile, &override.CertFile},
+		{&c.KeyFile, &override.KeyFile},
+		{&c.DialTimeout, &override.DialTimeout},
+		{&c.TLSHandshakeTimeout, &override.TLSHandshakeTimeout},
+		{&c.ResponseHeaderTimeout, &override.ResponseHeaderTimeout},
+	} {
+		if *f.override != "" {
+			*f.field = *f.override
+		}
+	}
+
+	return c
+}
+
+// LogValue logs the fields that are set. Credentials in the proxy URL are redacted.
+func (c Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	if c.Proxy != "" {
+		proxy := c.Proxy
+		if u, err := url.Parse(c.Proxy); err == nil {
+			proxy = u.Redacted()
+		}
+		attrs = append(attrs, slog.String("proxy", proxy))
+	}
+	for _, f := range []struct{ key, value string }{
+		{"ca_file", c.CAFile},
+		{"cert_file", c.CertFile},
+		{"key_file", c.KeyFile},
+		{"dial_timeout", c.DialTimeout},
+		{"tls_handshake_timeout", c.TLSHandshakeTimeout},
+		{"response_header_timeout", c.ResponseHeaderTimeout},
+	} {
+		if f.value != "" {
+			attrs = append(attrs, slog.String(f.key, f.value))
+		}
+	}
+	if len(attrs) == 0 {
+		return slog.StringValue("defaults")
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// NewTransport returns a transport with the configuration.
+func (c Config) NewTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if c.DialTimeout != "" {
+		timeout, err := time.ParseDuration(c.DialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial timeout: %w", err)
+		}
+		transport.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	for _, t := range []struct {
+		name, value string
+		timeout     *time.Duration
+	}{
+		{"TLS handshake", c.TLSHandshakeTimeout, &transport.TLSHandshakeTimeout},
+		{"response header", c.ResponseHeaderTimeout, &transport.ResponseHeaderTimeout},
+	} {
+		if t.value == "" {
+			continue
+		}
+
+		timeout, err := time.ParseDuration(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s timeout: %w", t.name, err)
+		}
+		*t.timeout = timeout
+	}
+
+	return transport, nil
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %s has no PEM certificates", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("a client certificate needs both a certificate and a key file")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Factory makes transports with a default configuration, which can be overridden, for example for a provider. A nil
+// factory makes transports with the defaults of http.DefaultTransport.
+type Factory struct {
+	defaults  Config
+	transport http.RoundTripper
+	wrap      func(http.RoundTripper) http.RoundTripper
+}
+
+// NewFactory returns a factory with the default configuration.
+func NewFactory(defaults Config) (*Factory, error) {
+	transport, err := defaults.NewTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Factory{defaults: defaults, transport: transport}, nil
+}
+
+// Wrap returns a factory whose transports are wrapped, for example to record the requests that are sent with them.
+func (f *Factory) Wrap(wrap func(http.RoundTripper) http.RoundTripper) *Factory {
+	if f == nil {
+		f = &Factory{transport: http.DefaultTransport}
+	}
+
+	wrapped := *f
+	if f.wrap != nil {
+		wrapped.wrap = func(t http.RoundTripper) http.RoundTripper {
+			return wrap(f.wrap(t))
+		}
+	} else {
+		wrapped.wrap = wrap
+	}
+
+	return &wrapped
+}
+
+// Transport returns the transport with the default configuration, which is shared so that connections are reused. It
+// returns nil, which clients treat as http.DefaultTransport, for a nil factory.
+func (f *Factory) Transport() http.RoundTripper {
+	if f == nil {
+		return nil
+	}
+	if f.wrap != nil {
+		return f.wrap(f.transport)
+	}
+
+	return f.transport
+}
+
+// TransportFor returns a transport with the fields that are set in override replacing the default configuration.
+func (f *Factory) TransportFor(override Config) (http.RoundTripper, error) {
+	if override.IsZero() {
+		return f.Transport(), nil
+	}
+
+	var defaults Config
+	if f != nil {
+		defaults = f.defaults
+	}
+
+	transport, err := defaults.Merge(override).NewTransport()
+	if err != nil {
+		return nil, err
+	}
+	if f != nil && f.wrap != nil {
+		return f.wrap(transport), nil
+	}
+
+	return transport, nil
+}
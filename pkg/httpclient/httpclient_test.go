@@ -0,0 +1,58 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTransportFor(t *testing.T) {
+	proxied := new(atomic.Int32)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	clients, err := NewFactory(Config{DialTimeout: "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := clients.TransportFor(Config{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://upstream.invalid/v1/models")
+	if err != nil {
+		t.Fatalf("request through the proxy failed: %v", err)
+	}
+	resp.Body.Close()
+	if n := proxied.Load(); n != 1 {
+		t.Errorf("proxy got %d requests, want 1", n)
+	}
+
+	if transport, _ = clients.TransportFor(Config{}); transport != clients.Transport() {
+		t.Error("an empty override should use the shared transport")
+	}
+
+	for _, cfg := range []Config{
+		{Proxy: "://"},
+		{DialTimeout: "soon"},
+		{CertFile: "cert.pem"},
+		{CAFile: "missing.pem"},
+	} {
+		if _, err = clients.TransportFor(cfg); err == nil {
+			t.Errorf("TransportFor(%+v) should fail", cfg)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	got := Config{Proxy: "http://proxy:3128", DialTimeout: "30s"}.Merge(Config{DialTimeout: "5s", CAFile: "ca.pem"})
+	want := Config{Proxy: "http://proxy:3128", DialTimeout: "5s", CAFile: "ca.pem"}
+	if got != want {
+		t.Errorf("Merge() = %+v, want %+v", got, want)
+	}
+}
@@ -9,9 +9,11 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
 )
 
 const (
@@ -68,7 +70,7 @@ func (m *KnowledgeBaseManager) CreateKnowledgeBase(ctx context.Context, id strin
 
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := m.client.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -102,7 +104,7 @@ func (m *KnowledgeBaseManager) DeleteKnowledgeBase(ctx context.Context, id strin
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := m.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -121,14 +123,19 @@ type IngestFileRequest struct {
 	Content  string `json:"content,omitempty"` // Base64 encoded content
 }
 
-func (m *KnowledgeBaseManager) AddFile(ctx context.Context, id string, fileID string) error {
+func (m *KnowledgeBaseManager) AddFile(ctx context.Context, id string, fileID string) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.KnowledgeBaseIngestionDuration.WithLabelValues(metrics.Result(err)).Observe(metrics.Since(start))
+	}()
+
 	id = strings.ToLower(id)
 
 	url := m.KnowledgeRetrievalAPIURL + "/datasets/" + id + "/ingest"
 
 	gdb := m.db.WithContext(ctx)
 	file := new(db.File)
-	err := db.Get(gdb, file, fileID)
+	err = db.Get(gdb, file, fileID)
 	if err != nil {
 		return err
 	}
@@ -153,7 +160,7 @@ func (m *KnowledgeBaseManager) AddFile(ctx context.Context, id string, fileID st
 
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := m.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -181,7 +188,7 @@ func (m *KnowledgeBaseManager) RemoveFile(ctx context.Context, id string, fileID
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := m.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -204,7 +211,7 @@ func (m *KnowledgeBaseManager) ListFiles(ctx context.Context, id string) ([]stri
 		return nil, err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := m.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -3,6 +3,7 @@ package knowledgebases
 import (
 	"context"
 	"log/slog"
+	"net/http"
 	"os"
 	"strings"
 
@@ -17,10 +18,13 @@ type Config struct {
 
 type KnowledgeBaseManager struct {
 	Config
-	db *db.DB
+	db     *db.DB
+	client *http.Client
 }
 
-func NewKnowledgeBaseManager(ctx context.Context, config Config, db *db.DB) (*KnowledgeBaseManager, error) {
+// NewKnowledgeBaseManager returns a manager that sends requests to the knowledge retrieval API with the transport, or
+// http.DefaultTransport if it is nil.
+func NewKnowledgeBaseManager(ctx context.Context, config Config, db *db.DB, transport http.RoundTripper) (*KnowledgeBaseManager, error) {
 	if !strings.HasPrefix(config.KnowledgeRetrievalAPIURL, "http") {
 		url, err := launchKnowledge(ctx, config.KnowledgeRetrievalAPIURL)
 		if err != nil {
@@ -32,6 +36,7 @@ func NewKnowledgeBaseManager(ctx context.Context, config Config, db *db.DB) (*Kn
 	return &KnowledgeBaseManager{
 		Config: config,
 		db:     db,
+		client: &http.Client{Transport: transport},
 	}, nil
 }
 
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "clicky_chats"
+
+var (
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of API requests handled by the server, by OpenAI operation and status code.",
+	}, []string{"operation", "code"})
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle API requests, by OpenAI operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	UpstreamRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_chat_completion_requests_total",
+		Help:      "Number of chat completion requests made to the upstream provider, by model and status code.",
+	}, []string{"model", "code"})
+	UpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_chat_completion_duration_seconds",
+		Help:      "Time taken by the upstream provider to complete chat completion requests, including streaming the whole response.",
+		Buckets:   longBuckets,
+	}, []string{"model", "stream"})
+	TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_chat_completion_time_to_first_token_seconds",
+		Help:      "Time taken by the upstream provider to stream the first chunk of a chat completion.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"model"})
+	ChatCompletionCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chat_completion_cache_lookups_total",
+		Help:      "Number of chat completion requests looked up in the response cache, by model and result (hit or miss).",
+	}, []string{"model", "result"})
+	EmbeddingsCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "embeddings_cache_lookups_total",
+		Help:      "Number of embeddings inputs looked up in the embeddings cache, by model and result (hit or miss).",
+	}, []string{"model", "result"})
+	ClientDisconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_disconnects_total",
+		Help:      "Number of jobs cancelled because their client disconnected before the response was ready, by queue.",
+	}, []string{"queue"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time taken by agents to process jobs, by agent and result.",
+		Buckets:   longBuckets,
+	}, []string{"agent", "result"})
+
+	ToolCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tool_call_duration_seconds",
+		Help:      "Time taken to run tool calls, by exit code. The exit code is \"timeout\" or \"error\" if the tool didn't exit.",
+		Buckets:   longBuckets,
+	}, []string{"exit_code"})
+
+	KnowledgeBaseIngestionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "knowledge_base_ingestion_duration_seconds",
+		Help:      "Time taken to ingest files into knowledge bases, by result.",
+		Buckets:   longBuckets,
+	}, []string{"result"})
+
+	// longBuckets are for operations that wait on a model or a tool, which can take minutes.
+	longBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+)
+
+// Result is the result label for an operation that failed with err.
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+// Since returns the number of seconds since start.
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// Code is the status code label for code.
+func Code(code int) string {
+	return strconv.Itoa(code)
+}
+
+// Handler serves the metrics. The queue depths are read from the database when the metrics are scraped.
+func Handler(gdb *db.DB) http.Handler {
+	// The server and the agents both serve metrics when they run in the same process, so the queue collector may have
+	// been registered already.
+	if err := prometheus.Register(queueCollector{db: gdb}); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			slog.Error("Failed to register queue metrics", "err", err)
+		}
+	}
+
+	return promhttp.Handler()
+}
+
+var (
+	queueJobsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "jobs"),
+		"Number of jobs in each queue, by state.",
+		[]string{"queue", "state"}, nil,
+	)
+	queueOldestPendingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "oldest_pending_age_seconds"),
+		"Age of the oldest job waiting to be claimed in each queue.",
+		[]string{"queue"}, nil,
+	)
+)
+
+// queueCollector reports the depth of the job queues.
+type queueCollector struct {
+	db *db.DB
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueJobsDesc
+	ch <- queueOldestPendingDesc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stats, err := db.ListQueueStats(c.db.WithContext(ctx))
+	if err != nil {
+		slog.Error("Failed to collect queue metrics", "err", err)
+		return
+	}
+
+	for _, s := range stats {
+		ch <- prometheus.MustNewConstMetric(queueJobsDesc, prometheus.GaugeValue, float64(s.Pending), s.Name, "pending")
+		ch <- prometheus.MustNewConstMetric(queueJobsDesc, prometheus.GaugeValue, float64(s.Claimed), s.Name, "claimed")
+		ch <- prometheus.MustNewConstMetric(queueJobsDesc, prometheus.GaugeValue, float64(s.Done), s.Name, "done")
+
+		var oldest float64
+		if s.OldestPendingAge != nil {
+			oldest = float64(*s.OldestPendingAge)
+		}
+		ch <- prometheus.MustNewConstMetric(queueOldestPendingDesc, prometheus.GaugeValue, oldest, s.Name)
+	}
+}
@@ -0,0 +1,426 @@
+// Package anthropic translates chat completions to and from Anthropic's Messages API, so that Claude models can be
+// served to clients of the OpenAI API.
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+// defaultMaxTokens is used for requests that don't set max_tokens, which the Messages API requires.
+const defaultMaxTokens = 4096
+
+type request struct {
+	Model         string      `json:"model"`
+	System        string      `json:"system,omitempty"`
+	Messages      []message   `json:"messages"`
+	MaxTokens     int         `json:"max_tokens"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Stream        bool        `json:"stream,omitempty"`
+	Temperature   *float32    `json:"temperature,omitempty"`
+	TopP          *float32    `json:"top_p,omitempty"`
+	Tools         []tool      `json:"tools,omitempty"`
+	ToolChoice    *toolChoice `json:"tool_choice,omitempty"`
+	Metadata      *metadata   `json:"metadata,omitempty"`
+}
+
+type message struct {
+	Role    string         `json:"role"`
+	Content []contentBlock `json:"content"`
+}
+
+type contentBlock struct {
+	Type string `json:"type"`
+	// Text is set for text blocks.
+	Text string `json:"text,omitempty"`
+	// Source is set for image blocks.
+	Source *imageSource `json:"source,omitempty"`
+	// ID, Name, and Input are set for tool_use blocks.
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// ToolUseID and Content are set for tool_result blocks.
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type imageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type tool struct {
+	Name        string                    `json:"name"`
+	Description string                    `json:"description,omitempty"`
+	InputSchema openai.FunctionParameters `json:"input_schema"`
+}
+
+type toolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type metadata struct {
+	UserID string `json:"user_id"`
+}
+
+type response struct {
+	ID         string         `json:"id"`
+	Model      string         `json:"model"`
+	Content    []contentBlock `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      usage          `json:"usage"`
+}
+
+type usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// chatMessage has the fields of every type of chat completion request message.
+type chatMessage struct {
+	Role       string                                 `json:"role"`
+	Content    json.RawMessage                        `json:"content"`
+	ToolCalls  []openai.ChatCompletionMessageToolCall `json:"tool_calls"`
+	ToolCallID string                                 `json:"tool_call_id"`
+}
+
+// MakeChatCompletionRequest makes a non-streaming chat completion request to the Messages API at url. If the provider
+// fails the request, then an agents.UpstreamError is returned.
+func MakeChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http.Client, url string, cc *db.CreateChatCompletionRequest) (*db.CreateChatCompletionResponse, error) {
+	resp, err := send(ctx, l, client, url, cc, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	m := new(response)
+	if err = json.NewDecoder(resp.Body).Decode(m); err != nil {
+		l.Error("Failed to decode message", "err", err)
+		return nil, fmt.Errorf("failed to decode message response: %w", err)
+	}
+
+	var (
+		content   *string
+		toolCalls []openai.ChatCompletionMessageToolCall
+	)
+	for _, block := range m.Content {
+		switch block.Type {
+		case "text":
+			content = z.Pointer(z.Dereference(content) + block.Text)
+		case "tool_use":
+			toolCall := openai.ChatCompletionMessageToolCall{
+				Id:   block.ID,
+				Type: openai.ChatCompletionMessageToolCallTypeFunction,
+			}
+			toolCall.Function.Name = block.Name
+			toolCall.Function.Arguments = string(block.Input)
+			toolCalls = append(toolCalls, toolCall)
+		}
+	}
+
+	public := &openai.CreateChatCompletionResponse{
+		Created: int(time.Now().Unix()),
+		Id:      m.ID,
+		Model:   m.Model,
+		Object:  openai.CreateChatCompletionResponseObjectChatCompletion,
+		Usage: &openai.CompletionUsage{
+			PromptTokens:     m.Usage.InputTokens,
+			CompletionTokens: m.Usage.OutputTokens,
+			TotalTokens:      m.Usage.InputTokens + m.Usage.OutputTokens,
+		},
+	}
+	public.Choices = make([]struct {
+		FinishReason openai.CreateChatCompletionResponseChoicesFinishReason `json:"finish_reason"`
+		Index        int                                                    `json:"index"`
+		Logprobs     *struct {
+			Content *[]openai.ChatCompletionTokenLogprob `json:"content"`
+		} `json:"logprobs"`
+		Message openai.ChatCompletionResponseMessage `json:"message"`
+	}, 1)
+	public.Choices[0].FinishReason = openai.CreateChatCompletionResponseChoicesFinishReason(finishReason(m.StopReason))
+	public.Choices[0].Message = openai.ChatCompletionResponseMessage{
+		Content: content,
+		Role:    openai.ChatCompletionResponseMessageRoleAssistant,
+	}
+	if len(toolCalls) > 0 {
+		public.Choices[0].Message.ToolCalls = &toolCalls
+	}
+
+	ccr := new(db.CreateChatCompletionResponse)
+	if err = ccr.FromPublic(public); err != nil {
+		return nil, err
+	}
+
+	ccr.StatusCode = resp.StatusCode
+	ccr.RequestID = cc.ID
+	ccr.Done = true
+
+	return ccr, nil
+}
+
+// send sends the chat completion to the Messages API and returns the successful response.
+func send(ctx context.Context, l *slog.Logger, client *http.Client, url string, cc *db.CreateChatCompletionRequest, stream bool) (*http.Response, error) {
+	r, err := toRequest(cc)
+	if err != nil {
+		return nil, err
+	}
+	r.Stream = stream
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if stream {
+		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		l.Error("Failed to create message", "err", err)
+		return nil, &agents.UpstreamError{Err: err}
+	}
+	if err = agents.CheckResponse(resp); err != nil {
+		l.Error("Failed to create message", "err", err)
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// toRequest translates the chat completion request into a Messages API request.
+func toRequest(cc *db.CreateChatCompletionRequest) (*request, error) {
+	r := &request{
+		Model:       cc.Model,
+		MaxTokens:   z.Dereference(cc.MaxTokens),
+		Temperature: cc.Temperature,
+		TopP:        cc.TopP,
+	}
+	if r.MaxTokens == 0 {
+		r.MaxTokens = defaultMaxTokens
+	}
+	if r.Temperature != nil {
+		// OpenAI temperatures go up to 2, but Anthropic's only go up to 1.
+		r.Temperature = z.Pointer(min(*r.Temperature, 1))
+	}
+	if user := z.Dereference(cc.User); user != "" {
+		r.Metadata = &metadata{UserID: user}
+	}
+
+	if stop := cc.Stop.Data(); stop != nil {
+		if s, err := stop.AsCreateChatCompletionRequestStop1(); err == nil {
+			r.StopSequences = s
+		} else if s, err := stop.AsCreateChatCompletionRequestStop0(); err == nil && s != "" {
+			r.StopSequences = []string{s}
+		}
+	}
+
+	for _, t := range cc.Tools {
+		schema := z.Dereference(t.Function.Parameters)
+		if schema == nil {
+			schema = openai.FunctionParameters{"type": "object", "properties": map[string]any{}}
+		}
+		r.Tools = append(r.Tools, tool{
+			Name:        t.Function.Name,
+			Description: z.Dereference(t.Function.Description),
+			InputSchema: schema,
+		})
+	}
+
+	if choice := cc.ToolChoice.Data(); choice != nil && len(r.Tools) > 0 {
+		if named, err := choice.AsChatCompletionNamedToolChoice(); err == nil && named.Function.Name != "" {
+			r.ToolChoice = &toolChoice{Type: "tool", Name: named.Function.Name}
+		} else if option, err := choice.AsChatCompletionToolChoiceOption0(); err == nil {
+			switch option {
+			case "none":
+				r.ToolChoice = &toolChoice{Type: "none"}
+			case "required":
+				r.ToolChoice = &toolChoice{Type: "any"}
+			case "auto":
+				r.ToolChoice = &toolChoice{Type: "auto"}
+			}
+		}
+	}
+
+	var system []string
+	for i, m := range cc.Messages {
+		data, err := m.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+		}
+
+		var msg chatMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+		}
+
+		switch msg.Role {
+		case "system":
+			text, err := textContent(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+			}
+			system = append(system, text)
+		case "user":
+			blocks, err := userContent(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+			}
+			r.addBlocks("user", blocks...)
+		case "assistant":
+			text, err := textContent(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+			}
+
+			var blocks []contentBlock
+			if text != "" {
+				blocks = append(blocks, contentBlock{Type: "text", Text: text})
+			}
+			for _, tc := range msg.ToolCalls {
+				input := json.RawMessage(tc.Function.Arguments)
+				if strings.TrimSpace(tc.Function.Arguments) == "" {
+					input = json.RawMessage("{}")
+				} else if !json.Valid(input) {
+					return nil, fmt.Errorf("tool call %s in message %d has invalid arguments", tc.Id, i)
+				}
+				blocks = append(blocks, contentBlock{Type: "tool_use", ID: tc.Id, Name: tc.Function.Name, Input: input})
+			}
+			r.addBlocks("assistant", blocks...)
+		case "tool":
+			text, err := textContent(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read message %d: %w", i, err)
+			}
+			// Tool results are sent back to Anthropic in a user message.
+			r.addBlocks("user", contentBlock{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: text})
+		default:
+			return nil, fmt.Errorf("message %d has unsupported role %q", i, msg.Role)
+		}
+	}
+	r.System = strings.Join(system, "\n\n")
+
+	return r, nil
+}
+
+// addBlocks adds the content blocks to the last message if it has the same role, because the Messages API requires the
+// roles to alternate, and adds a new message otherwise.
+func (r *request) addBlocks(role string, blocks ...contentBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+	if len(r.Messages) > 0 && r.Messages[len(r.Messages)-1].Role == role {
+		last := &r.Messages[len(r.Messages)-1]
+		last.Content = append(last.Content, blocks...)
+		return
+	}
+
+	r.Messages = append(r.Messages, message{Role: role, Content: blocks})
+}
+
+// textContent returns the text of message content that is either a string or an array of content parts.
+func textContent(content json.RawMessage) (string, error) {
+	blocks, err := userContent(content)
+	if err != nil {
+		return "", err
+	}
+
+	var text []string
+	for _, b := range blocks {
+		if b.Type == "text" {
+			text = append(text, b.Text)
+		}
+	}
+
+	return strings.Join(text, "\n"), nil
+}
+
+// userContent translates message content that is either a string or an array of text and image content parts.
+func userContent(content json.RawMessage) ([]contentBlock, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return nil, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []contentBlock{{Type: "text", Text: text}}, nil
+	}
+
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return nil, fmt.Errorf("unsupported message content: %w", err)
+	}
+
+	blocks := make([]contentBlock, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			if p.Text != "" {
+				blocks = append(blocks, contentBlock{Type: "text", Text: p.Text})
+			}
+		case "image_url":
+			blocks = append(blocks, contentBlock{Type: "image", Source: toImageSource(p.ImageURL.URL)})
+		default:
+			return nil, fmt.Errorf("unsupported message content part %q", p.Type)
+		}
+	}
+
+	return blocks, nil
+}
+
+// toImageSource translates an image URL, which may be a base64 data URL, into an image source.
+func toImageSource(url string) *imageSource {
+	// Data URLs look like data:image/png;base64,<data>.
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if mediaType, data, ok := strings.Cut(rest, ";base64,"); ok {
+			return &imageSource{Type: "base64", MediaType: mediaType, Data: data}
+		}
+	}
+
+	return &imageSource{Type: "url", URL: url}
+}
+
+// finishReason translates a stop reason into an OpenAI finish reason.
+func finishReason(stopReason string) string {
+	switch stopReason {
+	case "":
+		return ""
+	case "max_tokens":
+		return string(openai.CreateChatCompletionResponseChoicesFinishReasonLength)
+	case "tool_use":
+		return string(openai.CreateChatCompletionResponseChoicesFinishReasonToolCalls)
+	default:
+		return string(openai.CreateChatCompletionResponseChoicesFinishReasonStop)
+	}
+}
@@ -0,0 +1,250 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+	"gorm.io/datatypes"
+)
+
+const conversation = `[
+	{"role": "system", "content": "You are a weather bot."},
+	{"role": "user", "content": [{"type": "text", "text": "Weather in Paris and Rome?"}, {"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}]},
+	{"role": "assistant", "content": null, "tool_calls": [
+		{"id": "toolu_1", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Paris\"}"}},
+		{"id": "toolu_2", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Rome\"}"}}
+	]},
+	{"role": "tool", "tool_call_id": "toolu_1", "content": "sunny"},
+	{"role": "tool", "tool_call_id": "toolu_2", "content": "rainy"}
+]`
+
+const tools = `[{"type": "function", "function": {"name": "weather", "description": "Get the weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}]`
+
+// fakeServer stands in for the Messages API. It records the last request and responds with the response for the
+// stream parameter of the request.
+type fakeServer struct {
+	request        request
+	headers        http.Header
+	response       string
+	streamedEvents []string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.headers = r.Header
+	if r.URL.Path != "/v1/messages" || json.NewDecoder(r.Body).Decode(&f.request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !f.request.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(f.response))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range f.streamedEvents {
+		var e struct {
+			Type string `json:"type"`
+		}
+		_ = json.Unmarshal([]byte(event), &e)
+		_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, event)
+	}
+}
+
+func newProvider(t *testing.T, f *fakeServer) *providers.Provider {
+	t.Helper()
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	router, err := providers.NewRouter(nil, []providers.Provider{{
+		Name:    "anthropic",
+		API:     providers.APIAnthropic,
+		BaseURL: server.URL + "/v1",
+		APIKey:  "secret",
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter() = %v", err)
+	}
+
+	return router.Providers()[0]
+}
+
+func newRequest(t *testing.T) *db.CreateChatCompletionRequest {
+	t.Helper()
+
+	cc := &db.CreateChatCompletionRequest{
+		Model:       "claude-3-5-sonnet",
+		Temperature: z.Pointer[float32](1.5),
+		ToolChoice:  datatypes.NewJSONType(new(openai.ChatCompletionToolChoiceOption)),
+	}
+	if err := json.Unmarshal([]byte(conversation), &cc.Messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(tools), &cc.Tools); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.ToolChoice.Data().FromChatCompletionToolChoiceOption0("required"); err != nil {
+		t.Fatal(err)
+	}
+
+	return cc
+}
+
+func TestStreamChatCompletionRequest(t *testing.T) {
+	f := &fakeServer{streamedEvents: []string{
+		`{"type": "message_start", "message": {"id": "msg_1", "model": "claude-3-5-sonnet", "content": [], "usage": {"input_tokens": 10, "output_tokens": 1}}}`,
+		`{"type": "ping"}`,
+		`{"type": "content_block_start", "index": 0, "content_block": {"type": "tool_use", "id": "toolu_3", "name": "weather", "input": {}}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "input_json_delta", "partial_json": "{\"city\":"}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "input_json_delta", "partial_json": " \"Oslo\"}"}}`,
+		`{"type": "content_block_stop", "index": 0}`,
+		`{"type": "message_delta", "delta": {"stop_reason": "tool_use"}, "usage": {"output_tokens": 20}}`,
+		`{"type": "message_stop"}`,
+	}}
+	p := newProvider(t, f)
+
+	stream, err := StreamChatCompletionRequest(context.Background(), slog.Default(), p.Client(), p.ChatCompletionsURL("claude-3-5-sonnet"), newRequest(t))
+	if err != nil {
+		t.Fatalf("StreamChatCompletionRequest() = %v", err)
+	}
+
+	// Merge the chunks the way the run agent does.
+	var (
+		runStep   = new(db.RunStep)
+		toolCalls []db.GenericToolCallInfo
+		finish    string
+	)
+	for chunk := range stream {
+		if chunk.Error != nil {
+			t.Fatalf("unexpected error chunk: %s", *chunk.Error)
+		}
+		if chunk.ID != "msg_1" {
+			t.Errorf("chunk ID = %q, want %q", chunk.ID, "msg_1")
+		}
+		if _, err = runStep.Merge(&toolCalls, chunk); err != nil {
+			t.Fatalf("Merge() = %v", err)
+		}
+		finish += chunk.Choices[0].FinishReason
+	}
+
+	want := []db.GenericToolCallInfo{{ID: "toolu_3", Name: "weather", Arguments: `{"city": "Oslo"}`}}
+	if !reflect.DeepEqual(toolCalls, want) {
+		t.Errorf("tool calls = %+v, want %+v", toolCalls, want)
+	}
+	if finish != "tool_calls" {
+		t.Errorf("finish reason = %q, want %q", finish, "tool_calls")
+	}
+
+	if f.headers.Get("x-api-key") != "secret" || f.headers.Get("anthropic-version") != providers.AnthropicVersion {
+		t.Errorf("request should be authenticated with the Anthropic headers, got %v", f.headers)
+	}
+	if !f.request.Stream {
+		t.Error("request should be streamed")
+	}
+
+	wantRequest := request{
+		Model:       "claude-3-5-sonnet",
+		System:      "You are a weather bot.",
+		MaxTokens:   defaultMaxTokens,
+		Stream:      true,
+		Temperature: z.Pointer[float32](1),
+		Messages: []message{
+			{Role: "user", Content: []contentBlock{
+				{Type: "text", Text: "Weather in Paris and Rome?"},
+				{Type: "image", Source: &imageSource{Type: "base64", MediaType: "image/png", Data: "iVBORw0KGgo="}},
+			}},
+			{Role: "assistant", Content: []contentBlock{
+				{Type: "tool_use", ID: "toolu_1", Name: "weather", Input: json.RawMessage(`{"city":"Paris"}`)},
+				{Type: "tool_use", ID: "toolu_2", Name: "weather", Input: json.RawMessage(`{"city":"Rome"}`)},
+			}},
+			// Consecutive tool results are combined into one user message.
+			{Role: "user", Content: []contentBlock{
+				{Type: "tool_result", ToolUseID: "toolu_1", Content: "sunny"},
+				{Type: "tool_result", ToolUseID: "toolu_2", Content: "rainy"},
+			}},
+		},
+		Tools: []tool{{
+			Name:        "weather",
+			Description: "Get the weather",
+			InputSchema: openai.FunctionParameters{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+		}},
+		ToolChoice: &toolChoice{Type: "any"},
+	}
+	if !reflect.DeepEqual(f.request, wantRequest) {
+		got, _ := json.Marshal(f.request)
+		expected, _ := json.Marshal(wantRequest)
+		t.Errorf("request = %s\nwant %s", got, expected)
+	}
+}
+
+func TestStreamChatCompletionRequestError(t *testing.T) {
+	p := newProvider(t, &fakeServer{streamedEvents: []string{
+		`{"type": "message_start", "message": {"id": "msg_1", "model": "claude-3-5-sonnet"}}`,
+		`{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`,
+	}})
+
+	stream, err := StreamChatCompletionRequest(context.Background(), slog.Default(), p.Client(), p.ChatCompletionsURL("claude-3-5-sonnet"), newRequest(t))
+	if err != nil {
+		t.Fatalf("StreamChatCompletionRequest() = %v", err)
+	}
+
+	var chunks []db.ChatCompletionResponseChunk
+	for chunk := range stream {
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) != 2 || chunks[1].Error == nil || chunks[1].StatusCode != agents.StatusOverloaded {
+		t.Errorf("stream should end with an overloaded error, got %+v", chunks)
+	}
+}
+
+func TestMakeChatCompletionRequest(t *testing.T) {
+	p := newProvider(t, &fakeServer{response: `{
+		"id": "msg_1",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-3-5-sonnet",
+		"content": [
+			{"type": "text", "text": "Let me check."},
+			{"type": "tool_use", "id": "toolu_3", "name": "weather", "input": {"city": "Oslo"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 10, "output_tokens": 20}
+	}`})
+
+	ccr, err := MakeChatCompletionRequest(context.Background(), slog.Default(), p.Client(), p.ChatCompletionsURL("claude-3-5-sonnet"), newRequest(t))
+	if err != nil {
+		t.Fatalf("MakeChatCompletionRequest() = %v", err)
+	}
+
+	public := ccr.ToPublic().(*openai.CreateChatCompletionResponse)
+	if len(public.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(public.Choices))
+	}
+
+	choice := public.Choices[0]
+	if choice.FinishReason != openai.CreateChatCompletionResponseChoicesFinishReasonToolCalls {
+		t.Errorf("finish reason = %q, want %q", choice.FinishReason, openai.CreateChatCompletionResponseChoicesFinishReasonToolCalls)
+	}
+	if content := z.Dereference(choice.Message.Content); content != "Let me check." {
+		t.Errorf("content = %q, want %q", content, "Let me check.")
+	}
+	if toolCalls := z.Dereference(choice.Message.ToolCalls); len(toolCalls) != 1 || toolCalls[0].Id != "toolu_3" || toolCalls[0].Function.Arguments != `{"city": "Oslo"}` {
+		t.Errorf("tool calls = %+v", toolCalls)
+	}
+	if usage := public.Usage; usage == nil || usage.TotalTokens != 30 {
+		t.Errorf("usage = %+v, want 30 total tokens", usage)
+	}
+}
@@ -0,0 +1,193 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/sse"
+	"gorm.io/datatypes"
+)
+
+// streamEvent has the fields of every type of event streamed by the Messages API.
+type streamEvent struct {
+	Type    string   `json:"type"`
+	Message response `json:"message"`
+	Index   int      `json:"index"`
+	// ContentBlock is set for content_block_start events.
+	ContentBlock contentBlock `json:"content_block"`
+	// Delta is set for content_block_delta and message_delta events.
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// StreamChatCompletionRequest makes a streaming chat completion request to the Messages API at url. The streamed events
+// are translated into chat completion chunks, with tool_use blocks as tool calls. If the provider fails the request
+// before streaming the response, then an agents.UpstreamError is returned.
+func StreamChatCompletionRequest(ctx context.Context, l *slog.Logger, client *http.Client, url string, cc *db.CreateChatCompletionRequest) (<-chan db.ChatCompletionResponseChunk, error) {
+	resp, err := send(ctx, l, client, url, cc, true)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := make(chan db.ChatCompletionResponseChunk, 500)
+	go func() {
+		defer close(stream)
+		defer resp.Body.Close()
+
+		t := &translator{toolCalls: make(map[int]int)}
+		err := readEvents(resp.Body, func(data []byte) bool {
+			event := new(streamEvent)
+			if err := json.Unmarshal(data, event); err != nil {
+				agents.SendChunk(ctx, stream, agents.ErrorChunk(http.StatusInternalServerError, fmt.Sprintf("failed to unmarshal stream event: %s", data)))
+				return false
+			}
+
+			chunk, done := t.translate(event)
+			if chunk != nil && !agents.SendChunk(ctx, stream, *chunk) {
+				return false
+			}
+			return !done
+		})
+		if err == nil && !t.done && ctx.Err() == nil {
+			err = fmt.Errorf("message stream ended before the message was complete: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			agents.SendChunk(ctx, stream, agents.ErrorChunk(http.StatusInternalServerError, err.Error()))
+		}
+	}()
+
+	return stream, nil
+}
+
+// readEvents calls handle with the data of each server-sent event until handle returns false or the stream ends. The
+// type of each event is also in its data.
+func readEvents(r io.Reader, handle func(data []byte) bool) error {
+	events := sse.NewReader(r)
+	for {
+		event, err := events.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !handle(event.Data) {
+			return nil
+		}
+	}
+}
+
+// translator translates the events of one streamed message into chat completion chunks.
+type translator struct {
+	id, model string
+	created   int
+	// toolCalls maps the index of each tool_use content block to the index of its tool call.
+	toolCalls map[int]int
+	// done is set once the message is complete or has failed.
+	done bool
+}
+
+// translate returns the chunk for the event, if it has one, and whether the stream is done.
+func (t *translator) translate(event *streamEvent) (*db.ChatCompletionResponseChunk, bool) {
+	var (
+		delta  openai.ChatCompletionStreamResponseDelta
+		reason string
+	)
+	switch event.Type {
+	case "message_start":
+		t.id, t.model, t.created = event.Message.ID, event.Message.Model, int(time.Now().Unix())
+		delta.Role = z.Pointer(openai.ChatCompletionStreamResponseDeltaRoleAssistant)
+	case "content_block_start":
+		switch event.ContentBlock.Type {
+		case "text":
+			if event.ContentBlock.Text == "" {
+				return nil, false
+			}
+			delta.Content = z.Pointer(event.ContentBlock.Text)
+		case "tool_use":
+			index := len(t.toolCalls)
+			t.toolCalls[event.Index] = index
+			delta.ToolCalls = toolCallDelta(index, event.ContentBlock.ID, event.ContentBlock.Name, "")
+		default:
+			return nil, false
+		}
+	case "content_block_delta":
+		switch event.Delta.Type {
+		case "text_delta":
+			delta.Content = z.Pointer(event.Delta.Text)
+		case "input_json_delta":
+			index, ok := t.toolCalls[event.Index]
+			if !ok || event.Delta.PartialJSON == "" {
+				return nil, false
+			}
+			delta.ToolCalls = toolCallDelta(index, "", "", event.Delta.PartialJSON)
+		default:
+			return nil, false
+		}
+	case "message_delta":
+		reason = finishReason(event.Delta.StopReason)
+	case "message_stop":
+		t.done = true
+		return nil, true
+	case "error":
+		t.done = true
+		code := http.StatusInternalServerError
+		if event.Error.Type == "overloaded_error" {
+			code = agents.StatusOverloaded
+		}
+		return z.Pointer(agents.ErrorChunk(code, fmt.Sprintf("%s: %s", event.Error.Type, event.Error.Message))), true
+	default:
+		// Ignore pings and content_block_stop events.
+		return nil, false
+	}
+
+	return &db.ChatCompletionResponseChunk{
+		Base: db.Base{
+			ID:        t.id,
+			CreatedAt: t.created,
+		},
+		Model: t.model,
+		Choices: datatypes.NewJSONSlice([]db.ChunkChoice{{
+			FinishReason: reason,
+			Delta:        datatypes.NewJSONType(delta),
+		}}),
+	}, false
+}
+
+// toolCallDelta returns the delta for the tool call at the index. The ID and name are only set in the first delta.
+func toolCallDelta(index int, id, name, arguments string) *[]openai.ChatCompletionMessageToolCallChunk {
+	toolCall := openai.ChatCompletionMessageToolCallChunk{
+		Index: index,
+		Function: &struct {
+			Arguments *string `json:"arguments,omitempty"`
+			Name      *string `json:"name,omitempty"`
+		}{
+			Arguments: z.Pointer(arguments),
+		},
+	}
+	if id != "" {
+		toolCall.Id = z.Pointer(id)
+		toolCall.Type = z.Pointer(openai.ChatCompletionMessageToolCallChunkTypeFunction)
+		toolCall.Function.Name = z.Pointer(name)
+	}
+
+	return &[]openai.ChatCompletionMessageToolCallChunk{toolCall}
+}
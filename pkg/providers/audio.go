@@ -0,0 +1,168 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/acorn-io/z"
+	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+// AudioProvider turns text into speech, and transcribes and translates audio. Errors from the provider's API are
+// recorded in the response, with the status code of the provider's response, and an error is only returned if the
+// request couldn't be made.
+type AudioProvider interface {
+	CreateSpeech(ctx context.Context, req *db.CreateSpeechRequest) (*db.CreateSpeechResponse, error)
+	CreateTranscription(ctx context.Context, req *db.CreateTranscriptionRequest) (*db.CreateTranscriptionResponse, error)
+	CreateTranslation(ctx context.Context, req *db.CreateTranslationRequest) (*db.CreateTranslationResponse, error)
+}
+
+// OpenAIAudio serves audio requests with OpenAI's audio API.
+type OpenAIAudio struct {
+	baseURL, apiKey string
+	client          *http.Client
+}
+
+// NewOpenAIAudio returns a provider that sends requests to the audio API at baseURL, which paths like /speech are
+// appended to.
+func NewOpenAIAudio(baseURL, apiKey string, client *http.Client) *OpenAIAudio {
+	return &OpenAIAudio{baseURL: baseURL, apiKey: apiKey, client: client}
+}
+
+func (o *OpenAIAudio) CreateSpeech(ctx context.Context, speechRequest *db.CreateSpeechRequest) (*db.CreateSpeechResponse, error) {
+	data, err := json.Marshal(speechRequest.ToPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal create speech request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/speech", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create speech request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	setBearerToken(req, o.apiKey)
+
+	sr := new(db.CreateSpeechResponse)
+	code, err := cclient.SendRequest(o.client, req, &sr.Content)
+	if err != nil {
+		sr.Error = z.Pointer(err.Error())
+	}
+	sr.StatusCode = code
+
+	return sr, nil
+}
+
+func (o *OpenAIAudio) CreateTranscription(ctx context.Context, transcriptionRequest *db.CreateTranscriptionRequest) (*db.CreateTranscriptionResponse, error) {
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	publicRequest := transcriptionRequest.ToPublic().(*openai.CreateTranscriptionRequest)
+	if err := writeFormFile(writer, "file", publicRequest.File); err != nil {
+		return nil, err
+	}
+
+	var granularities *string
+	if transcriptionRequest.TimestampGranularities != nil {
+		data, err := json.Marshal(transcriptionRequest.TimestampGranularities)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal timestamp granularities: %w", err)
+		}
+		granularities = z.Pointer(string(data))
+	}
+
+	if err := writeFormFields(writer, []formField{
+		{"language", transcriptionRequest.Language},
+		{"model", &transcriptionRequest.Model},
+		{"prompt", transcriptionRequest.Prompt},
+		{"response_format", transcriptionRequest.ResponseFormat},
+		{"temperature", formatFloat(transcriptionRequest.Temperature)},
+		{"timestamp_granularities", granularities},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close body writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/transcriptions", &requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transcription request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	setBearerToken(req, o.apiKey)
+
+	oir, ir := new(openai.CreateTranscriptionResponseJson), new(db.CreateTranscriptionResponse)
+	code, err := cclient.SendRequest(o.client, req, oir)
+	if fromErr := ir.FromPublic(oir); fromErr != nil {
+		return nil, fromErr
+	}
+
+	if err != nil {
+		ir.Error = z.Pointer(err.Error())
+	}
+	ir.StatusCode = code
+
+	return ir, nil
+}
+
+func (o *OpenAIAudio) CreateTranslation(ctx context.Context, translationRequest *db.CreateTranslationRequest) (*db.CreateTranslationResponse, error) {
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	publicRequest := translationRequest.ToPublic().(*openai.CreateTranslationRequest)
+	if err := writeFormFile(writer, "file", publicRequest.File); err != nil {
+		return nil, err
+	}
+
+	if err := writeFormFields(writer, []formField{
+		{"model", &translationRequest.Model},
+		{"prompt", translationRequest.Prompt},
+		{"response_format", translationRequest.ResponseFormat},
+		{"temperature", formatFloat(translationRequest.Temperature)},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close body writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/translations", &requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create translation request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	setBearerToken(req, o.apiKey)
+
+	oir, ir := new(openai.CreateTranslationResponseJson), new(db.CreateTranslationResponse)
+	code, err := cclient.SendRequest(o.client, req, oir)
+	if fromErr := ir.FromPublic(oir); fromErr != nil {
+		return nil, fromErr
+	}
+
+	if err != nil {
+		ir.Error = z.Pointer(err.Error())
+	}
+	ir.StatusCode = code
+
+	return ir, nil
+}
+
+func formatFloat(f *float32) *string {
+	if f == nil {
+		return nil
+	}
+	return z.Pointer(fmt.Sprintf("%f", *f))
+}
@@ -0,0 +1,92 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultCooldown         = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of sending a request to a provider that has failed too many times in a row.
+var ErrCircuitOpen = errors.New("provider circuit breaker is open")
+
+// BreakerConfig configures a provider's circuit breaker.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that open the circuit. Defaults to 5.
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+	// Cooldown is how long the circuit stays open before a single trial request is let through. Defaults to 30s.
+	Cooldown string `json:"cooldown,omitempty"`
+}
+
+// CircuitBreaker stops requests to a degraded provider. The circuit opens after a number of consecutive failures. Once
+// the cooldown has passed, one trial request is let through: the circuit closes if it succeeds and opens again if it
+// fails.
+type CircuitBreaker struct {
+	failureThreshold int
+	cooldown         time.Duration
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func newCircuitBreaker(cfg BreakerConfig) (*CircuitBreaker, error) {
+	b := &CircuitBreaker{
+		failureThreshold: cfg.FailureThreshold,
+		cooldown:         defaultCooldown,
+	}
+	if b.failureThreshold == 0 {
+		b.failureThreshold = defaultFailureThreshold
+	}
+	if b.failureThreshold < 0 {
+		return nil, fmt.Errorf("circuit breaker failure threshold must be positive")
+	}
+	if cfg.Cooldown != "" {
+		var err error
+		if b.cooldown, err = time.ParseDuration(cfg.Cooldown); err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker cooldown: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+// Allow returns true if a request can be sent to the provider.
+func (b *CircuitBreaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.failureThreshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+// Record records the result of a request that was allowed. Only failures that indicate that the provider is degraded,
+// like rate limits and server errors, should be recorded as failures.
+func (b *CircuitBreaker) Record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.failureThreshold {
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,129 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/acorn-io/z"
+	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+// EmbeddingsProvider creates embeddings. Errors from the provider's API are recorded in the response, with the status
+// code of the provider's response, and an error is only returned if the request couldn't be made.
+type EmbeddingsProvider interface {
+	CreateEmbeddings(ctx context.Context, req *db.CreateEmbeddingRequest) (*db.CreateEmbeddingResponse, error)
+}
+
+// OpenAIEmbeddings creates embeddings with OpenAI's embeddings API.
+type OpenAIEmbeddings struct {
+	url, apiKey string
+	client      *http.Client
+}
+
+// NewOpenAIEmbeddings returns a provider that sends requests to the embeddings API at url, or to the URL of the
+// request's model API if it has one.
+func NewOpenAIEmbeddings(url, apiKey string, client *http.Client) *OpenAIEmbeddings {
+	return &OpenAIEmbeddings{url: url, apiKey: apiKey, client: client}
+}
+
+func (o *OpenAIEmbeddings) CreateEmbeddings(ctx context.Context, er *db.CreateEmbeddingRequest) (*db.CreateEmbeddingResponse, error) {
+	b, err := json.Marshal(er.ToPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	url := er.ModelAPI
+	if url == "" {
+		url = o.url
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	setBearerToken(req, o.apiKey)
+
+	resp := new(openai.CreateEmbeddingResponse)
+
+	// Wait to process this error until after we have the DB object.
+	code, err := cclient.SendRequest(o.client, req, resp)
+
+	embedresp := new(db.CreateEmbeddingResponse)
+	if fromErr := embedresp.FromPublic(resp); fromErr != nil {
+		return nil, fromErr
+	}
+
+	if err != nil {
+		embedresp.Error = z.Pointer(err.Error())
+	}
+	embedresp.StatusCode = code
+
+	return embedresp, nil
+}
+
+func setBearerToken(req *http.Request, apiKey string) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
+
+// EmbeddingInputs returns the texts of the JSON input of an embeddings request, which is a string, an array of strings,
+// an array of tokens, or an array of token arrays. The tokens of each array are joined with spaces, as if they were
+// words, for providers that embed texts.
+func EmbeddingInputs(input []byte) ([]string, error) {
+	var text string
+	if json.Unmarshal(input, &text) == nil {
+		return []string{text}, nil
+	}
+	var texts []string
+	if json.Unmarshal(input, &texts) == nil && len(texts) > 0 {
+		return texts, nil
+	}
+	var tokens []int
+	if json.Unmarshal(input, &tokens) == nil && len(tokens) > 0 {
+		return []string{joinTokens(tokens)}, nil
+	}
+	var tokenArrays [][]int
+	if json.Unmarshal(input, &tokenArrays) == nil && len(tokenArrays) > 0 {
+		texts = make([]string, 0, len(tokenArrays))
+		for _, tokens := range tokenArrays {
+			texts = append(texts, joinTokens(tokens))
+		}
+		return texts, nil
+	}
+
+	return nil, fmt.Errorf("input must be a string or a non-empty array")
+}
+
+func joinTokens(tokens []int) string {
+	words := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		words = append(words, strconv.Itoa(t))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// EncodeEmbedding encodes the embedding as base64 little-endian floats, like OpenAI's API does for requests with the
+// base64 encoding format.
+func EncodeEmbedding(vector []float32) string {
+	data := make([]byte, 0, 4*len(vector))
+	for _, v := range vector {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(v))
+	}
+
+	return base64.StdEncoding.EncodeToString(data)
+}
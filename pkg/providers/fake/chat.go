@@ -0,0 +1,235 @@
+package fake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type chatCompletionRequest struct {
+	Model    string `json:"model"`
+	Stream   bool   `json:"stream"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+type toolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type message struct {
+	Role      string     `json:"role,omitempty"`
+	Content   *string    `json:"content,omitempty"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+}
+
+type choice struct {
+	Index        int      `json:"index"`
+	Message      *message `json:"message,omitempty"`
+	Delta        *message `json:"delta,omitempty"`
+	FinishReason *string  `json:"finish_reason"`
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type chatCompletionResponse struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int      `json:"created"`
+	Model   string   `json:"model"`
+	Choices []choice `json:"choices"`
+	Usage   *usage   `json:"usage,omitempty"`
+}
+
+func (h *handler) createChatCompletion(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to read request: %v", err))
+		return
+	}
+
+	req := new(chatCompletionRequest)
+	if err = json.Unmarshal(body, req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request: %v", err))
+		return
+	}
+	if req.Model == "" || len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "model and messages are required")
+		return
+	}
+
+	var (
+		last    = req.Messages[len(req.Messages)-1]
+		content = messageText(last.Content)
+		// Threads join message content with newlines, which aren't worth echoing.
+		reply     = strings.TrimSpace(content)
+		toolCalls []toolCall
+	)
+	if fixture := h.fixtures.Load().match(req.Model, last.Role, content); fixture != nil {
+		if fixture.StatusCode != 0 {
+			writeError(w, fixture.StatusCode, fixture.Error)
+			return
+		}
+
+		reply = fixture.Content
+		for i, tc := range fixture.ToolCalls {
+			call := toolCall{ID: "call_" + hash(body, i)[:24], Type: "function"}
+			call.Function.Name, call.Function.Arguments = tc.Name, arguments(tc.Arguments)
+			toolCalls = append(toolCalls, call)
+		}
+	}
+
+	finishReason := "stop"
+	if len(toolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+
+	var promptTokens int
+	for _, m := range req.Messages {
+		promptTokens += countTokens(messageText(m.Content))
+	}
+	completionTokens := countTokens(reply)
+	for _, tc := range toolCalls {
+		completionTokens += countTokens(tc.Function.Arguments)
+	}
+
+	resp := chatCompletionResponse{
+		ID:      "chatcmpl-" + hash(body, -1)[:24],
+		Object:  "chat.completion",
+		Created: int(time.Now().Unix()),
+		Model:   req.Model,
+		Usage: &usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}
+
+	if !req.Stream {
+		m := &message{Role: "assistant", ToolCalls: toolCalls}
+		if reply != "" || len(toolCalls) == 0 {
+			m.Content = &reply
+		}
+		resp.Choices = []choice{{Message: m, FinishReason: &finishReason}}
+		writeJSON(w, resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	resp.Object, resp.Usage = "chat.completion.chunk", nil
+	send := func(choices []choice) {
+		resp.Choices = choices
+		data, _ := json.Marshal(resp)
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	// Like OpenAI, only set the content of the first chunk if the response is a message.
+	first := &message{Role: "assistant"}
+	if reply != "" || len(toolCalls) == 0 {
+		first.Content = new(string)
+	}
+	send([]choice{{Delta: first}})
+	for _, word := range strings.SplitAfter(reply, " ") {
+		if word != "" {
+			send([]choice{{Delta: &message{Content: &word}}})
+		}
+	}
+	for i, tc := range toolCalls {
+		tc.Index = &i
+		send([]choice{{Delta: &message{ToolCalls: []toolCall{tc}}}})
+	}
+	send([]choice{{Delta: new(message), FinishReason: &finishReason}})
+
+	_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// messageText returns the text of a message's content, which is either a string or an array of content parts.
+func messageText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(content, &parts) != nil {
+		return ""
+	}
+
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// arguments returns the arguments of a scripted tool call as a JSON string.
+func arguments(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "{}"
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, raw) != nil {
+		return string(raw)
+	}
+
+	return compacted.String()
+}
+
+func matchesModel(pattern, model string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	matched, _ := path.Match(pattern, model)
+	return matched
+}
+
+// countTokens approximates the number of tokens in the text by its number of words.
+func countTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+// hash returns a hex-encoded hash of the data and the index, which makes IDs deterministic for the same request.
+func hash(data []byte, index int) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%d:", index)
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,262 @@
+// Package fake is a deterministic stand-in for an OpenAI-compatible upstream provider. It serves scripted or echoed
+// chat completions, and made-up embeddings, images and audio, so that the server and agents can run without network
+// access or an API key.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/invopop/yaml"
+)
+
+// DefaultModels are the models that are listed if the fixtures don't list any.
+var DefaultModels = []string{
+	"gpt-4o",
+	"gpt-4o-mini",
+	"gpt-3.5-turbo",
+	"text-embedding-3-small",
+	"text-embedding-ada-002",
+	"dall-e-3",
+	"tts-1",
+	"whisper-1",
+}
+
+// defaultEmbeddingDimensions is the number of dimensions of embeddings when neither the request nor the fixtures set
+// them.
+const defaultEmbeddingDimensions = 16
+
+// Fixtures script the responses of the fake provider.
+type Fixtures struct {
+	// Models are listed by the models endpoint. Defaults to DefaultModels.
+	Models []string `json:"models,omitempty"`
+	// ChatCompletions are the scripted chat completion responses. The first one that matches a request is used, and the
+	// content of the last message of a request that matches none is echoed.
+	ChatCompletions []ChatCompletion `json:"chatCompletions,omitempty"`
+	// EmbeddingDimensions is the number of dimensions of embeddings for requests that don't set them.
+	EmbeddingDimensions int `json:"embeddingDimensions,omitempty"`
+	// Transcription is the text of every transcription and translation. By default, it describes the audio file.
+	Transcription string `json:"transcription,omitempty"`
+}
+
+// ChatCompletion is a scripted chat completion response.
+type ChatCompletion struct {
+	Match Match `json:"match"`
+	// Content is the content of the response message.
+	Content string `json:"content,omitempty"`
+	// ToolCalls are the tool calls of the response message.
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+	// StatusCode fails the request with this status code, and Error as the message, if set.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Match selects the requests that a ChatCompletion responds to. Empty fields match every request.
+type Match struct {
+	// Model is a path.Match pattern for the requested model.
+	Model string `json:"model,omitempty"`
+	// Role is the role of the last message, for example "user" to not call a tool again once it has responded.
+	Role string `json:"role,omitempty"`
+	// Contains is a substring of the content of the last message.
+	Contains string `json:"contains,omitempty"`
+}
+
+// ToolCall is a scripted tool call. The arguments can either be a JSON object or a string.
+type ToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// LoadFixtures reads fixtures from a YAML or JSON file.
+func LoadFixtures(file string) (*Fixtures, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake upstream fixtures: %w", err)
+	}
+
+	fixtures := new(Fixtures)
+	if err = yaml.Unmarshal(data, fixtures); err != nil {
+		return nil, fmt.Errorf("failed to parse fake upstream fixtures %s: %w", file, err)
+	}
+
+	return fixtures, fixtures.validate()
+}
+
+func (f *Fixtures) validate() error {
+	for i, cc := range f.ChatCompletions {
+		if _, err := path.Match(cc.Match.Model, ""); err != nil {
+			return fmt.Errorf("chat completion fixture %d has an invalid model pattern %q: %w", i, cc.Match.Model, err)
+		}
+		if cc.StatusCode != 0 && (cc.StatusCode < 400 || cc.StatusCode > 599) {
+			return fmt.Errorf("chat completion fixture %d has status code %d, which is not an error", i, cc.StatusCode)
+		}
+		for _, tc := range cc.ToolCalls {
+			if tc.Name == "" {
+				return fmt.Errorf("chat completion fixture %d has a tool call without a name", i)
+			}
+		}
+	}
+	if f.EmbeddingDimensions < 0 {
+		return fmt.Errorf("embedding dimensions must not be negative")
+	}
+
+	return nil
+}
+
+// match returns the first chat completion that matches the request, or nil if none do.
+func (f *Fixtures) match(model, role, content string) *ChatCompletion {
+	for i, cc := range f.ChatCompletions {
+		if matchesModel(cc.Match.Model, model) && (cc.Match.Role == "" || cc.Match.Role == role) && strings.Contains(content, cc.Match.Contains) {
+			return &f.ChatCompletions[i]
+		}
+	}
+
+	return nil
+}
+
+// NewHandler returns the handler of the fake provider's API, which is served under /v1.
+func NewHandler(fixtures *Fixtures) http.Handler {
+	return newHandler(fixtures)
+}
+
+func newHandler(fixtures *Fixtures) *handler {
+	h := new(handler)
+	h.setFixtures(fixtures)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/models", h.listModels)
+	mux.HandleFunc("POST /v1/chat/completions", h.createChatCompletion)
+	mux.HandleFunc("POST /v1/embeddings", h.createEmbeddings)
+	mux.HandleFunc("POST /v1/images/generations", h.createImages)
+	mux.HandleFunc("POST /v1/images/edits", h.createImages)
+	mux.HandleFunc("POST /v1/images/variations", h.createImages)
+	mux.HandleFunc("GET /v1/images/files/{file}", h.getImage)
+	mux.HandleFunc("POST /v1/audio/speech", h.createSpeech)
+	mux.HandleFunc("POST /v1/audio/transcriptions", h.createTranscription)
+	mux.HandleFunc("POST /v1/audio/translations", h.createTranscription)
+	h.mux = mux
+
+	return h
+}
+
+// Server serves the fake provider on a local port.
+type Server struct {
+	// URL is the base URL of the API, which the API paths, like /chat/completions, are appended to.
+	URL string
+
+	handler *handler
+	server  *http.Server
+}
+
+// NewServer starts serving the fake provider on a random local port.
+func NewServer(fixtures *Fixtures) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the fake upstream: %w", err)
+	}
+
+	h := newHandler(fixtures)
+	s := &Server{
+		URL:     fmt.Sprintf("http://%s/v1", listener.Addr()),
+		handler: h,
+		server: &http.Server{
+			Handler:           h,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Fake upstream failed", "err", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// SetFixtures replaces the fixtures of the requests that the server receives from now on.
+func (s *Server) SetFixtures(fixtures *Fixtures) {
+	s.handler.setFixtures(fixtures)
+}
+
+// Close stops the server, waiting for the responses that are being written.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
+
+type handler struct {
+	fixtures atomic.Pointer[Fixtures]
+	mux      *http.ServeMux
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) setFixtures(fixtures *Fixtures) {
+	if fixtures == nil {
+		fixtures = new(Fixtures)
+	}
+	h.fixtures.Store(fixtures)
+}
+
+func (h *handler) listModels(w http.ResponseWriter, _ *http.Request) {
+	ids := h.fixtures.Load().Models
+	if len(ids) == 0 {
+		ids = DefaultModels
+	}
+
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int    `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+	models := make([]model, 0, len(ids))
+	for _, id := range ids {
+		models = append(models, model{ID: id, Object: "model", OwnedBy: "fake"})
+	}
+
+	writeJSON(w, map[string]any{"object": "list", "data": models})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the format of OpenAI's API.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errorType(code),
+		},
+	})
+}
+
+func errorType(code int) string {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	case code >= 500:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
@@ -0,0 +1,174 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/acorn-io/z"
+	"github.com/gptscript-ai/clicky-chats/pkg/agents"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+const fixtures = `
+chatCompletions:
+- match:
+    contains: weather
+    role: user
+  toolCalls:
+  - name: weather
+    arguments:
+      city: Oslo
+- match:
+    model: gpt-3.5-*
+  statusCode: 429
+  error: Slow down
+`
+
+func newServer(t *testing.T) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "fixtures.yaml")
+	if err := os.WriteFile(file, []byte(fixtures), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadFixtures(file)
+	if err != nil {
+		t.Fatalf("LoadFixtures() = %v", err)
+	}
+
+	server := httptest.NewServer(NewHandler(f))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/v1"
+}
+
+func newRequest(t *testing.T, model, messages string) *db.CreateChatCompletionRequest {
+	t.Helper()
+
+	cc := &db.CreateChatCompletionRequest{Model: model}
+	if err := json.Unmarshal([]byte(messages), &cc.Messages); err != nil {
+		t.Fatal(err)
+	}
+
+	return cc
+}
+
+func TestStreamedToolCalls(t *testing.T) {
+	url := newServer(t)
+
+	stream, err := agents.StreamChatCompletionRequest(context.Background(), slog.Default(), http.DefaultClient, url+"/chat/completions", "", newRequest(t, "gpt-4o", `[{"role": "user", "content": "What's the weather?"}]`))
+	if err != nil {
+		t.Fatalf("StreamChatCompletionRequest() = %v", err)
+	}
+
+	var (
+		runStep   = new(db.RunStep)
+		toolCalls []db.GenericToolCallInfo
+		finish    string
+	)
+	for chunk := range stream {
+		if chunk.Error != nil {
+			t.Fatalf("unexpected error chunk: %s", *chunk.Error)
+		}
+		if _, err = runStep.Merge(&toolCalls, chunk); err != nil {
+			t.Fatalf("Merge() = %v", err)
+		}
+		finish += chunk.Choices[0].FinishReason
+	}
+
+	if len(toolCalls) != 1 || toolCalls[0].Name != "weather" || toolCalls[0].Arguments != `{"city":"Oslo"}` {
+		t.Errorf("tool calls = %+v", toolCalls)
+	}
+	if finish != "tool_calls" {
+		t.Errorf("finish reason = %q, want %q", finish, "tool_calls")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	url := newServer(t)
+
+	// The tool call fixture only matches user messages, so the tool's response is echoed.
+	ccr, err := agents.MakeChatCompletionRequest(context.Background(), slog.Default(), http.DefaultClient, url+"/chat/completions", "", newRequest(t, "gpt-4o", `[
+		{"role": "user", "content": "What's the weather?"},
+		{"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{}"}}]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "The weather is sunny."}
+	]`))
+	if err != nil {
+		t.Fatalf("MakeChatCompletionRequest() = %v", err)
+	}
+
+	public := ccr.ToPublic().(*openai.CreateChatCompletionResponse)
+	if len(public.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(public.Choices))
+	}
+	if content := z.Dereference(public.Choices[0].Message.Content); content != "The weather is sunny." {
+		t.Errorf("content = %q, want the tool's response", content)
+	}
+}
+
+func TestScriptedError(t *testing.T) {
+	url := newServer(t)
+
+	_, err := agents.StreamChatCompletionRequest(context.Background(), slog.Default(), http.DefaultClient, url+"/chat/completions", "", newRequest(t, "gpt-3.5-turbo", `[{"role": "user", "content": "Hi"}]`))
+
+	var upstreamErr *agents.UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("StreamChatCompletionRequest() = %v, want a rate limit error", err)
+	}
+}
+
+func TestEmbeddings(t *testing.T) {
+	url := newServer(t)
+
+	embed := func(input string) []float32 {
+		t.Helper()
+
+		resp, err := http.Post(url+"/embeddings", "application/json", bytes.NewBufferString(`{"model": "text-embedding-3-small", "input": [`+input+`]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var r struct {
+			Data []struct {
+				Embedding []float32 `json:"embedding"`
+			} `json:"data"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&r); err != nil || len(r.Data) != 1 {
+			t.Fatalf("failed to decode embeddings: %v", err)
+		}
+
+		return r.Data[0].Embedding
+	}
+
+	hello, world := embed(`"hello"`), embed(`"world"`)
+	if len(hello) != defaultEmbeddingDimensions {
+		t.Errorf("got %d dimensions, want %d", len(hello), defaultEmbeddingDimensions)
+	}
+	if !reflect.DeepEqual(hello, embed(`"hello"`)) {
+		t.Error("embeddings of the same input should be equal")
+	}
+	if reflect.DeepEqual(hello, world) {
+		t.Error("embeddings of different inputs should differ")
+	}
+
+	var norm float64
+	for _, v := range hello {
+		norm += float64(v) * float64(v)
+	}
+	if math.Abs(norm-1) > 1e-5 {
+		t.Errorf("embedding should be a unit vector, has squared norm %f", norm)
+	}
+}
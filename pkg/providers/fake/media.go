@@ -0,0 +1,262 @@
+package fake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/providers"
+)
+
+const (
+	// imageSize is the width and height of generated images.
+	imageSize = 8
+	// sampleRate is the sample rate of generated speech, which has a tenth of a second of silence per word.
+	sampleRate = 8000
+)
+
+type embeddingsRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	Dimensions     int             `json:"dimensions"`
+	EncodingFormat string          `json:"encoding_format"`
+}
+
+func (h *handler) createEmbeddings(w http.ResponseWriter, r *http.Request) {
+	req := new(embeddingsRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request: %v", err))
+		return
+	}
+
+	inputs, err := providers.EmbeddingInputs(req.Input)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dimensions := req.Dimensions
+	if dimensions <= 0 {
+		dimensions = h.fixtures.Load().EmbeddingDimensions
+	}
+	if dimensions <= 0 {
+		dimensions = defaultEmbeddingDimensions
+	}
+
+	type embedding struct {
+		Object    string `json:"object"`
+		Index     int    `json:"index"`
+		Embedding any    `json:"embedding"`
+	}
+
+	var (
+		tokens int
+		data   = make([]embedding, 0, len(inputs))
+	)
+	for i, input := range inputs {
+		tokens += countTokens(input)
+
+		var vector any = embed(input, dimensions)
+		if req.EncodingFormat == "base64" {
+			vector = providers.EncodeEmbedding(vector.([]float32))
+		}
+		data = append(data, embedding{Object: "embedding", Index: i, Embedding: vector})
+	}
+
+	writeJSON(w, map[string]any{
+		"object": "list",
+		"model":  req.Model,
+		"data":   data,
+		"usage": map[string]int{
+			"prompt_tokens": tokens,
+			"total_tokens":  tokens,
+		},
+	})
+}
+
+// embed returns a unit vector that is derived from the hash of the input, so that the same input always has the same
+// embedding.
+func embed(input string, dimensions int) []float32 {
+	var (
+		vector = make([]float32, dimensions)
+		sum    [sha256.Size]byte
+		norm   float64
+	)
+	for i := range vector {
+		if i%(sha256.Size/4) == 0 {
+			sum = sha256.Sum256([]byte(fmt.Sprintf("%d:%s", i, input)))
+		}
+
+		offset := i % (sha256.Size / 4) * 4
+		v := float64(binary.LittleEndian.Uint32(sum[offset:]))/math.MaxUint32*2 - 1
+		vector[i] = float32(v)
+		norm += v * v
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+
+	return vector
+}
+
+// createImages responds to image generations, edits and variations with solid images, which have a color that is
+// derived from the prompt.
+func (h *handler) createImages(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prompt         string `json:"prompt"`
+		N              int    `json:"n"`
+		ResponseFormat string `json:"response_format"`
+	}
+	if isMultipart(r) {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request: %v", err))
+			return
+		}
+
+		req.Prompt, req.ResponseFormat = r.FormValue("prompt"), r.FormValue("response_format")
+		if n := r.FormValue("n"); n != "" {
+			req.N, _ = strconv.Atoi(n)
+		}
+		if _, header, err := r.FormFile("image"); err == nil {
+			req.Prompt += header.Filename
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request: %v", err))
+		return
+	}
+
+	if req.N <= 0 {
+		req.N = 1
+	}
+
+	type generatedImage struct {
+		URL           string `json:"url,omitempty"`
+		B64JSON       string `json:"b64_json,omitempty"`
+		RevisedPrompt string `json:"revised_prompt,omitempty"`
+	}
+	images := make([]generatedImage, 0, req.N)
+	for i := range req.N {
+		c := hash([]byte(req.Prompt), i)[:6]
+		if req.ResponseFormat == "b64_json" {
+			images = append(images, generatedImage{B64JSON: base64.StdEncoding.EncodeToString(solidImage(c)), RevisedPrompt: req.Prompt})
+			continue
+		}
+
+		images = append(images, generatedImage{URL: fmt.Sprintf("http://%s/v1/images/files/%s.png", r.Host, c), RevisedPrompt: req.Prompt})
+	}
+
+	writeJSON(w, map[string]any{
+		"created": time.Now().Unix(),
+		"data":    images,
+	})
+}
+
+// getImage serves the images that are referred to by URL. The file name is the hex-encoded color of the image.
+func (h *handler) getImage(w http.ResponseWriter, r *http.Request) {
+	c := strings.TrimSuffix(r.PathValue("file"), ".png")
+	if _, err := hex.DecodeString(c); err != nil || len(c) != 6 {
+		writeError(w, http.StatusNotFound, "image not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(solidImage(c))
+}
+
+// solidImage returns a PNG of the hex-encoded RGB color.
+func solidImage(c string) []byte {
+	rgb, _ := hex.DecodeString(c)
+
+	img := image.NewRGBA(image.Rect(0, 0, imageSize, imageSize))
+	for x := range imageSize {
+		for y := range imageSize {
+			img.Set(x, y, color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+
+	return buf.Bytes()
+}
+
+// createSpeech responds with a WAV file of silence, which is a tenth of a second long for each word of the input.
+func (h *handler) createSpeech(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request: %v", err))
+		return
+	}
+
+	samples := max(countTokens(req.Input), 1) * sampleRate / 10
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(36+samples))
+	buf.WriteString("WAVEfmt ")
+	// A PCM format chunk for mono 8-bit audio.
+	for _, field := range []any{uint32(16), uint16(1), uint16(1), uint32(sampleRate), uint32(sampleRate), uint16(1), uint16(8)} {
+		_ = binary.Write(&buf, binary.LittleEndian, field)
+	}
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(samples))
+	// Silence is the midpoint of unsigned 8-bit samples.
+	buf.Write(bytes.Repeat([]byte{0x80}, samples))
+
+	w.Header().Set("Content-Type", "audio/wav")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// createTranscription responds to transcriptions and translations with the text of the fixtures, or a description of
+// the audio file.
+func (h *handler) createTranscription(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request: %v", err))
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer file.Close()
+
+	size, _ := io.Copy(io.Discard, file)
+
+	text := h.fixtures.Load().Transcription
+	if text == "" {
+		text = fmt.Sprintf("Transcription of %s, which is %d bytes long.", header.Filename, size)
+	}
+
+	switch r.FormValue("response_format") {
+	case "text", "srt", "vtt":
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, text)
+	default:
+		writeJSON(w, map[string]string{"text": text})
+	}
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
@@ -0,0 +1,194 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/acorn-io/z"
+	cclient "github.com/gptscript-ai/clicky-chats/pkg/client"
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+)
+
+// ImageProvider creates, edits and makes variations of images. Errors from the provider's API are recorded in the
+// response, with the status code of the provider's response, and an error is only returned if the request couldn't be
+// made.
+type ImageProvider interface {
+	CreateImage(ctx context.Context, req *db.CreateImageRequest) (*db.ImagesResponse, error)
+	CreateImageEdit(ctx context.Context, req *db.CreateImageEditRequest) (*db.ImagesResponse, error)
+	CreateImageVariation(ctx context.Context, req *db.CreateImageVariationRequest) (*db.ImagesResponse, error)
+}
+
+// OpenAIImages makes images with OpenAI's images API.
+type OpenAIImages struct {
+	baseURL, apiKey string
+	client          *http.Client
+}
+
+// NewOpenAIImages returns a provider that sends requests to the images API at baseURL, which paths like /generations
+// are appended to.
+func NewOpenAIImages(baseURL, apiKey string, client *http.Client) *OpenAIImages {
+	return &OpenAIImages{baseURL: baseURL, apiKey: apiKey, client: client}
+}
+
+func (o *OpenAIImages) CreateImage(ctx context.Context, createRequest *db.CreateImageRequest) (*db.ImagesResponse, error) {
+	data, err := json.Marshal(createRequest.ToPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal create image request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/generations", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	return o.send(req)
+}
+
+func (o *OpenAIImages) CreateImageEdit(ctx context.Context, editRequest *db.CreateImageEditRequest) (*db.ImagesResponse, error) {
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	publicRequest := editRequest.ToPublic().(*openai.CreateImageEditRequest)
+	if err := writeFormFile(writer, "image", publicRequest.Image); err != nil {
+		return nil, err
+	}
+	if mask := publicRequest.Mask; mask != nil {
+		if err := writeFormFile(writer, "mask", *mask); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeFormFields(writer, []formField{
+		{"model", editRequest.Model},
+		{"n", formatInt(editRequest.N)},
+		{"prompt", &editRequest.Prompt},
+		{"response_format", editRequest.ResponseFormat},
+		{"size", editRequest.Size},
+		{"user", editRequest.User},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close body writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/edits", &requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image edit request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return o.send(req)
+}
+
+func (o *OpenAIImages) CreateImageVariation(ctx context.Context, variationRequest *db.CreateImageVariationRequest) (*db.ImagesResponse, error) {
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	publicRequest := variationRequest.ToPublic().(*openai.CreateImageVariationRequest)
+	if err := writeFormFile(writer, "image", publicRequest.Image); err != nil {
+		return nil, err
+	}
+
+	if err := writeFormFields(writer, []formField{
+		{"model", variationRequest.Model},
+		{"n", formatInt(variationRequest.N)},
+		{"response_format", variationRequest.ResponseFormat},
+		{"size", variationRequest.Size},
+		{"user", variationRequest.User},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close body writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/variations", &requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image variation request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return o.send(req)
+}
+
+func (o *OpenAIImages) send(req *http.Request) (*db.ImagesResponse, error) {
+	req.Header.Set("Accept", "application/json")
+	setBearerToken(req, o.apiKey)
+
+	oir, ir := new(openai.ImagesResponse), new(db.ImagesResponse)
+	code, err := cclient.SendRequest(o.client, req, oir)
+	if fromErr := ir.FromPublic(oir); fromErr != nil {
+		return nil, fromErr
+	}
+
+	if err != nil {
+		ir.Error = z.Pointer(err.Error())
+	}
+	ir.StatusCode = code
+
+	return ir, nil
+}
+
+// formFile is a file of a multipart request, like openapi_types.File.
+type formFile interface {
+	Filename() string
+	Reader() (io.ReadCloser, error)
+}
+
+func writeFormFile(writer *multipart.Writer, field string, file formFile) error {
+	part, err := writer.CreateFormFile(field, file.Filename())
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %w", err)
+	}
+	r, err := file.Reader()
+	if err != nil {
+		return fmt.Errorf("failed to get %s reader: %w", field, err)
+	}
+	defer r.Close()
+
+	if _, err = io.Copy(part, r); err != nil {
+		return fmt.Errorf("failed to copy %s to form file: %w", field, err)
+	}
+
+	return nil
+}
+
+type formField struct {
+	name  string
+	value *string
+}
+
+// writeFormFields writes the fields that are set, in order.
+func writeFormFields(writer *multipart.Writer, fields []formField) error {
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+		if err := writer.WriteField(field.name, *field.value); err != nil {
+			return fmt.Errorf("failed to write %s field: %w", field.name, err)
+		}
+	}
+
+	return nil
+}
+
+func formatInt(n *int) *string {
+	if n == nil {
+		return nil
+	}
+	return z.Pointer(strconv.Itoa(*n))
+}
@@ -0,0 +1,359 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/httpclient"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
+	"github.com/invopop/yaml"
+)
+
+// ModelPlaceholder is replaced with the model name in a provider's base URL, for providers like Azure OpenAI that have a
+// URL per deployment.
+const ModelPlaceholder = "{model}"
+
+const (
+	// APIOpenAI is the API of providers that are compatible with OpenAI's chat completions API. It is the default.
+	APIOpenAI = "openai"
+	// APIAnthropic is the API of providers that serve Anthropic's Messages API.
+	APIAnthropic = "anthropic"
+
+	// AnthropicVersion is the version of the Anthropic API that is requested, unless a provider sets the
+	// anthropic-version header.
+	AnthropicVersion = "2023-06-01"
+)
+
+// ErrNoRoute is returned when no provider serves a model.
+var ErrNoRoute = errors.New("no provider found for model")
+
+// Provider is an upstream server with an OpenAI-compatible API.
+type Provider struct {
+	Name string `json:"name"`
+	// API is the API that the provider serves, either APIOpenAI or APIAnthropic. Defaults to APIOpenAI.
+	API string `json:"api,omitempty"`
+	// BaseURL is the URL that API paths, like /chat/completions, are appended to. It may contain ModelPlaceholder.
+	BaseURL string `json:"baseURL"`
+	// ModelsURL overrides the URL that models are listed from, which is BaseURL + "/models" by default.
+	ModelsURL string `json:"modelsURL,omitempty"`
+	// ListModels determines whether the provider's models are listed and stored. By default, models are listed unless
+	// the base URL contains ModelPlaceholder.
+	ListModels *bool `json:"listModels,omitempty"`
+	// APIKey is sent as a bearer token, or in the x-api-key header for Anthropic, if set. Environment variables in the key and header values are expanded.
+	APIKey      string            `json:"apiKey,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	QueryParams map[string]string `json:"queryParams,omitempty"`
+	// Timeout limits the time taken by each request to the provider, including reading streamed responses.
+	Timeout string `json:"timeout,omitempty"`
+	// HTTP overrides the proxy, certificates and connection timeouts that are used for every provider.
+	HTTP httpclient.Config `json:"http,omitempty"`
+	// Models are the model names and path.Match patterns that are routed to the provider. A provider without models
+	// serves every model.
+	Models []string `json:"models,omitempty"`
+	// Fallbacks are the models that are tried, in order, when a model routed to the provider keeps failing or the
+	// provider's circuit breaker is open. The fallbacks may be routed to other providers.
+	Fallbacks      []string      `json:"fallbacks,omitempty"`
+	CircuitBreaker BreakerConfig `json:"circuitBreaker,omitempty"`
+
+	client  *http.Client
+	breaker *CircuitBreaker
+}
+
+// Assistant configures the chat completion requests of an assistant's runs.
+type Assistant struct {
+	ID string `json:"id"`
+	// Fallbacks are the models that are tried, in order, when the run's model keeps failing, before the fallbacks of
+	// the model's provider.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+}
+
+// Route is a provider of images, audio or embeddings with an OpenAI-compatible API.
+type Route struct {
+	Name string `json:"name"`
+	// URL is the URL of the provider's images or audio API, which paths like /generations are appended to, or of its
+	// embeddings API.
+	URL string `json:"url"`
+	// APIKey is sent as a bearer token, if set. Environment variables in the key are expanded.
+	APIKey string `json:"apiKey,omitempty"`
+	// Models are the model names and path.Match patterns that are routed to the provider. A provider without models
+	// replaces the default provider.
+	Models []string `json:"models,omitempty"`
+}
+
+// Config is the routing configuration file.
+type Config struct {
+	Providers  []Provider  `json:"providers"`
+	Assistants []Assistant `json:"assistants,omitempty"`
+	// Images, Audio and Embeddings route the models of the image, audio and embeddings agents. Models that they don't
+	// route are sent to the agents' default providers.
+	Images     []Route `json:"images,omitempty"`
+	Audio      []Route `json:"audio,omitempty"`
+	Embeddings []Route `json:"embeddings,omitempty"`
+}
+
+// LoadConfig reads the routing configuration from a YAML or JSON file.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model routes: %w", err)
+	}
+
+	cfg := new(Config)
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse model routes %s: %w", file, err)
+	}
+
+	return cfg, nil
+}
+
+// AssistantFallbacks returns the fallback models of each assistant by its ID.
+func (c *Config) AssistantFallbacks() map[string][]string {
+	fallbacks := make(map[string][]string, len(c.Assistants))
+	for _, a := range c.Assistants {
+		fallbacks[a.ID] = a.Fallbacks
+	}
+
+	return fallbacks
+}
+
+// ImageProviders returns the registry of the image routes, which falls back to defaultProvider. The providers send
+// requests with client.
+func (c *Config) ImageProviders(defaultProvider ImageProvider, client *http.Client) (*Registry[ImageProvider], error) {
+	return newRouteRegistry(defaultProvider, c.Images, func(r Route) ImageProvider {
+		return NewOpenAIImages(r.URL, os.ExpandEnv(r.APIKey), client)
+	})
+}
+
+// AudioProviders returns the registry of the audio routes, which falls back to defaultProvider. The providers send
+// requests with client.
+func (c *Config) AudioProviders(defaultProvider AudioProvider, client *http.Client) (*Registry[AudioProvider], error) {
+	return newRouteRegistry(defaultProvider, c.Audio, func(r Route) AudioProvider {
+		return NewOpenAIAudio(r.URL, os.ExpandEnv(r.APIKey), client)
+	})
+}
+
+// EmbeddingsProviders returns the registry of the embeddings routes, which falls back to defaultProvider. The providers
+// send requests with client.
+func (c *Config) EmbeddingsProviders(defaultProvider EmbeddingsProvider, client *http.Client) (*Registry[EmbeddingsProvider], error) {
+	return newRouteRegistry(defaultProvider, c.Embeddings, func(r Route) EmbeddingsProvider {
+		return NewOpenAIEmbeddings(r.URL, os.ExpandEnv(r.APIKey), client)
+	})
+}
+
+func newRouteRegistry[T any](defaultProvider T, routes []Route, newProvider func(Route) T) (*Registry[T], error) {
+	registry := NewRegistry[T]()
+	if err := registry.Register(defaultProvider); err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.URL == "" {
+			return nil, fmt.Errorf("provider %s has no URL", r.Name)
+		}
+		if err := registry.Register(newProvider(r), r.Models...); err != nil {
+			return nil, fmt.Errorf("provider %s: %w", r.Name, err)
+		}
+	}
+
+	return registry, nil
+}
+
+// Serves returns true if requests for the model are routed to the provider.
+func (p *Provider) Serves(model string) bool {
+	if len(p.Models) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Models {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// URL returns the URL of the API path for the model.
+func (p *Provider) URL(model, apiPath string) string {
+	u := strings.TrimSuffix(strings.ReplaceAll(p.BaseURL, ModelPlaceholder, url.PathEscape(model)), "/") + apiPath
+	if len(p.QueryParams) == 0 {
+		return u
+	}
+
+	q := make(url.Values, len(p.QueryParams))
+	for k, v := range p.QueryParams {
+		q.Set(k, v)
+	}
+
+	return u + "?" + q.Encode()
+}
+
+// ChatCompletionsURL returns the URL that chat completion requests for the model are sent to.
+func (p *Provider) ChatCompletionsURL(model string) string {
+	if p.API == APIAnthropic {
+		return p.URL(model, "/messages")
+	}
+
+	return p.URL(model, "/chat/completions")
+}
+
+// ModelListURL returns the URL that the provider's models are listed from, or an empty string if they aren't listed.
+func (p *Provider) ModelListURL() string {
+	if p.ListModels != nil && !*p.ListModels || p.ListModels == nil && strings.Contains(p.BaseURL, ModelPlaceholder) {
+		return ""
+	}
+	if p.ModelsURL != "" {
+		return p.ModelsURL
+	}
+
+	return p.URL("", "/models")
+}
+
+// ExactModels returns the model names that the provider is configured with, ignoring patterns.
+func (p *Provider) ExactModels() []string {
+	models := make([]string, 0, len(p.Models))
+	for _, m := range p.Models {
+		if !strings.ContainsAny(m, `*?[\`) {
+			models = append(models, m)
+		}
+	}
+
+	return models
+}
+
+// Client returns the client for requests to the provider. It sets the provider's headers on each request and applies
+// the provider's timeout.
+func (p *Provider) Client() *http.Client {
+	return p.client
+}
+
+// Breaker returns the provider's circuit breaker.
+func (p *Provider) Breaker() *CircuitBreaker {
+	return p.breaker
+}
+
+func (p *Provider) init(clients *httpclient.Factory) error {
+	if p.Name == "" {
+		return fmt.Errorf("provider with base URL %q has no name", p.BaseURL)
+	}
+	if p.BaseURL == "" {
+		return fmt.Errorf("provider %s has no base URL", p.Name)
+	}
+	switch p.API {
+	case "":
+		p.API = APIOpenAI
+	case APIOpenAI, APIAnthropic:
+	default:
+		return fmt.Errorf("provider %s has unsupported API %q", p.Name, p.API)
+	}
+	for _, pattern := range p.Models {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("provider %s has invalid model pattern %q: %w", p.Name, pattern, err)
+		}
+	}
+
+	var timeout time.Duration
+	if p.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(p.Timeout); err != nil {
+			return fmt.Errorf("provider %s has invalid timeout: %w", p.Name, err)
+		}
+	}
+
+	breaker, err := newCircuitBreaker(p.CircuitBreaker)
+	if err != nil {
+		return fmt.Errorf("provider %s: %w", p.Name, err)
+	}
+	p.breaker = breaker
+
+	headers := make(http.Header, len(p.Headers)+2)
+	if p.API == APIAnthropic {
+		headers.Set("anthropic-version", AnthropicVersion)
+		if p.APIKey != "" {
+			headers.Set("x-api-key", os.ExpandEnv(p.APIKey))
+		}
+	} else if p.APIKey != "" {
+		headers.Set("Authorization", "Bearer "+os.ExpandEnv(p.APIKey))
+	}
+	for k, v := range p.Headers {
+		headers.Set(k, os.ExpandEnv(v))
+	}
+
+	transport, err := clients.TransportFor(p.HTTP)
+	if err != nil {
+		return fmt.Errorf("provider %s: %w", p.Name, err)
+	}
+
+	p.client = &http.Client{
+		Transport: headerTransport{base: tracing.Transport{Base: transport}, headers: headers},
+		Timeout:   timeout,
+	}
+
+	return nil
+}
+
+// headerTransport sets headers on every request.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// Router routes models to providers. The first provider that serves a model is used.
+type Router struct {
+	providers []*Provider
+}
+
+// NewRouter validates the providers and returns a router for them. The transports of the providers' clients are made by
+// clients, which may be nil.
+func NewRouter(clients *httpclient.Factory, providers []Provider) (*Router, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("at least one model provider is required")
+	}
+
+	r := &Router{providers: make([]*Provider, 0, len(providers))}
+	names := make(map[string]struct{}, len(providers))
+	for i := range providers {
+		p := providers[i]
+		if err := p.init(clients); err != nil {
+			return nil, err
+		}
+		if _, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate provider name %s", p.Name)
+		}
+		names[p.Name] = struct{}{}
+
+		r.providers = append(r.providers, &p)
+	}
+
+	return r, nil
+}
+
+// Route returns the provider that serves the model.
+func (r *Router) Route(model string) (*Provider, error) {
+	for _, p := range r.providers {
+		if p.Serves(model) {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %s", ErrNoRoute, model)
+}
+
+// Providers returns the providers in the order that they are matched.
+func (r *Router) Providers() []*Provider {
+	return r.providers
+}
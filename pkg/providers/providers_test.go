@@ -0,0 +1,235 @@
+package providers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRoute(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(file, []byte(`
+providers:
+- name: azure
+  baseURL: https://example.openai.azure.com/openai/deployments/{model}
+  headers:
+    api-key: ${TEST_AZURE_KEY}
+  queryParams:
+    api-version: "2024-02-01"
+  models: [gpt-4o]
+- name: local
+  baseURL: http://localhost:11434/v1/
+  models: ["llama3*", "mistral:*"]
+- name: openai
+  baseURL: https://api.openai.com/v1
+assistants:
+- id: asst_1
+  fallbacks: [gpt-4o-mini]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf("LoadConfig() = %v", err)
+	}
+	if fallbacks := cfg.AssistantFallbacks()["asst_1"]; len(fallbacks) != 1 || fallbacks[0] != "gpt-4o-mini" {
+		t.Errorf("fallbacks of asst_1 = %v, want [gpt-4o-mini]", fallbacks)
+	}
+	providers := cfg.Providers
+	router, err := NewRouter(nil, providers)
+	if err != nil {
+		t.Fatalf("NewRouter() = %v", err)
+	}
+
+	for model, want := range map[string]string{
+		"gpt-4o":         "https://example.openai.azure.com/openai/deployments/gpt-4o/chat/completions?api-version=2024-02-01",
+		"llama3:8b":      "http://localhost:11434/v1/chat/completions",
+		"mistral:latest": "http://localhost:11434/v1/chat/completions",
+		"gpt-4-turbo":    "https://api.openai.com/v1/chat/completions",
+	} {
+		p, err := router.Route(model)
+		if err != nil {
+			t.Errorf("Route(%q) = %v", model, err)
+			continue
+		}
+		if got := p.ChatCompletionsURL(model); got != want {
+			t.Errorf("ChatCompletionsURL(%q) = %q, want %q", model, got, want)
+		}
+	}
+
+	azure := router.Providers()[0]
+	if azure.ModelListURL() != "" {
+		t.Errorf("models of a provider with a URL per model shouldn't be listed, got %q", azure.ModelListURL())
+	}
+	if got := router.Providers()[1].ModelListURL(); got != "http://localhost:11434/v1/models" {
+		t.Errorf("ModelListURL() = %q", got)
+	}
+
+	router, err = NewRouter(nil, providers[:2])
+	if err != nil {
+		t.Fatalf("NewRouter() = %v", err)
+	}
+	if _, err = router.Route("gpt-4-turbo"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Route() for an unrouted model = %v, want %v", err, ErrNoRoute)
+	}
+}
+
+func TestProviderClient(t *testing.T) {
+	t.Setenv("TEST_PROVIDER_KEY", "secret")
+
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer upstream.Close()
+
+	router, err := NewRouter(nil, []Provider{{
+		Name:    "upstream",
+		BaseURL: upstream.URL,
+		APIKey:  "${TEST_PROVIDER_KEY}",
+		Headers: map[string]string{"X-Team": "blue"},
+		Timeout: "5s",
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter() = %v", err)
+	}
+
+	p := router.Providers()[0]
+	resp, err := p.Client().Get(p.ChatCompletionsURL("model"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if auth := got.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Authorization header = %q, want %q", auth, "Bearer secret")
+	}
+	if team := got.Get("X-Team"); team != "blue" {
+		t.Errorf("X-Team header = %q, want %q", team, "blue")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker, err := newCircuitBreaker(BreakerConfig{FailureThreshold: 2, Cooldown: "50ms"})
+	if err != nil {
+		t.Fatalf("newCircuitBreaker() = %v", err)
+	}
+
+	breaker.Record(true)
+	if !breaker.Allow() {
+		t.Fatal("circuit shouldn't open before the failure threshold")
+	}
+	breaker.Record(true)
+	if breaker.Allow() {
+		t.Fatal("circuit should open at the failure threshold")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Fatal("a trial request should be allowed after the cooldown")
+	}
+	if breaker.Allow() {
+		t.Fatal("only one trial request should be allowed")
+	}
+	breaker.Record(false)
+	if !breaker.Allow() {
+		t.Fatal("circuit should close after a successful trial request")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry[string]()
+	if _, err := registry.Lookup("tts-1"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Lookup() in an empty registry = %v, want %v", err, ErrNoRoute)
+	}
+
+	for _, r := range []struct {
+		provider string
+		models   []string
+	}{
+		{"openai", nil},
+		{"piper", []string{"tts-*"}},
+		{"local", []string{"tts-1-local", "nomic-embed-*"}},
+	} {
+		if err := registry.Register(r.provider, r.models...); err != nil {
+			t.Fatalf("Register(%s) = %v", r.provider, err)
+		}
+	}
+	if err := registry.Register("invalid", "tts-["); err == nil {
+		t.Error("Register() with an invalid pattern should fail")
+	}
+
+	for model, want := range map[string]string{
+		"tts-1-local":            "local",
+		"tts-1-hd":               "piper",
+		"nomic-embed-text":       "local",
+		"text-embedding-3-small": "openai",
+		"":                       "openai",
+	} {
+		if got, err := registry.Lookup(model); err != nil || got != want {
+			t.Errorf("Lookup(%q) = %q, %v, want %q", model, got, err, want)
+		}
+	}
+}
+
+func TestEmbeddingInputs(t *testing.T) {
+	for input, want := range map[string][]string{
+		`"hello world"`:        {"hello world"},
+		`["hello", "world"]`:   {"hello", "world"},
+		`[1, 2, 3]`:            {"1 2 3"},
+		`[[1, 2], [3]]`:        {"1 2", "3"},
+		`[]`:                   nil,
+		`{"text": "not text"}`: nil,
+	} {
+		got, err := EmbeddingInputs([]byte(input))
+		if want == nil {
+			if err == nil {
+				t.Errorf("EmbeddingInputs(%s) = %q, want an error", input, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("EmbeddingInputs(%s) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+}
+
+func TestRouteRegistries(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(file, []byte(`
+embeddings:
+- name: self-hosted
+  url: http://localhost:8000/v1/embeddings
+  models: ["nomic-embed-*"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultProvider := NewOpenAIEmbeddings("https://api.openai.com/v1/embeddings", "", http.DefaultClient)
+	registry, err := cfg.EmbeddingsProviders(defaultProvider, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := registry.Lookup("nomic-embed-text"); err != nil || p.(*OpenAIEmbeddings).url != "http://localhost:8000/v1/embeddings" {
+		t.Errorf("Lookup(nomic-embed-text) = %+v, %v, want the self-hosted provider", p, err)
+	}
+	if p, err := registry.Lookup("text-embedding-3-small"); err != nil || p != EmbeddingsProvider(defaultProvider) {
+		t.Errorf("Lookup(text-embedding-3-small) = %+v, %v, want the default provider", p, err)
+	}
+
+	cfg.Images = []Route{{Name: "no-url", Models: []string{"dall-e-3"}}}
+	if _, err = cfg.ImageProviders(NewOpenAIImages("https://api.openai.com/v1/images", "", http.DefaultClient), http.DefaultClient); err == nil {
+		t.Error("ImageProviders() of a provider without a URL should fail")
+	}
+}
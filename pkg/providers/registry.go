@@ -0,0 +1,86 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Registry routes models to the providers of a capability, like embeddings or speech. A model is routed to the
+// provider registered with its name, then to the first provider registered with a path.Match pattern that matches it,
+// and otherwise to the default provider, which is registered without models.
+type Registry[T any] struct {
+	exact    map[string]T
+	patterns []patternRoute[T]
+	fallback *T
+}
+
+type patternRoute[T any] struct {
+	pattern  string
+	provider T
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry[T any]() *Registry[T] {
+	return &Registry[T]{exact: make(map[string]T)}
+}
+
+// Register routes the models, which are model names or path.Match patterns, to the provider. A provider registered
+// without models is the default provider, replacing the previous one. A model name that is already registered is
+// routed to the new provider.
+func (r *Registry[T]) Register(provider T, models ...string) error {
+	if len(models) == 0 {
+		r.fallback = &provider
+		return nil
+	}
+
+	for _, model := range models {
+		if _, err := path.Match(model, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %q: %w", model, err)
+		}
+	}
+	for _, model := range models {
+		if strings.ContainsAny(model, `*?[\`) {
+			r.patterns = append(r.patterns, patternRoute[T]{pattern: model, provider: provider})
+		} else {
+			r.exact[model] = provider
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the provider that serves the model, or an error that wraps ErrNoRoute if there is none.
+func (r *Registry[T]) Lookup(model string) (T, error) {
+	if p, ok := r.exact[model]; ok {
+		return p, nil
+	}
+	for _, route := range r.patterns {
+		if matched, _ := path.Match(route.pattern, model); matched {
+			return route.provider, nil
+		}
+	}
+	if r.fallback != nil {
+		return *r.fallback, nil
+	}
+
+	var zero T
+	return zero, noRouteError(model)
+}
+
+// noRouteError is returned when no registered provider serves a model. Requests for the model fail with the status
+// code that OpenAI uses for unknown models.
+type noRouteError string
+
+func (e noRouteError) Error() string {
+	return fmt.Sprintf("%s %s", ErrNoRoute, string(e))
+}
+
+func (e noRouteError) Unwrap() error {
+	return ErrNoRoute
+}
+
+func (e noRouteError) GetStatusCode() int {
+	return http.StatusNotFound
+}
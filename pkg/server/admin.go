@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+	"gorm.io/gorm"
+)
+
+// AdminJob is the response to an admin action on a job.
+type AdminJob struct {
+	ID     string `json:"id"`
+	Queue  string `json:"queue"`
+	Action string `json:"action"`
+}
+
+// registerAdminRoutes adds the admin API for inspecting and managing the job queues. The admin API is only served if an
+// admin token is configured, and requests to it must carry the token as a bearer token.
+func (s *Server) registerAdminRoutes(mux *http.ServeMux, apiBase, token string) {
+	if token == "" {
+		return
+	}
+
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, LogRequest(slog.Default())(SetContentType("application/json")(requireAdminToken(token)(handler))))
+	}
+
+	handle(fmt.Sprintf("GET %s/x/admin/queues", apiBase), s.listQueues)
+	handle(fmt.Sprintf("POST %s/x/admin/queues/{queue}/jobs/{id}/requeue", apiBase), s.adminJobAction("requeue", db.RequeueJob))
+	handle(fmt.Sprintf("POST %s/x/admin/queues/{queue}/jobs/{id}/cancel", apiBase), s.adminJobAction("cancel", db.CancelJob))
+	handle(fmt.Sprintf("DELETE %s/x/admin/queues/{queue}/jobs/{id}", apiBase), s.adminJobAction("purge", db.PurgeJob))
+}
+
+// requireAdminToken rejects requests that don't carry the admin token as a bearer token.
+func requireAdminToken(token string) MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(NewAPIError("Invalid admin token.", InvalidRequestErrorType).Error()))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) listQueues(w http.ResponseWriter, r *http.Request) {
+	stats, err := db.ListQueueStats(s.db.WithContext(r.Context()))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to list queues: %v", err), InternalErrorType).Error()))
+		return
+	}
+
+	writeObjectToResponse(w, map[string]any{
+		"object": "list",
+		"data":   stats,
+	})
+}
+
+func (s *Server) adminJobAction(action string, apply func(*gorm.DB, string, string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue, id := r.PathValue("queue"), r.PathValue("id")
+		if err := apply(s.db.WithContext(r.Context()), queue, id); err != nil {
+			switch {
+			case errors.Is(err, db.ErrUnknownQueue):
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("No queue found with name '%s'.", queue), InvalidRequestErrorType).Error()))
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("No %s job found with id '%s'.", queue, id), InvalidRequestErrorType).Error()))
+			case errors.Is(err, db.ErrJobDone):
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Cannot %s job '%s' because it is already done.", action, id), InvalidRequestErrorType).Error()))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to %s job: %v", action, err), InternalErrorType).Error()))
+			}
+			return
+		}
+
+		writeObjectToResponse(w, AdminJob{
+			ID:     id,
+			Queue:  queue,
+			Action: action,
+		})
+	}
+}
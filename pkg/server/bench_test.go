@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gptscript-ai/clicky-chats/pkg/db"
+)
+
+const (
+	benchRequests         = 2000
+	benchChunksPerRequest = 50
+)
+
+// BenchmarkStreamChatCompletion measures the latency of streaming a completed chat completion from a large chunk table.
+func BenchmarkStreamChatCompletion(b *testing.B) {
+	ctx := context.Background()
+	gdb, err := db.New("sqlite://"+filepath.Join(b.TempDir(), "bench.db"), true)
+	if err != nil {
+		b.Fatalf("failed to create database: %v", err)
+	}
+	b.Cleanup(func() {
+		_ = gdb.Close()
+	})
+	if err = gdb.EnsureSchema(ctx); err != nil {
+		b.Fatalf("failed to migrate database: %v", err)
+	}
+
+	chunks := make([]db.ChatCompletionResponseChunk, 0, benchRequests*benchChunksPerRequest)
+	for i := 0; i < benchRequests; i++ {
+		for j := 0; j < benchChunksPerRequest; j++ {
+			chunks = append(chunks, db.ChatCompletionResponseChunk{
+				Base:        db.Base{ID: fmt.Sprintf("chatcmpl-%d-%d", i, j), CreatedAt: i},
+				JobResponse: db.JobResponse{RequestID: fmt.Sprintf("chatcmpl-%d", i), Done: j == benchChunksPerRequest-1},
+				ResponseIdx: j,
+			})
+		}
+	}
+	if err = gdb.WithContext(ctx).CreateInBatches(chunks, 500).Error; err != nil {
+		b.Fatalf("failed to seed database: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		waitForAndStreamResponse[*db.ChatCompletionResponseChunk](ctx, w, gdb.WithContext(ctx), fmt.Sprintf("chatcmpl-%d", i%benchRequests), 0)
+		if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+			b.Fatalf("unexpected response: %s", w.Body.String())
+		}
+	}
+}
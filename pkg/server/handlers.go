@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"slices"
 	"strconv"
@@ -17,6 +18,7 @@ import (
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
 	kb "github.com/gptscript-ai/clicky-chats/pkg/knowledgebases"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
 	"github.com/oapi-codegen/runtime"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
@@ -401,6 +403,8 @@ func (s *Server) CreateSpeech(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	speech.Priority = s.priorities.forRequest(r, "")
+
 	var (
 		ctx    = r.Context()
 		gormDB = s.db.WithContext(ctx)
@@ -416,6 +420,7 @@ func (s *Server) CreateSpeech(w http.ResponseWriter, r *http.Request) {
 
 	speechResponse := new(db.CreateSpeechResponse)
 	if err := waitForResponse(ctx, ready, gormDB, speech.ID, speechResponse); err != nil {
+		cancelIfDisconnected(ctx, gormDB, "audio", speech.ID)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to get response: %v", err), InternalErrorType).Error()))
 		return
@@ -551,6 +556,8 @@ func (s *Server) CreateTranscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	agentReq.Priority = s.priorities.forRequest(r, "")
+
 	var (
 		ctx    = r.Context()
 		gormDB = s.db.WithContext(ctx)
@@ -564,7 +571,7 @@ func (s *Server) CreateTranscription(w http.ResponseWriter, r *http.Request) {
 	// Kick the audio runner to check for new requests.
 	ready := s.triggers.Audio.Kick(agentReq.ID)
 
-	waitForAndWriteResponse(ctx, ready, w, gormDB, agentReq.ID, new(db.CreateTranscriptionResponse))
+	waitForAndWriteResponse(ctx, ready, w, gormDB, "audio", agentReq.ID, new(db.CreateTranscriptionResponse))
 }
 
 func (s *Server) CreateTranslation(w http.ResponseWriter, r *http.Request) {
@@ -651,6 +658,8 @@ func (s *Server) CreateTranslation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	agentReq.Priority = s.priorities.forRequest(r, "")
+
 	var (
 		ctx    = r.Context()
 		gormDB = s.db.WithContext(ctx)
@@ -664,7 +673,7 @@ func (s *Server) CreateTranslation(w http.ResponseWriter, r *http.Request) {
 	// Kick the audio runner to check for new requests.
 	ready := s.triggers.Audio.Kick(agentReq.ID)
 
-	waitForAndWriteResponse(ctx, ready, w, gormDB, agentReq.ID, new(db.CreateTranslationResponse))
+	waitForAndWriteResponse(ctx, ready, w, gormDB, "audio", agentReq.ID, new(db.CreateTranslationResponse))
 }
 
 func (s *Server) CreateChatCompletion(w http.ResponseWriter, r *http.Request) {
@@ -682,22 +691,28 @@ func (s *Server) CreateChatCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ccr.Priority = s.priorities.forRequest(r, "")
+	ccr.APIKeyHash = db.HashAPIKey(apiKeyFromRequest(r))
+	ccr.AssistantID = r.Header.Get(db.AssistantIDHeader)
+
 	gormDB := s.db.WithContext(r.Context())
 	if err := db.Create(gormDB, ccr); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(NewAPIError("Failed to create chat completion request.", InternalErrorType).Error()))
 		return
 	}
+	w.Header().Set(db.RequestIDHeader, ccr.ID)
 
 	// Kick the chat completion runner to check for new requests, and get the ready signal.
 	ready := s.triggers.ChatCompletion.Kick(ccr.ID)
 
 	if !z.Dereference(ccr.Stream) {
-		waitForAndWriteResponse(r.Context(), ready, w, gormDB, ccr.ID, new(db.CreateChatCompletionResponse))
+		waitForAndWriteResponse(r.Context(), ready, w, gormDB, "chat_completion", ccr.ID, new(db.CreateChatCompletionResponse))
 		return
 	}
 
 	waitForAndStreamResponse[*db.ChatCompletionResponseChunk](r.Context(), w, gormDB, ccr.ID, 0)
+	cancelIfDisconnected(r.Context(), gormDB, "chat_completion", ccr.ID)
 }
 
 func (s *Server) CreateCompletion(w http.ResponseWriter, _ *http.Request) {
@@ -720,6 +735,9 @@ func (s *Server) CreateEmbedding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cer.Priority = s.priorities.forRequest(r, "")
+	cer.APIKeyHash = db.HashAPIKey(apiKeyFromRequest(r))
+
 	gormDB := s.db.WithContext(r.Context())
 	if err := db.Create(gormDB, cer); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -730,7 +748,7 @@ func (s *Server) CreateEmbedding(w http.ResponseWriter, r *http.Request) {
 	// Kick the embeddings runner to check for new requests.
 	ready := s.triggers.Embeddings.Kick(cer.ID)
 
-	waitForAndWriteResponse(r.Context(), ready, w, gormDB, cer.ID, new(db.CreateEmbeddingResponse))
+	waitForAndWriteResponse(r.Context(), ready, w, gormDB, "embeddings", cer.ID, new(db.CreateEmbeddingResponse))
 }
 
 func (s *Server) ListFiles(w http.ResponseWriter, r *http.Request, params openai.ListFilesParams) {
@@ -818,9 +836,24 @@ func (s *Server) RetrieveFile(w http.ResponseWriter, r *http.Request, fileID str
 	getAndRespond(s.db.WithContext(r.Context()), w, new(db.File), fileID)
 }
 
-func (s *Server) DownloadFile(w http.ResponseWriter, _ *http.Request, _ string) {
-	//TODO implement me
-	w.WriteHeader(http.StatusNotImplemented)
+func (s *Server) DownloadFile(w http.ResponseWriter, r *http.Request, fileID string) {
+	file, err := db.GetImageFile(s.db.WithContext(r.Context()), fileID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("No file found with id '%s'.", fileID), InvalidRequestErrorType).Error()))
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to get file: %v", err), InternalErrorType).Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(file.Content))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.Content)))
+	_, _ = w.Write(file.Content)
 }
 
 func (s *Server) ListPaginatedFineTuningJobs(w http.ResponseWriter, _ *http.Request, _ openai.ListPaginatedFineTuningJobsParams) {
@@ -869,6 +902,8 @@ func (s *Server) CreateImageEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	agentReq.Priority = s.priorities.forRequest(r, "")
+
 	var (
 		ctx    = r.Context()
 		gormDB = s.db.WithContext(ctx)
@@ -882,7 +917,7 @@ func (s *Server) CreateImageEdit(w http.ResponseWriter, r *http.Request) {
 	// Kick the image runner to check for new requests.
 	ready := s.triggers.Image.Kick(agentReq.ID)
 
-	waitForAndWriteResponse(ctx, ready, w, gormDB, agentReq.ID, new(db.ImagesResponse))
+	waitForAndWriteImagesResponse(ctx, ready, w, gormDB, agentReq.ID, agentReq.ResponseFormat)
 }
 
 func (s *Server) CreateImage(w http.ResponseWriter, r *http.Request) {
@@ -900,6 +935,8 @@ func (s *Server) CreateImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	agentReq.Priority = s.priorities.forRequest(r, "")
+
 	var (
 		ctx    = r.Context()
 		gormDB = s.db.WithContext(ctx)
@@ -913,7 +950,7 @@ func (s *Server) CreateImage(w http.ResponseWriter, r *http.Request) {
 	// Kick the image runner to check for new requests.
 	ready := s.triggers.Image.Kick(agentReq.ID)
 
-	waitForAndWriteResponse(ctx, ready, w, gormDB, agentReq.ID, new(db.ImagesResponse))
+	waitForAndWriteImagesResponse(ctx, ready, w, gormDB, agentReq.ID, agentReq.ResponseFormat)
 }
 
 func (s *Server) CreateImageVariation(w http.ResponseWriter, r *http.Request) {
@@ -938,6 +975,8 @@ func (s *Server) CreateImageVariation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	agentReq.Priority = s.priorities.forRequest(r, "")
+
 	var (
 		ctx    = r.Context()
 		gormDB = s.db.WithContext(ctx)
@@ -951,7 +990,7 @@ func (s *Server) CreateImageVariation(w http.ResponseWriter, r *http.Request) {
 	// Kick the image runner to check for new requests.
 	ready := s.triggers.Image.Kick(agentReq.ID)
 
-	waitForAndWriteResponse(ctx, ready, w, gormDB, agentReq.ID, new(db.ImagesResponse))
+	waitForAndWriteImagesResponse(ctx, ready, w, gormDB, agentReq.ID, agentReq.ResponseFormat)
 }
 
 func (s *Server) ListModels(w http.ResponseWriter, r *http.Request) {
@@ -1169,6 +1208,7 @@ func (s *Server) CreateThreadAndRun(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(NewAPIError("Failed to process request.", InvalidRequestErrorType).Error()))
 		return
 	}
+	run.Priority = s.priorities.forRequest(r, run.AssistantID)
 
 	runCreatedEvent := &db.RunEvent{
 		EventName: string(openai.ThreadRunCreated),
@@ -1487,6 +1527,7 @@ func (s *Server) CreateRun(w http.ResponseWriter, r *http.Request, threadID stri
 		_, _ = w.Write([]byte(NewAPIError("Failed to process request.", InvalidRequestErrorType).Error()))
 		return
 	}
+	run.Priority = s.priorities.forRequest(r, run.AssistantID)
 
 	runCreatedEvent := &db.RunEvent{
 		EventName: string(openai.ThreadRunCreated),
@@ -2031,13 +2072,44 @@ func waitForResponse(ctx context.Context, readyIndicator <-chan struct{}, gormDB
 	}
 }
 
-func waitForAndWriteResponse(ctx context.Context, readyIndicator <-chan struct{}, w http.ResponseWriter, gormDB *gorm.DB, id string, respObj JobResponder) {
+// waitForAndWriteResponse waits for the response to the job with the given ID in the queue, and writes it. If the
+// client disconnects first, then the job is cancelled.
+func waitForAndWriteResponse(ctx context.Context, readyIndicator <-chan struct{}, w http.ResponseWriter, gormDB *gorm.DB, queueName, id string, respObj JobResponder) {
 	if err := waitForResponse(ctx, readyIndicator, gormDB, id, respObj); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to get response: %v", err), InternalErrorType).Error()))
+		writeWaitError(ctx, w, gormDB, queueName, id, err)
+		return
+	}
+
+	writeJobResponse(w, respObj)
+}
+
+// waitForAndWriteImagesResponse waits for the response to an image request, and inlines the images that are stored as
+// files if the request asked for b64_json.
+func waitForAndWriteImagesResponse(ctx context.Context, readyIndicator <-chan struct{}, w http.ResponseWriter, gormDB *gorm.DB, id string, responseFormat *string) {
+	ir := new(db.ImagesResponse)
+	if err := waitForResponse(ctx, readyIndicator, gormDB, id, ir); err != nil {
+		writeWaitError(ctx, w, gormDB, "image", id, err)
 		return
 	}
 
+	if ir.GetErrorString() == "" && z.Dereference(responseFormat) == string(openai.CreateImageRequestResponseFormatB64Json) {
+		if err := db.InlineImageFiles(gormDB, ir); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to get images: %v", err), InternalErrorType).Error()))
+			return
+		}
+	}
+
+	writeJobResponse(w, ir)
+}
+
+func writeWaitError(ctx context.Context, w http.ResponseWriter, gormDB *gorm.DB, queueName, id string, err error) {
+	cancelIfDisconnected(ctx, gormDB, queueName, id)
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to get response: %v", err), InternalErrorType).Error()))
+}
+
+func writeJobResponse(w http.ResponseWriter, respObj JobResponder) {
 	if errStr := respObj.GetErrorString(); errStr != "" {
 		code := respObj.GetStatusCode()
 		errorType := InternalErrorType
@@ -2047,16 +2119,52 @@ func waitForAndWriteResponse(ctx context.Context, readyIndicator <-chan struct{}
 		w.WriteHeader(code)
 		_, _ = w.Write([]byte(NewAPIError(errStr, errorType).Error()))
 	} else {
+		setCacheHeader(w, respObj)
 		writeObjectToResponse(w, respObj.ToPublic())
 	}
 }
 
+// cancelIfDisconnected cancels the job with the given ID in the queue if the client disconnected before its response was
+// ready, so that the agent processing the job stops instead of finishing work that nobody is waiting for. The agent
+// stores the failed response itself, after the responses it has already stored.
+func cancelIfDisconnected(ctx context.Context, gormDB *gorm.DB, queueName, id string) {
+	if ctx.Err() == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	if err := db.CancelDisconnectedJob(gormDB.WithContext(ctx), queueName, id); err != nil && !errors.Is(err, db.ErrJobDone) {
+		slog.Error("Failed to cancel the job of a disconnected client", "queue", queueName, "id", id, "err", err)
+		return
+	}
+	metrics.ClientDisconnectsTotal.WithLabelValues(queueName).Inc()
+}
+
+// CacheHeader is set to "hit" on responses that were served from the chat completion cache.
+const CacheHeader = "X-Clicky-Chats-Cache"
+
+// setCacheHeader marks the response as served from a cache if the response object was. It must be called before the
+// response is written.
+func setCacheHeader(w http.ResponseWriter, respObj any) {
+	if c, ok := respObj.(cacheHitter); ok && c.IsCacheHit() {
+		w.Header().Set(CacheHeader, "hit")
+	}
+}
+
 // waitForAndStreamResponse waits for the stream responses to come through and will pass them as SSE to the client.
 func waitForAndStreamResponse[T JobRespondStreamer](ctx context.Context, w http.ResponseWriter, gormDB *gorm.DB, id string, index int) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	var printDoneEvent bool
+	var (
+		printDoneEvent, streaming bool
+		// streamed are the chat completion chunks that have been streamed, in case the rest of the stream is compacted
+		// before it is read.
+		streamed []db.ChatCompletionResponseChunk
+	)
+stream:
 	for {
 		select {
 		case <-ctx.Done():
@@ -2064,8 +2172,8 @@ func waitForAndStreamResponse[T JobRespondStreamer](ctx context.Context, w http.
 		default:
 		}
 
-		respObj := *new(T)
-		if err := gormDB.Model(respObj).Where("request_id = ?", id).Where("response_idx >= ?", index).Order("response_idx asc").First(&respObj).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		respObjs, err := nextStreamedResponses[T](gormDB, id, index, streamed)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
 			time.Sleep(time.Second)
 			continue
 		} else if err != nil {
@@ -2073,36 +2181,63 @@ func waitForAndStreamResponse[T JobRespondStreamer](ctx context.Context, w http.
 			w.WriteHeader(http.StatusInternalServerError)
 			_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed streaming responses: %v", err), InternalErrorType).Error()))
 			break
-		} else if errStr := respObj.GetErrorString(); errStr != "" {
-			slog.Error("Failed to get response chunk", "err", errStr)
-			_, _ = w.Write([]byte(fmt.Sprintf("data: %v\n\n", NewAPIError(errStr, InternalErrorType).Error())))
-			break
 		}
 
-		index = respObj.GetIndex() + 1
-		if respObj.IsDone() {
-			break
-		}
+		for _, respObj := range respObjs {
+			if errStr := respObj.GetErrorString(); errStr != "" {
+				slog.Error("Failed to get response chunk", "err", errStr)
+				if !streaming {
+					// Nothing has been streamed yet, so respond with the status code of the error, like the upstream provider
+					// would, so that clients can tell whether to retry.
+					code := respObj.GetStatusCode()
+					if code < http.StatusBadRequest {
+						code = http.StatusInternalServerError
+					}
+					errorType := InternalErrorType
+					if code < 500 {
+						errorType = InvalidRequestErrorType
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(code)
+					_, _ = w.Write([]byte(NewAPIError(errStr, errorType).Error()))
+					return
+				}
+				_, _ = w.Write([]byte(fmt.Sprintf("data: %v\n\n", NewAPIError(errStr, InternalErrorType).Error())))
+				break stream
+			}
 
-		respObj.SetID(id)
-		body, err := json.Marshal(respObj.ToPublic())
-		if err != nil {
-			slog.Error("Failed to marshal response", "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(fmt.Sprintf("data: %v\n\n", NewAPIError(fmt.Sprintf("Failed to process streamed response: %v", err), InternalErrorType).Error())))
-			break
-		}
+			index = respObj.GetIndex() + 1
+			if respObj.IsDone() {
+				break stream
+			}
+			if chunk, ok := any(respObj).(*db.ChatCompletionResponseChunk); ok {
+				streamed = append(streamed, *chunk)
+			}
 
-		event := respObj.GetEvent()
-		if event != "" {
-			printDoneEvent = true
-			event = fmt.Sprintf("event: %s\n", event)
-		}
+			respObj.SetID(id)
+			body, err := json.Marshal(respObj.ToPublic())
+			if err != nil {
+				slog.Error("Failed to marshal response", "err", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(fmt.Sprintf("data: %v\n\n", NewAPIError(fmt.Sprintf("Failed to process streamed response: %v", err), InternalErrorType).Error())))
+				break stream
+			}
+
+			event := respObj.GetEvent()
+			if event != "" {
+				printDoneEvent = true
+				event = fmt.Sprintf("event: %s\n", event)
+			}
 
-		d := make([]byte, 0, len(body)+len(event)+9)
-		_, _ = w.Write(append(append(append(append(d, []byte(event)...), []byte("data: ")...), body...), []byte("\n\n")...))
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+			if !streaming {
+				setCacheHeader(w, respObj)
+			}
+			streaming = true
+			d := make([]byte, 0, len(body)+len(event)+9)
+			_, _ = w.Write(append(append(append(append(d, []byte(event)...), []byte("data: ")...), body...), []byte("\n\n")...))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
 		}
 	}
 
@@ -2113,6 +2248,35 @@ func waitForAndStreamResponse[T JobRespondStreamer](ctx context.Context, w http.
 	_, _ = w.Write([]byte(doneMessage))
 }
 
+// nextStreamedResponses returns the next response of the stream with the given ID, starting at index. The chunks of
+// streamed chat completions are compacted into a response some time after the stream is done, which leaves a gap
+// before the final chunk. If a reader finds the gap, then the rest of the stream after the chunks that it has already
+// streamed is replayed from the compacted response.
+func nextStreamedResponses[T JobRespondStreamer](gormDB *gorm.DB, id string, index int, streamed []db.ChatCompletionResponseChunk) ([]T, error) {
+	respObj := *new(T)
+	if err := gormDB.Model(respObj).Where("request_id = ?", id).Where("response_idx >= ?", index).Order("response_idx asc").First(&respObj).Error; err != nil {
+		return nil, err
+	}
+
+	chunk, ok := any(respObj).(*db.ChatCompletionResponseChunk)
+	if !ok || chunk.ResponseIdx == index {
+		return []T{respObj}, nil
+	}
+
+	compacted := new(db.CreateChatCompletionResponse)
+	if err := gormDB.Where("request_id = ?", id).First(compacted).Error; err != nil {
+		return nil, fmt.Errorf("failed to get compacted stream: %v", err)
+	}
+
+	chunks := compacted.ChunksAfter(streamed)
+	respObjs := make([]T, 0, len(chunks)+1)
+	for i := range chunks {
+		respObjs = append(respObjs, any(&chunks[i]).(T))
+	}
+
+	return append(respObjs, respObj), nil
+}
+
 // transposeObject will marshal the first object and unmarshal it into the second object.
 func transposeObject(first json.Marshaler, second json.Unmarshaler) error {
 	firstBytes, err := first.MarshalJSON()
@@ -4,8 +4,12 @@ import (
 	"log/slog"
 	"net/http"
 	"runtime/debug"
+	"time"
 
+	"github.com/getkin/kin-openapi/routers"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
+	"github.com/gptscript-ai/clicky-chats/pkg/tracing"
 )
 
 type MiddlewareFunc func(http.Handler) http.Handler
@@ -34,3 +38,62 @@ func SetContentType(ct string) openai.MiddlewareFunc {
 		})
 	}
 }
+
+// RecordMetrics records the number and duration of requests by OpenAI operation. The operation is found with the
+// router, which should be built from the same spec as the handlers.
+func RecordMetrics(router routers.Router) openai.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			operation := operationID(router, r)
+
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			metrics.RequestsTotal.WithLabelValues(operation, metrics.Code(sw.status)).Inc()
+			metrics.RequestDuration.WithLabelValues(operation).Observe(metrics.Since(start))
+		})
+	}
+}
+
+// Trace records a span for each request, named by OpenAI operation, that continues the trace of the caller. Jobs
+// created while handling the request store the trace context so that the agents processing them continue the trace.
+func Trace(router routers.Router) openai.MiddlewareFunc {
+	return tracing.Middleware(func(r *http.Request) string {
+		return operationID(router, r)
+	})
+}
+
+// operationID returns the ID of the OpenAI operation that the request is for, or "unknown" if it doesn't match one.
+func operationID(router routers.Router, r *http.Request) string {
+	if route, _, err := router.FindRoute(r); err == nil && route.Operation != nil {
+		return route.Operation.OperationID
+	}
+
+	return "unknown"
+}
+
+// statusWriter records the status code written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Priorities are the queue priorities given to jobs based on the API key used to create them and the assistant they
+// use. Jobs with a higher priority are processed before jobs with a lower priority. Jobs with the same priority are
+// processed in the order they were created. Jobs that don't match any key or assistant have priority 0.
+type Priorities struct {
+	APIKeys    map[string]int
+	Assistants map[string]int
+}
+
+// forRequest returns the priority of a job created by the request. The assistant's priority takes precedence over the
+// API key's priority.
+func (p Priorities) forRequest(r *http.Request, assistantID string) int {
+	if priority, ok := p.Assistants[assistantID]; ok && assistantID != "" {
+		return priority
+	}
+
+	return p.APIKeys[apiKeyFromRequest(r)]
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(key)
+}
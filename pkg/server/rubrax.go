@@ -276,6 +276,8 @@ func (s *Server) XRunTool(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	runTool.Priority = s.priorities.forRequest(r, "")
+
 	if err := db.Create(s.db.WithContext(r.Context()), runTool); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(NewAPIError(fmt.Sprintf("Failed to create run tool: %v", err), InternalErrorType).Error()))
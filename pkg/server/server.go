@@ -6,15 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
 	"github.com/gptscript-ai/clicky-chats/pkg/db"
 	"github.com/gptscript-ai/clicky-chats/pkg/generated/openai"
 	kb "github.com/gptscript-ai/clicky-chats/pkg/knowledgebases"
+	"github.com/gptscript-ai/clicky-chats/pkg/metrics"
 	"github.com/gptscript-ai/clicky-chats/pkg/trigger"
 	nethttpmiddleware "github.com/oapi-codegen/nethttp-middleware"
 	"github.com/rs/cors"
@@ -54,12 +57,22 @@ func (t *Triggers) Complete() {
 type Config struct {
 	ServerURL, Port, APIBase string
 	Triggers                 *Triggers
+	Priorities               Priorities
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown. Defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+	// Mux is the mux that the routes are registered on. Defaults to http.DefaultServeMux, which serves pprof.
+	Mux *http.ServeMux
+	// Listener is served instead of listening on Port, if set.
+	Listener net.Listener
+	// AdminToken is the bearer token that the admin API requires. The admin API isn't served if it is empty.
+	AdminToken string
 }
 
 type Server struct {
-	db       *db.DB
-	kbm      *kb.KnowledgeBaseManager
-	triggers *Triggers
+	db         *db.DB
+	kbm        *kb.KnowledgeBaseManager
+	triggers   *Triggers
+	priorities Priorities
 }
 
 func NewServer(db *db.DB, kbm *kb.KnowledgeBaseManager) *Server {
@@ -73,6 +86,10 @@ func (s *Server) Start(ctx context.Context, wg *sync.WaitGroup, config Config) e
 	// Setup triggers
 	config.Triggers.Complete()
 	s.triggers = config.Triggers
+	s.priorities = config.Priorities
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30 * time.Second
+	}
 
 	// Treat image/png as files during decoding.
 	// This is required to pass body validation for image and mask fields for the following endpoints:
@@ -80,7 +97,7 @@ func (s *Server) Start(ctx context.Context, wg *sync.WaitGroup, config Config) e
 	openapi3filter.RegisterBodyDecoder("image/png", openapi3filter.FileBodyDecoder)
 	openapi3filter.RegisterBodyDecoder("text/plain", plainBodyDecoder)
 
-	if err := s.db.AutoMigrate(); err != nil {
+	if err := s.db.EnsureSchema(ctx); err != nil {
 		return err
 	}
 
@@ -91,9 +108,19 @@ func (s *Server) Start(ctx context.Context, wg *sync.WaitGroup, config Config) e
 
 	swagger.Servers = openapi3.Servers{&openapi3.Server{URL: fmt.Sprintf("%s:%s%s", config.ServerURL, config.Port, config.APIBase)}}
 
-	mux := http.DefaultServeMux
+	router, err := gorillamux.NewRouter(swagger)
+	if err != nil {
+		return err
+	}
+
+	mux := config.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
 	mux.HandleFunc("GET /healthz", s.db.Check)
+	mux.Handle("GET /metrics", metrics.Handler(s.db))
 	mux.Handle("/v1/openapi.yaml", http.StripPrefix("/v1/", http.FileServerFS(openapiSpec)))
+	s.registerAdminRoutes(mux, config.APIBase, config.AdminToken)
 
 	h := openai.HandlerWithOptions(s, openai.StdHTTPServerOptions{
 		BaseURL:    config.APIBase,
@@ -108,6 +135,8 @@ func (s *Server) Start(ctx context.Context, wg *sync.WaitGroup, config Config) e
 			}),
 			LogRequest(slog.Default()),
 			SetContentType("application/json"),
+			RecordMetrics(router),
+			Trace(router),
 		},
 	})
 
@@ -119,8 +148,15 @@ func (s *Server) Start(ctx context.Context, wg *sync.WaitGroup, config Config) e
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		slog.Info("Starting server", "addr", server.Addr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if config.Listener != nil {
+			slog.Info("Starting server", "addr", config.Listener.Addr())
+			err = server.Serve(config.Listener)
+		} else {
+			slog.Info("Starting server", "addr", server.Addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("Server failed", "err", err)
 		}
 	}()
@@ -128,7 +164,7 @@ func (s *Server) Start(ctx context.Context, wg *sync.WaitGroup, config Config) e
 	wg.Add(1)
 	context.AfterFunc(ctx, func() {
 		defer wg.Done()
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
 		defer cancel()
 		if err := server.Shutdown(timeoutCtx); err != nil {
 			slog.Error("Server shutdown failed", "err", err)
@@ -30,6 +30,11 @@ type JobResponder interface {
 	IsDone() bool
 }
 
+// cacheHitter is implemented by responses that can be served from a cache.
+type cacheHitter interface {
+	IsCacheHit() bool
+}
+
 type JobRespondStreamer interface {
 	db.Storer
 	JobResponder
@@ -0,0 +1,136 @@
+// Package sse reads server-sent event streams, as specified by
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+)
+
+// maxLineSize is the size of the longest line that is read. Chat completion chunks are far smaller, but tool call
+// arguments and images can make single events large.
+const maxLineSize = 10 * 1024 * 1024
+
+var bom = []byte("\xEF\xBB\xBF")
+
+// Event is a server-sent event.
+type Event struct {
+	// Type is the event's type, which is "message" unless the event names another one.
+	Type string
+	// ID is the last event ID that the stream set, which carries over to the events after it.
+	ID string
+	// Data is the event's data. The lines of events with several data fields are joined with newlines.
+	Data []byte
+	// Retry is the last reconnection time that the stream set, or zero.
+	Retry time.Duration
+}
+
+// Reader reads the events of a stream. Comments, which servers send as keep-alives, and blank events are skipped.
+type Reader struct {
+	scanner *bufio.Scanner
+	started bool
+	lastID  string
+	retry   time.Duration
+}
+
+// NewReader returns a reader of the event stream.
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	scanner.Split(scanLines)
+
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next event. It returns io.EOF once the stream ends, discarding an event that wasn't terminated by
+// a blank line.
+func (r *Reader) Next() (*Event, error) {
+	var (
+		eventType string
+		data      []byte
+	)
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if !r.started {
+			r.started = true
+			line = bytes.TrimPrefix(line, bom)
+		}
+
+		if len(line) == 0 {
+			if data == nil {
+				// Events without data aren't dispatched.
+				eventType = ""
+				continue
+			}
+
+			if eventType == "" {
+				eventType = "message"
+			}
+			return &Event{
+				Type:  eventType,
+				ID:    r.lastID,
+				Data:  bytes.TrimSuffix(data, []byte("\n")),
+				Retry: r.retry,
+			}, nil
+		}
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			eventType = string(value)
+		case "data":
+			data = append(data, value...)
+			data = append(data, '\n')
+		case "id":
+			if !bytes.ContainsRune(value, 0) {
+				r.lastID = string(value)
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(string(value), 10, 32); err == nil {
+				r.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+		// Other fields are ignored.
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// scanLines splits lines that end with CRLF, LF or CR.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if !atEOF {
+			// Wait for the next byte, which may be the LF of a CRLF.
+			return 0, nil, nil
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
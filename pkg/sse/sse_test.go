@@ -0,0 +1,49 @@
+package sse
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	stream := "\xEF\xBB\xBF: keep-alive\n\n" +
+		"data: first\n\n" +
+		"event: update\r\nid: 1\r\ndata: {\"a\":\r\ndata:  1}\r\n\r\n" +
+		"retry: 3000\rdata\r\r" +
+		": ping\n" +
+		"event: ignored\n\n" +
+		"id\nunknown: field\ndata: last\n\n" +
+		"data: unterminated"
+
+	r := NewReader(strings.NewReader(stream))
+	var events []Event
+	for {
+		event, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, *event)
+	}
+
+	want := []Event{
+		{Type: "message", Data: []byte("first")},
+		{Type: "update", ID: "1", Data: []byte("{\"a\":\n 1}")},
+		{Type: "message", ID: "1", Data: []byte(""), Retry: 3 * time.Second},
+		{Type: "message", Data: []byte("last"), Retry: 3 * time.Second},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(events[i], want[i]) {
+			t.Errorf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
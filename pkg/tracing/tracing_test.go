@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector stands in for an OTLP collector and records the spans that are exported to it.
+type collector struct {
+	lock  sync.Mutex
+	spans map[string]*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.URL.Path != "/v1/traces" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := new(coltracepb.ExportTraceServiceRequest)
+	if err = proto.Unmarshal(body, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				c.spans[span.GetName()] = span
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(nil)
+}
+
+func TestTraceAcrossJobBoundary(t *testing.T) {
+	c := &collector{spans: make(map[string]*tracepb.Span)}
+	otlp := httptest.NewServer(c)
+	defer otlp.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", otlp.URL)
+	provider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(provider) })
+
+	ctx := context.Background()
+	shutdown, err := Setup(ctx, "test")
+	if err != nil {
+		t.Fatalf("Setup() = %v", err)
+	}
+
+	// The server stores the trace context with the job that it creates.
+	var traceParent string
+	api := httptest.NewServer(Middleware(func(*http.Request) string { return "CreateJob" })(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		traceParent = TraceParent(r.Context())
+	})))
+	defer api.Close()
+
+	clientCtx, clientSpan := Start(ctx, "client")
+	req, err := http.NewRequestWithContext(clientCtx, http.MethodPost, api.URL, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := (&http.Client{Transport: Transport{}}).Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	clientSpan.End()
+
+	if traceParent == "" {
+		t.Fatal("the server should have a trace context to store with the job")
+	}
+
+	// The agent continues the trace from the stored trace context.
+	_, jobSpan := Start(WithTraceParent(context.Background(), traceParent), "process job")
+	End(jobSpan, errors.New("failed"))
+
+	if err = shutdown(ctx); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, name := range []string{"client", "POST " + req.URL.Host, "CreateJob", "process job"} {
+		if c.spans[name] == nil {
+			t.Fatalf("span %q wasn't exported, got %d spans", name, len(c.spans))
+		}
+	}
+
+	traceID := c.spans["client"].GetTraceId()
+	for name, span := range c.spans {
+		if !bytes.Equal(span.GetTraceId(), traceID) {
+			t.Errorf("span %q isn't part of the client's trace", name)
+		}
+	}
+	if !bytes.Equal(c.spans["CreateJob"].GetParentSpanId(), c.spans["POST "+req.URL.Host].GetSpanId()) {
+		t.Errorf("server span should be a child of the client's request span")
+	}
+	if !bytes.Equal(c.spans["process job"].GetParentSpanId(), c.spans["CreateJob"].GetSpanId()) {
+		t.Errorf("job span should be a child of the server span that created the job")
+	}
+	if code := c.spans["process job"].GetStatus().GetCode(); code != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("job span has status %v, want %v", code, tracepb.Status_STATUS_CODE_ERROR)
+	}
+}
@@ -0,0 +1,297 @@
+// Package vcr records the requests that agents send to upstream providers, and the responses to them, in a cassette,
+// and replays them from it. That makes bug reports reproducible, and tests of real conversations fast and
+// deterministic.
+package vcr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Mode is whether a Transport records or replays exchanges.
+type Mode string
+
+const (
+	// ModeRecord sends requests upstream, and stores them and their responses in the cassette.
+	ModeRecord Mode = "record"
+	// ModeReplay responds to requests from the cassette, and fails requests that weren't recorded.
+	ModeReplay Mode = "replay"
+)
+
+// Transport records exchanges in, or replays them from, a cassette, which is a directory with a file for each
+// exchange. Each file is named by the hash of the normalized request, so identical requests share a response.
+// Credentials aren't recorded because request headers aren't part of the hash, and aren't stored.
+type Transport struct {
+	mode     Mode
+	cassette string
+	base     http.RoundTripper
+}
+
+// NewTransport returns a transport that records exchanges in, or replays them from, the cassette directory. Requests
+// are recorded by sending them with base, or http.DefaultTransport if it is nil.
+func NewTransport(mode Mode, cassette string, base http.RoundTripper) (*Transport, error) {
+	if cassette == "" {
+		return nil, fmt.Errorf("no cassette directory to %s requests", mode)
+	}
+
+	switch mode {
+	case ModeRecord:
+		if err := os.MkdirAll(cassette, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+		}
+	case ModeReplay:
+		if info, err := os.Stat(cassette); err != nil {
+			return nil, fmt.Errorf("failed to open cassette: %w", err)
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("cassette %s is not a directory", cassette)
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q, must be %q or %q", mode, ModeRecord, ModeReplay)
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{mode: mode, cassette: cassette, base: base}, nil
+}
+
+// Wrap returns a transport that records or replays the requests that base sends, in the same cassette.
+func (t *Transport) Wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{mode: t.mode, cassette: t.cassette, base: base}
+}
+
+// Interaction is the content of a cassette file.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded request. It is only stored to make cassettes readable, the file name is what a request is
+// matched by.
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   Body   `json:"body,omitempty"`
+}
+
+// Response is a recorded response. Streamed responses are read to the end before they are returned while recording.
+type Response struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       Body        `json:"body,omitempty"`
+}
+
+// Body is stored as a string if it is text, and base64 encoded otherwise.
+type Body []byte
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(map[string]string{"text": string(b)})
+	}
+
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var body struct {
+		Text   string `json:"text"`
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+
+	if body.Base64 == "" {
+		*b = Body(body.Text)
+		return nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(body.Base64)
+	*b = decoded
+	return err
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+	}
+
+	file := filepath.Join(t.cassette, fileName(req, body))
+	if t.mode == ModeReplay {
+		return replay(req, file)
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	interaction := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    req.URL.Redacted(),
+			Body:   body,
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     header,
+			Body:       respBody,
+		},
+	}
+	if err = write(file, interaction); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func replay(req *http.Request, file string) (*http.Response, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no recorded response to %s %s in %s", req.Method, req.URL.Redacted(), file)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read cassette file: %w", err)
+	}
+
+	var interaction Interaction
+	if err = json.Unmarshal(data, &interaction); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette file %s: %w", file, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+		StatusCode:    interaction.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        interaction.Response.Header,
+		Body:          io.NopCloser(bytes.NewReader(interaction.Response.Body)),
+		ContentLength: int64(len(interaction.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// write writes the interaction to a temporary file first, so that concurrent replays never read a partial file.
+func write(file string, interaction Interaction) error {
+	data, err := json.MarshalIndent(interaction, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode interaction: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".recording-*")
+	if err != nil {
+		return fmt.Errorf("failed to record interaction: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to record interaction: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to record interaction: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("failed to record interaction: %w", err)
+	}
+
+	return nil
+}
+
+// fileName returns the name of the cassette file of the request, which starts with the method and path to be readable,
+// and ends with the hash of the normalized request. The host isn't part of the hash, so that cassettes can be replayed
+// against another base URL with the same paths.
+func fileName(req *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s %s?%s\n", req.Method, req.URL.Path, req.URL.Query().Encode())
+	_, _ = h.Write(normalize(req.Header.Get("Content-Type"), body))
+
+	name := strings.ToLower(req.Method) + "-" + strings.Trim(strings.ReplaceAll(req.URL.Path, "/", "-"), "-")
+	return name + "-" + hex.EncodeToString(h.Sum(nil))[:16] + ".json"
+}
+
+// normalize returns a representation of the body that doesn't change between equivalent requests. JSON objects are
+// re-encoded with sorted keys, and multipart forms are described by their parts, without the random boundary.
+func normalize(contentType string, body []byte) []byte {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "multipart/form-data" {
+		if normalized, err := normalizeMultipart(params["boundary"], body); err == nil {
+			return normalized
+		}
+		return body
+	}
+
+	var v any
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil || decoder.More() {
+		return body
+	}
+
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+
+	return normalized
+}
+
+func normalizeMultipart(boundary string, body []byte) ([]byte, error) {
+	var (
+		normalized bytes.Buffer
+		reader     = multipart.NewReader(bytes.NewReader(body), boundary)
+	)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return normalized.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(content)
+		_, _ = fmt.Fprintf(&normalized, "%s %s %x\n", part.FormName(), part.FileName(), sum)
+	}
+}
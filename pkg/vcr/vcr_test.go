@@ -0,0 +1,115 @@
+package vcr
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newUpstream(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+
+	requests := new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write(append([]byte("data: "), body...))
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, requests
+}
+
+func post(t *testing.T, transport http.RoundTripper, url, contentType string, body []byte) (string, error) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	url, requests := newUpstream(t)
+	cassette := t.TempDir()
+
+	recorder, err := NewTransport(ModeRecord, cassette, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := post(t, recorder, url+"/v1/chat/completions", "application/json", []byte(`{"model": "gpt-4o", "stream": true}`))
+	if err != nil {
+		t.Fatalf("failed to record: %v", err)
+	}
+
+	player, err := NewTransport(ModeReplay, cassette, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same request, with its keys in another order, is sent to another host.
+	replayed, err := post(t, player, "http://upstream.invalid/v1/chat/completions", "application/json", []byte(`{"stream":true,"model":"gpt-4o"}`))
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+
+	if replayed != recorded {
+		t.Errorf("replayed response %q, want %q", replayed, recorded)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+
+	if _, err = post(t, player, url+"/v1/chat/completions", "application/json", []byte(`{"model": "gpt-4o-mini"}`)); err == nil {
+		t.Error("replaying a request that wasn't recorded should fail")
+	}
+}
+
+func TestMultipartBoundary(t *testing.T) {
+	form := func() ([]byte, string) {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		_ = w.WriteField("model", "whisper-1")
+		f, _ := w.CreateFormFile("file", "audio.wav")
+		_, _ = f.Write([]byte("RIFF"))
+		_ = w.Close()
+		return buf.Bytes(), w.FormDataContentType()
+	}
+
+	url, _ := newUpstream(t)
+	cassette := t.TempDir()
+
+	recorder, err := NewTransport(ModeRecord, cassette, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, contentType := form()
+	if _, err = post(t, recorder, url+"/v1/audio/transcriptions", contentType, body); err != nil {
+		t.Fatalf("failed to record: %v", err)
+	}
+
+	player, err := NewTransport(ModeReplay, cassette, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new form has a new random boundary.
+	body, contentType = form()
+	if _, err = post(t, player, url+"/v1/audio/transcriptions", contentType, body); err != nil {
+		t.Errorf("failed to replay a form with another boundary: %v", err)
+	}
+}